@@ -0,0 +1,253 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"regexp"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+var errUnknownAssignee = errors.New("Unknown or deactivated assignee")
+
+var uuidPattern = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+// taskPeople holds the assignees and watchers of a set of tasks keyed by task ID.
+// Assignees are ordered with the primary assignee first.
+type taskPeople struct {
+	assignees map[string][]UserRef
+	watchers  map[string][]UserRef
+}
+
+// loadTaskPeople fetches assignees and watchers for the given tasks
+func loadTaskPeople(taskIDs []string) (*taskPeople, error) {
+	people := &taskPeople{
+		assignees: make(map[string][]UserRef),
+		watchers:  make(map[string][]UserRef),
+	}
+	if len(taskIDs) == 0 {
+		return people, nil
+	}
+
+	load := func(query string, into map[string][]UserRef) error {
+		rows, err := db.Query(query, pq.Array(taskIDs))
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var taskID string
+			var ref UserRef
+			var avatarVersion sql.NullInt64
+			if err := rows.Scan(&taskID, &ref.ID, &ref.Username, &avatarVersion); err != nil {
+				return err
+			}
+			ref.AvatarURL = avatarURL(ref.ID, avatarVersion)
+			into[taskID] = append(into[taskID], ref)
+		}
+		return rows.Err()
+	}
+
+	err := load(`
+		SELECT a.task_id, u.id, u.username, u.avatar_version
+		FROM task_assignees a
+		JOIN users u ON u.id = a.user_id
+		WHERE a.task_id = ANY($1::uuid[])
+		ORDER BY a.is_primary DESC, a.created_at, u.username
+	`, people.assignees)
+	if err != nil {
+		return nil, err
+	}
+
+	err = load(`
+		SELECT w.task_id, u.id, u.username, u.avatar_version
+		FROM task_watchers w
+		JOIN users u ON u.id = w.user_id
+		WHERE w.task_id = ANY($1::uuid[])
+		ORDER BY u.username
+	`, people.watchers)
+	if err != nil {
+		return nil, err
+	}
+	return people, nil
+}
+
+// apply fills in a task's assignees and watchers. The first assignee is also
+// exposed as the task's single assignee.
+func (p *taskPeople) apply(task *Task) {
+	task.Assignees = p.assignees[task.ID]
+	if task.Assignees == nil {
+		task.Assignees = []UserRef{}
+	}
+	task.Watchers = p.watchers[task.ID]
+	if task.Watchers == nil {
+		task.Watchers = []UserRef{}
+	}
+
+	task.AssigneeIDs = []string{}
+	for _, a := range task.Assignees {
+		task.AssigneeIDs = append(task.AssigneeIDs, a.ID)
+	}
+
+	task.AssigneeID = ""
+	task.Assignee = nil
+	if len(task.Assignees) > 0 {
+		primary := task.Assignees[0]
+		task.AssigneeID = primary.ID
+		task.Assignee = &primary
+	}
+}
+
+// setTaskAssignees updates who is assigned to a task. A non-nil ids replaces the
+// full set of assignees, a non-nil primary marks one of them as primary, adding
+// them if needed, or clears the primary when empty. It returns the users that
+// were newly assigned.
+func setTaskAssignees(tx *sql.Tx, taskID string, primary *string, ids *[]string) ([]string, error) {
+	added := []string{}
+
+	// Check every assignee up front so a bad ID is reported as such instead
+	// of surfacing later as a failed notification
+	wanted := []string{}
+	if ids != nil {
+		wanted = append(wanted, *ids...)
+	}
+	if primary != nil && *primary != "" {
+		wanted = append(wanted, *primary)
+	}
+	for _, id := range wanted {
+		if !uuidPattern.MatchString(id) {
+			return nil, errUnknownAssignee
+		}
+	}
+	if len(wanted) > 0 {
+		var missing bool
+		err := tx.QueryRow(`
+			SELECT EXISTS (
+				SELECT 1 FROM unnest($1::uuid[]) AS w(id)
+				WHERE NOT EXISTS (SELECT 1 FROM users u WHERE u.id = w.id AND u.deactivated_at IS NULL)
+			)
+		`, pq.Array(wanted)).Scan(&missing)
+		if err != nil {
+			return nil, err
+		}
+		if missing {
+			return nil, errUnknownAssignee
+		}
+	}
+
+	if ids != nil {
+		_, err := tx.Exec("DELETE FROM task_assignees WHERE task_id = $1 AND NOT (user_id = ANY($2::uuid[]))", taskID, pq.Array(*ids))
+		if err != nil {
+			return nil, err
+		}
+		rows, err := tx.Query(`
+			INSERT INTO task_assignees (task_id, user_id)
+			SELECT $1, unnest($2::uuid[])
+			ON CONFLICT DO NOTHING
+			RETURNING user_id
+		`, taskID, pq.Array(*ids))
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var userID string
+			if err := rows.Scan(&userID); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			added = append(added, userID)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	if primary != nil {
+		if _, err := tx.Exec("UPDATE task_assignees SET is_primary = false WHERE task_id = $1 AND is_primary", taskID); err != nil {
+			return nil, err
+		}
+		if *primary != "" {
+			var exists bool
+			err := tx.QueryRow("SELECT EXISTS (SELECT 1 FROM task_assignees WHERE task_id = $1 AND user_id = $2)", taskID, *primary).Scan(&exists)
+			if err != nil {
+				return nil, err
+			}
+			_, err = tx.Exec(`
+				INSERT INTO task_assignees (task_id, user_id, is_primary) VALUES ($1, $2, true)
+				ON CONFLICT (task_id, user_id) DO UPDATE SET is_primary = true
+			`, taskID, *primary)
+			if err != nil {
+				return nil, err
+			}
+			if !exists {
+				added = append(added, *primary)
+			}
+		}
+	}
+
+	return added, nil
+}
+
+// assigneeError writes the response for an unknown assignee and reports
+// whether it did
+func assigneeError(w http.ResponseWriter, err error) bool {
+	if err == errUnknownAssignee {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return true
+	}
+	return false
+}
+
+// setTaskWatching subscribes or unsubscribes the current user from a task
+func setTaskWatching(w http.ResponseWriter, r *http.Request, watch bool) {
+	vars := mux.Vars(r)
+	taskID := vars["id"]
+	userID := r.Context().Value("userId").(string)
+
+	var exists bool
+	err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM tasks WHERE id::text = $1)", taskID).Scan(&exists)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if !exists {
+		http.Error(w, "Task not found", http.StatusNotFound)
+		return
+	}
+
+	if watch {
+		_, err = db.Exec("INSERT INTO task_watchers (task_id, user_id) VALUES ($1, $2) ON CONFLICT DO NOTHING", taskID, userID)
+	} else {
+		_, err = db.Exec("DELETE FROM task_watchers WHERE task_id = $1 AND user_id = $2", taskID, userID)
+	}
+	if err != nil {
+		http.Error(w, "Error updating watchers", http.StatusInternalServerError)
+		return
+	}
+
+	people, err := loadTaskPeople([]string{taskID})
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	watchers := people.watchers[taskID]
+	if watchers == nil {
+		watchers = []UserRef{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(watchers)
+}
+
+func watchTaskHandler(w http.ResponseWriter, r *http.Request) {
+	setTaskWatching(w, r, true)
+}
+
+func unwatchTaskHandler(w http.ResponseWriter, r *http.Request) {
+	setTaskWatching(w, r, false)
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gorilla/mux"
+)
+
+func TestSetTaskAssignees(t *testing.T) {
+	a, b := testUserA, testUserB
+	empty := ""
+
+	tests := []struct {
+		name    string
+		primary *string
+		ids     *[]string
+		expect  func(mock sqlmock.Sqlmock)
+		added   []string
+		err     error
+	}{
+		{
+			name:   "malformed ID",
+			ids:    &[]string{"not-a-uuid"},
+			expect: func(mock sqlmock.Sqlmock) {},
+			err:    errUnknownAssignee,
+		},
+		{
+			name: "unknown or deactivated user",
+			ids:  &[]string{a},
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`SELECT EXISTS`).WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+			},
+			err: errUnknownAssignee,
+		},
+		{
+			name: "replace the set",
+			ids:  &[]string{a, b},
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`SELECT EXISTS`).WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+				mock.ExpectExec(`DELETE FROM task_assignees`).WithArgs(testTask, sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 1))
+				// b was already assigned
+				mock.ExpectQuery(`INSERT INTO task_assignees`).WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow(a))
+			},
+			added: []string{a},
+		},
+		{
+			name:    "new primary",
+			primary: &a,
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`SELECT EXISTS`).WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+				mock.ExpectExec(`UPDATE task_assignees SET is_primary = false`).WillReturnResult(sqlmock.NewResult(0, 0))
+				mock.ExpectQuery(`SELECT EXISTS \(SELECT 1 FROM task_assignees`).WithArgs(testTask, a).WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+				mock.ExpectExec(`INSERT INTO task_assignees .* is_primary`).WithArgs(testTask, a).WillReturnResult(sqlmock.NewResult(0, 1))
+			},
+			added: []string{a},
+		},
+		{
+			name:    "existing assignee made primary",
+			primary: &a,
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`SELECT EXISTS`).WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+				mock.ExpectExec(`UPDATE task_assignees SET is_primary = false`).WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectQuery(`SELECT EXISTS \(SELECT 1 FROM task_assignees`).WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+				mock.ExpectExec(`INSERT INTO task_assignees .* is_primary`).WillReturnResult(sqlmock.NewResult(0, 1))
+			},
+			added: []string{},
+		},
+		{
+			name:    "clear primary",
+			primary: &empty,
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectExec(`UPDATE task_assignees SET is_primary = false`).WillReturnResult(sqlmock.NewResult(0, 1))
+			},
+			added: []string{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock := mockDB(t)
+			mock.ExpectBegin()
+			tt.expect(mock)
+			mock.ExpectRollback()
+
+			tx, err := db.Begin()
+			if err != nil {
+				t.Fatal(err)
+			}
+			added, err := setTaskAssignees(tx, testTask, tt.primary, tt.ids)
+			tx.Rollback()
+
+			if err != tt.err {
+				t.Fatalf("err = %v, want %v", err, tt.err)
+			}
+			if tt.err == nil && !reflect.DeepEqual(added, tt.added) {
+				t.Errorf("added = %v, want %v", added, tt.added)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+// expectTaskLoaded expects the queries that fill in a task's people after a
+// change, with a as its only assignee
+func expectTaskLoaded(mock sqlmock.Sqlmock, a string) {
+	mock.ExpectQuery(`FROM task_assignees a`).WillReturnRows(
+		sqlmock.NewRows([]string{"task_id", "id", "username", "avatar_version"}).AddRow(testTask, a, "alice", nil))
+	mock.ExpectQuery(`FROM task_watchers w`).WillReturnRows(
+		sqlmock.NewRows([]string{"task_id", "id", "username", "avatar_version"}))
+}
+
+// expectAssignedNotification expects the notification of new assignees, with
+// nobody left to notify
+func expectAssignedNotification(mock sqlmock.Sqlmock) {
+	mock.ExpectQuery(`SELECT u.id FROM users u`).WillReturnRows(sqlmock.NewRows([]string{"id"}))
+}
+
+func TestCreateTaskHandlerAssigns(t *testing.T) {
+	tests := []struct {
+		name   string
+		body   string
+		expect func(mock sqlmock.Sqlmock)
+		status int
+	}{
+		{
+			name: "assigneeId",
+			body: `{"title":"Report","state":"backlog","priority":3,"assigneeId":"` + testUserA + `"}`,
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`SELECT EXISTS`).WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+				mock.ExpectExec(`UPDATE task_assignees SET is_primary = false`).WillReturnResult(sqlmock.NewResult(0, 0))
+				mock.ExpectQuery(`SELECT EXISTS \(SELECT 1 FROM task_assignees`).WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+				mock.ExpectExec(`INSERT INTO task_assignees .* is_primary`).WithArgs(testTask, testUserA).WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectCommit()
+				expectAssignedNotification(mock)
+				expectTaskLoaded(mock, testUserA)
+				mock.ExpectExec(`INSERT INTO webhook_deliveries`).WillReturnResult(sqlmock.NewResult(0, 0))
+			},
+			status: http.StatusCreated,
+		},
+		{
+			name: "bare ID in assignee from older clients",
+			body: `{"title":"Report","state":"backlog","priority":3,"assignee":"` + testUserA + `"}`,
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`SELECT EXISTS`).WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+				mock.ExpectExec(`UPDATE task_assignees SET is_primary = false`).WillReturnResult(sqlmock.NewResult(0, 0))
+				mock.ExpectQuery(`SELECT EXISTS \(SELECT 1 FROM task_assignees`).WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+				mock.ExpectExec(`INSERT INTO task_assignees .* is_primary`).WithArgs(testTask, testUserA).WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectCommit()
+				expectAssignedNotification(mock)
+				expectTaskLoaded(mock, testUserA)
+				mock.ExpectExec(`INSERT INTO webhook_deliveries`).WillReturnResult(sqlmock.NewResult(0, 0))
+			},
+			status: http.StatusCreated,
+		},
+		{
+			name: "unknown assignee",
+			body: `{"title":"Report","state":"backlog","priority":3,"assigneeIds":["not-a-uuid"]}`,
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectRollback()
+			},
+			status: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock := mockDB(t)
+			mock.ExpectBegin()
+			now := time.Now()
+			mock.ExpectQuery(`INSERT INTO tasks`).WillReturnRows(
+				sqlmock.NewRows([]string{"id", "number", "created_at", "updated_at"}).AddRow(testTask, 7, now, now))
+			tt.expect(mock)
+
+			r := asUser(httptest.NewRequest("POST", "/api/tasks", strings.NewReader(tt.body)), testUserB, roleUser)
+			w := httptest.NewRecorder()
+			createTaskHandler(w, r)
+
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			if tt.status == http.StatusCreated {
+				var task Task
+				if err := json.NewDecoder(w.Body).Decode(&task); err != nil {
+					t.Fatal(err)
+				}
+				if task.Assignee == nil || task.Assignee.ID != testUserA || task.AssigneeID != testUserA {
+					t.Errorf("assignee = %+v, want %s", task.Assignee, testUserA)
+				}
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestUpdateTaskHandlerAssigns(t *testing.T) {
+	setRoles(t, map[string][]string{roleUser: {permTaskEdit}})
+
+	tests := []struct {
+		name   string
+		body   string
+		expect func(mock sqlmock.Sqlmock)
+		status int
+	}{
+		{
+			name: "assigneeIds",
+			body: `{"assigneeIds":["` + testUserA + `"]}`,
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`SELECT EXISTS`).WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+				mock.ExpectExec(`DELETE FROM task_assignees`).WillReturnResult(sqlmock.NewResult(0, 0))
+				mock.ExpectQuery(`INSERT INTO task_assignees`).WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow(testUserA))
+				mock.ExpectCommit()
+				expectAssignedNotification(mock)
+				expectTaskLoaded(mock, testUserA)
+				mock.ExpectExec(`INSERT INTO webhook_deliveries`).WillReturnResult(sqlmock.NewResult(0, 0))
+			},
+			status: http.StatusOK,
+		},
+		{
+			name: "assigneeId",
+			body: `{"assigneeId":"` + testUserA + `"}`,
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`SELECT EXISTS`).WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+				mock.ExpectExec(`UPDATE task_assignees SET is_primary = false`).WillReturnResult(sqlmock.NewResult(0, 0))
+				mock.ExpectQuery(`SELECT EXISTS \(SELECT 1 FROM task_assignees`).WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+				mock.ExpectExec(`INSERT INTO task_assignees .* is_primary`).WithArgs(testTask, testUserA).WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectCommit()
+				expectAssignedNotification(mock)
+				expectTaskLoaded(mock, testUserA)
+				mock.ExpectExec(`INSERT INTO webhook_deliveries`).WillReturnResult(sqlmock.NewResult(0, 0))
+			},
+			status: http.StatusOK,
+		},
+		{
+			name: "deactivated assignee",
+			body: `{"assigneeIds":["` + testUserA + `"]}`,
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`SELECT EXISTS`).WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+				mock.ExpectRollback()
+			},
+			status: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock := mockDB(t)
+			mock.ExpectQuery(`SELECT state, team_id FROM tasks`).WillReturnRows(
+				sqlmock.NewRows([]string{"state", "team_id"}).AddRow("backlog", nil))
+			mock.ExpectBegin()
+			now := time.Now()
+			mock.ExpectQuery(`UPDATE tasks SET`).WillReturnRows(
+				sqlmock.NewRows([]string{"id", "number", "title", "description", "state", "priority", "due_at", "team_id", "created_at", "updated_at"}).
+					AddRow(testTask, 7, "Report", "", "backlog", 3, nil, nil, now, now))
+			tt.expect(mock)
+
+			r := httptest.NewRequest("PATCH", "/api/tasks/"+testTask, strings.NewReader(tt.body))
+			r = asUser(mux.SetURLVars(r, map[string]string{"id": testTask}), testUserB, roleUser)
+			w := httptest.NewRecorder()
+			updateTaskHandler(w, r)
+
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			if tt.status == http.StatusOK {
+				var task Task
+				if err := json.NewDecoder(w.Body).Decode(&task); err != nil {
+					t.Fatal(err)
+				}
+				if !reflect.DeepEqual(task.AssigneeIDs, []string{testUserA}) {
+					t.Errorf("assigneeIds = %v, want [%s]", task.AssigneeIDs, testUserA)
+				}
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
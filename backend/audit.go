@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// AuditEntry represents a record in the audit log
+type AuditEntry struct {
+	ID         int64           `json:"id"`
+	ActorID    string          `json:"actorId,omitempty"`
+	Action     string          `json:"action"`
+	TargetType string          `json:"targetType,omitempty"`
+	TargetID   string          `json:"targetId,omitempty"`
+	IP         string          `json:"ip"`
+	UserAgent  string          `json:"userAgent"`
+	RequestID  string          `json:"requestId"`
+	Details    json.RawMessage `json:"details"`
+	CreatedAt  time.Time       `json:"createdAt"`
+}
+
+// AuditPage is a page of audit entries with the cursor of the next page
+type AuditPage struct {
+	Items      []AuditEntry `json:"items"`
+	NextCursor string       `json:"nextCursor,omitempty"`
+}
+
+// requestIDMiddleware tags every request with an ID, reusing the caller's
+// X-Request-ID when present, and echoes it in the response
+func requestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestID := r.Header.Get("X-Request-ID")
+		if requestID == "" || len(requestID) > 128 {
+			requestID, _ = randomToken(12)
+		}
+		w.Header().Set("X-Request-ID", requestID)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), "requestId", requestID)))
+	})
+}
+
+// recordAudit appends an entry to the audit log. The actor defaults to the
+// authenticated user; pass actorID for events such as login where the request
+// isn't authenticated yet. Failures are logged and never fail the request.
+func recordAudit(r *http.Request, actorID, action, targetType, targetID string, details map[string]interface{}) {
+	if actorID == "" {
+		actorID, _ = r.Context().Value("userId").(string)
+	}
+	requestID, _ := r.Context().Value("requestId").(string)
+
+	if details == nil {
+		details = map[string]interface{}{}
+	}
+	detailsJSON, err := json.Marshal(details)
+	if err != nil {
+		log.Printf("Error encoding audit details: %v", err)
+		detailsJSON = []byte("{}")
+	}
+
+	_, err = db.Exec(`
+		INSERT INTO audit_log (actor_id, action, target_type, target_id, ip, user_agent, request_id, details)
+		VALUES (NULLIF($1, '')::uuid, $2, $3, $4, $5, $6, $7, $8)
+	`, actorID, action, targetType, targetID, clientIP(r), r.UserAgent(), requestID, detailsJSON)
+	if err != nil {
+		log.Printf("Error writing audit log (%s): %v", action, err)
+	}
+}
+
+// likeEscaper escapes the LIKE wildcards and the escape character itself
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// auditQuery builds the filtered audit log query from request parameters
+func auditQuery(r *http.Request) (string, []interface{}, error) {
+	q := r.URL.Query()
+	query := `
+		SELECT id, COALESCE(actor_id::text, ''), action, target_type, target_id, ip, user_agent, request_id, details, created_at
+		FROM audit_log
+		WHERE true`
+	params := []interface{}{}
+	paramCount := 1
+
+	add := func(cond string, value interface{}) {
+		query += fmt.Sprintf(" AND "+cond, paramCount)
+		params = append(params, value)
+		paramCount++
+	}
+
+	if v := q.Get("actor"); v != "" {
+		add("actor_id::text = $%d", v)
+	}
+	if v := q.Get("action"); v != "" {
+		// "auth." matches every auth event; wildcards in the filter are literal
+		add("action LIKE $%d", likeEscaper.Replace(v)+"%")
+	}
+	if v := q.Get("targetType"); v != "" {
+		add("target_type = $%d", v)
+	}
+	if v := q.Get("targetId"); v != "" {
+		add("target_id = $%d", v)
+	}
+	for _, p := range []struct{ name, cond string }{{"from", "created_at >= $%d"}, {"to", "created_at < $%d"}} {
+		if v := q.Get(p.name); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				return "", nil, fmt.Errorf("invalid %s: expected RFC 3339 time", p.name)
+			}
+			add(p.cond, t)
+		}
+	}
+	if v := q.Get("cursor"); v != "" {
+		id, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return "", nil, fmt.Errorf("invalid cursor")
+		}
+		add("id < $%d", id)
+	}
+
+	query += " ORDER BY id DESC"
+	return query, params, nil
+}
+
+// scanAuditEntry reads one audit row
+func scanAuditEntry(rows *sql.Rows) (AuditEntry, error) {
+	var e AuditEntry
+	var details []byte
+	err := rows.Scan(&e.ID, &e.ActorID, &e.Action, &e.TargetType, &e.TargetID, &e.IP, &e.UserAgent, &e.RequestID, &details, &e.CreatedAt)
+	e.Details = details
+	return e, err
+}
+
+func getAuditLogHandler(w http.ResponseWriter, r *http.Request) {
+	query, params, err := auditQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	limit := 50
+	if v, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && v > 0 && v <= 200 {
+		limit = v
+	}
+	// Fetch one extra row to know whether there is a next page
+	query += fmt.Sprintf(" LIMIT %d", limit+1)
+
+	rows, err := db.Query(query, params...)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	page := AuditPage{Items: []AuditEntry{}}
+	for rows.Next() {
+		entry, err := scanAuditEntry(rows)
+		if err != nil {
+			http.Error(w, "Error scanning audit log", http.StatusInternalServerError)
+			return
+		}
+		page.Items = append(page.Items, entry)
+	}
+
+	if len(page.Items) > limit {
+		page.Items = page.Items[:limit]
+		page.NextCursor = strconv.FormatInt(page.Items[limit-1].ID, 10)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(page)
+}
+
+func exportAuditLogHandler(w http.ResponseWriter, r *http.Request) {
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "jsonl"
+	}
+	if format != "csv" && format != "jsonl" {
+		http.Error(w, "format must be csv or jsonl", http.StatusBadRequest)
+		return
+	}
+
+	query, params, err := auditQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	rows, err := db.Query(query, params...)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	filename := "audit-" + time.Now().Format("20060102-150405") + "." + format
+	w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`"`)
+
+	// Exporting is itself an auditable event
+	recordAudit(r, "", "audit.exported", "", "", map[string]interface{}{
+		"format": format,
+		"filter": r.URL.Query(),
+	})
+
+	if format == "csv" {
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		cw := csv.NewWriter(w)
+		cw.Write([]string{"id", "created_at", "actor_id", "action", "target_type", "target_id", "ip", "user_agent", "request_id", "details"})
+		for rows.Next() {
+			e, err := scanAuditEntry(rows)
+			if err != nil {
+				log.Printf("Error scanning audit log: %v", err)
+				break
+			}
+			cw.Write([]string{
+				strconv.FormatInt(e.ID, 10), e.CreatedAt.Format(time.RFC3339), e.ActorID, e.Action,
+				e.TargetType, e.TargetID, e.IP, e.UserAgent, e.RequestID, string(e.Details),
+			})
+		}
+		cw.Flush()
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	enc := json.NewEncoder(w)
+	for rows.Next() {
+		e, err := scanAuditEntry(rows)
+		if err != nil {
+			log.Printf("Error scanning audit log: %v", err)
+			break
+		}
+		enc.Encode(e)
+	}
+}
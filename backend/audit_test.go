@@ -0,0 +1,36 @@
+package main
+
+import (
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestAuditQueryActionFilter(t *testing.T) {
+	tests := []struct {
+		action string
+		want   string
+	}{
+		{"auth.", "auth.%"},
+		{"auth.login_failed", `auth.login\_failed%`},
+		{"100%", `100\%%`},
+		{`a\b`, `a\\b%`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.action, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/api/audit?action="+strings.NewReplacer("%", "%25", `\`, "%5C").Replace(tt.action), nil)
+			query, params, err := auditQuery(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(query, "action LIKE $1") {
+				t.Errorf("query lacks the action filter:\n%s", query)
+			}
+			if want := []interface{}{tt.want}; !reflect.DeepEqual(params, want) {
+				t.Errorf("params = %q, want %q", params, want)
+			}
+		})
+	}
+}
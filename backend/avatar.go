@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/draw"
+	_ "image/gif"
+	_ "image/jpeg"
+	"image/png"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+// Avatar sizes in pixels, largest first. Each size is scaled down from the previous one.
+var avatarSizes = []int{256, 128, 64, 32}
+
+const (
+	maxAvatarUpload = 5 << 20
+	maxAvatarPixels = 4096
+)
+
+// avatarURL returns the public URL of a user's avatar, or "" if they have none.
+// The version changes with every upload so the image can be cached forever.
+func avatarURL(userID string, version sql.NullInt64) string {
+	if !version.Valid {
+		return ""
+	}
+	return fmt.Sprintf("/api/users/%s/avatar?v=%d", userID, version.Int64)
+}
+
+// processAvatar decodes an uploaded image, crops it to a centered square and
+// renders it as PNG in every avatar size. Re-encoding drops EXIF and any
+// other metadata from the original file.
+func processAvatar(data []byte) (map[int][]byte, error) {
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("unsupported image format")
+	}
+	if cfg.Width > maxAvatarPixels || cfg.Height > maxAvatarPixels {
+		return nil, fmt.Errorf("image must be at most %dx%d pixels", maxAvatarPixels, maxAvatarPixels)
+	}
+
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("unsupported image format")
+	}
+
+	// Center crop to a square
+	b := src.Bounds()
+	side := b.Dx()
+	if b.Dy() < side {
+		side = b.Dy()
+	}
+	if side == 0 {
+		return nil, fmt.Errorf("image is empty")
+	}
+	x0 := b.Min.X + (b.Dx()-side)/2
+	y0 := b.Min.Y + (b.Dy()-side)/2
+	square := image.NewRGBA(image.Rect(0, 0, side, side))
+	draw.Draw(square, square.Bounds(), src, image.Pt(x0, y0), draw.Src)
+
+	out := make(map[int][]byte)
+	current := square
+	for _, size := range avatarSizes {
+		current = resizeSquare(current, size)
+
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, current); err != nil {
+			return nil, err
+		}
+		out[size] = buf.Bytes()
+	}
+	return out, nil
+}
+
+// resizeSquare scales a square image to size x size, averaging the source
+// pixels covered by each target pixel when shrinking
+func resizeSquare(src *image.RGBA, size int) *image.RGBA {
+	side := src.Bounds().Dx()
+	dst := image.NewRGBA(image.Rect(0, 0, size, size))
+
+	for y := 0; y < size; y++ {
+		sy0 := y * side / size
+		sy1 := (y + 1) * side / size
+		if sy1 <= sy0 {
+			sy1 = sy0 + 1
+		}
+		for x := 0; x < size; x++ {
+			sx0 := x * side / size
+			sx1 := (x + 1) * side / size
+			if sx1 <= sx0 {
+				sx1 = sx0 + 1
+			}
+
+			var r, g, b, a, n int
+			for sy := sy0; sy < sy1; sy++ {
+				i := src.PixOffset(sx0, sy)
+				for sx := sx0; sx < sx1; sx++ {
+					r += int(src.Pix[i])
+					g += int(src.Pix[i+1])
+					b += int(src.Pix[i+2])
+					a += int(src.Pix[i+3])
+					i += 4
+					n++
+				}
+			}
+
+			j := dst.PixOffset(x, y)
+			dst.Pix[j] = uint8(r / n)
+			dst.Pix[j+1] = uint8(g / n)
+			dst.Pix[j+2] = uint8(b / n)
+			dst.Pix[j+3] = uint8(a / n)
+		}
+	}
+	return dst
+}
+
+func uploadAvatarHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userId").(string)
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxAvatarUpload+1<<20)
+	file, _, err := r.FormFile("avatar")
+	if err != nil {
+		http.Error(w, "Multipart field \"avatar\" is required", http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(io.LimitReader(file, maxAvatarUpload+1))
+	if err != nil {
+		http.Error(w, "Error reading upload", http.StatusBadRequest)
+		return
+	}
+	if len(data) > maxAvatarUpload {
+		http.Error(w, "Avatar must be at most 5 MB", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	images, err := processAvatar(data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	for size, img := range images {
+		_, err = tx.Exec(`
+			INSERT INTO avatars (user_id, size, data) VALUES ($1, $2, $3)
+			ON CONFLICT (user_id, size) DO UPDATE SET data = EXCLUDED.data
+		`, userID, size, img)
+		if err != nil {
+			http.Error(w, "Error saving avatar", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	var version sql.NullInt64
+	err = tx.QueryRow(
+		"UPDATE users SET avatar_version = COALESCE(avatar_version, 0) + 1 WHERE id = $1 RETURNING avatar_version",
+		userID,
+	).Scan(&version)
+	if err != nil {
+		http.Error(w, "Error saving avatar", http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Error saving avatar", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"avatarUrl": avatarURL(userID, version),
+	})
+}
+
+func deleteAvatarHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userId").(string)
+
+	_, err := db.Exec("DELETE FROM avatars WHERE user_id = $1", userID)
+	if err == nil {
+		_, err = db.Exec("UPDATE users SET avatar_version = NULL WHERE id = $1", userID)
+	}
+	if err != nil {
+		http.Error(w, "Error deleting avatar", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "Avatar deleted",
+	})
+}
+
+// getAvatarHandler serves an avatar image. It is public so that the URL can be
+// used directly in <img> tags, which can't send an Authorization header.
+func getAvatarHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	userID := vars["id"]
+
+	// Pick the smallest rendition at least as large as requested
+	size := avatarSizes[0]
+	if requested, err := strconv.Atoi(r.URL.Query().Get("size")); err == nil {
+		for _, s := range avatarSizes {
+			if s >= requested {
+				size = s
+			}
+		}
+	}
+
+	var data []byte
+	var version sql.NullInt64
+	err := db.QueryRow(`
+		SELECT a.data, u.avatar_version
+		FROM avatars a
+		JOIN users u ON u.id = a.user_id
+		WHERE a.user_id = $1 AND a.size = $2
+	`, userID, size).Scan(&data, &version)
+	if err != nil {
+		http.Error(w, "Avatar not found", http.StatusNotFound)
+		return
+	}
+
+	etag := fmt.Sprintf(`"%s-%d-%d"`, userID, version.Int64, size)
+	w.Header().Set("ETag", etag)
+	if r.URL.Query().Get("v") == strconv.FormatInt(version.Int64, 10) {
+		// Versioned URLs never change content
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	} else {
+		w.Header().Set("Cache-Control", "public, max-age=300")
+	}
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.Write(data)
+}
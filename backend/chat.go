@@ -0,0 +1,448 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/lib/pq"
+)
+
+// Provider of accounts linked through Slack or Mattermost slash commands
+const chatProviderSlack = "slack"
+
+// Slack rejects requests whose timestamp is further off than this
+const slackSignatureMaxAge = 5 * time.Minute
+
+// chatCatalog holds the channel messages per locale. {task} is a link to the
+// task, the other placeholders are plain text.
+var chatCatalog = map[string]map[string]string{
+	"ru": {
+		notifTaskAssigned:     "{actor} назначил(а) {assignees} на задачу {task}",
+		notifTaskStateChanged: "{actor} перевел(а) задачу {task} в «{state}»",
+	},
+	"en": {
+		notifTaskAssigned:     "{actor} assigned {assignees} to {task}",
+		notifTaskStateChanged: "{actor} moved {task} to “{state}”",
+	},
+}
+
+// chatStrings holds the slash command replies per locale
+var chatStrings = map[string]map[string]string{
+	"ru": {
+		"help":         "Команды:\n`/taskflow create <название>` — создать задачу в бэклоге\n`/taskflow my` — мои задачи\n`/taskflow link <код>` — привязать аккаунт (код выдается в профиле TaskFlow)\n`/taskflow unlink` — отвязать аккаунт",
+		"notLinked":    "Аккаунт не привязан к TaskFlow. Получите код в профиле и отправьте `/taskflow link <код>`.",
+		"linked":       "Аккаунт привязан к пользователю {username}.",
+		"badCode":      "Код неверный или устарел.",
+		"unlinked":     "Аккаунт отвязан от TaskFlow.",
+		"noTitle":      "Укажите название: `/taskflow create <название>`",
+		"noPermission": "У вас нет прав на создание задач.",
+		"created":      "{actor} создал(а) задачу {task}",
+		"noTasks":      "У вас нет открытых задач.",
+		"myTasks":      "Ваши задачи:",
+		"error":        "Не удалось выполнить команду, попробуйте позже.",
+	},
+	"en": {
+		"help":         "Commands:\n`/taskflow create <title>` — create a task in the backlog\n`/taskflow my` — your tasks\n`/taskflow link <code>` — link your account (get the code in your TaskFlow profile)\n`/taskflow unlink` — unlink your account",
+		"notLinked":    "Your account isn't linked to TaskFlow. Get a code in your profile and send `/taskflow link <code>`.",
+		"linked":       "Your account is now linked to {username}.",
+		"badCode":      "The code is invalid or has expired.",
+		"unlinked":     "Your account has been unlinked from TaskFlow.",
+		"noTitle":      "Please give a title: `/taskflow create <title>`",
+		"noPermission": "You are not allowed to create tasks.",
+		"created":      "{actor} created {task}",
+		"noTasks":      "You have no open tasks.",
+		"myTasks":      "Your tasks:",
+		"error":        "The command failed, please try again later.",
+	},
+}
+
+// chatNotifier posts board events to a Slack or Mattermost incoming webhook
+// and verifies slash commands coming from them
+type chatNotifier struct {
+	webhookURL    string
+	signingSecret string
+	commandToken  string
+	locale        string
+	client        *http.Client
+}
+
+var chat *chatNotifier
+
+// newChatNotifierFromEnv configures chat from CHAT_WEBHOOK_URL (channel
+// messages), CHAT_SIGNING_SECRET (Slack) or CHAT_COMMAND_TOKEN (Mattermost)
+// for slash commands, and CHAT_LOCALE
+func newChatNotifierFromEnv() *chatNotifier {
+	c := &chatNotifier{
+		webhookURL:    os.Getenv("CHAT_WEBHOOK_URL"),
+		signingSecret: os.Getenv("CHAT_SIGNING_SECRET"),
+		commandToken:  os.Getenv("CHAT_COMMAND_TOKEN"),
+		locale:        os.Getenv("CHAT_LOCALE"),
+		client:        &http.Client{Timeout: 10 * time.Second},
+	}
+	if !validLocale(c.locale) {
+		c.locale = supportedLocales[0]
+	}
+	return c
+}
+
+// chatText returns a fixed chat text in the locale with placeholders filled in
+func chatText(locale, key string, pairs ...string) string {
+	s, ok := chatStrings[locale][key]
+	if !ok {
+		s = chatStrings[supportedLocales[0]][key]
+	}
+	return strings.NewReplacer(pairs...).Replace(s)
+}
+
+// escapeChat escapes the characters Slack and Mattermost treat as markup
+func escapeChat(s string) string {
+	return strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;").Replace(s)
+}
+
+// chatTaskLink formats a link to a task
+func chatTaskLink(taskID, title string) string {
+	return "<" + appURL + "/tasks/" + taskID + "|" + escapeChat(title) + ">"
+}
+
+// notify posts an assignment or state change to the channel. userIDs are the
+// users the event is about, such as the new assignees. It does nothing when
+// no channel is configured.
+func (c *chatNotifier) notify(event NotificationEvent, userIDs []string) {
+	if c == nil || c.webhookURL == "" {
+		return
+	}
+	template, ok := chatCatalog[c.locale][event.Type]
+	if !ok || (event.Type == notifTaskAssigned && len(userIDs) == 0) {
+		return
+	}
+
+	var actor string
+	if err := db.QueryRow("SELECT username FROM users WHERE id::text = $1", event.ActorID).Scan(&actor); err != nil {
+		actor = "TaskFlow"
+	}
+
+	assignees := []string{}
+	if len(userIDs) > 0 {
+		rows, err := db.Query("SELECT username FROM users WHERE id = ANY($1::uuid[]) ORDER BY username", pq.Array(userIDs))
+		if err != nil {
+			log.Printf("Error posting chat message: %v", err)
+			return
+		}
+		for rows.Next() {
+			var username string
+			if err := rows.Scan(&username); err == nil {
+				assignees = append(assignees, "*"+escapeChat(username)+"*")
+			}
+		}
+		rows.Close()
+	}
+
+	title, _ := event.Params["title"].(string)
+	state, _ := event.Params["state"].(string)
+	var stateTitle string
+	if err := db.QueryRow("SELECT title FROM columns WHERE id = $1", state).Scan(&stateTitle); err != nil {
+		stateTitle = state
+	}
+
+	text := strings.NewReplacer(
+		"{actor}", "*"+escapeChat(actor)+"*",
+		"{assignees}", strings.Join(assignees, ", "),
+		"{task}", chatTaskLink(event.TaskID, title),
+		"{state}", escapeChat(stateTitle),
+	).Replace(template)
+
+	go func() {
+		if err := c.post(text); err != nil {
+			log.Printf("Error posting chat message: %v", err)
+		}
+	}()
+}
+
+// post sends a message to the incoming webhook, retrying a few times on
+// network errors and server errors
+func (c *chatNotifier) post(text string) error {
+	body, err := json.Marshal(map[string]string{"text": text})
+	if err != nil {
+		return err
+	}
+
+	delay := time.Second
+	for attempt := 1; ; attempt++ {
+		var resp *http.Response
+		resp, err = c.client.Post(c.webhookURL, "application/json", bytes.NewReader(body))
+		if err == nil {
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode < 300 {
+				return nil
+			}
+			err = fmt.Errorf("chat responded with %s", resp.Status)
+			if resp.StatusCode < 500 && resp.StatusCode != http.StatusTooManyRequests {
+				return err
+			}
+		}
+		if attempt == 3 {
+			return err
+		}
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// verifySlackSignature checks Slack's X-Slack-Signature header, an
+// HMAC-SHA256 of "v0:<timestamp>:<body>", and that the request is recent
+func verifySlackSignature(secret string, header http.Header, body []byte, now time.Time) bool {
+	ts := header.Get("X-Slack-Request-Timestamp")
+	sec, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return false
+	}
+	if age := now.Sub(time.Unix(sec, 0)); age > slackSignatureMaxAge || age < -slackSignatureMaxAge {
+		return false
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte("v0:" + ts + ":"))
+	mac.Write(body)
+	expected := "v0=" + hex.EncodeToString(mac.Sum(nil))
+	return hmac.Equal([]byte(expected), []byte(header.Get("X-Slack-Signature")))
+}
+
+// verifyCommand reports whether a slash command really comes from the chat
+// server. Slack requests are signed, Mattermost ones carry a shared token.
+func (c *chatNotifier) verifyCommand(header http.Header, body []byte, form url.Values) bool {
+	if c.signingSecret != "" && header.Get("X-Slack-Signature") != "" {
+		return verifySlackSignature(c.signingSecret, header, body, time.Now())
+	}
+	if c.commandToken != "" {
+		return subtle.ConstantTimeCompare([]byte(form.Get("token")), []byte(c.commandToken)) == 1
+	}
+	return false
+}
+
+// chatReply is the response to a slash command. Ephemeral replies are only
+// shown to the user who sent the command.
+type chatReply struct {
+	ResponseType string `json:"response_type"`
+	Text         string `json:"text"`
+}
+
+// chatCommandHandler handles "/taskflow ..." slash commands from Slack or
+// Mattermost. The chat user is mapped to a TaskFlow user through a linked
+// chat account.
+func chatCommandHandler(w http.ResponseWriter, r *http.Request) {
+	if chat == nil || (chat.signingSecret == "" && chat.commandToken == "") {
+		http.Error(w, "Chat commands are not configured", http.StatusNotFound)
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, 64<<10))
+	if err != nil {
+		http.Error(w, "Error reading request", http.StatusBadRequest)
+		return
+	}
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		http.Error(w, "Malformed command", http.StatusBadRequest)
+		return
+	}
+	if !chat.verifyCommand(r.Header, body, form) {
+		http.Error(w, "Invalid signature", http.StatusUnauthorized)
+		return
+	}
+
+	// User IDs are only unique within a Slack workspace or Mattermost team
+	externalID := form.Get("team_id") + ":" + form.Get("user_id")
+	text := strings.TrimSpace(form.Get("text"))
+	command, arg := text, ""
+	if i := strings.IndexAny(text, " \t\n"); i >= 0 {
+		command, arg = text[:i], strings.TrimSpace(text[i+1:])
+	}
+	command = strings.ToLower(command)
+
+	user, err := lookupChatUser(chatProviderSlack, externalID)
+	if err != nil {
+		log.Printf("Error looking up chat user: %v", err)
+		writeChatReply(w, "ephemeral", chatText(chat.locale, "error"))
+		return
+	}
+	locale := chat.locale
+	if user != nil {
+		locale = user.Locale
+	}
+
+	switch command {
+	case "link":
+		userID, err := linkChatAccount(chatProviderSlack, externalID, form.Get("user_name"), arg)
+		if err != nil {
+			writeChatReply(w, "ephemeral", chatText(locale, "badCode"))
+			return
+		}
+		var username string
+		db.QueryRow("SELECT username FROM users WHERE id = $1", userID).Scan(&username)
+		recordAudit(r, userID, "chat.linked", "user", userID, map[string]interface{}{
+			"provider": chatProviderSlack,
+		})
+		writeChatReply(w, "ephemeral", chatText(locale, "linked", "{username}", username))
+		return
+	case "unlink":
+		if _, err := unlinkChatAccount(chatProviderSlack, externalID); err != nil {
+			writeChatReply(w, "ephemeral", chatText(locale, "error"))
+			return
+		}
+		writeChatReply(w, "ephemeral", chatText(locale, "unlinked"))
+		return
+	case "create", "my":
+		if user == nil {
+			writeChatReply(w, "ephemeral", chatText(locale, "notLinked"))
+			return
+		}
+	default:
+		writeChatReply(w, "ephemeral", chatText(locale, "help"))
+		return
+	}
+
+	if command == "my" {
+		reply, err := myTasksText(user)
+		if err != nil {
+			log.Printf("Error listing chat user tasks: %v", err)
+			reply = chatText(locale, "error")
+		}
+		writeChatReply(w, "ephemeral", reply)
+		return
+	}
+
+	task, err := createTaskFromChat(user, arg)
+	switch {
+	case err == errChatNoTitle:
+		writeChatReply(w, "ephemeral", chatText(locale, "noTitle"))
+	case err == errChatForbidden:
+		writeChatReply(w, "ephemeral", chatText(locale, "noPermission"))
+	case err != nil:
+		log.Printf("Error creating task from chat: %v", err)
+		writeChatReply(w, "ephemeral", chatText(locale, "error"))
+	default:
+		writeChatReply(w, "in_channel", chatText(locale, "created",
+			"{actor}", "*"+escapeChat(user.Username)+"*",
+			"{task}", chatTaskLink(task.ID, task.Title)))
+	}
+}
+
+func writeChatReply(w http.ResponseWriter, responseType, text string) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(chatReply{ResponseType: responseType, Text: text})
+}
+
+var (
+	errChatNoTitle   = errors.New("task title is required")
+	errChatForbidden = errors.New("permission denied: " + permTaskCreate + " required")
+)
+
+// createTaskFromChat creates a backlog task on behalf of a linked chat user
+func createTaskFromChat(user *chatUser, title string) (Task, error) {
+	var task Task
+	title = strings.TrimSpace(title)
+	if title == "" {
+		return task, errChatNoTitle
+	}
+	if len(title) > 255 {
+		title = title[:255]
+		for !utf8.ValidString(title) {
+			title = title[:len(title)-1]
+		}
+	}
+
+	perms, err := rolePermissions(user.Role)
+	if err != nil {
+		return task, err
+	}
+	if !perms[permTaskCreate] {
+		return task, errChatForbidden
+	}
+
+	err = db.QueryRow(`
+		INSERT INTO tasks (title, description, created_by)
+		VALUES ($1, '', $2)
+		RETURNING id, number, title, description, state, priority, created_at, updated_at
+	`, title, user.ID).Scan(&task.ID, &task.Number, &task.Title, &task.Description, &task.State, &task.Priority, &task.CreatedAt, &task.UpdatedAt)
+	if err != nil {
+		return task, err
+	}
+	task.Key = taskKey(task.Number)
+	people := &taskPeople{}
+	people.apply(&task)
+	task.DescriptionMentions = []Mention{}
+
+	emitWebhookEvent(user.ID, hookTaskCreated, map[string]interface{}{
+		"task": task,
+	})
+	return task, nil
+}
+
+// openTask is a task in a user's list of open tasks
+type openTask struct {
+	ID       string
+	Title    string
+	Column   string
+	Priority int
+}
+
+// loadOpenTasks returns the tasks assigned to a user that aren't done,
+// highest priority, which is 1, first
+func loadOpenTasks(userID string) ([]openTask, error) {
+	rows, err := db.Query(`
+		SELECT t.id, t.title, t.priority, c.title
+		FROM tasks t
+		JOIN task_assignees a ON a.task_id = t.id
+		JOIN columns c ON c.id = t.state
+		WHERE a.user_id = $1 AND t.state <> 'done'
+		ORDER BY t.priority ASC, t.created_at
+		LIMIT 20
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tasks := []openTask{}
+	for rows.Next() {
+		var t openTask
+		if err := rows.Scan(&t.ID, &t.Title, &t.Priority, &t.Column); err != nil {
+			return nil, err
+		}
+		tasks = append(tasks, t)
+	}
+	return tasks, rows.Err()
+}
+
+// myTasksText lists the open tasks assigned to a user
+func myTasksText(user *chatUser) (string, error) {
+	tasks, err := loadOpenTasks(user.ID)
+	if err != nil {
+		return "", err
+	}
+	if len(tasks) == 0 {
+		return chatText(user.Locale, "noTasks"), nil
+	}
+
+	lines := []string{chatText(user.Locale, "myTasks")}
+	for _, t := range tasks {
+		lines = append(lines, fmt.Sprintf("• %s — %s (P%d)", chatTaskLink(t.ID, t.Title), escapeChat(t.Column), t.Priority))
+	}
+	return strings.Join(lines, "\n"), nil
+}
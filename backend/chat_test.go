@@ -0,0 +1,264 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// slackHeader returns the headers Slack signs a request body with
+func slackHeader(secret string, ts time.Time, body []byte) http.Header {
+	stamp := strconv.FormatInt(ts.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte("v0:" + stamp + ":"))
+	mac.Write(body)
+	header := http.Header{}
+	header.Set("X-Slack-Request-Timestamp", stamp)
+	header.Set("X-Slack-Signature", "v0="+hex.EncodeToString(mac.Sum(nil)))
+	return header
+}
+
+func TestVerifySlackSignature(t *testing.T) {
+	body := []byte("team_id=T1&user_id=U1&text=my")
+	now := time.Now()
+
+	tampered := slackHeader("secret", now, body)
+	tampered.Set("X-Slack-Signature", "v0="+strings.Repeat("0", 64))
+
+	tests := []struct {
+		name   string
+		header http.Header
+		want   bool
+	}{
+		{"valid", slackHeader("secret", now, body), true},
+		{"stale timestamp", slackHeader("secret", now.Add(-slackSignatureMaxAge-time.Minute), body), false},
+		{"other secret", slackHeader("other", now, body), false},
+		{"bad signature", tampered, false},
+		{"no timestamp", http.Header{}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := verifySlackSignature("secret", tt.header, body, now); got != tt.want {
+				t.Errorf("verifySlackSignature() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestChatVerifyCommandMattermost(t *testing.T) {
+	c := &chatNotifier{commandToken: "mm-token"}
+	tests := []struct {
+		name  string
+		token string
+		want  bool
+	}{
+		{"matching token", "mm-token", true},
+		{"other token", "mm-tokem", false},
+		{"no token", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			form := url.Values{"token": {tt.token}}
+			if got := c.verifyCommand(http.Header{}, []byte(form.Encode()), form); got != tt.want {
+				t.Errorf("verifyCommand() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func expectSlackUser(mock sqlmock.Sqlmock, role string) {
+	rows := sqlmock.NewRows(chatUserColumns)
+	if role != "" {
+		rows.AddRow(testUserA, "alice", role, "en")
+	}
+	mock.ExpectQuery(`SELECT u.id, u.username, u.role, u.locale\s+FROM chat_accounts`).
+		WithArgs(chatProviderSlack, "T1:U1").WillReturnRows(rows)
+}
+
+func TestChatCommandHandler(t *testing.T) {
+	saved, savedURL := chat, appURL
+	chat = &chatNotifier{commandToken: "mm-token", locale: "en"}
+	appURL = "https://taskflow.example"
+	t.Cleanup(func() { chat, appURL = saved, savedURL })
+
+	tests := []struct {
+		name     string
+		text     string
+		expect   func(mock sqlmock.Sqlmock)
+		response string
+		reply    string
+	}{
+		{
+			name: "link",
+			text: "link abcd-1234",
+			expect: func(mock sqlmock.Sqlmock) {
+				expectSlackUser(mock, "")
+				mock.ExpectQuery(`UPDATE user_tokens SET used_at = NOW\(\)`).WithArgs(hashToken("ABCD-1234"), tokenPurposeChatLink).
+					WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow(testUserA))
+				mock.ExpectExec(`INSERT INTO chat_accounts`).WithArgs(chatProviderSlack, "T1:U1", "alice_mm", testUserA).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectQuery(`SELECT username FROM users`).WithArgs(testUserA).
+					WillReturnRows(sqlmock.NewRows([]string{"username"}).AddRow("alice"))
+				mock.ExpectExec(`INSERT INTO audit_log`).WithArgs(testUserA, "chat.linked", "user", testUserA,
+					sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(1, 1))
+			},
+			response: "ephemeral",
+			reply:    chatText("en", "linked", "{username}", "alice"),
+		},
+		{
+			name: "link with a bad code",
+			text: "link nope",
+			expect: func(mock sqlmock.Sqlmock) {
+				expectSlackUser(mock, "")
+				mock.ExpectQuery(`UPDATE user_tokens SET used_at = NOW\(\)`).WillReturnError(sql.ErrNoRows)
+			},
+			response: "ephemeral",
+			reply:    chatText("en", "badCode"),
+		},
+		{
+			name: "create",
+			text: "create Fix the parser",
+			expect: func(mock sqlmock.Sqlmock) {
+				expectSlackUser(mock, "member")
+				mock.ExpectQuery(`INSERT INTO tasks`).WithArgs("Fix the parser", testUserA).WillReturnRows(
+					sqlmock.NewRows([]string{"id", "number", "title", "description", "state", "priority", "created_at", "updated_at"}).
+						AddRow(testTask, 42, "Fix the parser", "", "backlog", 3, time.Now(), time.Now()))
+				mock.ExpectExec(`INSERT INTO webhook_deliveries`).WithArgs(hookTaskCreated, sqlmock.AnyArg()).
+					WillReturnResult(sqlmock.NewResult(0, 0))
+			},
+			response: "in_channel",
+			reply:    "*alice* created <https://taskflow.example/tasks/" + testTask + "|Fix the parser>",
+		},
+		{
+			name:     "create without permission",
+			text:     "create Fix the parser",
+			expect:   func(mock sqlmock.Sqlmock) { expectSlackUser(mock, "viewer") },
+			response: "ephemeral",
+			reply:    chatText("en", "noPermission"),
+		},
+		{
+			name:     "create when not linked",
+			text:     "create Fix the parser",
+			expect:   func(mock sqlmock.Sqlmock) { expectSlackUser(mock, "") },
+			response: "ephemeral",
+			reply:    chatText("en", "notLinked"),
+		},
+		{
+			name: "my",
+			text: "my",
+			expect: func(mock sqlmock.Sqlmock) {
+				expectSlackUser(mock, "member")
+				mock.ExpectQuery(`SELECT t.id, t.title, t.priority, c.title`).WithArgs(testUserA).WillReturnRows(
+					sqlmock.NewRows([]string{"id", "title", "priority", "column"}).AddRow(testTask, "Fix <the> parser", 1, "In progress"))
+			},
+			response: "ephemeral",
+			reply: chatText("en", "myTasks") + "\n• <https://taskflow.example/tasks/" + testTask +
+				"|Fix &lt;the&gt; parser> — In progress (P1)",
+		},
+		{
+			name: "my with nothing open",
+			text: "MY",
+			expect: func(mock sqlmock.Sqlmock) {
+				expectSlackUser(mock, "member")
+				mock.ExpectQuery(`SELECT t.id, t.title, t.priority, c.title`).WithArgs(testUserA).
+					WillReturnRows(sqlmock.NewRows([]string{"id", "title", "priority", "column"}))
+			},
+			response: "ephemeral",
+			reply:    chatText("en", "noTasks"),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock := mockDB(t)
+			setRoles(t, map[string][]string{"member": {permTaskCreate}, "viewer": {}})
+			tt.expect(mock)
+
+			form := url.Values{"token": {"mm-token"}, "team_id": {"T1"}, "user_id": {"U1"}, "user_name": {"alice_mm"}, "text": {tt.text}}
+			r := httptest.NewRequest("POST", "/api/chat/command", strings.NewReader(form.Encode()))
+			w := httptest.NewRecorder()
+			chatCommandHandler(w, r)
+
+			var reply chatReply
+			if err := json.NewDecoder(w.Body).Decode(&reply); err != nil {
+				t.Fatalf("status = %d: %v", w.Code, err)
+			}
+			if reply.ResponseType != tt.response || reply.Text != tt.reply {
+				t.Errorf("reply = %+v, want %s %q", reply, tt.response, tt.reply)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestChatCommandHandlerRejectsBadToken(t *testing.T) {
+	saved := chat
+	chat = &chatNotifier{commandToken: "mm-token", locale: "en"}
+	t.Cleanup(func() { chat = saved })
+	mock := mockDB(t)
+
+	form := url.Values{"token": {"guess"}, "team_id": {"T1"}, "user_id": {"U1"}, "text": {"my"}}
+	r := httptest.NewRequest("POST", "/api/chat/command", strings.NewReader(form.Encode()))
+	w := httptest.NewRecorder()
+	chatCommandHandler(w, r)
+
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestChatNotify(t *testing.T) {
+	posted := make(chan string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var msg map[string]string
+		json.NewDecoder(r.Body).Decode(&msg)
+		posted <- msg["text"]
+	}))
+	t.Cleanup(server.Close)
+
+	savedURL := appURL
+	appURL = "https://taskflow.example"
+	t.Cleanup(func() { appURL = savedURL })
+	mock := mockDB(t)
+
+	mock.ExpectQuery(`SELECT username FROM users WHERE id::text = \$1`).WithArgs(testUserA).
+		WillReturnRows(sqlmock.NewRows([]string{"username"}).AddRow("alice"))
+	mock.ExpectQuery(`SELECT username FROM users WHERE id = ANY`).
+		WillReturnRows(sqlmock.NewRows([]string{"username"}).AddRow("bob"))
+	mock.ExpectQuery(`SELECT title FROM columns`).WillReturnError(sql.ErrNoRows)
+
+	c := &chatNotifier{webhookURL: server.URL, locale: "en", client: server.Client()}
+	c.notify(NotificationEvent{
+		Type:    notifTaskAssigned,
+		TaskID:  testTask,
+		ActorID: testUserA,
+		Params:  map[string]interface{}{"title": "Parser"},
+	}, []string{testUserB})
+
+	select {
+	case text := <-posted:
+		if want := "*alice* assigned *bob* to <https://taskflow.example/tasks/" + testTask + "|Parser>"; text != want {
+			t.Errorf("posted %q, want %q", text, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("nothing was posted")
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
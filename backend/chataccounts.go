@@ -0,0 +1,152 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// How long a code for linking a chat account stays valid
+const chatLinkTTL = 10 * time.Minute
+
+// ChatAccount is an account in a chat app linked to a TaskFlow user, so
+// commands sent from it act as that user
+type ChatAccount struct {
+	Provider    string    `json:"provider"`
+	ExternalID  string    `json:"externalId"`
+	DisplayName string    `json:"displayName"`
+	CreatedAt   time.Time `json:"createdAt"`
+}
+
+// chatUser is the TaskFlow user behind a linked chat account
+type chatUser struct {
+	ID       string
+	Username string
+	Role     string
+	Locale   string
+}
+
+// linkChatAccount links a chat account to the user who issued the code,
+// replacing an earlier link of the same chat account
+func linkChatAccount(provider, externalID, displayName, code string) (string, error) {
+	userID, err := consumeLinkCode(code)
+	if err != nil {
+		return "", err
+	}
+	_, err = db.Exec(`
+		INSERT INTO chat_accounts (provider, external_id, display_name, user_id) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (provider, external_id) DO UPDATE SET user_id = EXCLUDED.user_id, display_name = EXCLUDED.display_name, created_at = NOW()
+	`, provider, externalID, displayName, userID)
+	return userID, err
+}
+
+// unlinkChatAccount removes the link of a chat account and reports whether
+// there was one
+func unlinkChatAccount(provider, externalID string) (bool, error) {
+	result, err := db.Exec("DELETE FROM chat_accounts WHERE provider = $1 AND external_id = $2", provider, externalID)
+	if err != nil {
+		return false, err
+	}
+	n, _ := result.RowsAffected()
+	return n > 0, nil
+}
+
+// lookupChatUser returns the active user linked to a chat account, or nil
+// if the account isn't linked
+func lookupChatUser(provider, externalID string) (*chatUser, error) {
+	var u chatUser
+	err := db.QueryRow(`
+		SELECT u.id, u.username, u.role, u.locale
+		FROM chat_accounts c
+		JOIN users u ON u.id = c.user_id
+		WHERE c.provider = $1 AND c.external_id = $2 AND u.deactivated_at IS NULL
+	`, provider, externalID).Scan(&u.ID, &u.Username, &u.Role, &u.Locale)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !validLocale(u.Locale) {
+		u.Locale = supportedLocales[0]
+	}
+	return &u, nil
+}
+
+// createChatLinkCodeHandler issues a code the user sends from a chat app to
+// link their chat account
+func createChatLinkCodeHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userId").(string)
+
+	code, err := issueLinkCode(userID, chatLinkTTL)
+	if err != nil {
+		http.Error(w, "Error creating link code", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"code":      code,
+		"expiresAt": time.Now().Add(chatLinkTTL),
+	})
+}
+
+func getChatAccountsHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userId").(string)
+
+	rows, err := db.Query(`
+		SELECT provider, external_id, display_name, created_at FROM chat_accounts
+		WHERE user_id = $1
+		ORDER BY created_at
+	`, userID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	accounts := []ChatAccount{}
+	for rows.Next() {
+		var a ChatAccount
+		if err := rows.Scan(&a.Provider, &a.ExternalID, &a.DisplayName, &a.CreatedAt); err != nil {
+			http.Error(w, "Error scanning chat accounts", http.StatusInternalServerError)
+			return
+		}
+		accounts = append(accounts, a)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(accounts)
+}
+
+func deleteChatAccountHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	userID := r.Context().Value("userId").(string)
+
+	result, err := db.Exec(
+		"DELETE FROM chat_accounts WHERE provider = $1 AND external_id = $2 AND user_id = $3",
+		vars["provider"], vars["externalId"], userID,
+	)
+	if err != nil {
+		http.Error(w, "Error unlinking chat account", http.StatusInternalServerError)
+		return
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil || rowsAffected == 0 {
+		http.Error(w, "Chat account not found", http.StatusNotFound)
+		return
+	}
+	recordAudit(r, "", "chat.unlinked", "user", userID, map[string]interface{}{
+		"provider": vars["provider"],
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "Chat account unlinked",
+	})
+}
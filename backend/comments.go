@@ -0,0 +1,145 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// CommentRequest represents the create comment request body
+type CommentRequest struct {
+	Content string `json:"content"`
+}
+
+func createCommentHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	taskID := vars["id"]
+	userID := r.Context().Value("userId").(string)
+
+	var req CommentRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	req.Content = strings.TrimSpace(req.Content)
+	if req.Content == "" {
+		http.Error(w, "Comment content is required", http.StatusBadRequest)
+		return
+	}
+
+	comment, err := addComment(taskID, userID, req.Content)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Task not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Error creating comment", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(comment)
+}
+
+// addComment adds a comment by the user to a task, notifies the people it
+// mentions and emits the webhook event. It returns sql.ErrNoRows if the task
+// doesn't exist.
+func addComment(taskID, userID, content string) (Comment, error) {
+	comment, taskTitle, err := insertComment(db, taskID, userID, content)
+	if err != nil {
+		return comment, err
+	}
+	return comment, announceComment(taskID, userID, taskTitle, &comment)
+}
+
+// insertComment stores a comment by the user and returns it with the title
+// of its task. It returns sql.ErrNoRows if the task doesn't exist.
+func insertComment(q interface {
+	QueryRow(string, ...interface{}) *sql.Row
+}, taskID, userID, content string) (Comment, string, error) {
+	var comment Comment
+	var taskTitle string
+	err := q.QueryRow(`
+		WITH inserted AS (
+			INSERT INTO comments (task_id, content, author)
+			SELECT id, $2, $3 FROM tasks WHERE id::text = $1
+			RETURNING id, task_id, content, author, created_at
+		)
+		SELECT i.id, i.content, u.username, i.created_at, t.title
+		FROM inserted i
+		JOIN users u ON i.author = u.id
+		JOIN tasks t ON i.task_id = t.id
+	`, taskID, content, userID).Scan(&comment.ID, &comment.Content, &comment.Author, &comment.CreatedAt, &taskTitle)
+	return comment, taskTitle, err
+}
+
+// announceComment notifies the people a stored comment mentions and the
+// task's followers, and emits the webhook event
+func announceComment(taskID, userID, taskTitle string, comment *Comment) error {
+	// Comments can't be edited, so every mention in one is new
+	mentions, err := loadMentionIndex(comment.Content)
+	if err != nil {
+		return err
+	}
+	comment.Mentions = mentions.spans(comment.Content)
+	mentioned := mentions.userIDs(comment.Content)
+	notifyUsers(mentioned, NotificationEvent{
+		Type:    notifMentioned,
+		TaskID:  taskID,
+		ActorID: userID,
+		Params:  map[string]interface{}{"title": taskTitle, "source": "comment", "commentId": comment.ID},
+	})
+	// Followers the comment mentions have just heard about it
+	notifyTaskFollowers(NotificationEvent{
+		Type:    notifCommented,
+		TaskID:  taskID,
+		ActorID: userID,
+		Params:  map[string]interface{}{"title": taskTitle, "commentId": comment.ID},
+	}, mentioned...)
+	emitWebhookEvent(userID, hookCommentCreated, map[string]interface{}{
+		"taskId":  taskID,
+		"comment": comment,
+	})
+	return nil
+}
+
+func deleteCommentHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	taskID := vars["id"]
+	commentID := vars["commentId"]
+	userID := r.Context().Value("userId").(string)
+
+	// Authors may delete their own comments, moderators any comment
+	query := "DELETE FROM comments WHERE id = $1 AND task_id = $2 AND author = $3"
+	params := []interface{}{commentID, taskID, userID}
+	if hasPermission(r, permCommentModerate) {
+		query = "DELETE FROM comments WHERE id = $1 AND task_id = $2"
+		params = params[:2]
+	}
+
+	result, err := db.Exec(query, params...)
+	if err != nil {
+		http.Error(w, "Error deleting comment", http.StatusInternalServerError)
+		return
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil || rowsAffected == 0 {
+		http.Error(w, "Comment not found or not owned by user", http.StatusNotFound)
+		return
+	}
+	emitWebhookEvent(userID, hookCommentDeleted, map[string]interface{}{
+		"taskId":    taskID,
+		"commentId": commentID,
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "Comment deleted",
+	})
+}
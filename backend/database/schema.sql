@@ -1,26 +1,180 @@
+-- Create roles table, each role is a set of permissions
+CREATE TABLE IF NOT EXISTS roles (
+    name VARCHAR(50) PRIMARY KEY,
+    description TEXT NOT NULL DEFAULT '',
+    permissions TEXT[] NOT NULL DEFAULT '{}',
+    builtin BOOLEAN NOT NULL DEFAULT false
+);
+
+-- Insert built-in roles
+INSERT INTO roles (name, description, permissions, builtin) VALUES
+    ('admin', 'Администратор', '{board.view,task.create,task.edit,task.move,task.delete,comment.create,comment.moderate,user.view,user.manage,role.manage,team.manage,webhook.manage,audit.view,settings.manage}', true),
+    ('user', 'Пользователь', '{board.view,task.move,comment.create,user.view}', true)
+ON CONFLICT (name) DO NOTHING;
+
+-- Grant permissions added after the admin role was first created
+UPDATE roles SET permissions = array_append(permissions, 'team.manage')
+WHERE name = 'admin' AND NOT 'team.manage' = ANY(permissions);
+UPDATE roles SET permissions = array_append(permissions, 'webhook.manage')
+WHERE name = 'admin' AND NOT 'webhook.manage' = ANY(permissions);
+
 -- Create users table
 CREATE TABLE IF NOT EXISTS users (
     id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
     username VARCHAR(255) NOT NULL,
     email VARCHAR(255) NOT NULL UNIQUE,
     password VARCHAR(255) NOT NULL,
-    role VARCHAR(50) NOT NULL DEFAULT 'user',
+    role VARCHAR(50) NOT NULL DEFAULT 'user' REFERENCES roles(name) ON UPDATE CASCADE,
+    email_verified BOOLEAN NOT NULL DEFAULT false,
+    pending_email VARCHAR(255),
+    session_version INTEGER NOT NULL DEFAULT 0,
+    avatar_version INTEGER,
+    locale VARCHAR(10) NOT NULL DEFAULT 'ru',
+    timezone VARCHAR(64) NOT NULL DEFAULT 'UTC',
+    quiet_hours_start VARCHAR(5),
+    quiet_hours_end VARCHAR(5),
+    email_mode VARCHAR(10) NOT NULL DEFAULT 'instant',
+    deactivated_at TIMESTAMP WITH TIME ZONE,
+    erased_at TIMESTAMP WITH TIME ZONE,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+-- Add the columns introduced after the table was first created. This file is
+-- run again to upgrade an existing database, so every statement in it is safe
+-- to repeat. Columns are added without their constraints, which are dropped
+-- and added again so they end up the same on new and upgraded databases.
+
+-- Accounts that predate email verification count as verified, new ones don't
+ALTER TABLE users ADD COLUMN IF NOT EXISTS email_verified BOOLEAN NOT NULL DEFAULT true;
+ALTER TABLE users ALTER COLUMN email_verified SET DEFAULT false;
+ALTER TABLE users
+    ADD COLUMN IF NOT EXISTS pending_email VARCHAR(255),
+    ADD COLUMN IF NOT EXISTS session_version INTEGER NOT NULL DEFAULT 0,
+    ADD COLUMN IF NOT EXISTS avatar_version INTEGER,
+    ADD COLUMN IF NOT EXISTS locale VARCHAR(10) NOT NULL DEFAULT 'ru',
+    ADD COLUMN IF NOT EXISTS timezone VARCHAR(64) NOT NULL DEFAULT 'UTC',
+    ADD COLUMN IF NOT EXISTS quiet_hours_start VARCHAR(5),
+    ADD COLUMN IF NOT EXISTS quiet_hours_end VARCHAR(5),
+    ADD COLUMN IF NOT EXISTS email_mode VARCHAR(10) NOT NULL DEFAULT 'instant',
+    ADD COLUMN IF NOT EXISTS deactivated_at TIMESTAMP WITH TIME ZONE,
+    ADD COLUMN IF NOT EXISTS erased_at TIMESTAMP WITH TIME ZONE;
+ALTER TABLE users
+    DROP CONSTRAINT IF EXISTS users_role_fkey,
+    ADD CONSTRAINT users_role_fkey FOREIGN KEY (role) REFERENCES roles(name) ON UPDATE CASCADE;
+
+-- Usernames are unique regardless of case
+CREATE UNIQUE INDEX IF NOT EXISTS users_username_key ON users (lower(username));
+
+-- Emails are looked up regardless of case, so they must be unique that way too
+CREATE UNIQUE INDEX IF NOT EXISTS users_email_lower_key ON users (lower(email));
+
+-- Create avatars table, one PNG per rendered size
+CREATE TABLE IF NOT EXISTS avatars (
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    size INTEGER NOT NULL,
+    data BYTEA NOT NULL,
+    PRIMARY KEY (user_id, size)
+);
+
+-- Create teams table
+CREATE TABLE IF NOT EXISTS teams (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    name VARCHAR(255) NOT NULL UNIQUE,
+    description TEXT NOT NULL DEFAULT '',
+    lead_id UUID REFERENCES users(id) ON DELETE SET NULL,
     created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
 );
 
+-- Create team members table
+CREATE TABLE IF NOT EXISTS team_members (
+    team_id UUID NOT NULL REFERENCES teams(id) ON DELETE CASCADE,
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    PRIMARY KEY (team_id, user_id)
+);
+
+CREATE INDEX IF NOT EXISTS team_members_user_idx ON team_members (user_id);
+
 -- Create tasks table
 CREATE TABLE IF NOT EXISTS tasks (
     id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    number BIGSERIAL UNIQUE,
     title VARCHAR(255) NOT NULL,
     description TEXT,
     state VARCHAR(50) NOT NULL DEFAULT 'backlog',
     priority INTEGER NOT NULL DEFAULT 3,
-    assignee UUID REFERENCES users(id),
+    due_at TIMESTAMP WITH TIME ZONE,
+    -- Set once followers were reminded of the due date, cleared when it changes
+    due_soon_notified BOOLEAN NOT NULL DEFAULT false,
+    team_id UUID REFERENCES teams(id) ON DELETE SET NULL,
     created_by UUID REFERENCES users(id),
     created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
     updated_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
 );
 
+-- Add the columns introduced after the table was first created. Existing
+-- tasks are numbered in the order they were created.
+ALTER TABLE tasks
+    ADD COLUMN IF NOT EXISTS number BIGINT,
+    ADD COLUMN IF NOT EXISTS due_at TIMESTAMP WITH TIME ZONE,
+    ADD COLUMN IF NOT EXISTS due_soon_notified BOOLEAN NOT NULL DEFAULT false,
+    ADD COLUMN IF NOT EXISTS team_id UUID;
+CREATE SEQUENCE IF NOT EXISTS tasks_number_seq OWNED BY tasks.number;
+UPDATE tasks SET number = numbered.number
+FROM (
+    SELECT id, nextval('tasks_number_seq') AS number
+    FROM (SELECT id FROM tasks WHERE number IS NULL ORDER BY created_at, id) unnumbered
+) numbered
+WHERE tasks.id = numbered.id;
+ALTER TABLE tasks
+    ALTER COLUMN number SET DEFAULT nextval('tasks_number_seq'),
+    ALTER COLUMN number SET NOT NULL,
+    DROP CONSTRAINT IF EXISTS tasks_team_id_fkey,
+    ADD CONSTRAINT tasks_team_id_fkey FOREIGN KEY (team_id) REFERENCES teams(id) ON DELETE SET NULL;
+CREATE UNIQUE INDEX IF NOT EXISTS tasks_number_key ON tasks (number);
+
+CREATE INDEX IF NOT EXISTS tasks_due_idx ON tasks (due_at) WHERE NOT due_soon_notified;
+
+-- Create task assignees table, at most one primary assignee per task
+CREATE TABLE IF NOT EXISTS task_assignees (
+    task_id UUID NOT NULL REFERENCES tasks(id) ON DELETE CASCADE,
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    is_primary BOOLEAN NOT NULL DEFAULT false,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    PRIMARY KEY (task_id, user_id)
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS task_assignees_primary_key ON task_assignees (task_id) WHERE is_primary;
+CREATE INDEX IF NOT EXISTS task_assignees_user_idx ON task_assignees (user_id);
+
+-- Move assignees from the old single assignee column
+DO $$
+BEGIN
+    IF EXISTS (SELECT 1 FROM information_schema.columns WHERE table_name = 'tasks' AND column_name = 'assignee') THEN
+        INSERT INTO task_assignees (task_id, user_id, is_primary)
+        SELECT id, assignee, true FROM tasks WHERE assignee IS NOT NULL
+        ON CONFLICT DO NOTHING;
+        ALTER TABLE tasks DROP COLUMN assignee;
+    END IF;
+END $$;
+
+-- Create task watchers table
+CREATE TABLE IF NOT EXISTS task_watchers (
+    task_id UUID NOT NULL REFERENCES tasks(id) ON DELETE CASCADE,
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    PRIMARY KEY (task_id, user_id)
+);
+
+-- Create task description mentions table, users already notified about being
+-- mentioned in a task's description
+CREATE TABLE IF NOT EXISTS task_mentions (
+    task_id UUID NOT NULL REFERENCES tasks(id) ON DELETE CASCADE,
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    PRIMARY KEY (task_id, user_id)
+);
+
 -- Create comments table
 CREATE TABLE IF NOT EXISTS comments (
     id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
@@ -41,19 +195,283 @@ CREATE TABLE IF NOT EXISTS columns (
 CREATE TABLE IF NOT EXISTS notifications (
     id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
     user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
-    message TEXT NOT NULL,
+    type VARCHAR(50) NOT NULL DEFAULT 'message',
+    task_id UUID REFERENCES tasks(id) ON DELETE SET NULL,
+    actor_id UUID REFERENCES users(id) ON DELETE SET NULL,
+    params JSONB NOT NULL DEFAULT '{}',
+    message TEXT NOT NULL DEFAULT '',
     read BOOLEAN NOT NULL DEFAULT false,
     created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
 );
 
+-- Add the columns introduced after the table was first created
+ALTER TABLE notifications
+    ADD COLUMN IF NOT EXISTS type VARCHAR(50) NOT NULL DEFAULT 'message',
+    ADD COLUMN IF NOT EXISTS task_id UUID,
+    ADD COLUMN IF NOT EXISTS actor_id UUID,
+    ADD COLUMN IF NOT EXISTS params JSONB NOT NULL DEFAULT '{}',
+    ALTER COLUMN message SET DEFAULT '';
+ALTER TABLE notifications
+    DROP CONSTRAINT IF EXISTS notifications_task_id_fkey,
+    ADD CONSTRAINT notifications_task_id_fkey FOREIGN KEY (task_id) REFERENCES tasks(id) ON DELETE SET NULL,
+    DROP CONSTRAINT IF EXISTS notifications_actor_id_fkey,
+    ADD CONSTRAINT notifications_actor_id_fkey FOREIGN KEY (actor_id) REFERENCES users(id) ON DELETE SET NULL;
+
+CREATE INDEX IF NOT EXISTS notifications_user_created_idx ON notifications (user_id, created_at DESC, id DESC);
+
+-- Create notification preferences table. Defaults live in the code, only
+-- choices a user made are stored.
+CREATE TABLE IF NOT EXISTS notification_preferences (
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    event VARCHAR(50) NOT NULL,
+    channel VARCHAR(50) NOT NULL,
+    enabled BOOLEAN NOT NULL,
+    PRIMARY KEY (user_id, event, channel)
+);
+
+-- Create muted tasks table
+CREATE TABLE IF NOT EXISTS task_mutes (
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    task_id UUID NOT NULL REFERENCES tasks(id) ON DELETE CASCADE,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    PRIMARY KEY (user_id, task_id)
+);
+
+-- Create outgoing notification email queue
+CREATE TABLE IF NOT EXISTS email_queue (
+    id BIGSERIAL PRIMARY KEY,
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    type VARCHAR(50) NOT NULL,
+    task_id UUID REFERENCES tasks(id) ON DELETE SET NULL,
+    actor_id UUID REFERENCES users(id) ON DELETE SET NULL,
+    params JSONB NOT NULL DEFAULT '{}',
+    digest BOOLEAN NOT NULL DEFAULT false,
+    status VARCHAR(20) NOT NULL DEFAULT 'pending',
+    attempts INTEGER NOT NULL DEFAULT 0,
+    last_error TEXT NOT NULL DEFAULT '',
+    next_attempt_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    sent_at TIMESTAMP WITH TIME ZONE,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS email_queue_due_idx ON email_queue (next_attempt_at) WHERE status IN ('pending', 'sending');
+
+-- Create single-use tokens table (password reset, email verification)
+CREATE TABLE IF NOT EXISTS user_tokens (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    purpose VARCHAR(50) NOT NULL,
+    token_hash VARCHAR(64) NOT NULL UNIQUE,
+    expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    used_at TIMESTAMP WITH TIME ZONE,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+-- Create personal access tokens table
+CREATE TABLE IF NOT EXISTS personal_access_tokens (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    name VARCHAR(255) NOT NULL,
+    token_hash VARCHAR(64) NOT NULL UNIQUE,
+    scopes TEXT[] NOT NULL DEFAULT '{read}',
+    expires_at TIMESTAMP WITH TIME ZONE,
+    last_used_at TIMESTAMP WITH TIME ZONE,
+    revoked_at TIMESTAMP WITH TIME ZONE,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+-- Create rate limiter state table, used when RATE_LIMITER=postgres
+CREATE TABLE IF NOT EXISTS rate_limits (
+    key VARCHAR(320) PRIMARY KEY,
+    attempts INTEGER NOT NULL DEFAULT 0,
+    last_attempt TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    blocked_until TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    locked BOOLEAN NOT NULL DEFAULT false
+);
+
+-- Create settings table for runtime configuration such as the registration mode
+CREATE TABLE IF NOT EXISTS settings (
+    key VARCHAR(100) PRIMARY KEY,
+    value JSONB NOT NULL,
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+-- Create invitations table
+CREATE TABLE IF NOT EXISTS invitations (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    email VARCHAR(255) NOT NULL,
+    role VARCHAR(50) NOT NULL REFERENCES roles(name) ON UPDATE CASCADE,
+    token_hash VARCHAR(64) NOT NULL UNIQUE,
+    invited_by UUID REFERENCES users(id) ON DELETE SET NULL,
+    expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    accepted_at TIMESTAMP WITH TIME ZONE,
+    revoked_at TIMESTAMP WITH TIME ZONE,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+-- Create audit log table. Actors are not foreign keys so that entries
+-- outlive the users they mention.
+CREATE TABLE IF NOT EXISTS audit_log (
+    id BIGSERIAL PRIMARY KEY,
+    actor_id UUID,
+    action VARCHAR(100) NOT NULL,
+    target_type VARCHAR(50) NOT NULL DEFAULT '',
+    target_id VARCHAR(255) NOT NULL DEFAULT '',
+    ip VARCHAR(64) NOT NULL DEFAULT '',
+    user_agent TEXT NOT NULL DEFAULT '',
+    request_id VARCHAR(128) NOT NULL DEFAULT '',
+    details JSONB NOT NULL DEFAULT '{}',
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS audit_log_actor_idx ON audit_log (actor_id, id);
+CREATE INDEX IF NOT EXISTS audit_log_action_idx ON audit_log (action, id);
+CREATE INDEX IF NOT EXISTS audit_log_target_idx ON audit_log (target_type, target_id, id);
+
+-- The audit log is append-only. Erasing a user may only redact the details,
+-- with taskflow.audit_redaction set for the transaction.
+CREATE OR REPLACE FUNCTION audit_log_append_only() RETURNS trigger AS $$
+BEGIN
+    IF TG_OP = 'UPDATE' AND current_setting('taskflow.audit_redaction', true) = 'on'
+        AND (NEW.id, NEW.actor_id, NEW.action, NEW.target_type, NEW.target_id, NEW.ip, NEW.user_agent, NEW.request_id, NEW.created_at)
+            IS NOT DISTINCT FROM (OLD.id, OLD.actor_id, OLD.action, OLD.target_type, OLD.target_id, OLD.ip, OLD.user_agent, OLD.request_id, OLD.created_at)
+    THEN
+        RETURN NEW;
+    END IF;
+    RAISE EXCEPTION 'audit_log is append-only';
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS audit_log_append_only ON audit_log;
+CREATE TRIGGER audit_log_append_only
+    BEFORE UPDATE OR DELETE ON audit_log
+    FOR EACH ROW EXECUTE FUNCTION audit_log_append_only();
+
+-- Create chat accounts table, accounts in chat apps linked to users
+CREATE TABLE IF NOT EXISTS chat_accounts (
+    provider VARCHAR(50) NOT NULL,
+    external_id VARCHAR(255) NOT NULL,
+    display_name VARCHAR(255) NOT NULL DEFAULT '',
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    PRIMARY KEY (provider, external_id)
+);
+
+CREATE INDEX IF NOT EXISTS chat_accounts_user_idx ON chat_accounts (user_id);
+
+-- Create Telegram messages table, the outbox of notifications sent by the bot.
+-- Sent messages keep their message_id so replies can be matched to the task.
+CREATE TABLE IF NOT EXISTS telegram_messages (
+    id BIGSERIAL PRIMARY KEY,
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    chat_id BIGINT NOT NULL,
+    type VARCHAR(50) NOT NULL,
+    task_id UUID REFERENCES tasks(id) ON DELETE SET NULL,
+    actor_id UUID REFERENCES users(id) ON DELETE SET NULL,
+    params JSONB NOT NULL DEFAULT '{}',
+    status VARCHAR(20) NOT NULL DEFAULT 'pending',
+    attempts INTEGER NOT NULL DEFAULT 0,
+    last_error TEXT NOT NULL DEFAULT '',
+    message_id BIGINT,
+    next_attempt_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    sent_at TIMESTAMP WITH TIME ZONE,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS telegram_messages_due_idx ON telegram_messages (next_attempt_at) WHERE status IN ('pending', 'sending');
+CREATE INDEX IF NOT EXISTS telegram_messages_reply_idx ON telegram_messages (chat_id, message_id);
+
+-- Create task Git refs table, the commits and merge requests that referenced
+-- a task in Git webhooks. Each is commented on once.
+CREATE TABLE IF NOT EXISTS task_git_refs (
+    task_id UUID NOT NULL REFERENCES tasks(id) ON DELETE CASCADE,
+    kind VARCHAR(20) NOT NULL,
+    ref TEXT NOT NULL,
+    url TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (task_id, kind, ref)
+);
+
+-- Create task emails table, the inbound emails that created or commented on
+-- a task, kept as received
+CREATE TABLE IF NOT EXISTS task_emails (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    task_id UUID NOT NULL REFERENCES tasks(id) ON DELETE CASCADE,
+    comment_id UUID REFERENCES comments(id) ON DELETE SET NULL,
+    message_id TEXT NOT NULL UNIQUE,
+    from_address TEXT NOT NULL,
+    sender_id UUID REFERENCES users(id) ON DELETE SET NULL,
+    subject TEXT NOT NULL DEFAULT '',
+    raw BYTEA NOT NULL,
+    received_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS task_emails_task_idx ON task_emails (task_id, received_at);
+
+-- Create task email attachments table
+CREATE TABLE IF NOT EXISTS task_email_attachments (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    email_id UUID NOT NULL REFERENCES task_emails(id) ON DELETE CASCADE,
+    filename VARCHAR(255) NOT NULL,
+    content_type VARCHAR(255) NOT NULL,
+    size INTEGER NOT NULL,
+    content BYTEA NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS task_email_attachments_email_idx ON task_email_attachments (email_id);
+
+-- Create outgoing webhooks table
+CREATE TABLE IF NOT EXISTS webhooks (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    url TEXT NOT NULL,
+    secret TEXT NOT NULL,
+    events TEXT[] NOT NULL DEFAULT '{}',
+    active BOOLEAN NOT NULL DEFAULT true,
+    consecutive_failures INTEGER NOT NULL DEFAULT 0,
+    disabled_at TIMESTAMP WITH TIME ZONE,
+    -- Set on a user's personal notification webhook, NULL on board webhooks
+    user_id UUID REFERENCES users(id) ON DELETE CASCADE,
+    created_by UUID REFERENCES users(id) ON DELETE SET NULL,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
+
+-- Add the columns introduced after the table was first created
+ALTER TABLE webhooks ADD COLUMN IF NOT EXISTS user_id UUID;
+ALTER TABLE webhooks
+    DROP CONSTRAINT IF EXISTS webhooks_user_id_fkey,
+    ADD CONSTRAINT webhooks_user_id_fkey FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE;
+
+-- A user has at most one personal notification webhook
+CREATE UNIQUE INDEX IF NOT EXISTS webhooks_user_id_key ON webhooks (user_id) WHERE user_id IS NOT NULL;
+
+-- Create webhook deliveries table, the delivery log of every webhook
+CREATE TABLE IF NOT EXISTS webhook_deliveries (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    webhook_id UUID NOT NULL REFERENCES webhooks(id) ON DELETE CASCADE,
+    event VARCHAR(50) NOT NULL,
+    payload JSONB NOT NULL,
+    status VARCHAR(20) NOT NULL DEFAULT 'pending',
+    attempts INTEGER NOT NULL DEFAULT 0,
+    response_status INTEGER,
+    response_body TEXT NOT NULL DEFAULT '',
+    last_error TEXT NOT NULL DEFAULT '',
+    redelivery_of UUID REFERENCES webhook_deliveries(id) ON DELETE SET NULL,
+    next_attempt_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    delivered_at TIMESTAMP WITH TIME ZONE,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS webhook_deliveries_due_idx ON webhook_deliveries (next_attempt_at) WHERE status IN ('pending', 'sending');
+CREATE INDEX IF NOT EXISTS webhook_deliveries_webhook_idx ON webhook_deliveries (webhook_id, created_at DESC);
+
 -- Insert default columns
 INSERT INTO columns (id, title, position) VALUES
     ('backlog', 'Бэклог', 1),
     ('inprogress', 'В работе', 2),
     ('aprove', 'На подтверждении', 3),
-    ('done', 'Завершено', 4);
+    ('done', 'Завершено', 4)
+ON CONFLICT (id) DO NOTHING;
 
--- Create default admin user (username: admin, password: admin)
-INSERT INTO users (username, email, password, role) 
-VALUES ('admin', 'admin@example.com', 'admin', 'admin')
-ON CONFLICT (email) DO NOTHING;
\ No newline at end of file
+-- The first administrator is created by the backend on startup from
+-- BOOTSTRAP_ADMIN_EMAIL and BOOTSTRAP_ADMIN_PASSWORD
\ No newline at end of file
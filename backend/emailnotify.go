@@ -0,0 +1,403 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"database/sql"
+	"errors"
+	htmltemplate "html/template"
+	"log"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const (
+	// Give up on a notification email after this many failed attempts
+	maxEmailAttempts = 6
+	// Retry delays double from the base delay up to the maximum
+	emailRetryBase = time.Minute
+	emailRetryMax  = time.Hour
+	// How long a claimed email may take to send before another instance
+	// claims it again
+	emailSendLease = 10 * time.Minute
+)
+
+// digestTime is the local time of day at which daily digests are sent,
+// configured with DIGEST_TIME
+var digestTime = "08:00"
+
+// emailStrings holds the fixed texts of notification emails per locale
+var emailStrings = map[string]map[string]string{
+	"ru": {
+		"greeting":      "Здравствуйте, {name}!",
+		"digestSubject": "TaskFlow: сводка уведомлений",
+		"digestIntro":   "Новые уведомления за последние сутки:",
+		"openTask":      "Открыть задачу",
+		"unsubscribe":   "Отписаться от этих писем",
+		"unsubscribed":  "Вы отписались от писем TaskFlow. Настройки можно изменить в профиле.",
+		"confirm":       "Отписаться",
+	},
+	"en": {
+		"greeting":      "Hello, {name}!",
+		"digestSubject": "TaskFlow: notification digest",
+		"digestIntro":   "New notifications from the last day:",
+		"openTask":      "Open task",
+		"unsubscribe":   "Unsubscribe from these emails",
+		"unsubscribed":  "You have been unsubscribed from TaskFlow emails. You can change this in your profile.",
+		"confirm":       "Unsubscribe",
+	},
+}
+
+// emailItem is one notification in an email
+type emailItem struct {
+	Message string
+	Link    string
+}
+
+// emailData is what notification email templates are rendered with
+type emailData struct {
+	Greeting       string
+	Intro          string
+	Items          []emailItem
+	OpenTask       string
+	Unsubscribe    string
+	UnsubscribeURL string
+}
+
+var notificationTextTemplate = template.Must(template.New("text").Parse(`{{.Greeting}}
+{{if .Intro}}
+{{.Intro}}
+{{end}}{{range .Items}}
+{{.Message}}{{if .Link}}
+{{.Link}}{{end}}
+{{end}}
+--
+{{.Unsubscribe}}: {{.UnsubscribeURL}}
+`))
+
+var notificationHTMLTemplate = htmltemplate.Must(htmltemplate.New("html").Parse(`<!DOCTYPE html>
+<html>
+<body style="font-family: sans-serif; color: #1f2937;">
+<p>{{.Greeting}}</p>
+{{if .Intro}}<p>{{.Intro}}</p>{{end}}
+<ul style="padding-left: 20px;">
+{{range .Items}}<li style="margin-bottom: 8px;">{{.Message}}{{if .Link}}<br><a href="{{.Link}}">{{$.OpenTask}}</a>{{end}}</li>
+{{end}}</ul>
+<p style="font-size: 12px; color: #6b7280;"><a href="{{.UnsubscribeURL}}">{{.Unsubscribe}}</a></p>
+</body>
+</html>
+`))
+
+var unsubscribePageTemplate = htmltemplate.Must(htmltemplate.New("unsubscribe").Parse(`<!DOCTYPE html>
+<html>
+<body style="font-family: sans-serif; color: #1f2937;">
+{{if .Done}}<p>{{.Message}}</p>{{else}}<form method="POST"><button type="submit">{{.Confirm}}</button></form>{{end}}
+</body>
+</html>
+`))
+
+// localized returns a fixed email text in the locale
+func localized(locale, key string) string {
+	if s, ok := emailStrings[locale][key]; ok {
+		return s
+	}
+	return emailStrings[supportedLocales[0]][key]
+}
+
+// unsubscribeURL returns a link that turns off email for one event, or for
+// every event when event is empty. It is signed so it works without signing in.
+func unsubscribeURL(userID, event string) string {
+	q := url.Values{}
+	q.Set("user", userID)
+	if event != "" {
+		q.Set("event", event)
+	}
+	q.Set("sig", signToken("unsubscribe", userID+":"+event))
+	return apiURL + "/api/notifications/unsubscribe?" + q.Encode()
+}
+
+// queueNotificationEmail is the email channel. Instant mode emails go out as
+// soon as quiet hours allow, daily mode ones wait for the next digest.
+func queueNotificationEmail(n Notification, notBefore time.Time) {
+	var mode, timezone string
+	err := db.QueryRow("SELECT email_mode, timezone FROM users WHERE id = $1", n.UserID).Scan(&mode, &timezone)
+	if err != nil {
+		log.Printf("Error queueing notification email: %v", err)
+		return
+	}
+
+	sendAt := notBefore
+	digest := mode == emailModeDaily
+	if digest {
+		loc, err := time.LoadLocation(timezone)
+		if err != nil {
+			loc = time.UTC
+		}
+		sendAt = nextClockTime(notBefore.In(loc), digestTime)
+	}
+
+	_, err = db.Exec(`
+		INSERT INTO email_queue (user_id, type, task_id, actor_id, params, digest, next_attempt_at)
+		VALUES ($1, $2, NULLIF($3, '')::uuid, NULLIF($4, '')::uuid, $5, $6, $7)
+	`, n.UserID, n.Type, n.TaskID, n.ActorID, []byte(n.Params), digest, sendAt)
+	if err != nil {
+		log.Printf("Error queueing notification email: %v", err)
+	}
+}
+
+// queuedEmail is a notification waiting in the email queue
+type queuedEmail struct {
+	id       int64
+	n        Notification
+	digest   bool
+	attempts int
+}
+
+// runEmailQueue sends due notification emails in the background
+func runEmailQueue() {
+	if v := os.Getenv("DIGEST_TIME"); v != "" {
+		if clockPattern.MatchString(v) {
+			digestTime = v
+		} else {
+			log.Printf("Invalid DIGEST_TIME %q, using %s", v, digestTime)
+		}
+	}
+
+	ticker := time.NewTicker(30 * time.Second)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := processEmailQueue(); err != nil {
+			log.Printf("Error processing email queue: %v", err)
+		}
+	}
+}
+
+// processEmailQueue sends every due email once, claimed as described in
+// queue.go. A user's due digest items are combined into a single email.
+func processEmailQueue() error {
+	var claimed []queuedEmail
+	err := claimDue(`
+		WITH due AS (
+			SELECT id FROM email_queue
+			WHERE status IN ('pending', 'sending') AND next_attempt_at <= NOW()
+			ORDER BY next_attempt_at
+			LIMIT 200
+			FOR UPDATE SKIP LOCKED
+		)
+		UPDATE email_queue q SET status = 'sending', next_attempt_at = $1
+		FROM due
+		WHERE q.id = due.id
+		RETURNING q.id, q.user_id, q.type, COALESCE(q.task_id::text, ''), COALESCE(q.actor_id::text, ''),
+			COALESCE((SELECT username FROM users a WHERE a.id = q.actor_id), ''), q.params, q.digest, q.attempts, q.created_at
+	`, emailSendLease, func(rows *sql.Rows) error {
+		var e queuedEmail
+		var params []byte
+		if err := rows.Scan(&e.id, &e.n.UserID, &e.n.Type, &e.n.TaskID, &e.n.ActorID, &e.n.Actor, &params, &e.digest, &e.attempts, &e.n.CreatedAt); err != nil {
+			return err
+		}
+		e.n.Params = params
+		claimed = append(claimed, e)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// Digest items are listed oldest first
+	sort.Slice(claimed, func(i, j int) bool {
+		return claimed[i].n.CreatedAt.Before(claimed[j].n.CreatedAt)
+	})
+	var batches [][]queuedEmail
+	digestBatch := make(map[string]int)
+	for _, e := range claimed {
+		if !e.digest {
+			batches = append(batches, []queuedEmail{e})
+			continue
+		}
+		if i, ok := digestBatch[e.n.UserID]; ok {
+			batches[i] = append(batches[i], e)
+		} else {
+			digestBatch[e.n.UserID] = len(batches)
+			batches = append(batches, []queuedEmail{e})
+		}
+	}
+
+	renderers := make(map[string]*notificationRenderer)
+	for _, batch := range batches {
+		if err := sendEmailBatch(batch, renderers); err != nil {
+			log.Printf("Error sending notification email: %v", err)
+		}
+	}
+	return nil
+}
+
+// sendEmailBatch sends one email for a claimed batch and records the outcome
+func sendEmailBatch(batch []queuedEmail, renderers map[string]*notificationRenderer) error {
+	ids := make([]int64, len(batch))
+	for i, e := range batch {
+		ids[i] = e.id
+	}
+	userID := batch[0].n.UserID
+
+	var email, username, locale string
+	var deactivated bool
+	err := db.QueryRow(
+		"SELECT email, username, locale, deactivated_at IS NOT NULL FROM users WHERE id = $1",
+		userID,
+	).Scan(&email, &username, &locale, &deactivated)
+	if err != nil {
+		return err
+	}
+	if deactivated {
+		_, err := db.Exec("UPDATE email_queue SET status = 'cancelled' WHERE id = ANY($1)", pq.Array(ids))
+		return err
+	}
+	if !validLocale(locale) {
+		locale = supportedLocales[0]
+	}
+
+	renderer, ok := renderers[locale]
+	if !ok {
+		if renderer, err = newNotificationRenderer(locale); err != nil {
+			return err
+		}
+		renderers[locale] = renderer
+	}
+
+	mail := buildNotificationMail(email, username, locale, batch, renderer)
+	sendErr := mailer.Send(mail)
+	if sendErr == nil {
+		_, err := db.Exec("UPDATE email_queue SET status = 'sent', sent_at = NOW() WHERE id = ANY($1)", pq.Array(ids))
+		return err
+	}
+
+	attempts := batch[0].attempts + 1
+	var tpErr *textproto.Error
+	if (errors.As(sendErr, &tpErr) && tpErr.Code >= 500) || attempts >= maxEmailAttempts {
+		// Permanent SMTP errors won't get better by retrying
+		log.Printf("Giving up on notification email to %s: %v", email, sendErr)
+		_, err := db.Exec(
+			"UPDATE email_queue SET status = 'failed', attempts = attempts + 1, last_error = $2 WHERE id = ANY($1)",
+			pq.Array(ids), sendErr.Error(),
+		)
+		return err
+	}
+
+	delay := retryDelay(emailRetryBase, emailRetryMax, attempts)
+	log.Printf("Notification email to %s failed, retrying in %s: %v", email, delay, sendErr)
+	_, err = db.Exec(
+		"UPDATE email_queue SET status = 'pending', attempts = attempts + 1, last_error = $2, next_attempt_at = $3 WHERE id = ANY($1)",
+		pq.Array(ids), sendErr.Error(), time.Now().Add(delay),
+	)
+	return err
+}
+
+// buildNotificationMail renders a single notification email or a digest
+func buildNotificationMail(to, username, locale string, batch []queuedEmail, renderer *notificationRenderer) Mail {
+	data := emailData{
+		Greeting:    strings.Replace(localized(locale, "greeting"), "{name}", username, 1),
+		OpenTask:    localized(locale, "openTask"),
+		Unsubscribe: localized(locale, "unsubscribe"),
+	}
+	for _, e := range batch {
+		n := e.n
+		renderer.render(&n)
+		item := emailItem{Message: n.Message}
+		if n.TaskID != "" {
+			item.Link = appURL + "/tasks/" + n.TaskID
+		}
+		data.Items = append(data.Items, item)
+	}
+
+	// Digests unsubscribe from all email, single emails from their event only
+	subject := data.Items[0].Message
+	event := ""
+	if batch[0].digest {
+		subject = localized(locale, "digestSubject")
+		data.Intro = localized(locale, "digestIntro")
+	} else {
+		event, _ = preferenceEvent(batch[0].n.Type)
+	}
+	data.UnsubscribeURL = unsubscribeURL(batch[0].n.UserID, event)
+
+	var text, html bytes.Buffer
+	if err := notificationTextTemplate.Execute(&text, data); err != nil {
+		log.Printf("Error rendering notification email: %v", err)
+	}
+	if err := notificationHTMLTemplate.Execute(&html, data); err != nil {
+		log.Printf("Error rendering notification email: %v", err)
+	}
+
+	return Mail{
+		To:      to,
+		Subject: subject,
+		Text:    text.String(),
+		HTML:    html.String(),
+		Headers: map[string]string{
+			"List-Unsubscribe":      "<" + data.UnsubscribeURL + ">",
+			"List-Unsubscribe-Post": "List-Unsubscribe=One-Click",
+		},
+	}
+}
+
+// unsubscribeHandler turns off notification emails from a signed link. GET
+// shows a confirmation button so link scanners can't unsubscribe anyone,
+// POST (also used by one-click unsubscribe in mail clients) applies it.
+func unsubscribeHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	userID := q.Get("user")
+	event := q.Get("event")
+	if !uuidPattern.MatchString(userID) || !hmac.Equal([]byte(q.Get("sig")), []byte(signToken("unsubscribe", userID+":"+event))) {
+		http.Error(w, "Invalid unsubscribe link", http.StatusBadRequest)
+		return
+	}
+
+	events := notificationEvents
+	if event != "" {
+		if _, ok := defaultPreferences[event]; !ok {
+			http.Error(w, "Invalid unsubscribe link", http.StatusBadRequest)
+			return
+		}
+		events = []string{event}
+	}
+
+	locale := userLocale(userID)
+	page := struct {
+		Done    bool
+		Message string
+		Confirm string
+	}{Confirm: localized(locale, "confirm")}
+
+	if r.Method == http.MethodPost {
+		for _, e := range events {
+			_, err := db.Exec(`
+				INSERT INTO notification_preferences (user_id, event, channel, enabled) VALUES ($1, $2, $3, false)
+				ON CONFLICT (user_id, event, channel) DO UPDATE SET enabled = false
+			`, userID, e, channelEmail)
+			if err != nil {
+				if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23503" {
+					http.Error(w, "Invalid unsubscribe link", http.StatusBadRequest)
+					return
+				}
+				http.Error(w, "Error updating preferences", http.StatusInternalServerError)
+				return
+			}
+		}
+		recordAudit(r, userID, "notifications.unsubscribed", "user", userID, map[string]interface{}{
+			"events": events,
+		})
+		page.Done = true
+		page.Message = localized(locale, "unsubscribed")
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	unsubscribePageTemplate.Execute(w, page)
+}
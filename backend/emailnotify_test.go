@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// recordingMailer keeps sent mail and fails for the given recipients
+type recordingMailer struct {
+	sent  []Mail
+	fails map[string]error
+}
+
+func (m *recordingMailer) Send(mail Mail) error {
+	if err := m.fails[mail.To]; err != nil {
+		return err
+	}
+	m.sent = append(m.sent, mail)
+	return nil
+}
+
+func withMailer(t *testing.T, m Mailer) {
+	saved := mailer
+	mailer = m
+	t.Cleanup(func() { mailer = saved })
+}
+
+var emailQueueColumns = []string{"id", "user_id", "type", "task_id", "actor_id", "actor", "params", "digest", "attempts", "created_at"}
+
+func expectMailUser(mock sqlmock.Sqlmock, userID, email, locale string) {
+	mock.ExpectQuery(`SELECT email, username, locale`).WithArgs(userID).WillReturnRows(
+		sqlmock.NewRows([]string{"email", "username", "locale", "deactivated"}).AddRow(email, "user", locale, false))
+	mock.ExpectQuery(`SELECT id, title FROM columns`).WillReturnRows(
+		sqlmock.NewRows([]string{"id", "title"}).AddRow("done", "Done"))
+}
+
+func TestProcessEmailQueue(t *testing.T) {
+	t0 := time.Now().Add(-time.Hour)
+	params := []byte(`{"title":"Report"}`)
+
+	tests := []struct {
+		name   string
+		fails  map[string]error
+		expect func(mock sqlmock.Sqlmock)
+		sent   []string
+	}{
+		{
+			name: "digest items combined, other users separate",
+			expect: func(mock sqlmock.Sqlmock) {
+				expectMailUser(mock, testUserA, "a@example.com", "en")
+				mock.ExpectExec(`UPDATE email_queue SET status = 'sent'`).WithArgs("{1,3}").WillReturnResult(sqlmock.NewResult(0, 2))
+				expectMailUser(mock, testUserB, "b@example.com", "ru")
+				mock.ExpectExec(`UPDATE email_queue SET status = 'sent'`).WithArgs("{2}").WillReturnResult(sqlmock.NewResult(0, 1))
+			},
+			sent: []string{"a@example.com", "b@example.com"},
+		},
+		{
+			// The rows stay claimed and nothing already sent is undone
+			name: "database error recording a send",
+			expect: func(mock sqlmock.Sqlmock) {
+				expectMailUser(mock, testUserA, "a@example.com", "en")
+				mock.ExpectExec(`UPDATE email_queue SET status = 'sent'`).WillReturnError(errors.New("connection reset"))
+				expectMailUser(mock, testUserB, "b@example.com", "ru")
+				mock.ExpectExec(`UPDATE email_queue SET status = 'sent'`).WithArgs("{2}").WillReturnResult(sqlmock.NewResult(0, 1))
+			},
+			sent: []string{"a@example.com", "b@example.com"},
+		},
+		{
+			name:  "permanent SMTP error",
+			fails: map[string]error{"a@example.com": &textproto.Error{Code: 550, Msg: "no such user"}},
+			expect: func(mock sqlmock.Sqlmock) {
+				expectMailUser(mock, testUserA, "a@example.com", "en")
+				mock.ExpectExec(`UPDATE email_queue SET status = 'failed'`).WithArgs("{1,3}", sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 2))
+				expectMailUser(mock, testUserB, "b@example.com", "ru")
+				mock.ExpectExec(`UPDATE email_queue SET status = 'sent'`).WithArgs("{2}").WillReturnResult(sqlmock.NewResult(0, 1))
+			},
+			sent: []string{"b@example.com"},
+		},
+		{
+			name:  "temporary error is retried later",
+			fails: map[string]error{"a@example.com": errors.New("connection refused")},
+			expect: func(mock sqlmock.Sqlmock) {
+				expectMailUser(mock, testUserA, "a@example.com", "en")
+				mock.ExpectExec(`UPDATE email_queue SET status = 'pending', attempts = attempts \+ 1`).WithArgs("{1,3}", sqlmock.AnyArg(), sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 2))
+				expectMailUser(mock, testUserB, "b@example.com", "ru")
+				mock.ExpectExec(`UPDATE email_queue SET status = 'sent'`).WithArgs("{2}").WillReturnResult(sqlmock.NewResult(0, 1))
+			},
+			sent: []string{"b@example.com"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock := mockDB(t)
+			m := &recordingMailer{fails: tt.fails}
+			withMailer(t, m)
+
+			// The claim is a statement of its own, committed before sending
+			mock.ExpectQuery(`UPDATE email_queue q SET status = 'sending'`).WillReturnRows(
+				sqlmock.NewRows(emailQueueColumns).
+					AddRow(3, testUserA, notifTaskAssigned, testTask, "", "", params, true, 0, t0.Add(2*time.Minute)).
+					AddRow(2, testUserB, notifTaskAssigned, testTask, "", "", params, false, 0, t0.Add(time.Minute)).
+					AddRow(1, testUserA, notifTaskAssigned, testTask, "", "", params, true, 0, t0))
+			tt.expect(mock)
+
+			if err := processEmailQueue(); err != nil {
+				t.Fatal(err)
+			}
+			var sent []string
+			for _, mail := range m.sent {
+				sent = append(sent, mail.To)
+			}
+			if strings.Join(sent, ",") != strings.Join(tt.sent, ",") {
+				t.Errorf("sent to %v, want %v", sent, tt.sent)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+// smtpCatcher is a minimal SMTP server that keeps the messages it receives
+func smtpCatcher(t *testing.T) (string, <-chan string) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	messages := make(chan string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		reply := func(s string) { conn.Write([]byte(s + "\r\n")) }
+		reply("220 catcher")
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			switch cmd := strings.ToUpper(strings.Fields(line + " ")[0]); cmd {
+			case "EHLO", "HELO":
+				reply("250 catcher")
+			case "DATA":
+				reply("354 go ahead")
+				var data strings.Builder
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil || line == ".\r\n" {
+						break
+					}
+					data.WriteString(line)
+				}
+				messages <- data.String()
+				reply("250 queued")
+			case "QUIT":
+				reply("221 bye")
+				return
+			default:
+				reply("250 ok")
+			}
+		}
+	}()
+	return ln.Addr().String(), messages
+}
+
+func TestSMTPMailerSend(t *testing.T) {
+	addr, messages := smtpCatcher(t)
+	m := &SMTPMailer{Addr: addr, From: "TaskFlow <no-reply@taskflow.local>"}
+
+	err := m.Send(Mail{
+		To:      "a@example.com",
+		Subject: "Задача назначена",
+		Text:    "Hello",
+		HTML:    "<p>Hello</p>",
+		Headers: map[string]string{"List-Unsubscribe": "<https://example.com/u>"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case msg := <-messages:
+		for _, want := range []string{"To: a@example.com", "Subject: =?utf-8?q?", "List-Unsubscribe: <https://example.com/u>", "multipart/alternative"} {
+			if !strings.Contains(msg, want) {
+				t.Errorf("message lacks %q:\n%s", want, msg)
+			}
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no message received")
+	}
+}
+
+func TestUnsubscribeHandlerSignature(t *testing.T) {
+	event, err := preferenceEvent(notifTaskAssigned)
+	if err != nil {
+		t.Fatal(err)
+	}
+	valid := signToken("unsubscribe", testUserA+":"+event)
+	tampered := []byte(valid)
+	tampered[0] ^= 1
+
+	tests := []struct {
+		name   string
+		user   string
+		event  string
+		sig    string
+		status int
+	}{
+		{"valid", testUserA, event, valid, http.StatusOK},
+		{"wrong signature", testUserA, event, string(tampered), http.StatusBadRequest},
+		{"signature of another event", testUserA, "", valid, http.StatusBadRequest},
+		{"signature of another user", testUserB, event, valid, http.StatusBadRequest},
+		{"missing signature", testUserA, event, "", http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock := mockDB(t)
+			if tt.status == http.StatusOK {
+				mock.ExpectQuery(`SELECT locale FROM users`).WillReturnRows(sqlmock.NewRows([]string{"locale"}).AddRow("en"))
+			}
+
+			q := url.Values{"user": {tt.user}, "sig": {tt.sig}}
+			if tt.event != "" {
+				q.Set("event", tt.event)
+			}
+			w := httptest.NewRecorder()
+			unsubscribeHandler(w, httptest.NewRequest("GET", "/api/notifications/unsubscribe?"+q.Encode(), nil))
+
+			if w.Code != tt.status {
+				t.Errorf("status = %d, want %d", w.Code, tt.status)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
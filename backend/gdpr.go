@@ -0,0 +1,443 @@
+package main
+
+import (
+	"archive/zip"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// DataExport is everything we hold about a user, as returned by the export endpoint
+type DataExport struct {
+	ExportedAt    time.Time         `json:"exportedAt"`
+	Profile       User              `json:"profile"`
+	AuthoredTasks []Task            `json:"authoredTasks"`
+	AssignedTasks []Task            `json:"assignedTasks"`
+	Comments      []ExportedComment `json:"comments"`
+	Notifications []Notification    `json:"notifications"`
+	// Settings and linked accounts
+	Preferences         *NotificationPreferences `json:"notificationPreferences"`
+	NotificationWebhook *Webhook                 `json:"notificationWebhook"`
+	ChatAccounts        []ChatAccount            `json:"chatAccounts"`
+	// Messages the Telegram bot sent the user
+	TelegramMessages []ExportedTelegramMessage `json:"telegramMessages"`
+	// Inbound emails sent from the user's address
+	Emails   []ExportedEmail `json:"emails"`
+	AuditLog []AuditEntry    `json:"auditLog"`
+}
+
+// ExportedComment is a comment along with the task it was left on
+type ExportedComment struct {
+	Comment
+	TaskID string `json:"taskId"`
+}
+
+// ExportedTelegramMessage is a notification message sent through the bot
+type ExportedTelegramMessage struct {
+	ChatID    int64      `json:"chatId"`
+	Type      string     `json:"type"`
+	TaskID    string     `json:"taskId,omitempty"`
+	Status    string     `json:"status"`
+	SentAt    *time.Time `json:"sentAt,omitempty"`
+	CreatedAt time.Time  `json:"createdAt"`
+}
+
+// ExportedEmail is an inbound email along with the task it went to
+type ExportedEmail struct {
+	TaskEmail
+	TaskID string `json:"taskId"`
+}
+
+// fromAddressMatch is the condition on task_emails matching messages from
+// the email address in $1, bare or with a display name
+const fromAddressMatch = `(lower(from_address) = lower($1) OR right(lower(from_address), length($1) + 2) = '<' || lower($1) || '>')`
+
+// collectUserData gathers the personal data export for a user
+func collectUserData(userID string) (*DataExport, error) {
+	export := &DataExport{ExportedAt: time.Now()}
+
+	var pendingEmail sql.NullString
+	var avatarVersion sql.NullInt64
+	err := db.QueryRow(
+		"SELECT id, username, email, role, email_verified, pending_email, avatar_version, locale, created_at FROM users WHERE id = $1",
+		userID,
+	).Scan(&export.Profile.ID, &export.Profile.Username, &export.Profile.Email, &export.Profile.Role,
+		&export.Profile.EmailVerified, &pendingEmail, &avatarVersion, &export.Profile.Locale, &export.Profile.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	export.Profile.PendingEmail = pendingEmail.String
+	export.Profile.AvatarURL = avatarURL(userID, avatarVersion)
+
+	queryTasks := func(condition string) ([]Task, error) {
+		rows, err := db.Query(`
+			SELECT id, title, COALESCE(description, ''), state, priority, created_at, updated_at
+			FROM tasks WHERE `+condition+`
+			ORDER BY created_at
+		`, userID)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+
+		tasks := []Task{}
+		for rows.Next() {
+			var task Task
+			if err := rows.Scan(&task.ID, &task.Title, &task.Description, &task.State, &task.Priority, &task.CreatedAt, &task.UpdatedAt); err != nil {
+				return nil, err
+			}
+			tasks = append(tasks, task)
+		}
+		return tasks, rows.Err()
+	}
+
+	if export.AuthoredTasks, err = queryTasks("created_by = $1"); err != nil {
+		return nil, err
+	}
+	if export.AssignedTasks, err = queryTasks("id IN (SELECT task_id FROM task_assignees WHERE user_id = $1)"); err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query(`
+		SELECT id, task_id, content, created_at
+		FROM comments WHERE author = $1
+		ORDER BY created_at
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	export.Comments = []ExportedComment{}
+	for rows.Next() {
+		var c ExportedComment
+		if err := rows.Scan(&c.ID, &c.TaskID, &c.Content, &c.CreatedAt); err != nil {
+			return nil, err
+		}
+		c.Author = export.Profile.Username
+		export.Comments = append(export.Comments, c)
+	}
+
+	renderer, err := newNotificationRenderer(userLocale(userID))
+	if err != nil {
+		return nil, err
+	}
+	notificationRows, err := db.Query(notificationSelect+`
+		WHERE n.user_id = $1
+		ORDER BY n.created_at
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer notificationRows.Close()
+
+	export.Notifications = []Notification{}
+	for notificationRows.Next() {
+		n, err := scanNotification(notificationRows)
+		if err != nil {
+			return nil, err
+		}
+		renderer.render(&n)
+		export.Notifications = append(export.Notifications, n)
+	}
+
+	if export.Preferences, err = loadNotificationPreferences(userID); err != nil {
+		return nil, err
+	}
+	hook, err := scanWebhook(db.QueryRow(webhookSelect+" WHERE user_id = $1", userID))
+	if err == nil {
+		export.NotificationWebhook = &hook
+	} else if err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	accountRows, err := db.Query(`
+		SELECT provider, external_id, display_name, created_at
+		FROM chat_accounts WHERE user_id = $1
+		ORDER BY created_at
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer accountRows.Close()
+
+	export.ChatAccounts = []ChatAccount{}
+	for accountRows.Next() {
+		var a ChatAccount
+		if err := accountRows.Scan(&a.Provider, &a.ExternalID, &a.DisplayName, &a.CreatedAt); err != nil {
+			return nil, err
+		}
+		export.ChatAccounts = append(export.ChatAccounts, a)
+	}
+
+	messageRows, err := db.Query(`
+		SELECT chat_id, type, COALESCE(task_id::text, ''), status, sent_at, created_at
+		FROM telegram_messages WHERE user_id = $1
+		ORDER BY created_at
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer messageRows.Close()
+
+	export.TelegramMessages = []ExportedTelegramMessage{}
+	for messageRows.Next() {
+		var m ExportedTelegramMessage
+		if err := messageRows.Scan(&m.ChatID, &m.Type, &m.TaskID, &m.Status, &m.SentAt, &m.CreatedAt); err != nil {
+			return nil, err
+		}
+		export.TelegramMessages = append(export.TelegramMessages, m)
+	}
+
+	emailRows, err := db.Query(`
+		SELECT id, task_id, COALESCE(comment_id::text, ''), message_id, from_address, subject, received_at
+		FROM task_emails WHERE `+fromAddressMatch+`
+		ORDER BY received_at
+	`, export.Profile.Email)
+	if err != nil {
+		return nil, err
+	}
+	defer emailRows.Close()
+
+	export.Emails = []ExportedEmail{}
+	for emailRows.Next() {
+		var e ExportedEmail
+		if err := emailRows.Scan(&e.ID, &e.TaskID, &e.CommentID, &e.MessageID, &e.From, &e.Subject, &e.ReceivedAt); err != nil {
+			return nil, err
+		}
+		e.Attachments = []EmailAttachment{}
+		export.Emails = append(export.Emails, e)
+	}
+
+	auditRows, err := db.Query(`
+		SELECT id, COALESCE(actor_id::text, ''), action, target_type, target_id, ip, user_agent, request_id, details, created_at
+		FROM audit_log WHERE actor_id = $1 OR (target_type = 'user' AND target_id = $1::text)
+		ORDER BY id
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer auditRows.Close()
+
+	export.AuditLog = []AuditEntry{}
+	for auditRows.Next() {
+		entry, err := scanAuditEntry(auditRows)
+		if err != nil {
+			return nil, err
+		}
+		export.AuditLog = append(export.AuditLog, entry)
+	}
+
+	return export, nil
+}
+
+func exportMyDataHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userId").(string)
+
+	export, err := collectUserData(userID)
+	if err != nil {
+		http.Error(w, "Error collecting data", http.StatusInternalServerError)
+		return
+	}
+	recordAudit(r, "", "user.data_exported", "user", userID, nil)
+
+	if r.URL.Query().Get("format") == "json" {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Disposition", `attachment; filename="taskflow-export.json"`)
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(export)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", `attachment; filename="taskflow-export.zip"`)
+
+	zw := zip.NewWriter(w)
+	files := []struct {
+		name string
+		data interface{}
+	}{
+		{"profile.json", export.Profile},
+		{"tasks-authored.json", export.AuthoredTasks},
+		{"tasks-assigned.json", export.AssignedTasks},
+		{"comments.json", export.Comments},
+		{"notifications.json", export.Notifications},
+		{"notification-preferences.json", export.Preferences},
+		{"chat-accounts.json", export.ChatAccounts},
+		{"telegram-messages.json", export.TelegramMessages},
+		{"emails.json", export.Emails},
+		{"audit-log.json", export.AuditLog},
+	}
+	for _, f := range files {
+		fw, err := zw.Create(f.name)
+		if err != nil {
+			return
+		}
+		enc := json.NewEncoder(fw)
+		enc.SetIndent("", "  ")
+		enc.Encode(f.data)
+	}
+
+	var avatar []byte
+	if err := db.QueryRow("SELECT data FROM avatars WHERE user_id = $1 AND size = $2", userID, avatarSizes[0]).Scan(&avatar); err == nil {
+		if fw, err := zw.Create("avatar.png"); err == nil {
+			fw.Write(avatar)
+		}
+	}
+
+	// The emails as received, next to their listing in emails.json
+	for _, e := range export.Emails {
+		var raw []byte
+		if err := db.QueryRow("SELECT raw FROM task_emails WHERE id = $1", e.ID).Scan(&raw); err != nil {
+			continue
+		}
+		if fw, err := zw.Create("emails/" + e.ID + ".eml"); err == nil {
+			fw.Write(raw)
+		}
+	}
+
+	zw.Close()
+}
+
+// eraseUserHandler anonymises a user's personal data. The account row stays so
+// that tasks and comments keep a valid author, but nothing in it identifies the
+// person any more. The account is deactivated as part of the erasure.
+func eraseUserHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	userID := vars["id"]
+
+	if userID == r.Context().Value("userId").(string) {
+		http.Error(w, "You can't erase your own account", http.StatusBadRequest)
+		return
+	}
+
+	password, err := randomToken(32)
+	if err != nil {
+		http.Error(w, "Error erasing user", http.StatusInternalServerError)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var oldEmail, role string
+	err = tx.QueryRow(`
+		SELECT email, role FROM users WHERE id = $1 AND erased_at IS NULL FOR UPDATE
+	`, userID).Scan(&oldEmail, &role)
+	if err == sql.ErrNoRows {
+		http.Error(w, "User not found or already erased", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	ok, err := canGrantRole(r, role)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		http.Error(w, "You can't manage a user with permissions you don't have", http.StatusForbidden)
+		return
+	}
+
+	statements := []string{
+		`UPDATE users SET
+			username = 'deleted-user-' || id::text,
+			email = 'deleted-' || id::text || '@invalid',
+			password = $2,
+			pending_email = NULL,
+			email_verified = false,
+			avatar_version = NULL,
+			session_version = session_version + 1,
+			deactivated_at = COALESCE(deactivated_at, NOW()),
+			erased_at = NOW()
+		WHERE id = $1`,
+		`DELETE FROM avatars WHERE user_id = $1`,
+		`DELETE FROM user_tokens WHERE user_id = $1`,
+		`DELETE FROM personal_access_tokens WHERE user_id = $1`,
+		`DELETE FROM notifications WHERE user_id = $1`,
+		`DELETE FROM email_queue WHERE user_id = $1`,
+		`DELETE FROM chat_accounts WHERE user_id = $1`,
+		`DELETE FROM telegram_messages WHERE user_id = $1`,
+		`DELETE FROM webhooks WHERE user_id = $1`,
+		`DELETE FROM notification_preferences WHERE user_id = $1`,
+		`DELETE FROM task_mutes WHERE user_id = $1`,
+		`UPDATE task_emails SET sender_id = NULL WHERE sender_id = $1`,
+	}
+	if _, err := tx.Exec("DELETE FROM invitations WHERE lower(email) = lower($1)", oldEmail); err != nil {
+		http.Error(w, "Error erasing user", http.StatusInternalServerError)
+		return
+	}
+	for i, stmt := range statements {
+		args := []interface{}{userID}
+		if i == 0 {
+			args = append(args, password)
+		}
+		if _, err := tx.Exec(stmt, args...); err != nil {
+			http.Error(w, "Error erasing user", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	// Emails they sent keep their place in the task's thread, but not the
+	// message, its attachments or the address
+	_, err = tx.Exec(`
+		WITH erased AS (
+			UPDATE task_emails SET from_address = '', subject = '', raw = ''
+			WHERE `+fromAddressMatch+`
+			RETURNING id
+		)
+		DELETE FROM task_email_attachments WHERE email_id IN (SELECT id FROM erased)
+	`, oldEmail)
+	if err != nil {
+		http.Error(w, "Error erasing user", http.StatusInternalServerError)
+		return
+	}
+
+	// The audit log is append-only, except that erasure may redact the
+	// personal data held in its details
+	if _, err := tx.Exec("SET LOCAL taskflow.audit_redaction = 'on'"); err != nil {
+		http.Error(w, "Error erasing user", http.StatusInternalServerError)
+		return
+	}
+	_, err = tx.Exec(`
+		UPDATE audit_log SET details = details - 'email' - CASE
+				WHEN action IN ('user.username_changed', 'user.email_change_requested') THEN ARRAY['from', 'to']
+				ELSE ARRAY[]::text[]
+			END
+		WHERE (target_type = 'user' AND target_id = $1) OR lower(details->>'email') = lower($2)
+	`, userID, oldEmail)
+	if err != nil {
+		http.Error(w, "Error erasing user", http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Error erasing user", http.StatusInternalServerError)
+		return
+	}
+
+	// The erasure has happened, a stale backoff mustn't hide that
+	if err := limiter.Reset(accountLimitKey(oldEmail)); err != nil {
+		log.Printf("Error resetting rate limit of erased user %s: %v", userID, err)
+	}
+
+	// The audit record deliberately doesn't repeat the erased personal data
+	recordAudit(r, "", "user.erased", "user", userID, nil)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "User personal data erased",
+	})
+}
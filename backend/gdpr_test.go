@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gorilla/mux"
+)
+
+// resetFailingLimiter is a limiter whose Reset always fails
+type resetFailingLimiter struct{ *MemoryLimiter }
+
+func (resetFailingLimiter) Reset(string) error { return errors.New("connection reset") }
+
+func TestEraseUserHandler(t *testing.T) {
+	// A failing limiter reset must neither fail the erasure nor skip its audit record
+	for name, l := range map[string]RateLimiter{
+		"limiter reset":        NewMemoryLimiter(),
+		"limiter reset failed": resetFailingLimiter{NewMemoryLimiter()},
+	} {
+		t.Run(name, func(t *testing.T) {
+			mock := mockDB(t)
+			setRoles(t, map[string][]string{"admin": {permUserManage}, "member": {}})
+			saved := limiter
+			limiter = l
+			t.Cleanup(func() { limiter = saved })
+
+			const email = "Bob@Example.com"
+			mock.ExpectBegin()
+			mock.ExpectQuery(`SELECT email, role FROM users WHERE id = \$1 AND erased_at IS NULL FOR UPDATE`).WithArgs(testUserB).
+				WillReturnRows(sqlmock.NewRows([]string{"email", "role"}).AddRow(email, "member"))
+			mock.ExpectExec(`DELETE FROM invitations`).WithArgs(email).WillReturnResult(sqlmock.NewResult(0, 0))
+			mock.ExpectExec(`UPDATE users SET`).WithArgs(testUserB, sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 1))
+			for _, table := range []string{"avatars", "user_tokens", "personal_access_tokens", "notifications", "email_queue",
+				"chat_accounts", "telegram_messages", "webhooks", "notification_preferences", "task_mutes"} {
+				mock.ExpectExec(`DELETE FROM ` + table + ` WHERE user_id = \$1`).WithArgs(testUserB).WillReturnResult(sqlmock.NewResult(0, 0))
+			}
+			mock.ExpectExec(`UPDATE task_emails SET sender_id = NULL`).WithArgs(testUserB).WillReturnResult(sqlmock.NewResult(0, 0))
+			mock.ExpectExec(`UPDATE task_emails SET from_address = '', subject = '', raw = ''(.|\n)*DELETE FROM task_email_attachments`).
+				WithArgs(email).WillReturnResult(sqlmock.NewResult(0, 0))
+			mock.ExpectExec(`SET LOCAL taskflow.audit_redaction = 'on'`).WillReturnResult(sqlmock.NewResult(0, 0))
+			mock.ExpectExec(`UPDATE audit_log SET details = details - 'email'`).WithArgs(testUserB, email).WillReturnResult(sqlmock.NewResult(0, 2))
+			mock.ExpectCommit()
+			mock.ExpectExec(`INSERT INTO audit_log`).WithArgs(testUserA, "user.erased", "user", testUserB,
+				sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(1, 1))
+
+			r := httptest.NewRequest("POST", "/api/users/"+testUserB+"/erase", nil)
+			r = mux.SetURLVars(asUser(r, testUserA, "admin"), map[string]string{"id": testUserB})
+			w := httptest.NewRecorder()
+			eraseUserHandler(w, r)
+
+			if w.Code != http.StatusOK {
+				t.Errorf("status = %d: %s", w.Code, w.Body)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestEraseUserHandlerAboveCaller(t *testing.T) {
+	mock := mockDB(t)
+	setRoles(t, map[string][]string{"user-manager": {permUserManage}, "admin": {permUserManage, permRoleManage}})
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(`SELECT email, role FROM users`).WithArgs(testUserB).
+		WillReturnRows(sqlmock.NewRows([]string{"email", "role"}).AddRow("boss@example.com", "admin"))
+	mock.ExpectRollback()
+
+	r := httptest.NewRequest("POST", "/api/users/"+testUserB+"/erase", nil)
+	r = mux.SetURLVars(asUser(r, testUserA, "user-manager"), map[string]string{"id": testUserB})
+	w := httptest.NewRecorder()
+	eraseUserHandler(w, r)
+
+	if w.Code != http.StatusForbidden {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusForbidden)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestEraseUserHandlerSelf(t *testing.T) {
+	mock := mockDB(t)
+	r := httptest.NewRequest("POST", "/api/users/"+testUserA+"/erase", nil)
+	r = mux.SetURLVars(asUser(r, testUserA, "admin"), map[string]string{"id": testUserA})
+	w := httptest.NewRecorder()
+	eraseUserHandler(w, r)
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
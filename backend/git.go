@@ -0,0 +1,569 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Git hosts we accept webhooks from
+const (
+	gitProviderGitHub = "github"
+	gitProviderGitea  = "gitea"
+	gitProviderGitLab = "gitlab"
+)
+
+// Kinds of links between tasks and Git objects, see task_git_refs
+const (
+	gitRefCommit   = "commit"
+	gitRefMROpened = "mr_opened"
+	gitRefMRMerged = "mr_merged"
+)
+
+// gitStrings holds the comments posted on tasks per locale
+var gitStrings = map[string]map[string]string{
+	"ru": {
+		"commit":   "Коммит {sha} в {repo} ({branch}): {message}\n{url}",
+		"mrOpened": "Открыт merge request {repo}{ref}: {title}\n{url}",
+		"mrMerged": "Merge request {repo}{ref} влит: {title}\n{url}",
+		"author":   "Автор: {email}",
+	},
+	"en": {
+		"commit":   "Commit {sha} to {repo} ({branch}): {message}\n{url}",
+		"mrOpened": "Merge request {repo}{ref} opened: {title}\n{url}",
+		"mrMerged": "Merge request {repo}{ref} merged: {title}\n{url}",
+		"author":   "Author: {email}",
+	},
+}
+
+// gitReceiver handles push and merge request webhooks of Git hosts
+type gitReceiver struct {
+	secret string
+	// Username or email of the account commenting when the commit author
+	// has no TaskFlow account or one that may not comment and move tasks
+	user string
+	// Columns tasks move to, empty to leave them in place
+	fixColumn    string
+	openedColumn string
+	mergedColumn string
+	pattern      *regexp.Regexp
+}
+
+var git *gitReceiver
+
+// newGitReceiverFromEnv configures the receiver from GIT_WEBHOOK_SECRET,
+// GIT_WEBHOOK_USER, GIT_FIX_COLUMN, GIT_MR_OPENED_COLUMN and
+// GIT_MR_MERGED_COLUMN. It returns nil without a secret.
+func newGitReceiverFromEnv() *gitReceiver {
+	secret := os.Getenv("GIT_WEBHOOK_SECRET")
+	if secret == "" {
+		return nil
+	}
+	// Links are kept with a comment, which needs an author even when the
+	// commit's has no account
+	if os.Getenv("GIT_WEBHOOK_USER") == "" {
+		log.Fatal("GIT_WEBHOOK_USER must be set when GIT_WEBHOOK_SECRET is")
+	}
+	column := func(key, fallback string) string {
+		if v, ok := os.LookupEnv(key); ok {
+			return v
+		}
+		return fallback
+	}
+	return &gitReceiver{
+		secret:       secret,
+		user:         os.Getenv("GIT_WEBHOOK_USER"),
+		fixColumn:    column("GIT_FIX_COLUMN", "done"),
+		openedColumn: column("GIT_MR_OPENED_COLUMN", "aprove"),
+		mergedColumn: column("GIT_MR_MERGED_COLUMN", "done"),
+		pattern:      taskRefPattern(taskKeyPrefix),
+	}
+}
+
+// taskRefPattern matches task keys with the prefix, optionally preceded by
+// a closing keyword such as "fixes TF-42"
+func taskRefPattern(prefix string) *regexp.Regexp {
+	return regexp.MustCompile(`(?i)(?:\b(fix|fixes|fixed|close|closes|closed|resolve|resolves|resolved)\b:?\s+)?\b` +
+		regexp.QuoteMeta(prefix) + `-(\d+)\b`)
+}
+
+// taskRef is a task referenced from a commit message or merge request
+type taskRef struct {
+	Number int64
+	// Referenced with a closing keyword
+	Closes bool
+}
+
+// parseTaskRefs returns the tasks referenced in the texts, each once
+func (g *gitReceiver) parseTaskRefs(texts ...string) []taskRef {
+	refs := []taskRef{}
+	seen := make(map[int64]int)
+	for _, text := range texts {
+		for _, m := range g.pattern.FindAllStringSubmatch(text, -1) {
+			number, err := strconv.ParseInt(m[2], 10, 64)
+			if err != nil {
+				continue
+			}
+			closes := m[1] != ""
+			if i, ok := seen[number]; ok {
+				refs[i].Closes = refs[i].Closes || closes
+				continue
+			}
+			seen[number] = len(refs)
+			refs = append(refs, taskRef{Number: number, Closes: closes})
+		}
+	}
+	return refs
+}
+
+// gitEvent is a push or merge request event, independent of the Git host
+type gitEvent struct {
+	Repo          string
+	Branch        string
+	DefaultBranch string
+	Commits       []gitCommit
+	MergeRequest  *gitMergeRequest
+}
+
+type gitCommit struct {
+	ID          string
+	Message     string
+	URL         string
+	AuthorEmail string
+}
+
+type gitMergeRequest struct {
+	// Reference within the repository, such as #12 or !12
+	Ref         string
+	Title       string
+	Body        string
+	Branch      string
+	URL         string
+	AuthorEmail string
+	Merged      bool
+}
+
+// detectGitProvider returns the Git host that sent the request and the
+// event type. Gitea also sends GitHub's headers, so it's checked first.
+func detectGitProvider(header http.Header) (string, string) {
+	if event := header.Get("X-Gitea-Event"); event != "" {
+		return gitProviderGitea, event
+	}
+	if event := header.Get("X-Gitlab-Event"); event != "" {
+		return gitProviderGitLab, event
+	}
+	if event := header.Get("X-GitHub-Event"); event != "" {
+		return gitProviderGitHub, event
+	}
+	return "", ""
+}
+
+// verify checks the secret the Git host sent with the request. GitHub and
+// Gitea sign the body with it, GitLab sends it as is.
+func (g *gitReceiver) verify(provider string, header http.Header, body []byte) bool {
+	switch provider {
+	case gitProviderGitHub:
+		return hmac.Equal([]byte(header.Get("X-Hub-Signature-256")), []byte(webhookSignature(g.secret, body)))
+	case gitProviderGitea:
+		signature := "sha256=" + header.Get("X-Gitea-Signature")
+		return hmac.Equal([]byte(signature), []byte(webhookSignature(g.secret, body)))
+	case gitProviderGitLab:
+		return subtle.ConstantTimeCompare([]byte(header.Get("X-Gitlab-Token")), []byte(g.secret)) == 1
+	}
+	return false
+}
+
+// GitHub and Gitea payloads, only the fields we use
+type ghRepository struct {
+	FullName      string `json:"full_name"`
+	DefaultBranch string `json:"default_branch"`
+}
+
+type ghPush struct {
+	Ref        string       `json:"ref"`
+	Repository ghRepository `json:"repository"`
+	Commits    []struct {
+		ID      string `json:"id"`
+		Message string `json:"message"`
+		URL     string `json:"url"`
+		Author  struct {
+			Email string `json:"email"`
+		} `json:"author"`
+	} `json:"commits"`
+}
+
+type ghPullRequestEvent struct {
+	Action      string       `json:"action"`
+	Repository  ghRepository `json:"repository"`
+	PullRequest struct {
+		Number  int64  `json:"number"`
+		Title   string `json:"title"`
+		Body    string `json:"body"`
+		HTMLURL string `json:"html_url"`
+		Merged  bool   `json:"merged"`
+		Head    struct {
+			Ref string `json:"ref"`
+		} `json:"head"`
+		User struct {
+			Email string `json:"email"`
+		} `json:"user"`
+	} `json:"pull_request"`
+}
+
+// parseGitHubEvent reads a GitHub or Gitea payload. It returns nil for
+// events we don't act on.
+func parseGitHubEvent(event string, body []byte) (*gitEvent, error) {
+	switch event {
+	case "push":
+		var p ghPush
+		if err := json.Unmarshal(body, &p); err != nil {
+			return nil, err
+		}
+		e := &gitEvent{
+			Repo:          p.Repository.FullName,
+			Branch:        strings.TrimPrefix(p.Ref, "refs/heads/"),
+			DefaultBranch: p.Repository.DefaultBranch,
+		}
+		for _, c := range p.Commits {
+			e.Commits = append(e.Commits, gitCommit{ID: c.ID, Message: c.Message, URL: c.URL, AuthorEmail: c.Author.Email})
+		}
+		return e, nil
+	case "pull_request":
+		var p ghPullRequestEvent
+		if err := json.Unmarshal(body, &p); err != nil {
+			return nil, err
+		}
+		pr := p.PullRequest
+		merged := p.Action == "closed" && pr.Merged
+		if p.Action != "opened" && p.Action != "reopened" && !merged {
+			return nil, nil
+		}
+		return &gitEvent{
+			Repo: p.Repository.FullName,
+			MergeRequest: &gitMergeRequest{
+				Ref:         "#" + strconv.FormatInt(pr.Number, 10),
+				Title:       pr.Title,
+				Body:        pr.Body,
+				Branch:      pr.Head.Ref,
+				URL:         pr.HTMLURL,
+				AuthorEmail: pr.User.Email,
+				Merged:      merged,
+			},
+		}, nil
+	}
+	return nil, nil
+}
+
+// GitLab payloads, only the fields we use
+type glProject struct {
+	PathWithNamespace string `json:"path_with_namespace"`
+	DefaultBranch     string `json:"default_branch"`
+}
+
+type glEvent struct {
+	ObjectKind string    `json:"object_kind"`
+	Ref        string    `json:"ref"`
+	Project    glProject `json:"project"`
+	Commits    []struct {
+		ID      string `json:"id"`
+		Message string `json:"message"`
+		URL     string `json:"url"`
+		Author  struct {
+			Email string `json:"email"`
+		} `json:"author"`
+	} `json:"commits"`
+	User struct {
+		Email string `json:"email"`
+	} `json:"user"`
+	ObjectAttributes struct {
+		IID          int64  `json:"iid"`
+		Title        string `json:"title"`
+		Description  string `json:"description"`
+		URL          string `json:"url"`
+		SourceBranch string `json:"source_branch"`
+		Action       string `json:"action"`
+	} `json:"object_attributes"`
+}
+
+// parseGitLabEvent reads a GitLab payload. It returns nil for events we
+// don't act on.
+func parseGitLabEvent(body []byte) (*gitEvent, error) {
+	var p glEvent
+	if err := json.Unmarshal(body, &p); err != nil {
+		return nil, err
+	}
+	switch p.ObjectKind {
+	case "push":
+		e := &gitEvent{
+			Repo:          p.Project.PathWithNamespace,
+			Branch:        strings.TrimPrefix(p.Ref, "refs/heads/"),
+			DefaultBranch: p.Project.DefaultBranch,
+		}
+		for _, c := range p.Commits {
+			e.Commits = append(e.Commits, gitCommit{ID: c.ID, Message: c.Message, URL: c.URL, AuthorEmail: c.Author.Email})
+		}
+		return e, nil
+	case "merge_request":
+		mr := p.ObjectAttributes
+		if mr.Action != "open" && mr.Action != "reopen" && mr.Action != "merge" {
+			return nil, nil
+		}
+		return &gitEvent{
+			Repo: p.Project.PathWithNamespace,
+			MergeRequest: &gitMergeRequest{
+				Ref:         "!" + strconv.FormatInt(mr.IID, 10),
+				Title:       mr.Title,
+				Body:        mr.Description,
+				Branch:      mr.SourceBranch,
+				URL:         mr.URL,
+				AuthorEmail: p.User.Email,
+				Merged:      mr.Action == "merge",
+			},
+		}, nil
+	}
+	return nil, nil
+}
+
+// gitResult sums up what a webhook did
+type gitResult struct {
+	Tasks    []string `json:"tasks"`
+	Comments int      `json:"comments"`
+	Moved    int      `json:"moved"`
+}
+
+func gitWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	if git == nil {
+		http.Error(w, "Git webhook is not configured", http.StatusNotFound)
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, 5<<20))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	provider, eventType := detectGitProvider(r.Header)
+	if provider == "" {
+		http.Error(w, "Unknown Git host", http.StatusBadRequest)
+		return
+	}
+	if !git.verify(provider, r.Header, body) {
+		http.Error(w, "Invalid signature", http.StatusUnauthorized)
+		return
+	}
+
+	var event *gitEvent
+	if provider == gitProviderGitLab {
+		event, err = parseGitLabEvent(body)
+	} else {
+		event, err = parseGitHubEvent(eventType, body)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if event == nil {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{
+			"message": "Event ignored",
+		})
+		return
+	}
+
+	result, err := git.apply(event)
+	if err != nil {
+		log.Printf("Error handling %s %s webhook: %v", provider, eventType, err)
+		http.Error(w, "Error handling webhook", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// apply comments on and moves the tasks an event references. Commits to the
+// default branch with a closing keyword move their tasks to fixColumn, merge
+// requests move theirs to openedColumn and mergedColumn.
+func (g *gitReceiver) apply(e *gitEvent) (gitResult, error) {
+	result := gitResult{Tasks: []string{}}
+	touched := make(map[string]bool)
+	locale := supportedLocales[0]
+
+	link := func(number int64, kind, ref, url, comment, authorEmail, column string) error {
+		author, fallback, err := g.author(authorEmail, column != "")
+		if err != nil {
+			return err
+		}
+		// Without anyone to comment as the link isn't recorded either, so a
+		// redelivery makes it once the Git user is active again
+		if author == "" {
+			log.Printf("Git webhook: no active user to comment on %s as", taskKey(number))
+			return nil
+		}
+		if fallback && authorEmail != "" {
+			comment += "\n" + gitText(locale, "author", "{email}", authorEmail)
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		taskID, isNew, err := recordGitRef(tx, number, kind, ref, url)
+		if err != nil || taskID == "" {
+			return err
+		}
+		// The same commit arrives again when its branch is merged, so it's
+		// only commented on once
+		var posted Comment
+		var taskTitle string
+		if isNew {
+			if posted, taskTitle, err = insertComment(tx, taskID, author, comment); err != nil {
+				return err
+			}
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+
+		key := taskKey(number)
+		if !touched[key] {
+			touched[key] = true
+			result.Tasks = append(result.Tasks, key)
+		}
+		if isNew {
+			if err := announceComment(taskID, author, taskTitle, &posted); err != nil {
+				log.Printf("Error announcing comment %s from Git: %v", posted.ID, err)
+			}
+			result.Comments++
+		}
+		if column == "" {
+			return nil
+		}
+		state, err := resolveColumn(column)
+		if err == errUnknownColumn {
+			log.Printf("Git webhook: unknown column %q", column)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if _, err := moveTask(taskID, state, author); err != nil {
+			return err
+		}
+		result.Moved++
+		return nil
+	}
+
+	if mr := e.MergeRequest; mr != nil {
+		kind, text, column := gitRefMROpened, "mrOpened", g.openedColumn
+		if mr.Merged {
+			kind, text, column = gitRefMRMerged, "mrMerged", g.mergedColumn
+		}
+		comment := gitText(locale, text, "{repo}", e.Repo, "{ref}", mr.Ref, "{title}", mr.Title, "{url}", mr.URL)
+		for _, ref := range g.parseTaskRefs(mr.Title, mr.Body, mr.Branch) {
+			if err := link(ref.Number, kind, mr.URL, mr.URL, comment, mr.AuthorEmail, column); err != nil {
+				return result, err
+			}
+		}
+		return result, nil
+	}
+
+	for _, c := range e.Commits {
+		sha := c.ID
+		if len(sha) > 8 {
+			sha = sha[:8]
+		}
+		message := strings.TrimSpace(strings.SplitN(c.Message, "\n", 2)[0])
+		comment := gitText(locale, "commit", "{sha}", sha, "{repo}", e.Repo, "{branch}", e.Branch, "{message}", message, "{url}", c.URL)
+		for _, ref := range g.parseTaskRefs(c.Message) {
+			column := ""
+			if ref.Closes && e.Branch == e.DefaultBranch {
+				column = g.fixColumn
+			}
+			if err := link(ref.Number, gitRefCommit, c.ID, c.URL, comment, c.AuthorEmail, column); err != nil {
+				return result, err
+			}
+		}
+	}
+	return result, nil
+}
+
+// recordGitRef links a Git object to the task with the number. It returns
+// the task ID, empty if there's no such task, and whether the link is new.
+func recordGitRef(tx *sql.Tx, number int64, kind, ref, url string) (string, bool, error) {
+	var taskID string
+	var isNew bool
+	err := tx.QueryRow(`
+		WITH task AS (
+			SELECT id FROM tasks WHERE number = $1
+		), inserted AS (
+			INSERT INTO task_git_refs (task_id, kind, ref, url)
+			SELECT id, $2, $3, $4 FROM task
+			ON CONFLICT (task_id, kind, ref) DO NOTHING
+			RETURNING task_id
+		)
+		SELECT id, EXISTS (SELECT 1 FROM inserted) FROM task
+	`, number, kind, ref, url).Scan(&taskID, &isNew)
+	if err == sql.ErrNoRows {
+		return "", false, nil
+	}
+	return taskID, isNew, err
+}
+
+// author returns the active user with the commit author's email, or the
+// configured Git user. Anyone can put any email in a commit, so the author's
+// account is only used when its role may comment and, with move, move tasks;
+// otherwise fallback is true. The ID is empty if there's neither.
+func (g *gitReceiver) author(email string, move bool) (id string, fallback bool, err error) {
+	rows, err := db.Query(`
+		SELECT id, role, $1 <> '' AND lower(email) = lower($1), $2 <> '' AND (username = $2 OR lower(email) = lower($2))
+		FROM users
+		WHERE deactivated_at IS NULL
+		AND (($1 <> '' AND lower(email) = lower($1)) OR ($2 <> '' AND (username = $2 OR lower(email) = lower($2))))
+		ORDER BY $1 <> '' AND lower(email) = lower($1) DESC
+		LIMIT 2
+	`, email, g.user)
+	if err != nil {
+		return "", false, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var role string
+		var isAuthor, isGitUser bool
+		if err := rows.Scan(&id, &role, &isAuthor, &isGitUser); err != nil {
+			return "", false, err
+		}
+		if isAuthor {
+			perms, err := rolePermissions(role)
+			if err != nil {
+				return "", false, err
+			}
+			if perms[permCommentCreate] && (!move || perms[permTaskMove]) {
+				return id, false, nil
+			}
+		}
+		if isGitUser {
+			return id, true, nil
+		}
+	}
+	return "", false, rows.Err()
+}
+
+// gitText returns a task comment in the locale with placeholders filled in
+func gitText(locale, key string, pairs ...string) string {
+	s, ok := gitStrings[locale][key]
+	if !ok {
+		s = gitStrings[supportedLocales[0]][key]
+	}
+	return strings.NewReplacer(pairs...).Replace(s)
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestParseTaskRefs(t *testing.T) {
+	g := &gitReceiver{pattern: taskRefPattern("TF")}
+	tests := []struct {
+		name  string
+		texts []string
+		want  []taskRef
+	}{
+		{"none", []string{"Update README"}, []taskRef{}},
+		{"mention", []string{"Refactor TF-12 parser"}, []taskRef{{Number: 12}}},
+		{"closing keyword", []string{"Fixes TF-12"}, []taskRef{{Number: 12, Closes: true}}},
+		{"keyword with a colon", []string{"resolved: tf-3"}, []taskRef{{Number: 3, Closes: true}}},
+		{"several", []string{"TF-1, closes TF-2 and TF-3"}, []taskRef{{Number: 1}, {Number: 2, Closes: true}, {Number: 3}}},
+		{"once across texts", []string{"TF-5 title", "body fixes TF-5", "tf-5-branch"}, []taskRef{{Number: 5, Closes: true}}},
+		{"other prefix", []string{"Fixes XTF-5 and OPS-6"}, []taskRef{}},
+		{"not a number", []string{"TF-abc"}, []taskRef{}},
+		{"keyword elsewhere", []string{"fix the build, see TF-8"}, []taskRef{{Number: 8}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := g.parseTaskRefs(tt.texts...); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseTaskRefs() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGitReceiverVerify(t *testing.T) {
+	g := &gitReceiver{secret: "s3cret"}
+	body := []byte(`{"ref":"refs/heads/main"}`)
+	signature := webhookSignature("s3cret", body)
+
+	tests := []struct {
+		name     string
+		provider string
+		header   http.Header
+		want     bool
+	}{
+		{"github", gitProviderGitHub, http.Header{"X-Hub-Signature-256": {signature}}, true},
+		{"github with the wrong secret", gitProviderGitHub, http.Header{"X-Hub-Signature-256": {webhookSignature("other", body)}}, false},
+		{"github without a signature", gitProviderGitHub, http.Header{}, false},
+		{"gitea", gitProviderGitea, http.Header{"X-Gitea-Signature": {signature[len("sha256="):]}}, true},
+		{"gitea with a prefixed signature", gitProviderGitea, http.Header{"X-Gitea-Signature": {signature}}, false},
+		{"gitlab", gitProviderGitLab, http.Header{"X-Gitlab-Token": {"s3cret"}}, true},
+		{"gitlab with the wrong token", gitProviderGitLab, http.Header{"X-Gitlab-Token": {"s3cre"}}, false},
+		{"unknown host", "bitbucket", http.Header{"X-Hub-Signature-256": {signature}}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := g.verify(tt.provider, tt.header, body); got != tt.want {
+				t.Errorf("verify() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGitApply(t *testing.T) {
+	g := &gitReceiver{user: "git", pattern: taskRefPattern("TF")}
+	event := &gitEvent{
+		Repo:          "acme/app",
+		Branch:        "feature",
+		DefaultBranch: "main",
+		Commits:       []gitCommit{{ID: "0123456789abcdef", Message: "Parser for TF-42", URL: "https://git/c/1", AuthorEmail: "dev@example.com"}},
+	}
+	expectAuthor := func(mock sqlmock.Sqlmock, id string) {
+		rows := sqlmock.NewRows([]string{"id", "role", "author", "git_user"})
+		if id != "" {
+			rows.AddRow(id, "member", true, false)
+		}
+		mock.ExpectQuery(`SELECT id, role`).WithArgs("dev@example.com", "git").WillReturnRows(rows)
+	}
+	expectRef := func(mock sqlmock.Sqlmock, isNew bool) {
+		mock.ExpectQuery(`INSERT INTO task_git_refs`).WithArgs(int64(42), gitRefCommit, "0123456789abcdef", "https://git/c/1").
+			WillReturnRows(sqlmock.NewRows([]string{"id", "new"}).AddRow(testTask, isNew))
+	}
+	commentRows := func() *sqlmock.Rows {
+		return sqlmock.NewRows([]string{"id", "content", "username", "created_at", "title"}).
+			AddRow("c1", "Commit", "dev", time.Now(), "Parser")
+	}
+
+	tests := []struct {
+		name     string
+		expect   func(mock sqlmock.Sqlmock)
+		comments int
+		tasks    int
+		wantErr  bool
+	}{
+		{
+			name: "new commit is linked and commented on together",
+			expect: func(mock sqlmock.Sqlmock) {
+				expectAuthor(mock, testUserA)
+				mock.ExpectBegin()
+				expectRef(mock, true)
+				mock.ExpectQuery(`INSERT INTO comments`).WithArgs(testTask, sqlmock.AnyArg(), testUserA).WillReturnRows(commentRows())
+				mock.ExpectCommit()
+				mock.ExpectExec(`INSERT INTO webhook_deliveries`).WillReturnResult(sqlmock.NewResult(0, 0))
+			},
+			comments: 1,
+			tasks:    1,
+		},
+		{
+			name: "known commit isn't commented on again",
+			expect: func(mock sqlmock.Sqlmock) {
+				expectAuthor(mock, testUserA)
+				mock.ExpectBegin()
+				expectRef(mock, false)
+				mock.ExpectCommit()
+			},
+			tasks: 1,
+		},
+		{
+			// Anyone can commit as anyone, so an author who may not comment
+			// is only named in the Git user's comment
+			name: "author without permission falls back to the Git user",
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`SELECT id, role`).WithArgs("dev@example.com", "git").WillReturnRows(
+					sqlmock.NewRows([]string{"id", "role", "author", "git_user"}).
+						AddRow(testUserA, "viewer", true, false).
+						AddRow(testUserB, "member", false, true))
+				mock.ExpectBegin()
+				expectRef(mock, true)
+				mock.ExpectQuery(`INSERT INTO comments`).
+					WithArgs(testTask, "Коммит 01234567 в acme/app (feature): Parser for TF-42\nhttps://git/c/1\nАвтор: dev@example.com", testUserB).
+					WillReturnRows(commentRows())
+				mock.ExpectCommit()
+				mock.ExpectExec(`INSERT INTO webhook_deliveries`).WillReturnResult(sqlmock.NewResult(0, 0))
+			},
+			comments: 1,
+			tasks:    1,
+		},
+		{
+			// Nothing is recorded, so a redelivery can still link it
+			name: "no one to comment as",
+			expect: func(mock sqlmock.Sqlmock) {
+				expectAuthor(mock, "")
+			},
+		},
+		{
+			name: "failed comment drops the link",
+			expect: func(mock sqlmock.Sqlmock) {
+				expectAuthor(mock, testUserA)
+				mock.ExpectBegin()
+				expectRef(mock, true)
+				mock.ExpectQuery(`INSERT INTO comments`).WillReturnError(errors.New("connection reset"))
+				mock.ExpectRollback()
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock := mockDB(t)
+			setRoles(t, map[string][]string{"member": {permCommentCreate, permTaskMove}, "viewer": {}})
+			tt.expect(mock)
+
+			result, err := g.apply(event)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("apply() error = %v", err)
+			}
+			if result.Comments != tt.comments || len(result.Tasks) != tt.tasks {
+				t.Errorf("result = %+v", result)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// Users the tests refer to
+const (
+	testUserA = "11111111-1111-1111-1111-111111111111"
+	testUserB = "22222222-2222-2222-2222-222222222222"
+	testTask  = "33333333-3333-3333-3333-333333333333"
+)
+
+// mockDB replaces the database with a sqlmock for the duration of the test.
+// Queries are matched as regular expressions, in order.
+func mockDB(t *testing.T) sqlmock.Sqlmock {
+	t.Helper()
+	mockConn, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := db
+	db = mockConn
+	t.Cleanup(func() {
+		db = saved
+		mockConn.Close()
+	})
+	return mock
+}
+
+// setRoles fills the role cache so permission checks don't hit the database
+func setRoles(t *testing.T, roles map[string][]string) {
+	t.Helper()
+	roleCache.Lock()
+	roleCache.perms = make(map[string]map[string]bool)
+	for role, perms := range roles {
+		roleCache.perms[role] = make(map[string]bool)
+		for _, p := range perms {
+			roleCache.perms[role][p] = true
+		}
+	}
+	roleCache.loaded = time.Now()
+	roleCache.Unlock()
+	t.Cleanup(invalidateRoleCache)
+}
+
+// asUser returns the request as authMiddleware passes it on for the user
+func asUser(r *http.Request, userID, role string) *http.Request {
+	ctx := context.WithValue(r.Context(), "userId", userID)
+	ctx = context.WithValue(ctx, "role", role)
+	return r.WithContext(ctx)
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/gorilla/mux"
+)
+
+// Impersonation tokens are deliberately short-lived and can't be renewed
+const impersonationTTL = 30 * time.Minute
+
+// Impersonator identifies the admin behind an impersonated session
+type Impersonator struct {
+	ID       string `json:"id"`
+	Username string `json:"username"`
+}
+
+// checkImpersonator verifies that the admin who minted an impersonation token
+// is still active, still signed in and still allowed to manage users
+func checkImpersonator(claims *Claims) bool {
+	var role string
+	var sessionVersion int
+	err := db.QueryRow(
+		"SELECT role, session_version FROM users WHERE id = $1 AND deactivated_at IS NULL",
+		claims.ImpersonatorID,
+	).Scan(&role, &sessionVersion)
+	if err != nil || sessionVersion != claims.ImpersonatorSessionVersion {
+		return false
+	}
+	perms, err := rolePermissions(role)
+	return err == nil && perms[permUserManage]
+}
+
+// withImpersonation marks the request context as impersonated and records the
+// request in the audit log under the real admin
+func withImpersonation(r *http.Request, claims *Claims) *http.Request {
+	ctx := context.WithValue(r.Context(), "impersonatorId", claims.ImpersonatorID)
+	r = r.WithContext(ctx)
+
+	recordAudit(r, claims.ImpersonatorID, "impersonation.request", "user", claims.UserID, map[string]interface{}{
+		"method": r.Method,
+		"path":   r.URL.Path,
+	})
+	return r
+}
+
+// isImpersonating reports whether the request is made by an admin acting as another user
+func isImpersonating(r *http.Request) bool {
+	id, _ := r.Context().Value("impersonatorId").(string)
+	return id != ""
+}
+
+func impersonateUserHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	targetID := vars["id"]
+	adminID := r.Context().Value("userId").(string)
+
+	if targetID == adminID {
+		http.Error(w, "You can't impersonate yourself", http.StatusBadRequest)
+		return
+	}
+
+	var target User
+	var sessionVersion int
+	err := db.QueryRow(
+		"SELECT id, username, role, session_version FROM users WHERE id = $1 AND deactivated_at IS NULL",
+		targetID,
+	).Scan(&target.ID, &target.Username, &target.Role, &sessionVersion)
+	if err == sql.ErrNoRows {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	// Impersonation must never grant the admin more than they already have
+	ok, err := canGrantRole(r, target.Role)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		http.Error(w, "You can't impersonate a user with permissions you don't have", http.StatusForbidden)
+		return
+	}
+
+	var adminSessionVersion int
+	err = db.QueryRow("SELECT session_version FROM users WHERE id = $1", adminID).Scan(&adminSessionVersion)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	expiresAt := time.Now().Add(impersonationTTL)
+	claims := &Claims{
+		UserID:                     target.ID,
+		Role:                       target.Role,
+		SessionVersion:             sessionVersion,
+		ImpersonatorID:             adminID,
+		ImpersonatorSessionVersion: adminSessionVersion,
+		StandardClaims: jwt.StandardClaims{
+			IssuedAt:  time.Now().Unix(),
+			ExpiresAt: expiresAt.Unix(),
+		},
+	}
+	tokenString, err := keyring.sign(claims)
+	if err != nil {
+		http.Error(w, "Error generating token", http.StatusInternalServerError)
+		return
+	}
+
+	recordAudit(r, "", "impersonation.started", "user", target.ID, map[string]interface{}{
+		"username":  target.Username,
+		"expiresAt": expiresAt,
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"token":     tokenString,
+		"expiresAt": expiresAt,
+		"user":      target,
+	})
+}
@@ -0,0 +1,795 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/http"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+// Largest inbound message we accept, attachments included
+const maxInboundMail = 25 << 20
+
+// mailStrings holds the texts added to tasks created from email per locale
+var mailStrings = map[string]map[string]string{
+	"ru": {
+		"noSubject":   "(без темы)",
+		"noText":      "(письмо без текста)",
+		"from":        "От: {from}",
+		"attachments": "Вложения: {names}",
+	},
+	"en": {
+		"noSubject":   "(no subject)",
+		"noText":      "(email without text)",
+		"from":        "From: {from}",
+		"attachments": "Attachments: {names}",
+	},
+}
+
+// TaskEmail is an inbound email that created or commented on a task
+type TaskEmail struct {
+	ID          string            `json:"id"`
+	CommentID   string            `json:"commentId,omitempty"`
+	MessageID   string            `json:"messageId"`
+	From        string            `json:"from"`
+	Subject     string            `json:"subject"`
+	ReceivedAt  time.Time         `json:"receivedAt"`
+	Attachments []EmailAttachment `json:"attachments"`
+}
+
+// EmailAttachment is a file attached to an inbound email
+type EmailAttachment struct {
+	ID          string `json:"id"`
+	Filename    string `json:"filename"`
+	ContentType string `json:"contentType"`
+	Size        int    `json:"size"`
+}
+
+// inboundMailbox turns inbound email into tasks and comments
+type inboundMailbox struct {
+	secret string
+	// Username or email of the account acting for senders without one
+	user string
+	// Authserv-id of the mail server whose Authentication-Results are trusted
+	authservID string
+}
+
+var inbox *inboundMailbox
+
+// newInboundMailboxFromEnv configures inbound email from INBOUND_MAIL_SECRET,
+// INBOUND_MAIL_USER and INBOUND_MAIL_AUTHSERV_ID. It returns nil without a
+// secret.
+func newInboundMailboxFromEnv() *inboundMailbox {
+	secret := os.Getenv("INBOUND_MAIL_SECRET")
+	if secret == "" {
+		return nil
+	}
+	return &inboundMailbox{
+		secret:     secret,
+		user:       os.Getenv("INBOUND_MAIL_USER"),
+		authservID: os.Getenv("INBOUND_MAIL_AUTHSERV_ID"),
+	}
+}
+
+// inboundMail is a parsed inbound message
+type inboundMail struct {
+	MessageID   string
+	InReplyTo   []string
+	From        *mail.Address
+	Subject     string
+	Text        string
+	HTML        string
+	Attachments []inboundAttachment
+	// Authentication-Results headers, topmost first
+	AuthResults []string
+}
+
+type inboundAttachment struct {
+	Filename    string
+	ContentType string
+	Content     []byte
+}
+
+var messageIDPattern = regexp.MustCompile(`<([^<>\s]+)>`)
+
+// mailWordDecoder decodes RFC 2047 encoded header words
+var mailWordDecoder = &mime.WordDecoder{
+	CharsetReader: func(charset string, input io.Reader) (io.Reader, error) {
+		data, err := io.ReadAll(input)
+		if err != nil {
+			return nil, err
+		}
+		return strings.NewReader(decodeCharset(data, charset)), nil
+	},
+}
+
+// parseInboundMail parses a raw RFC 5322 message. Messages without a
+// Message-ID get one derived from their content, so a redelivery is still
+// recognised.
+func parseInboundMail(raw []byte) (*inboundMail, error) {
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return nil, err
+	}
+	m := &inboundMail{}
+
+	parser := mail.AddressParser{WordDecoder: mailWordDecoder}
+	m.From, err = parser.Parse(msg.Header.Get("From"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid From address: %v", err)
+	}
+
+	m.Subject = msg.Header.Get("Subject")
+	if subject, err := mailWordDecoder.DecodeHeader(m.Subject); err == nil {
+		m.Subject = subject
+	}
+	m.Subject = strings.TrimSpace(m.Subject)
+
+	if ids := messageIDPattern.FindStringSubmatch(msg.Header.Get("Message-Id")); ids != nil {
+		m.MessageID = ids[1]
+	} else {
+		sum := sha256.Sum256(raw)
+		m.MessageID = hex.EncodeToString(sum[:]) + "@inbound.taskflow"
+	}
+	for _, ids := range messageIDPattern.FindAllStringSubmatch(msg.Header.Get("In-Reply-To")+" "+msg.Header.Get("References"), -1) {
+		m.InReplyTo = append(m.InReplyTo, ids[1])
+	}
+	m.AuthResults = msg.Header["Authentication-Results"]
+
+	if err := m.readPart(textproto.MIMEHeader(msg.Header), msg.Body, 0); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// readPart collects the text and attachments of a message part, descending
+// into multipart parts
+func (m *inboundMail) readPart(header textproto.MIMEHeader, body io.Reader, depth int) error {
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		mediaType, params = "text/plain", map[string]string{}
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") && depth < 10 {
+		mr := multipart.NewReader(body, params["boundary"])
+		for {
+			part, err := mr.NextPart()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if err := m.readPart(part.Header, part, depth+1); err != nil {
+				return err
+			}
+		}
+	}
+
+	// The multipart reader already decodes quoted-printable parts and drops
+	// the header
+	switch strings.ToLower(strings.TrimSpace(header.Get("Content-Transfer-Encoding"))) {
+	case "base64":
+		body = base64.NewDecoder(base64.StdEncoding, body)
+	case "quoted-printable":
+		body = quotedprintable.NewReader(body)
+	}
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return err
+	}
+
+	disposition, dispositionParams, _ := mime.ParseMediaType(header.Get("Content-Disposition"))
+	filename := dispositionParams["filename"]
+	if filename == "" {
+		filename = params["name"]
+	}
+	if decoded, err := mailWordDecoder.DecodeHeader(filename); err == nil {
+		filename = decoded
+	}
+
+	if disposition != "attachment" && filename == "" {
+		switch {
+		case mediaType == "text/plain" && m.Text == "":
+			m.Text = decodeCharset(data, params["charset"])
+			return nil
+		case mediaType == "text/html" && m.HTML == "":
+			m.HTML = decodeCharset(data, params["charset"])
+			return nil
+		}
+	}
+
+	if filename == "" {
+		filename = "attachment"
+		if exts, _ := mime.ExtensionsByType(mediaType); len(exts) > 0 {
+			filename += exts[0]
+		}
+	}
+	if len(filename) > 255 {
+		filename = filename[len(filename)-255:]
+		for !utf8.ValidString(filename) {
+			filename = filename[1:]
+		}
+	}
+	m.Attachments = append(m.Attachments, inboundAttachment{
+		Filename:    filename,
+		ContentType: mediaType,
+		Content:     data,
+	})
+	return nil
+}
+
+// windows1251 maps the upper half of Windows-1251, still used by some
+// Russian mail clients, from 0x80
+var windows1251 = []rune("ЂЃ‚ѓ„…†‡€‰Љ‹ЊЌЋЏђ‘’“”•–—�™љ›њќћџ ЎўЈ¤Ґ¦§Ё©Є«¬­®Ї°±Ііґµ¶·ё№є»јЅѕї" +
+	"АБВГДЕЖЗИЙКЛМНОПРСТУФХЦЧШЩЪЫЬЭЮЯабвгдежзийклмнопрстуфхцчшщъыьэюя")
+
+// decodeCharset converts text in the charset to UTF-8. Besides UTF-8 it
+// knows Latin-1 and Windows-1251; anything else that isn't valid UTF-8 has
+// its invalid bytes replaced.
+func decodeCharset(data []byte, charset string) string {
+	var table []rune
+	switch strings.ToLower(strings.TrimSpace(charset)) {
+	case "windows-1251", "cp1251":
+		table = windows1251
+	case "iso-8859-1", "latin1":
+	default:
+		return strings.ToValidUTF8(string(data), "�")
+	}
+	var b strings.Builder
+	for _, c := range data {
+		switch {
+		case c < 0x80:
+			b.WriteByte(c)
+		case table != nil:
+			b.WriteRune(table[c-0x80])
+		default:
+			b.WriteRune(rune(c))
+		}
+	}
+	return b.String()
+}
+
+var (
+	htmlHiddenPattern = regexp.MustCompile(`(?is)<(head|script|style)\b.*?</(head|script|style)\s*>`)
+	htmlBreakPattern  = regexp.MustCompile(`(?i)<(br|/p|/div|/li|/tr|/h[1-6])\b[^>]*>`)
+	htmlTagPattern    = regexp.MustCompile(`<[^>]*>`)
+	blankLinesPattern = regexp.MustCompile(`\n[ \t]*\n(\s*\n)+`)
+)
+
+// htmlToText is a rough plain text rendering of an HTML mail body, used when
+// the message has no text part
+func htmlToText(s string) string {
+	s = htmlHiddenPattern.ReplaceAllString(s, "")
+	s = htmlBreakPattern.ReplaceAllString(s, "\n")
+	s = htmlTagPattern.ReplaceAllString(s, "")
+	s = html.UnescapeString(s)
+	return blankLinesPattern.ReplaceAllString(s, "\n\n")
+}
+
+// sender returns the From address for display. Unlike mail.Address.String
+// it leaves non-ASCII names readable.
+func (m *inboundMail) sender() string {
+	if m.From.Name == "" {
+		return m.From.Address
+	}
+	return fmt.Sprintf("%s <%s>", m.From.Name, m.From.Address)
+}
+
+// body returns the message text, preferring the plain text part
+func (m *inboundMail) body() string {
+	text := m.Text
+	if strings.TrimSpace(text) == "" && m.HTML != "" {
+		text = htmlToText(m.HTML)
+	}
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+	return strings.TrimSpace(text)
+}
+
+// replyAttributionPattern matches lines such as "On Mon, Bob wrote:" that
+// introduce the quoted message in a reply
+var replyAttributionPattern = regexp.MustCompile(`(?i)^(on\s.+\swrote|.+\s(пишет|написал|написала)):$`)
+
+// stripQuotedReply drops the quoted previous message and the signature from
+// a reply, keeping answers written between quoted lines
+func stripQuotedReply(text string) string {
+	kept := []string{}
+	for _, line := range strings.Split(text, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "--" || strings.HasPrefix(trimmed, "-----Original Message") || strings.HasPrefix(trimmed, "-----Исходное сообщение") {
+			break
+		}
+		if strings.HasPrefix(trimmed, ">") || replyAttributionPattern.MatchString(trimmed) {
+			continue
+		}
+		kept = append(kept, line)
+	}
+	return blankLinesPattern.ReplaceAllString(strings.TrimSpace(strings.Join(kept, "\n")), "\n\n")
+}
+
+// mailText returns a text in the locale with placeholders filled in
+func mailText(locale, key string, pairs ...string) string {
+	s, ok := mailStrings[locale][key]
+	if !ok {
+		s = mailStrings[supportedLocales[0]][key]
+	}
+	return strings.NewReplacer(pairs...).Replace(s)
+}
+
+// mailSender is the user an inbound email acts as
+type mailSender struct {
+	ID   string
+	Role string
+	// The sender has no account of their own
+	Fallback bool
+}
+
+// authCommentPattern matches the comments of an Authentication-Results header
+var authCommentPattern = regexp.MustCompile(`\([^()]*\)`)
+
+// mailAuthenticated reports whether the mail server verified that the message
+// comes from the domain of the From address: DMARC passed, or SPF or DKIM
+// passed for exactly that domain. Headers further down may be forged by the
+// sender, so only the topmost one counts, or with authservID the topmost one
+// the server with that authserv-id added.
+func mailAuthenticated(results []string, authservID, from string) bool {
+	domain := strings.ToLower(from[strings.LastIndex(from, "@")+1:])
+	for _, header := range results {
+		parts := strings.Split(authCommentPattern.ReplaceAllString(header, ""), ";")
+		fields := strings.Fields(parts[0])
+		if authservID != "" && (len(fields) == 0 || !strings.EqualFold(fields[0], authservID)) {
+			continue
+		}
+
+		for _, part := range parts[1:] {
+			fields := strings.Fields(part)
+			if len(fields) == 0 {
+				continue
+			}
+			method, result, _ := strings.Cut(strings.ToLower(fields[0]), "=")
+			if result != "pass" {
+				continue
+			}
+			// Properties such as smtp.mailfrom=bob@example.com or header.d=example.com
+			props := make(map[string]string)
+			for _, field := range fields[1:] {
+				if key, value, ok := strings.Cut(strings.ToLower(field), "="); ok {
+					props[key] = strings.Trim(value[strings.LastIndex(value, "@")+1:], `"`)
+				}
+			}
+			switch method {
+			case "dmarc":
+				if from, ok := props["header.from"]; !ok || from == domain {
+					return true
+				}
+			case "spf":
+				if props["smtp.mailfrom"] == domain {
+					return true
+				}
+			case "dkim":
+				if props["header.d"] == domain || props["header.i"] == domain {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	return false
+}
+
+// sender returns the active user with the sender's email address, or the
+// configured inbound mail user. Anyone can write any From header, so the
+// address is only matched to an account when the mail server authenticated
+// it. It's nil if there's no such user.
+func (b *inboundMailbox) sender(m *inboundMail) (*mailSender, error) {
+	address := ""
+	if mailAuthenticated(m.AuthResults, b.authservID, m.From.Address) {
+		address = m.From.Address
+	}
+
+	var s mailSender
+	err := db.QueryRow(`
+		SELECT id, role, lower(email) <> lower($1) FROM users
+		WHERE deactivated_at IS NULL
+		AND ((lower(email) = lower($1) AND $1 <> '') OR ($2 <> '' AND (username = $2 OR lower(email) = lower($2))))
+		ORDER BY lower(email) = lower($1) DESC
+		LIMIT 1
+	`, address, b.user).Scan(&s.ID, &s.Role, &s.Fallback)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// subjectKeyPattern matches a task key such as [TF-42] in a subject
+var subjectKeyPattern = regexp.MustCompile(`\[([A-Za-z][A-Za-z0-9]*)-(\d+)\]`)
+
+// threadTask returns the task a reply belongs to, found by the messages it
+// replies to or by a task key such as [TF-42] in the subject. It's empty for
+// a new request.
+func threadTask(m *inboundMail) (string, error) {
+	var taskID string
+	if len(m.InReplyTo) > 0 {
+		err := db.QueryRow(`
+			SELECT e.task_id FROM task_emails e WHERE e.message_id = ANY($1)
+			ORDER BY e.received_at DESC LIMIT 1
+		`, pq.Array(m.InReplyTo)).Scan(&taskID)
+		if err == nil || err != sql.ErrNoRows {
+			return taskID, err
+		}
+	}
+
+	for _, match := range subjectKeyPattern.FindAllStringSubmatch(m.Subject, -1) {
+		if !strings.EqualFold(match[1], taskKeyPrefix) {
+			continue
+		}
+		number, err := strconv.ParseInt(match[2], 10, 64)
+		if err != nil {
+			return "", nil
+		}
+		err = db.QueryRow("SELECT id FROM tasks WHERE number = $1", number).Scan(&taskID)
+		if err == sql.ErrNoRows {
+			return "", nil
+		}
+		return taskID, err
+	}
+	return "", nil
+}
+
+// inboundMailHandler accepts a raw RFC 5322 message, for example piped in by
+// the mail server. A new message creates a backlog task, a reply becomes a
+// comment on the task of its thread.
+func inboundMailHandler(w http.ResponseWriter, r *http.Request) {
+	if inbox == nil {
+		http.Error(w, "Inbound email is not configured", http.StatusNotFound)
+		return
+	}
+	secret := r.Header.Get("X-Inbound-Mail-Secret")
+	if subtle.ConstantTimeCompare([]byte(secret), []byte(inbox.secret)) != 1 {
+		http.Error(w, "Invalid secret", http.StatusUnauthorized)
+		return
+	}
+
+	raw, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxInboundMail))
+	if err != nil {
+		http.Error(w, "Message is too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	m, err := parseInboundMail(raw)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Mail servers retry deliveries, so a message we already have is fine
+	var emailID, taskID string
+	var commentID sql.NullString
+	err = db.QueryRow("SELECT id, task_id, comment_id FROM task_emails WHERE message_id = $1", m.MessageID).Scan(&emailID, &taskID, &commentID)
+	if err == nil {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{
+			"emailId":   emailID,
+			"taskId":    taskID,
+			"commentId": commentID.String,
+		})
+		return
+	}
+	if err != sql.ErrNoRows {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	sender, err := inbox.sender(m)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if sender == nil {
+		http.Error(w, "Unknown sender", http.StatusForbidden)
+		return
+	}
+	perms, err := rolePermissions(sender.Role)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	taskID, err = threadTask(m)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	var result map[string]string
+	if taskID != "" {
+		if !perms[permCommentCreate] {
+			http.Error(w, "Permission denied: "+permCommentCreate+" required", http.StatusForbidden)
+			return
+		}
+		result, err = inbox.commentFromMail(taskID, sender, m, raw)
+	} else {
+		if !perms[permTaskCreate] {
+			http.Error(w, "Permission denied: "+permTaskCreate+" required", http.StatusForbidden)
+			return
+		}
+		result, err = inbox.createTaskFromMail(sender, m, raw)
+	}
+	if err != nil {
+		log.Printf("Error handling inbound email %s: %v", m.MessageID, err)
+		http.Error(w, "Error handling email", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(result)
+}
+
+// mailContent is the task description or comment made from a message. When
+// the sender has no account their address is added, and so are the names of
+// the attachments.
+func mailContent(sender *mailSender, m *inboundMail, text string) string {
+	locale := supportedLocales[0]
+	parts := []string{}
+	if sender.Fallback {
+		parts = append(parts, mailText(locale, "from", "{from}", m.sender()))
+	}
+	if text != "" {
+		parts = append(parts, text)
+	}
+	if len(m.Attachments) > 0 {
+		names := make([]string, len(m.Attachments))
+		for i, a := range m.Attachments {
+			names[i] = a.Filename
+		}
+		parts = append(parts, mailText(locale, "attachments", "{names}", strings.Join(names, ", ")))
+	}
+	if len(parts) == 0 {
+		return mailText(locale, "noText")
+	}
+	return strings.Join(parts, "\n\n")
+}
+
+// createTaskFromMail creates a backlog task from a new message, with the
+// subject as title and the text as description
+func (b *inboundMailbox) createTaskFromMail(sender *mailSender, m *inboundMail, raw []byte) (map[string]string, error) {
+	var task Task
+	task.Title = m.Subject
+	if task.Title == "" {
+		task.Title = mailText(supportedLocales[0], "noSubject")
+	}
+	if len(task.Title) > 255 {
+		task.Title = task.Title[:255]
+		for !utf8.ValidString(task.Title) {
+			task.Title = task.Title[:len(task.Title)-1]
+		}
+	}
+	task.Description = mailContent(sender, m, m.body())
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRow(`
+		INSERT INTO tasks (title, description, state, created_by)
+		VALUES ($1, $2, 'backlog', $3)
+		RETURNING id, number, title, description, state, priority, created_at, updated_at
+	`, task.Title, task.Description, sender.ID).Scan(&task.ID, &task.Number, &task.Title, &task.Description, &task.State, &task.Priority, &task.CreatedAt, &task.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	task.Key = taskKey(task.Number)
+
+	mentioned, err := recordDescriptionMentions(tx, task.ID, task.Description)
+	if err != nil {
+		return nil, err
+	}
+	emailID, err := storeTaskEmail(tx, task.ID, "", sender.ID, m, raw)
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	notifyUsers(mentioned, NotificationEvent{
+		Type:    notifMentioned,
+		TaskID:  task.ID,
+		ActorID: sender.ID,
+		Params:  map[string]interface{}{"title": task.Title, "source": "description"},
+	})
+
+	people := &taskPeople{}
+	people.apply(&task)
+	if err := applyMentions(&task); err != nil {
+		return nil, err
+	}
+	emitWebhookEvent(sender.ID, hookTaskCreated, map[string]interface{}{
+		"task": task,
+	})
+	return map[string]string{
+		"emailId": emailID,
+		"taskId":  task.ID,
+		"taskKey": task.Key,
+	}, nil
+}
+
+// commentFromMail adds a reply to the task of its thread as a comment,
+// without the quoted previous message. The comment and the message are
+// stored together, so a redelivery after a failure doesn't comment twice.
+func (b *inboundMailbox) commentFromMail(taskID string, sender *mailSender, m *inboundMail, raw []byte) (map[string]string, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	comment, taskTitle, err := insertComment(tx, taskID, sender.ID, mailContent(sender, m, stripQuotedReply(m.body())))
+	if err != nil {
+		return nil, err
+	}
+	emailID, err := storeTaskEmail(tx, taskID, comment.ID, sender.ID, m, raw)
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	// The comment is stored, so the mail server mustn't deliver it again
+	if err := announceComment(taskID, sender.ID, taskTitle, &comment); err != nil {
+		log.Printf("Error announcing comment %s from email: %v", comment.ID, err)
+	}
+	return map[string]string{
+		"emailId":   emailID,
+		"taskId":    taskID,
+		"commentId": comment.ID,
+	}, nil
+}
+
+// storeTaskEmail keeps the original message and its attachments with the task
+func storeTaskEmail(tx *sql.Tx, taskID, commentID, senderID string, m *inboundMail, raw []byte) (string, error) {
+	var emailID string
+	err := tx.QueryRow(`
+		INSERT INTO task_emails (task_id, comment_id, message_id, from_address, sender_id, subject, raw)
+		VALUES ($1, NULLIF($2, '')::uuid, $3, $4, $5, $6, $7)
+		RETURNING id
+	`, taskID, commentID, m.MessageID, m.sender(), senderID, m.Subject, raw).Scan(&emailID)
+	if err != nil {
+		return "", err
+	}
+	for _, a := range m.Attachments {
+		_, err := tx.Exec(`
+			INSERT INTO task_email_attachments (email_id, filename, content_type, size, content)
+			VALUES ($1, $2, $3, $4, $5)
+		`, emailID, a.Filename, a.ContentType, len(a.Content), a.Content)
+		if err != nil {
+			return "", err
+		}
+	}
+	return emailID, nil
+}
+
+func getTaskEmailsHandler(w http.ResponseWriter, r *http.Request) {
+	taskID := mux.Vars(r)["id"]
+
+	rows, err := db.Query(`
+		SELECT e.id, e.comment_id, e.message_id, e.from_address, e.subject, e.received_at,
+			a.id, a.filename, a.content_type, a.size
+		FROM task_emails e
+		LEFT JOIN task_email_attachments a ON a.email_id = e.id
+		WHERE e.task_id::text = $1
+		ORDER BY e.received_at, e.id, a.filename
+	`, taskID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	emails := []TaskEmail{}
+	for rows.Next() {
+		var e TaskEmail
+		var commentID, attachmentID, filename, contentType sql.NullString
+		var size sql.NullInt64
+		if err := rows.Scan(&e.ID, &commentID, &e.MessageID, &e.From, &e.Subject, &e.ReceivedAt, &attachmentID, &filename, &contentType, &size); err != nil {
+			http.Error(w, "Error scanning emails", http.StatusInternalServerError)
+			return
+		}
+		if n := len(emails); n == 0 || emails[n-1].ID != e.ID {
+			e.CommentID = commentID.String
+			e.Attachments = []EmailAttachment{}
+			emails = append(emails, e)
+		}
+		if attachmentID.Valid {
+			last := &emails[len(emails)-1]
+			last.Attachments = append(last.Attachments, EmailAttachment{
+				ID:          attachmentID.String,
+				Filename:    filename.String,
+				ContentType: contentType.String,
+				Size:        int(size.Int64),
+			})
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(emails)
+}
+
+// getTaskEmailRawHandler downloads the original message as an .eml file
+func getTaskEmailRawHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	var raw []byte
+	err := db.QueryRow(`
+		SELECT raw FROM task_emails WHERE id::text = $1 AND task_id::text = $2
+	`, vars["emailId"], vars["id"]).Scan(&raw)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Email not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "message/rfc822")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": vars["emailId"] + ".eml"}))
+	w.Write(raw)
+}
+
+// getTaskEmailAttachmentHandler downloads an attachment. It's always served
+// as a download, so attached HTML can't run in the app's origin.
+func getTaskEmailAttachmentHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	var filename, contentType string
+	var content []byte
+	err := db.QueryRow(`
+		SELECT a.filename, a.content_type, a.content
+		FROM task_email_attachments a
+		JOIN task_emails e ON e.id = a.email_id
+		WHERE a.id::text = $1 AND e.id::text = $2 AND e.task_id::text = $3
+	`, vars["attachmentId"], vars["emailId"], vars["id"]).Scan(&filename, &contentType, &content)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Attachment not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Security-Policy", "sandbox")
+	w.Write(content)
+}
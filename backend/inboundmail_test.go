@@ -0,0 +1,291 @@
+package main
+
+import (
+	"errors"
+	"net/mail"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestParseInboundMail(t *testing.T) {
+	tests := []struct {
+		name string
+		raw  string
+		want inboundMail
+	}{
+		{
+			name: "plain text",
+			raw: "From: Bob <bob@example.com>\r\n" +
+				"Subject: Printer is broken\r\n" +
+				"Message-ID: <abc@example.com>\r\n" +
+				"\r\n" +
+				"It doesn't print.\r\n",
+			want: inboundMail{
+				MessageID: "abc@example.com",
+				From:      &mail.Address{Name: "Bob", Address: "bob@example.com"},
+				Subject:   "Printer is broken",
+				Text:      "It doesn't print.\r\n",
+			},
+		},
+		{
+			name: "encoded headers and a reply",
+			raw: "From: =?utf-8?b?0JHQvtGA0LjRgQ==?= <boris@example.com>\r\n" +
+				"Subject: =?utf-8?q?Re=3A_=5BTF-42=5D_=D0=9F=D1=80=D0=B8=D0=BD=D1=82=D0=B5=D1=80?=\r\n" +
+				"Message-ID: <r1@example.com>\r\n" +
+				"In-Reply-To: <n1@taskflow>\r\n" +
+				"References: <n0@taskflow> <n1@taskflow>\r\n" +
+				"Authentication-Results: mx.taskflow.local; spf=pass smtp.mailfrom=example.com\r\n" +
+				"Content-Type: text/plain; charset=windows-1251\r\n" +
+				"\r\n" +
+				"\xc3\xee\xf2\xee\xe2\xee\r\n",
+			want: inboundMail{
+				MessageID:   "r1@example.com",
+				InReplyTo:   []string{"n1@taskflow", "n0@taskflow", "n1@taskflow"},
+				From:        &mail.Address{Name: "Борис", Address: "boris@example.com"},
+				Subject:     "Re: [TF-42] Принтер",
+				Text:        "Готово\r\n",
+				AuthResults: []string{"mx.taskflow.local; spf=pass smtp.mailfrom=example.com"},
+			},
+		},
+		{
+			name: "multipart with an attachment",
+			raw: "From: bob@example.com\r\n" +
+				"Subject: Logs\r\n" +
+				"Message-ID: <m1@example.com>\r\n" +
+				"Content-Type: multipart/mixed; boundary=b1\r\n" +
+				"\r\n" +
+				"--b1\r\n" +
+				"Content-Type: multipart/alternative; boundary=b2\r\n" +
+				"\r\n" +
+				"--b2\r\n" +
+				"Content-Type: text/plain\r\n" +
+				"\r\n" +
+				"See attached\r\n" +
+				"--b2\r\n" +
+				"Content-Type: text/html\r\n" +
+				"\r\n" +
+				"<p>See attached</p>\r\n" +
+				"--b2--\r\n" +
+				"--b1\r\n" +
+				"Content-Type: text/plain; name=\"app.log\"\r\n" +
+				"Content-Disposition: attachment; filename=\"app.log\"\r\n" +
+				"Content-Transfer-Encoding: base64\r\n" +
+				"\r\n" +
+				"ZXJyb3I=\r\n" +
+				"--b1--\r\n",
+			want: inboundMail{
+				MessageID: "m1@example.com",
+				From:      &mail.Address{Address: "bob@example.com"},
+				Subject:   "Logs",
+				Text:      "See attached",
+				HTML:      "<p>See attached</p>",
+				Attachments: []inboundAttachment{
+					{Filename: "app.log", ContentType: "text/plain", Content: []byte("error")},
+				},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseInboundMail([]byte(tt.raw))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(*got, tt.want) {
+				t.Errorf("parseInboundMail() = %+v\nwant %+v", *got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseInboundMailErrors(t *testing.T) {
+	if _, err := parseInboundMail([]byte("Subject: no sender\r\n\r\nHello")); err == nil {
+		t.Error("message without From parsed")
+	}
+
+	// Without a Message-ID the same message always gets the same one
+	raw := []byte("From: bob@example.com\r\nSubject: Hi\r\n\r\nHello")
+	a, err := parseInboundMail(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := parseInboundMail(raw)
+	if a.MessageID != b.MessageID || !strings.HasSuffix(a.MessageID, "@inbound.taskflow") {
+		t.Errorf("derived Message-IDs %q and %q", a.MessageID, b.MessageID)
+	}
+}
+
+func TestStripQuotedReply(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want string
+	}{
+		{"no quote", "Done.", "Done."},
+		{"quote below", "Done.\n\nOn Mon, 1 Jan 2024, Bob wrote:\n> Is it done?\n> Thanks", "Done."},
+		{"answers between quotes", "> Is it done?\nYes.\n> And the tests?\nThose too.", "Yes.\nThose too."},
+		{"signature", "Done.\n-- \nBob\nACME Inc.", "Done."},
+		{"outlook quote", "Done.\n\n-----Original Message-----\nFrom: Bob\nIs it done?", "Done."},
+		{"russian attribution", "Готово.\n\n1 янв. 2024 г., Борис пишет:\n> Сделано?", "Готово."},
+		{"blank lines collapsed", "One.\n\n\n\nTwo.", "One.\n\nTwo."},
+		{"only a quote", "> Is it done?", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := stripQuotedReply(tt.text); got != tt.want {
+				t.Errorf("stripQuotedReply() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMailAuthenticated(t *testing.T) {
+	tests := []struct {
+		name       string
+		results    []string
+		authservID string
+		want       bool
+	}{
+		{"no results", nil, "", false},
+		{"dmarc pass", []string{"mx.local; dmarc=pass (p=reject) header.from=example.com"}, "", true},
+		{"dmarc pass for another domain", []string{"mx.local; dmarc=pass header.from=evil.com"}, "", false},
+		{"spf pass", []string{"mx.local; spf=pass smtp.mailfrom=bounce@example.com"}, "", true},
+		{"spf pass for another domain", []string{"mx.local; spf=pass smtp.mailfrom=evil.com"}, "", false},
+		{"dkim pass", []string{"mx.local; dkim=pass header.d=Example.COM header.s=sel"}, "", true},
+		{"dkim identity", []string{"mx.local; dkim=pass header.i=@example.com"}, "", true},
+		{"failures", []string{"mx.local; spf=fail smtp.mailfrom=example.com; dkim=none; dmarc=fail header.from=example.com"}, "", false},
+		{"forged result below ours", []string{"mx.local; spf=softfail smtp.mailfrom=example.com", "evil; dmarc=pass"}, "", false},
+		{"result of our server", []string{"evil; dmarc=pass", "mx.local 1; dkim=pass header.d=example.com"}, "mx.local", true},
+		{"no result of our server", []string{"evil; dmarc=pass"}, "mx.local", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := mailAuthenticated(tt.results, tt.authservID, "bob@example.com"); got != tt.want {
+				t.Errorf("mailAuthenticated() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestInboundMailboxSender(t *testing.T) {
+	tests := []struct {
+		name     string
+		results  []string
+		address  string
+		fallback bool
+	}{
+		{"authenticated sender", []string{"mx.local; dmarc=pass header.from=example.com"}, "bob@example.com", false},
+		// The claimed address is shown, but the account isn't used
+		{"unauthenticated sender", nil, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock := mockDB(t)
+			mock.ExpectQuery(`SELECT id, role, lower\(email\) <> lower\(\$1\) FROM users`).WithArgs(tt.address, "inbox").
+				WillReturnRows(sqlmock.NewRows([]string{"id", "role", "fallback"}).AddRow(testUserA, "member", tt.fallback))
+
+			b := &inboundMailbox{user: "inbox"}
+			m := &inboundMail{From: &mail.Address{Address: "bob@example.com"}, AuthResults: tt.results}
+			s, err := b.sender(m)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if s.Fallback != tt.fallback {
+				t.Errorf("Fallback = %v, want %v", s.Fallback, tt.fallback)
+			}
+			if tt.fallback && !strings.Contains(mailContent(s, m, "Hello"), "bob@example.com") {
+				t.Error("content lacks the claimed address")
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestThreadTaskSubjectKey(t *testing.T) {
+	tests := []struct {
+		subject string
+		number  int64
+	}{
+		{"Re: [TF-42] Printer", 42},
+		{"Re: [tf-7] Printer", 7},
+		{"[OPS-1] [TF-9] Printer", 9},
+		{"Printer TF-42", 0},
+		{"[OPS-1] Printer", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.subject, func(t *testing.T) {
+			mock := mockDB(t)
+			if tt.number != 0 {
+				mock.ExpectQuery(`SELECT id FROM tasks WHERE number`).WithArgs(tt.number).
+					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(testTask))
+			}
+			taskID, err := threadTask(&inboundMail{Subject: tt.subject})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (taskID != "") != (tt.number != 0) {
+				t.Errorf("threadTask() = %q", taskID)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestCommentFromMail(t *testing.T) {
+	m := &inboundMail{
+		MessageID: "r1@example.com",
+		From:      &mail.Address{Address: "bob@example.com"},
+		Subject:   "Re: [TF-42] Printer",
+		Text:      "Done.\n\n> Is it done?",
+	}
+	sender := &mailSender{ID: testUserA, Role: "member"}
+
+	t.Run("comment and email in one transaction", func(t *testing.T) {
+		mock := mockDB(t)
+		mock.ExpectBegin()
+		mock.ExpectQuery(`INSERT INTO comments`).WithArgs(testTask, "Done.", testUserA).
+			WillReturnRows(sqlmock.NewRows([]string{"id", "content", "username", "created_at", "title"}).
+				AddRow("c1", "Done.", "bob", time.Now(), "Printer"))
+		mock.ExpectQuery(`INSERT INTO task_emails`).WithArgs(testTask, "c1", m.MessageID, "bob@example.com", testUserA, m.Subject, []byte("raw")).
+			WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("e1"))
+		mock.ExpectCommit()
+		mock.ExpectExec(`INSERT INTO webhook_deliveries`).WillReturnResult(sqlmock.NewResult(0, 0))
+
+		result, err := (&inboundMailbox{}).commentFromMail(testTask, sender, m, []byte("raw"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result["commentId"] != "c1" || result["emailId"] != "e1" {
+			t.Errorf("result = %v", result)
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("failing to store the email drops the comment", func(t *testing.T) {
+		mock := mockDB(t)
+		mock.ExpectBegin()
+		mock.ExpectQuery(`INSERT INTO comments`).
+			WillReturnRows(sqlmock.NewRows([]string{"id", "content", "username", "created_at", "title"}).
+				AddRow("c1", "Done.", "bob", time.Now(), "Printer"))
+		mock.ExpectQuery(`INSERT INTO task_emails`).WillReturnError(errors.New("connection reset"))
+		mock.ExpectRollback()
+
+		if _, err := (&inboundMailbox{}).commentFromMail(testTask, sender, m, []byte("raw")); err == nil {
+			t.Fatal("expected an error")
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Error(err)
+		}
+	})
+}
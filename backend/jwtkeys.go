@@ -0,0 +1,272 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// Secret shipped in the examples, refused in production
+const defaultJWTSecret = "your_jwt_secret_key_change_in_production"
+
+// jwtKey is a key used to sign or verify JWTs
+type jwtKey struct {
+	ID      string
+	Method  jwt.SigningMethod
+	Private interface{} // nil for verification-only keys
+	Public  interface{}
+}
+
+// jwtKeyring holds the signing key and every key tokens are still accepted with
+type jwtKeyring struct {
+	Signing *jwtKey
+	Verify  map[string]*jwtKey
+}
+
+var keyring *jwtKeyring
+
+func init() {
+	jwt.RegisterSigningMethod(signingMethodEdDSA.Alg(), func() jwt.SigningMethod {
+		return signingMethodEdDSA
+	})
+}
+
+// signingMethodEd25519 implements the EdDSA algorithm, which jwt-go lacks
+type signingMethodEd25519 struct{}
+
+var signingMethodEdDSA = &signingMethodEd25519{}
+
+func (m *signingMethodEd25519) Alg() string {
+	return "EdDSA"
+}
+
+func (m *signingMethodEd25519) Sign(signingString string, key interface{}) (string, error) {
+	k, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return "", jwt.ErrInvalidKeyType
+	}
+	return jwt.EncodeSegment(ed25519.Sign(k, []byte(signingString))), nil
+}
+
+func (m *signingMethodEd25519) Verify(signingString, signature string, key interface{}) error {
+	k, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return jwt.ErrInvalidKeyType
+	}
+
+	sig, err := jwt.DecodeSegment(signature)
+	if err != nil {
+		return err
+	}
+
+	if !ed25519.Verify(k, []byte(signingString), sig) {
+		return jwt.ErrSignatureInvalid
+	}
+	return nil
+}
+
+// loadKeyring configures JWT keys from the environment.
+//
+// With JWT_ALG=HS256 (the default) tokens are signed with JWT_SECRET. With
+// RS256 or EdDSA, every "<kid>.pem" private key and "<kid>.pub.pem" public key
+// in JWT_KEYS_DIR is accepted for verification, and JWT_SIGNING_KID selects the
+// key new tokens are signed with. Rotating is a matter of adding the new key,
+// switching JWT_SIGNING_KID once every instance has it, and removing the old
+// key after the longest token lifetime has passed.
+func loadKeyring() (*jwtKeyring, error) {
+	alg := os.Getenv("JWT_ALG")
+	if alg == "" {
+		alg = "HS256"
+	}
+
+	if alg == "HS256" {
+		key := &jwtKey{ID: "hs256", Method: jwt.SigningMethodHS256, Private: jwtSecret, Public: jwtSecret}
+		return &jwtKeyring{Signing: key, Verify: map[string]*jwtKey{key.ID: key}}, nil
+	}
+
+	var method jwt.SigningMethod
+	switch alg {
+	case "RS256":
+		method = jwt.SigningMethodRS256
+	case "EdDSA":
+		method = signingMethodEdDSA
+	default:
+		return nil, fmt.Errorf("unsupported JWT_ALG %q", alg)
+	}
+
+	dir := os.Getenv("JWT_KEYS_DIR")
+	if dir == "" {
+		return nil, errors.New("JWT_KEYS_DIR is required for asymmetric signing")
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.pem"))
+	if err != nil {
+		return nil, err
+	}
+
+	ring := &jwtKeyring{Verify: make(map[string]*jwtKey)}
+	for _, file := range files {
+		key, err := readKeyFile(file, method)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", file, err)
+		}
+		// A private key already holds its public half, so a "<kid>.pub.pem"
+		// next to it adds nothing
+		if existing, ok := ring.Verify[key.ID]; ok && existing.Private != nil {
+			continue
+		}
+		ring.Verify[key.ID] = key
+	}
+
+	signingKID := os.Getenv("JWT_SIGNING_KID")
+	key, ok := ring.Verify[signingKID]
+	if !ok || key.Private == nil {
+		return nil, fmt.Errorf("private key for JWT_SIGNING_KID %q not found in %s", signingKID, dir)
+	}
+	ring.Signing = key
+
+	return ring, nil
+}
+
+// readKeyFile parses a PEM key, taking the key ID from the file name
+func readKeyFile(path string, method jwt.SigningMethod) (*jwtKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM data")
+	}
+
+	name := filepath.Base(path)
+	key := &jwtKey{Method: method}
+
+	if strings.HasSuffix(name, ".pub.pem") {
+		key.ID = strings.TrimSuffix(name, ".pub.pem")
+		key.Public, err = x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		key.ID = strings.TrimSuffix(name, ".pem")
+		key.Private, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			// RSA keys generated by openssl genrsa are PKCS#1
+			key.Private, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		switch k := key.Private.(type) {
+		case *rsa.PrivateKey:
+			key.Public = &k.PublicKey
+		case ed25519.PrivateKey:
+			key.Public = k.Public()
+		}
+	}
+
+	switch key.Public.(type) {
+	case *rsa.PublicKey:
+		if method != jwt.SigningMethodRS256 {
+			return nil, errors.New("RSA key does not match JWT_ALG")
+		}
+	case ed25519.PublicKey:
+		if method != signingMethodEdDSA {
+			return nil, errors.New("Ed25519 key does not match JWT_ALG")
+		}
+	default:
+		return nil, errors.New("unsupported key type")
+	}
+
+	return key, nil
+}
+
+// sign signs claims with the current signing key
+func (k *jwtKeyring) sign(claims jwt.Claims) (string, error) {
+	token := jwt.NewWithClaims(k.Signing.Method, claims)
+	if k.Signing.Method != jwt.SigningMethodHS256 {
+		token.Header["kid"] = k.Signing.ID
+	}
+	return token.SignedString(k.Signing.Private)
+}
+
+// keyFunc resolves the verification key for a token, rejecting any token
+// whose alg doesn't match the key it claims to be signed with
+func (k *jwtKeyring) keyFunc(token *jwt.Token) (interface{}, error) {
+	var key *jwtKey
+	if k.Signing.Method == jwt.SigningMethodHS256 {
+		key = k.Signing
+	} else {
+		kid, _ := token.Header["kid"].(string)
+		key = k.Verify[kid]
+		if key == nil {
+			return nil, fmt.Errorf("unknown key id %q", kid)
+		}
+	}
+
+	if token.Method.Alg() != key.Method.Alg() {
+		return nil, fmt.Errorf("unexpected signing method %q", token.Method.Alg())
+	}
+	return key.Public, nil
+}
+
+// parse validates a token string into claims
+func (k *jwtKeyring) parse(tokenString string, claims jwt.Claims) (*jwt.Token, error) {
+	parser := &jwt.Parser{ValidMethods: []string{k.Signing.Method.Alg()}}
+	return parser.ParseWithClaims(tokenString, claims, k.keyFunc)
+}
+
+// jwksHandler publishes the public verification keys as a JSON Web Key Set
+func jwksHandler(w http.ResponseWriter, r *http.Request) {
+	ids := make([]string, 0, len(keyring.Verify))
+	for id := range keyring.Verify {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	keys := []map[string]string{}
+	for _, id := range ids {
+		key := keyring.Verify[id]
+		switch pub := key.Public.(type) {
+		case *rsa.PublicKey:
+			keys = append(keys, map[string]string{
+				"kty": "RSA",
+				"use": "sig",
+				"alg": key.Method.Alg(),
+				"kid": id,
+				"n":   jwt.EncodeSegment(pub.N.Bytes()),
+				"e":   jwt.EncodeSegment(big.NewInt(int64(pub.E)).Bytes()),
+			})
+		case ed25519.PublicKey:
+			keys = append(keys, map[string]string{
+				"kty": "OKP",
+				"crv": "Ed25519",
+				"use": "sig",
+				"alg": key.Method.Alg(),
+				"kid": id,
+				"x":   jwt.EncodeSegment(pub),
+			})
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"keys": keys,
+	})
+}
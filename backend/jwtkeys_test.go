@@ -0,0 +1,109 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeEd25519Key writes "<kid>.pem" and, if public is set, "<kid>.pub.pem"
+func writeEd25519Key(t *testing.T, dir, kid string, private, public bool) {
+	t.Helper()
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	write := func(name, blockType string, der []byte) {
+		data := pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if private {
+		der, err := x509.MarshalPKCS8PrivateKey(priv)
+		if err != nil {
+			t.Fatal(err)
+		}
+		write(kid+".pem", "PRIVATE KEY", der)
+	}
+	if public {
+		der, err := x509.MarshalPKIXPublicKey(pub)
+		if err != nil {
+			t.Fatal(err)
+		}
+		write(kid+".pub.pem", "PUBLIC KEY", der)
+	}
+}
+
+func TestLoadKeyring(t *testing.T) {
+	tests := []struct {
+		name    string
+		keys    func(dir string)
+		kid     string
+		wantErr bool
+	}{
+		{
+			name: "private and public key of the signing kid",
+			keys: func(dir string) {
+				writeEd25519Key(t, dir, "2024", true, true)
+			},
+			kid: "2024",
+		},
+		{
+			name: "only a private key",
+			keys: func(dir string) {
+				writeEd25519Key(t, dir, "2024", true, false)
+			},
+			kid: "2024",
+		},
+		{
+			name: "old public key kept for verification",
+			keys: func(dir string) {
+				writeEd25519Key(t, dir, "2023", false, true)
+				writeEd25519Key(t, dir, "2024", true, true)
+			},
+			kid: "2024",
+		},
+		{
+			name: "signing kid without a private key",
+			keys: func(dir string) {
+				writeEd25519Key(t, dir, "2024", false, true)
+			},
+			kid:     "2024",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			tt.keys(dir)
+			t.Setenv("JWT_ALG", "EdDSA")
+			t.Setenv("JWT_KEYS_DIR", dir)
+			t.Setenv("JWT_SIGNING_KID", tt.kid)
+
+			ring, err := loadKeyring()
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ring.Signing.ID != tt.kid || ring.Signing.Private == nil {
+				t.Errorf("signing key = %+v, want private key %s", ring.Signing, tt.kid)
+			}
+			for kid, key := range ring.Verify {
+				if key.Public == nil {
+					t.Errorf("key %s has no public key", kid)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"mime"
+	"net"
+	"net/smtp"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Mail represents an outgoing email message
+type Mail struct {
+	To      string
+	Subject string
+	Text    string
+	HTML    string
+	// Extra headers such as List-Unsubscribe
+	Headers map[string]string
+}
+
+// Mailer sends outgoing email
+type Mailer interface {
+	Send(m Mail) error
+}
+
+var mailer Mailer
+
+// newMailerFromEnv builds the mailer selected by the MAILER environment variable.
+// Supported values are "smtp", "file" and "log" (the default).
+func newMailerFromEnv() Mailer {
+	from := os.Getenv("SMTP_FROM")
+	if from == "" {
+		from = "TaskFlow <no-reply@taskflow.local>"
+	}
+
+	switch os.Getenv("MAILER") {
+	case "smtp":
+		host := os.Getenv("SMTP_HOST")
+		if host == "" {
+			host = "localhost"
+		}
+		port := os.Getenv("SMTP_PORT")
+		if port == "" {
+			port = "1025"
+		}
+		return &SMTPMailer{
+			Addr:     net.JoinHostPort(host, port),
+			Username: os.Getenv("SMTP_USERNAME"),
+			Password: os.Getenv("SMTP_PASSWORD"),
+			From:     from,
+		}
+	case "file":
+		path := os.Getenv("MAIL_FILE")
+		if path == "" {
+			path = "mail.log"
+		}
+		return &FileMailer{Path: path, From: from}
+	default:
+		return &LogMailer{From: from}
+	}
+}
+
+// SMTPMailer delivers mail through an SMTP server. It works against a local
+// catcher such as MailHog as well as a real relay.
+type SMTPMailer struct {
+	Addr     string
+	Username string
+	Password string
+	From     string
+}
+
+func (m *SMTPMailer) Send(mail Mail) error {
+	var auth smtp.Auth
+	if m.Username != "" {
+		host, _, _ := net.SplitHostPort(m.Addr)
+		auth = smtp.PlainAuth("", m.Username, m.Password, host)
+	}
+
+	return smtp.SendMail(m.Addr, auth, envelopeAddress(m.From), []string{envelopeAddress(mail.To)}, buildMessage(m.From, mail))
+}
+
+// LogMailer writes messages to the server log instead of sending them
+type LogMailer struct {
+	From string
+}
+
+func (m *LogMailer) Send(mail Mail) error {
+	log.Printf("Mail to %s: %s\n%s", mail.To, mail.Subject, mail.Text)
+	return nil
+}
+
+// FileMailer appends full RFC 5322 messages to a file, for development
+type FileMailer struct {
+	Path string
+	From string
+	mu   sync.Mutex
+}
+
+func (m *FileMailer) Send(mail Mail) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	f, err := os.OpenFile(m.Path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = f.Write(append(buildMessage(m.From, mail), "\r\n"...))
+	return err
+}
+
+// buildMessage renders a mail as a MIME message, multipart when an HTML body is present
+func buildMessage(from string, mail Mail) []byte {
+	var b strings.Builder
+	b.WriteString("From: " + from + "\r\n")
+	b.WriteString("To: " + mail.To + "\r\n")
+	b.WriteString("Subject: " + mime.QEncoding.Encode("utf-8", mail.Subject) + "\r\n")
+	b.WriteString("Date: " + time.Now().Format(time.RFC1123Z) + "\r\n")
+	b.WriteString("MIME-Version: 1.0\r\n")
+	keys := make([]string, 0, len(mail.Headers))
+	for k := range mail.Headers {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		b.WriteString(k + ": " + mail.Headers[k] + "\r\n")
+	}
+
+	if mail.HTML == "" {
+		b.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+		b.WriteString(mail.Text)
+		return []byte(b.String())
+	}
+
+	boundary := fmt.Sprintf("taskflow-%d", time.Now().UnixNano())
+	b.WriteString("Content-Type: multipart/alternative; boundary=" + boundary + "\r\n\r\n")
+	b.WriteString("--" + boundary + "\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	b.WriteString(mail.Text + "\r\n")
+	b.WriteString("--" + boundary + "\r\n")
+	b.WriteString("Content-Type: text/html; charset=utf-8\r\n\r\n")
+	b.WriteString(mail.HTML + "\r\n")
+	b.WriteString("--" + boundary + "--\r\n")
+	return []byte(b.String())
+}
+
+// envelopeAddress strips a display name, "Name <a@b>" becomes "a@b"
+func envelopeAddress(addr string) string {
+	if i := strings.LastIndex(addr, "<"); i >= 0 {
+		return strings.TrimSuffix(addr[i+1:], ">")
+	}
+	return addr
+}
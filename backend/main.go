@@ -4,11 +4,14 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
 	"time"
+	"sort"
+	"strconv"
 	"strings"
 
 	"github.com/gorilla/mux"
@@ -20,42 +23,92 @@ import (
 
 // User represents a user in the system
 type User struct {
-	ID        string    `json:"id"`
-	Username  string    `json:"username"`
-	Email     string    `json:"email"`
-	Password  string    `json:"-"`
-	Role      string    `json:"role"`
-	CreatedAt time.Time `json:"createdAt"`
+	ID             string        `json:"id"`
+	Username       string        `json:"username"`
+	Email          string        `json:"email"`
+	Password       string        `json:"-"`
+	Role           string        `json:"role"`
+	EmailVerified  bool          `json:"emailVerified"`
+	PendingEmail   string        `json:"pendingEmail,omitempty"`
+	AvatarURL      string        `json:"avatarUrl"`
+	Locale         string        `json:"locale,omitempty"`
+	DeactivatedAt  *time.Time    `json:"deactivatedAt,omitempty"`
+	ImpersonatedBy *Impersonator `json:"impersonatedBy,omitempty"`
+	CreatedAt      time.Time     `json:"createdAt"`
+}
+
+// UserRef is a short reference to a user embedded in other resources
+type UserRef struct {
+	ID        string `json:"id"`
+	Username  string `json:"username"`
+	AvatarURL string `json:"avatarUrl"`
+}
+
+// UnmarshalJSON also accepts a bare user ID, which is what older clients send
+// as a task's assignee
+func (u *UserRef) UnmarshalJSON(data []byte) error {
+	var id string
+	if err := json.Unmarshal(data, &id); err == nil {
+		*u = UserRef{ID: id}
+		return nil
+	}
+	type plain UserRef
+	return json.Unmarshal(data, (*plain)(u))
 }
 
 // Task represents a task in the system
+
 type Task struct {
-	ID          string    `json:"id"`
-	Title       string    `json:"title"`
-	Description string    `json:"description"`
-	State       string    `json:"state"`
-	Priority    int       `json:"priority"`
-	Assignee    string    `json:"assignee,omitempty"`
-	Comments    []Comment `json:"comments,omitempty"`
-	CreatedAt   time.Time `json:"createdAt"`
-	UpdatedAt   time.Time `json:"updatedAt"`
+	ID                  string     `json:"id"`
+	Number              int64      `json:"number"`
+	Key                 string     `json:"key"`
+	Title               string     `json:"title"`
+	Description         string     `json:"description"`
+	DescriptionMentions []Mention  `json:"descriptionMentions"`
+	State               string     `json:"state"`
+	Priority            int        `json:"priority"`
+	DueAt               *time.Time `json:"dueAt,omitempty"`
+	AssigneeID          string     `json:"assigneeId,omitempty"`
+	Assignee            *UserRef   `json:"assignee,omitempty"`
+	AssigneeIDs         []string   `json:"assigneeIds"`
+	Assignees           []UserRef  `json:"assignees"`
+	Watchers            []UserRef  `json:"watchers"`
+	TeamID              string     `json:"teamId,omitempty"`
+	Team                string     `json:"team,omitempty"`
+	Comments            []Comment  `json:"comments,omitempty"`
+	CreatedAt           time.Time  `json:"createdAt"`
+	UpdatedAt           time.Time  `json:"updatedAt"`
+}
+
+// taskKeyPrefix starts the short references of tasks, set with TASK_KEY_PREFIX
+var taskKeyPrefix = "TF"
+
+// taskKey returns the short reference of a task, such as TF-42
+func taskKey(number int64) string {
+	return fmt.Sprintf("%s-%d", taskKeyPrefix, number)
 }
 
 // Comment represents a comment on a task
 type Comment struct {
 	ID        string    `json:"id"`
 	Content   string    `json:"content"`
+	Mentions  []Mention `json:"mentions"`
 	Author    string    `json:"author"`
 	CreatedAt time.Time `json:"createdAt"`
 }
 
 // Notification represents a notification in the system
 type Notification struct {
-	ID        string    `json:"id"`
-	UserID    string    `json:"userId"`
-	Message   string    `json:"message"`
-	Read      bool      `json:"read"`
-	CreatedAt time.Time `json:"createdAt"`
+	ID        string          `json:"id"`
+	UserID    string          `json:"userId"`
+	Type      string          `json:"type"`
+	TaskID    string          `json:"taskId,omitempty"`
+	ActorID   string          `json:"actorId,omitempty"`
+	Actor     string          `json:"actor,omitempty"`
+	Params    json.RawMessage `json:"params"`
+	Message   string          `json:"message"`
+	Read      bool            `json:"read"`
+	CreatedAt time.Time       `json:"createdAt"`
 }
 
 // Column represents a column in the kanban board
@@ -74,8 +127,12 @@ type Board struct {
 
 // Claims represents the JWT claims
 type Claims struct {
-	UserID string `json:"userId"`
-	Role   string `json:"role"`
+	UserID         string `json:"userId"`
+	Role           string `json:"role"`
+	SessionVersion int    `json:"sv"`
+	// Set when an admin is acting as UserID
+	ImpersonatorID             string `json:"imp,omitempty"`
+	ImpersonatorSessionVersion int    `json:"isv,omitempty"`
 	jwt.StandardClaims
 }
 
@@ -87,9 +144,10 @@ type LoginRequest struct {
 
 // RegisterRequest represents the register request body
 type RegisterRequest struct {
-	Username string `json:"username"`
-	Email    string `json:"email"`
-	Password string `json:"password"`
+	Username    string `json:"username"`
+	Email       string `json:"email"`
+	Password    string `json:"password"`
+	InviteToken string `json:"inviteToken,omitempty"`
 }
 
 // AuthResponse represents the authentication response
@@ -100,6 +158,10 @@ type AuthResponse struct {
 
 var db *sql.DB
 var jwtSecret []byte
+var appURL string
+var apiURL string
+var requireEmailVerification bool
+var trustProxy bool
 
 func main() {
 	// Load environment variables
@@ -108,13 +170,54 @@ func main() {
 		log.Println("Warning: .env file not found")
 	}
 
-	// Set JWT secret
+	// Set JWT secret, also used to sign password reset and verification tokens
+	production := os.Getenv("APP_ENV") == "production"
 	jwtSecret = []byte(os.Getenv("JWT_SECRET"))
-	if len(jwtSecret) == 0 {
-		jwtSecret = []byte("your_jwt_secret_key_change_in_production")
+	if len(jwtSecret) == 0 || string(jwtSecret) == defaultJWTSecret {
+		if production {
+			log.Fatal("JWT_SECRET must be set to a non-default value in production")
+		}
+		jwtSecret = []byte(defaultJWTSecret)
 		log.Println("Warning: Using default JWT secret")
 	}
 
+	keyring, err = loadKeyring()
+	if err != nil {
+		log.Fatalf("Failed to load JWT keys: %v", err)
+	}
+	log.Printf("Signing JWTs with %s (key %s)", keyring.Signing.Method.Alg(), keyring.Signing.ID)
+
+	// Public URL of the frontend, used for links in emails
+	appURL = strings.TrimSuffix(os.Getenv("APP_URL"), "/")
+	if appURL == "" {
+		appURL = "http://localhost:3000"
+	}
+
+	// Public URL of this API, used for links that are handled by the backend
+	apiURL = strings.TrimSuffix(os.Getenv("API_URL"), "/")
+	if apiURL == "" {
+		apiURL = "http://localhost:8080"
+	}
+
+	// Prefix of task references such as TF-42, used in commit messages
+	if prefix := os.Getenv("TASK_KEY_PREFIX"); prefix != "" {
+		taskKeyPrefix = strings.ToUpper(prefix)
+	}
+
+	// Block login until the email address is verified
+	requireEmailVerification = os.Getenv("REQUIRE_EMAIL_VERIFICATION") == "true"
+
+	mailer = newMailerFromEnv()
+	chat = newChatNotifierFromEnv()
+	git = newGitReceiverFromEnv()
+	inbox = newInboundMailboxFromEnv()
+	telegram = newTelegramBotFromEnv()
+	if telegram != nil {
+		externalChannels[channelTelegram] = telegram.queueNotification
+	}
+	externalChannels[channelEmail] = queueNotificationEmail
+	externalChannels[channelWebhook] = queueNotificationWebhook
+
 	// Connect to PostgreSQL
 	dbURL := os.Getenv("DATABASE_URL")
 	if dbURL == "" {
@@ -134,9 +237,42 @@ func main() {
 	}
 	log.Println("Connected to PostgreSQL database")
 
+	// Throttling of login and registration attempts
+	trustProxy = os.Getenv("TRUST_PROXY") == "true"
+	limiter = newLimiterFromEnv()
+
+	// Purge old read notifications in the background
+	go runNotificationRetention()
+
+	// Send notification emails and daily digests
+	go runEmailQueue()
+
+	// Deliver outgoing webhooks
+	go runWebhookDeliveries()
+
+	// Remind followers of tasks that are about to be due
+	go runDueSoonReminders()
+
+	// Send Telegram notifications, and poll for messages to the bot unless
+	// Telegram delivers them to our webhook
+	if telegram != nil {
+		go telegram.runQueue()
+		if telegram.webhookSecret == "" {
+			go telegram.runPolling()
+		}
+	}
+
+	// Create the first administrator if configured
+	if err := bootstrapAdmin(); err != nil {
+		log.Fatalf("Failed to bootstrap administrator: %v", err)
+	}
+
 	// Initialize router
 	r := mux.NewRouter()
 
+	// Public keys for services verifying our tokens
+	r.HandleFunc("/.well-known/jwks.json", jwksHandler).Methods("GET")
+
 	// API routes
 	api := r.PathPrefix("/api").Subrouter()
 	
@@ -144,28 +280,124 @@ func main() {
 	api.HandleFunc("/auth/register", registerHandler).Methods("POST")
 	api.HandleFunc("/auth/login", loginHandler).Methods("POST")
 	api.HandleFunc("/auth/me", authMiddleware(getCurrentUserHandler)).Methods("GET")
+	api.HandleFunc("/auth/me", authMiddleware(requireSession(updateProfileHandler))).Methods("PATCH")
+	api.HandleFunc("/auth/me/avatar", authMiddleware(requireSession(uploadAvatarHandler))).Methods("POST")
+	api.HandleFunc("/auth/me/avatar", authMiddleware(requireSession(deleteAvatarHandler))).Methods("DELETE")
+	api.HandleFunc("/auth/me/password", authMiddleware(requireSession(changePasswordHandler))).Methods("POST")
+	api.HandleFunc("/auth/me/notification-preferences", authMiddleware(getNotificationPreferencesHandler)).Methods("GET")
+	api.HandleFunc("/auth/me/chat-link-code", authMiddleware(requireSession(createChatLinkCodeHandler))).Methods("POST")
+	api.HandleFunc("/auth/me/chat-accounts", authMiddleware(getChatAccountsHandler)).Methods("GET")
+	api.HandleFunc("/auth/me/chat-accounts/{provider}/{externalId}", authMiddleware(requireSession(deleteChatAccountHandler))).Methods("DELETE")
+	api.HandleFunc("/auth/me/notification-preferences", authMiddleware(requireSession(updateNotificationPreferencesHandler))).Methods("PUT")
+	api.HandleFunc("/auth/me/notification-webhook", authMiddleware(getNotificationWebhookHandler)).Methods("GET")
+	api.HandleFunc("/auth/me/notification-webhook", authMiddleware(requireSession(putNotificationWebhookHandler))).Methods("PUT")
+	api.HandleFunc("/auth/me/notification-webhook", authMiddleware(requireSession(deleteNotificationWebhookHandler))).Methods("DELETE")
+	api.HandleFunc("/auth/me/export", authMiddleware(requireSession(exportMyDataHandler))).Methods("GET")
+	api.HandleFunc("/auth/password/forgot", forgotPasswordHandler).Methods("POST")
+	api.HandleFunc("/auth/password/reset", resetPasswordHandler).Methods("POST")
+	api.HandleFunc("/auth/verify", verifyEmailHandler).Methods("POST")
+	api.HandleFunc("/auth/verify/resend", authMiddleware(resendVerificationHandler)).Methods("POST")
+
+	// Personal access token routes
+	api.HandleFunc("/auth/tokens", authMiddleware(requireSession(getTokensHandler))).Methods("GET")
+	api.HandleFunc("/auth/tokens", authMiddleware(requireSession(createTokenHandler))).Methods("POST")
+	api.HandleFunc("/auth/tokens/{id}", authMiddleware(requireSession(revokeTokenHandler))).Methods("DELETE")
 	
 	// Board routes
-	api.HandleFunc("/board", authMiddleware(getBoardHandler)).Methods("GET")
+	api.HandleFunc("/board", authMiddleware(requirePermission(getBoardHandler, permBoardView))).Methods("GET")
 	
 	// Task routes
-	api.HandleFunc("/tasks", authMiddleware(createTaskHandler)).Methods("POST")
-	api.HandleFunc("/tasks/{id}", authMiddleware(getTaskHandler)).Methods("GET")
-	api.HandleFunc("/tasks/{id}", authMiddleware(updateTaskHandler)).Methods("PATCH")
-	api.HandleFunc("/tasks/{id}", authMiddleware(deleteTaskHandler)).Methods("DELETE")
+	api.HandleFunc("/tasks", authMiddleware(requirePermission(createTaskHandler, permTaskCreate))).Methods("POST")
+	api.HandleFunc("/tasks/{id}", authMiddleware(requirePermission(getTaskHandler, permBoardView))).Methods("GET")
+	api.HandleFunc("/tasks/{id}", authMiddleware(requirePermission(updateTaskHandler, permTaskEdit, permTaskMove))).Methods("PATCH")
+	api.HandleFunc("/tasks/{id}", authMiddleware(requirePermission(deleteTaskHandler, permTaskDelete))).Methods("DELETE")
+
+	api.HandleFunc("/tasks/{id}/watchers", authMiddleware(requirePermission(watchTaskHandler, permBoardView))).Methods("POST")
+	api.HandleFunc("/tasks/{id}/watchers", authMiddleware(requirePermission(unwatchTaskHandler, permBoardView))).Methods("DELETE")
+	api.HandleFunc("/tasks/{id}/mute", authMiddleware(requirePermission(muteTaskHandler, permBoardView))).Methods("POST")
+	api.HandleFunc("/tasks/{id}/mute", authMiddleware(requirePermission(unmuteTaskHandler, permBoardView))).Methods("DELETE")
+	api.HandleFunc("/tasks/{id}/emails", authMiddleware(requirePermission(getTaskEmailsHandler, permBoardView))).Methods("GET")
+	api.HandleFunc("/tasks/{id}/emails/{emailId}/raw", authMiddleware(requirePermission(getTaskEmailRawHandler, permBoardView))).Methods("GET")
+	api.HandleFunc("/tasks/{id}/emails/{emailId}/attachments/{attachmentId}", authMiddleware(requirePermission(getTaskEmailAttachmentHandler, permBoardView))).Methods("GET")
+
+	// Comment routes
+	api.HandleFunc("/tasks/{id}/comments", authMiddleware(requirePermission(createCommentHandler, permCommentCreate))).Methods("POST")
+	api.HandleFunc("/tasks/{id}/comments/{commentId}", authMiddleware(requirePermission(deleteCommentHandler, permCommentCreate, permCommentModerate))).Methods("DELETE")
 	
 	// User routes
-	api.HandleFunc("/users", authMiddleware(getUsersHandler)).Methods("GET")
+	api.HandleFunc("/users", authMiddleware(requirePermission(getUsersHandler, permUserView))).Methods("GET")
+	api.HandleFunc("/users", authMiddleware(requirePermission(createUserHandler, permUserManage))).Methods("POST")
+	api.HandleFunc("/users/{id}/avatar", getAvatarHandler).Methods("GET")
+	api.HandleFunc("/users/{id}/role", authMiddleware(requirePermission(updateUserRoleHandler, permUserManage))).Methods("PATCH")
+	api.HandleFunc("/users/{id}", authMiddleware(requirePermission(deactivateUserHandler, permUserManage))).Methods("DELETE")
+	api.HandleFunc("/users/{id}/deactivate", authMiddleware(requirePermission(deactivateUserHandler, permUserManage))).Methods("POST")
+	api.HandleFunc("/users/{id}/reactivate", authMiddleware(requirePermission(reactivateUserHandler, permUserManage))).Methods("POST")
+	api.HandleFunc("/users/{id}/erase", authMiddleware(requirePermission(eraseUserHandler, permUserManage))).Methods("POST")
+	api.HandleFunc("/users/{id}/impersonate", authMiddleware(requireSession(requirePermission(impersonateUserHandler, permUserManage)))).Methods("POST")
+	api.HandleFunc("/users/{id}/unlock", authMiddleware(requirePermission(unlockUserHandler, permUserManage))).Methods("POST")
+
+	// Role routes
+	api.HandleFunc("/permissions", authMiddleware(requirePermission(getPermissionsHandler, permRoleManage))).Methods("GET")
+	api.HandleFunc("/roles", authMiddleware(requirePermission(getRolesHandler, permRoleManage, permUserManage))).Methods("GET")
+	api.HandleFunc("/roles", authMiddleware(requirePermission(createRoleHandler, permRoleManage))).Methods("POST")
+	api.HandleFunc("/roles/{name}", authMiddleware(requirePermission(updateRoleHandler, permRoleManage))).Methods("PATCH")
+	api.HandleFunc("/roles/{name}", authMiddleware(requirePermission(deleteRoleHandler, permRoleManage))).Methods("DELETE")
+
+	// Team routes, leads can update their own team without team.manage
+	api.HandleFunc("/teams", authMiddleware(requirePermission(getTeamsHandler, permBoardView))).Methods("GET")
+	api.HandleFunc("/teams", authMiddleware(requirePermission(createTeamHandler, permTeamManage))).Methods("POST")
+	api.HandleFunc("/teams/{id}", authMiddleware(requirePermission(getTeamHandler, permBoardView))).Methods("GET")
+	api.HandleFunc("/teams/{id}", authMiddleware(updateTeamHandler)).Methods("PATCH")
+	api.HandleFunc("/teams/{id}", authMiddleware(requirePermission(deleteTeamHandler, permTeamManage))).Methods("DELETE")
+	api.HandleFunc("/teams/{id}/members/{userId}", authMiddleware(addTeamMemberHandler)).Methods("PUT")
+	api.HandleFunc("/teams/{id}/members/{userId}", authMiddleware(removeTeamMemberHandler)).Methods("DELETE")
+
+	// Registration settings and invitation routes
+	api.HandleFunc("/settings/registration", authMiddleware(requirePermission(getRegistrationSettingsHandler, permSettingsManage))).Methods("GET")
+	api.HandleFunc("/settings/registration", authMiddleware(requirePermission(updateRegistrationSettingsHandler, permSettingsManage))).Methods("PUT")
+	api.HandleFunc("/invitations", authMiddleware(requirePermission(getInvitationsHandler, permUserManage))).Methods("GET")
+	api.HandleFunc("/invitations", authMiddleware(requirePermission(createInvitationHandler, permUserManage))).Methods("POST")
+	api.HandleFunc("/invitations/{id}", authMiddleware(requirePermission(revokeInvitationHandler, permUserManage))).Methods("DELETE")
+
+	// Outgoing webhook routes
+	api.HandleFunc("/webhooks", authMiddleware(requirePermission(getWebhooksHandler, permWebhookManage))).Methods("GET")
+	api.HandleFunc("/webhooks", authMiddleware(requirePermission(createWebhookHandler, permWebhookManage))).Methods("POST")
+	api.HandleFunc("/webhooks/{id}", authMiddleware(requirePermission(getWebhookHandler, permWebhookManage))).Methods("GET")
+	api.HandleFunc("/webhooks/{id}", authMiddleware(requirePermission(updateWebhookHandler, permWebhookManage))).Methods("PATCH")
+	api.HandleFunc("/webhooks/{id}", authMiddleware(requirePermission(deleteWebhookHandler, permWebhookManage))).Methods("DELETE")
+	api.HandleFunc("/webhooks/{id}/deliveries", authMiddleware(requirePermission(getWebhookDeliveriesHandler, permWebhookManage))).Methods("GET")
+	api.HandleFunc("/webhooks/{id}/deliveries/{deliveryId}/redeliver", authMiddleware(requirePermission(redeliverWebhookHandler, permWebhookManage))).Methods("POST")
+
+	// Chat slash commands, authenticated by the chat server's signature
+	api.HandleFunc("/chat/command", chatCommandHandler).Methods("POST")
+	api.HandleFunc("/telegram/webhook", telegramWebhookHandler).Methods("POST")
+
+	// Push and merge request webhooks of GitHub, Gitea and GitLab,
+	// authenticated by the shared secret
+	api.HandleFunc("/git/webhook", gitWebhookHandler).Methods("POST")
+
+	// Raw inbound email piped in by the mail server, authenticated by the
+	// shared secret
+	api.HandleFunc("/mail/inbound", inboundMailHandler).Methods("POST")
+
+	// Audit routes
+	api.HandleFunc("/audit", authMiddleware(requirePermission(getAuditLogHandler, permAuditView))).Methods("GET")
+	api.HandleFunc("/audit/export", authMiddleware(requirePermission(exportAuditLogHandler, permAuditView))).Methods("GET")
 	
 	// Notification routes
 	api.HandleFunc("/notifications", authMiddleware(getNotificationsHandler)).Methods("GET")
+	api.HandleFunc("/notifications/unread-count", authMiddleware(getUnreadNotificationCountHandler)).Methods("GET")
+	api.HandleFunc("/notifications/read-all", authMiddleware(markAllNotificationsReadHandler)).Methods("POST")
+	api.HandleFunc("/notifications/unsubscribe", unsubscribeHandler).Methods("GET", "POST")
 	api.HandleFunc("/notifications/{id}/read", authMiddleware(markNotificationReadHandler)).Methods("PATCH")
+	api.HandleFunc("/notifications/{id}", authMiddleware(deleteNotificationHandler)).Methods("DELETE")
 
 	// CORS configuration
 	c := cors.New(cors.Options{
 		AllowedOrigins:   []string{"http://localhost:3000"},
 		AllowedMethods:   []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
-		AllowedHeaders:   []string{"Content-Type", "Authorization"},
+		AllowedHeaders:   []string{"Content-Type", "Authorization", "X-Request-ID"},
+		ExposedHeaders:   []string{"Retry-After", "X-Request-ID"},
 		AllowCredentials: true,
 	})
 
@@ -176,7 +408,7 @@ func main() {
 	}
 
 	log.Printf("Server starting on port %s...", port)
-	log.Fatal(http.ListenAndServe(":"+port, c.Handler(r)))
+	log.Fatal(http.ListenAndServe(":"+port, c.Handler(requestIDMiddleware(r))))
 }
 
 // Authentication handlers
@@ -187,46 +419,102 @@ func registerHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Check if email already exists
-	var count int
-	err := db.QueryRow("SELECT COUNT(*) FROM users WHERE email = $1", req.Email).Scan(&count)
-	if err != nil {
-		http.Error(w, "Database error", http.StatusInternalServerError)
+	// Throttle registrations per client IP
+	ipKey := "register:ip:" + clientIP(r)
+	if wait, _ := checkLimits(ipKey); wait > 0 {
+		writeRetryAfter(w, wait, "Too many registration attempts, try again later")
 		return
 	}
+	if err := limiter.Record(ipKey, registerIPPolicy); err != nil {
+		log.Printf("Error recording rate limit: %v", err)
+	}
 
-	if count > 0 {
-		http.Error(w, "Email already in use", http.StatusBadRequest)
+	req.Username = strings.TrimSpace(req.Username)
+	req.Email = strings.TrimSpace(req.Email)
+	if req.Username == "" || !strings.Contains(req.Email, "@") || req.Password == "" {
+		http.Error(w, "Username, a valid email and a password are required", http.StatusBadRequest)
 		return
 	}
 
-	// Store password directly without hashing
-	password := req.Password
-
-	// Determine role (first user is admin, rest are users)
-	role := "user"
-	err = db.QueryRow("SELECT COUNT(*) FROM users").Scan(&count)
+	// Check the registration mode
+	settings, err := loadRegistrationSettings()
 	if err != nil {
 		http.Error(w, "Database error", http.StatusInternalServerError)
 		return
 	}
+	switch {
+	case settings.Mode == registrationDisabled:
+		http.Error(w, "Registration is disabled", http.StatusForbidden)
+		return
+	case req.InviteToken != "":
+		// Checked against the invitation below
+	case settings.Mode == registrationInvite:
+		http.Error(w, "Registration is by invitation only", http.StatusForbidden)
+		return
+	case settings.Mode == registrationDomains && !emailDomainAllowed(req.Email, settings.AllowedDomains):
+		http.Error(w, "Registration is not open for this email domain", http.StatusForbidden)
+		return
+	}
 
-	if count == 0 {
-		role = "admin"
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	// New accounts are plain users unless an invitation says otherwise.
+	// Administrators are created by the bootstrap step or by other admins.
+	role := roleUser
+	verified := false
+	if req.InviteToken != "" {
+		role, err = acceptInvitation(tx, req.InviteToken, req.Email)
+		if err != nil {
+			http.Error(w, "Invalid or expired invitation", http.StatusBadRequest)
+			return
+		}
+		// The invitation was delivered to this address
+		verified = true
 	}
 
-	// Insert user
+	// Store password directly without hashing
+	password := req.Password
+
+	// Insert user, the unique constraint rejects duplicate emails
 	var userID string
-	err = db.QueryRow(
-		"INSERT INTO users (username, email, password, role, created_at) VALUES ($1, $2, $3, $4, $5) RETURNING id",
-		req.Username, req.Email, password, role, time.Now(),
+	err = tx.QueryRow(
+		"INSERT INTO users (username, email, password, role, email_verified, created_at) VALUES ($1, $2, $3, $4, $5, $6) RETURNING id",
+		req.Username, req.Email, password, role, verified, time.Now(),
 	).Scan(&userID)
 
 	if err != nil {
+		if msg, ok := uniqueViolationMessage(err); ok {
+			http.Error(w, msg, http.StatusBadRequest)
+			return
+		}
+		http.Error(w, "Error creating user", http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
 		http.Error(w, "Error creating user", http.StatusInternalServerError)
 		return
 	}
 
+	if !verified {
+		if err := sendVerificationEmail(userID, req.Email); err != nil {
+			log.Printf("Error sending verification email: %v", err)
+		}
+	}
+	recordAudit(r, userID, "auth.registered", "user", userID, map[string]interface{}{
+		"email":   req.Email,
+		"role":    role,
+		"invited": req.InviteToken != "",
+	})
+	emitWebhookEvent(userID, hookUserCreated, map[string]interface{}{
+		"user": map[string]string{"id": userID, "username": req.Username, "role": role},
+	})
+
 	w.WriteHeader(http.StatusCreated)
 	json.NewEncoder(w).Encode(map[string]string{
 		"message": "User registered successfully",
@@ -240,41 +528,66 @@ func loginHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Refuse attempts while the client or the account is backing off
+	if wait, locked := checkLimits("login:ip:"+clientIP(r), accountLimitKey(req.Email)); wait > 0 {
+		message := "Too many login attempts, try again later"
+		if locked {
+			message = "Account temporarily locked due to repeated failed logins"
+		}
+		writeRetryAfter(w, wait, message)
+		return
+	}
+
 	// Get user by email
 	var user User
 	var password string
+	var sessionVersion int
+	var avatarVersion sql.NullInt64
+	var deactivatedAt sql.NullTime
 	err := db.QueryRow(
-		"SELECT id, username, email, password, role, created_at FROM users WHERE email = $1",
+		"SELECT id, username, email, password, role, email_verified, session_version, avatar_version, deactivated_at, created_at FROM users WHERE lower(email) = lower($1)",
 		req.Email,
-	).Scan(&user.ID, &user.Username, &user.Email, &password, &user.Role, &user.CreatedAt)
+	).Scan(&user.ID, &user.Username, &user.Email, &password, &user.Role, &user.EmailVerified, &sessionVersion, &avatarVersion, &deactivatedAt, &user.CreatedAt)
 
 	if err != nil {
+		recordFailedLogin(r, req.Email, "", "unknown email")
 		http.Error(w, "Invalid email or password", http.StatusUnauthorized)
 		return
 	}
 
 	// Check password directly without hashing
 	if password != req.Password {
+		recordFailedLogin(r, req.Email, user.ID, "wrong password")
 		http.Error(w, "Invalid email or password", http.StatusUnauthorized)
 		return
 	}
 
-	// Generate JWT token
-	expirationTime := time.Now().Add(24 * time.Hour)
-	claims := &Claims{
-		UserID: user.ID,
-		Role:   user.Role,
-		StandardClaims: jwt.StandardClaims{
-			ExpiresAt: expirationTime.Unix(),
-		},
+	if deactivatedAt.Valid {
+		recordFailedLogin(r, req.Email, user.ID, "account deactivated")
+		http.Error(w, "Account is deactivated", http.StatusForbidden)
+		return
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	tokenString, err := token.SignedString(jwtSecret)
+	if requireEmailVerification && !user.EmailVerified {
+		recordFailedLogin(r, req.Email, user.ID, "email not verified")
+		http.Error(w, "Email address is not verified", http.StatusForbidden)
+		return
+	}
+
+	// A successful login clears the account's backoff
+	if err := limiter.Reset(accountLimitKey(req.Email)); err != nil {
+		log.Printf("Error resetting rate limit: %v", err)
+	}
+
+	user.AvatarURL = avatarURL(user.ID, avatarVersion)
+
+	// Generate JWT token
+	tokenString, err := issueSessionToken(user.ID, user.Role, sessionVersion)
 	if err != nil {
 		http.Error(w, "Error generating token", http.StatusInternalServerError)
 		return
 	}
+	recordAudit(r, user.ID, "auth.login", "user", user.ID, nil)
 
 	// Return token and user
 	w.Header().Set("Content-Type", "application/json")
@@ -289,22 +602,38 @@ func getCurrentUserHandler(w http.ResponseWriter, r *http.Request) {
 	userID := r.Context().Value("userId").(string)
 
 	var user User
+	var pendingEmail sql.NullString
+	var avatarVersion sql.NullInt64
 	err := db.QueryRow(
-		"SELECT id, username, email, role, created_at FROM users WHERE id = $1",
+		"SELECT id, username, email, role, email_verified, pending_email, avatar_version, locale, created_at FROM users WHERE id = $1",
 		userID,
-	).Scan(&user.ID, &user.Username, &user.Email, &user.Role, &user.CreatedAt)
+	).Scan(&user.ID, &user.Username, &user.Email, &user.Role, &user.EmailVerified, &pendingEmail, &avatarVersion, &user.Locale, &user.CreatedAt)
 
 	if err != nil {
 		http.Error(w, "User not found", http.StatusNotFound)
 		return
 	}
+	user.PendingEmail = pendingEmail.String
+	user.AvatarURL = avatarURL(user.ID, avatarVersion)
+
+	if impersonatorID, _ := r.Context().Value("impersonatorId").(string); impersonatorID != "" {
+		user.ImpersonatedBy = &Impersonator{ID: impersonatorID}
+		db.QueryRow("SELECT username FROM users WHERE id = $1", impersonatorID).Scan(&user.ImpersonatedBy.Username)
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(user)
 }
 
 func getUsersHandler(w http.ResponseWriter, r *http.Request) {
-	rows, err := db.Query("SELECT id, username, email, role, created_at FROM users")
+	// Deactivated users are hidden, e.g. from assignee pickers, unless a
+	// user manager explicitly asks for them
+	query := "SELECT id, username, email, role, email_verified, avatar_version, deactivated_at, created_at FROM users WHERE deactivated_at IS NULL"
+	if r.URL.Query().Get("includeDeactivated") == "true" && hasPermission(r, permUserManage) {
+		query = "SELECT id, username, email, role, email_verified, avatar_version, deactivated_at, created_at FROM users"
+	}
+
+	rows, err := db.Query(query + " ORDER BY username")
 	if err != nil {
 		http.Error(w, "Database error", http.StatusInternalServerError)
 		return
@@ -314,10 +643,16 @@ func getUsersHandler(w http.ResponseWriter, r *http.Request) {
 	users := []User{}
 	for rows.Next() {
 		var user User
-		if err := rows.Scan(&user.ID, &user.Username, &user.Email, &user.Role, &user.CreatedAt); err != nil {
+		var avatarVersion sql.NullInt64
+		var deactivatedAt sql.NullTime
+		if err := rows.Scan(&user.ID, &user.Username, &user.Email, &user.Role, &user.EmailVerified, &avatarVersion, &deactivatedAt, &user.CreatedAt); err != nil {
 			http.Error(w, "Error scanning users", http.StatusInternalServerError)
 			return
 		}
+		user.AvatarURL = avatarURL(user.ID, avatarVersion)
+		if deactivatedAt.Valid {
+			user.DeactivatedAt = &deactivatedAt.Time
+		}
 		users = append(users, user)
 	}
 
@@ -350,13 +685,23 @@ func getBoardHandler(w http.ResponseWriter, r *http.Request) {
 		columnOrder = append(columnOrder, col.ID)
 	}
 
-	// Get all tasks
-	taskRows, err := db.Query(`
-		SELECT t.id, t.title, t.description, t.state, t.priority, u.username as assignee, t.created_at, t.updated_at
+	// Get all tasks, optionally only those of one team or of the user's teams
+	query := `
+		SELECT t.id, t.number, t.title, t.description, t.state, t.priority, t.due_at, t.team_id, tm.name, t.created_at, t.updated_at
 		FROM tasks t
-		LEFT JOIN users u ON t.assignee = u.id
-		ORDER BY t.created_at DESC
-	`)
+		LEFT JOIN teams tm ON t.team_id = tm.id`
+	params := []interface{}{}
+	switch team := r.URL.Query().Get("team"); team {
+	case "":
+	case "mine":
+		query += " WHERE t.team_id IN (SELECT team_id FROM team_members WHERE user_id = $1)"
+		params = append(params, r.Context().Value("userId").(string))
+	default:
+		query += " WHERE t.team_id::text = $1"
+		params = append(params, team)
+	}
+
+	taskRows, err := db.Query(query+" ORDER BY t.created_at DESC", params...)
 	if err != nil {
 		http.Error(w, "Database error", http.StatusInternalServerError)
 		return
@@ -364,19 +709,24 @@ func getBoardHandler(w http.ResponseWriter, r *http.Request) {
 	defer taskRows.Close()
 
 	tasks := make(map[string]Task)
+	taskIDs := []string{}
 	for taskRows.Next() {
 		var task Task
-		var assignee sql.NullString
-		if err := taskRows.Scan(&task.ID, &task.Title, &task.Description, &task.State, &task.Priority, &assignee, &task.CreatedAt, &task.UpdatedAt); err != nil {
+		var teamID, teamName sql.NullString
+		var dueAt sql.NullTime
+		if err := taskRows.Scan(&task.ID, &task.Number, &task.Title, &task.Description, &task.State, &task.Priority, &dueAt, &teamID, &teamName, &task.CreatedAt, &task.UpdatedAt); err != nil {
 			http.Error(w, "Error scanning tasks", http.StatusInternalServerError)
 			return
 		}
-
-		if assignee.Valid {
-			task.Assignee = assignee.String
+		if dueAt.Valid {
+			task.DueAt = &dueAt.Time
 		}
+		task.TeamID = teamID.String
+		task.Team = teamName.String
+		task.Key = taskKey(task.Number)
 
 		tasks[task.ID] = task
+		taskIDs = append(taskIDs, task.ID)
 
 		// Add task ID to column
 		if col, exists := columns[task.State]; exists {
@@ -385,8 +735,17 @@ func getBoardHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	// Get assignees and watchers for all tasks at once
+	people, err := loadTaskPeople(taskIDs)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
 	// Get comments for each task
 	for taskID, task := range tasks {
+		people.apply(&task)
+
 		commentRows, err := db.Query(`
 			SELECT c.id, c.content, u.username as author, c.created_at
 			FROM comments c
@@ -415,6 +774,20 @@ func getBoardHandler(w http.ResponseWriter, r *http.Request) {
 		tasks[taskID] = task
 	}
 
+	// Resolve mentions across the whole board at once
+	taskRefs := []*Task{}
+	for taskID := range tasks {
+		task := tasks[taskID]
+		taskRefs = append(taskRefs, &task)
+	}
+	if err := applyMentions(taskRefs...); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	for _, task := range taskRefs {
+		tasks[task.ID] = *task
+	}
+
 	board := Board{
 		Tasks:       tasks,
 		Columns:     columns,
@@ -431,22 +804,32 @@ func getTaskHandler(w http.ResponseWriter, r *http.Request) {
 	taskID := vars["id"]
 
 	var task Task
-	var assignee sql.NullString
+	var teamID, teamName sql.NullString
+	var dueAt sql.NullTime
 	err := db.QueryRow(`
-		SELECT t.id, t.title, t.description, t.state, t.priority, u.username as assignee, t.created_at, t.updated_at
+		SELECT t.id, t.number, t.title, t.description, t.state, t.priority, t.due_at, t.team_id, tm.name, t.created_at, t.updated_at
 		FROM tasks t
-		LEFT JOIN users u ON t.assignee = u.id
+		LEFT JOIN teams tm ON t.team_id = tm.id
 		WHERE t.id = $1
-	`, taskID).Scan(&task.ID, &task.Title, &task.Description, &task.State, &task.Priority, &assignee, &task.CreatedAt, &task.UpdatedAt)
+	`, taskID).Scan(&task.ID, &task.Number, &task.Title, &task.Description, &task.State, &task.Priority, &dueAt, &teamID, &teamName, &task.CreatedAt, &task.UpdatedAt)
 
 	if err != nil {
 		http.Error(w, "Task not found", http.StatusNotFound)
 		return
 	}
+	if dueAt.Valid {
+		task.DueAt = &dueAt.Time
+	}
+	task.TeamID = teamID.String
+	task.Team = teamName.String
+	task.Key = taskKey(task.Number)
 
-	if assignee.Valid {
-		task.Assignee = assignee.String
+	people, err := loadTaskPeople([]string{task.ID})
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
 	}
+	people.apply(&task)
 
 	// Get comments for the task
 	commentRows, err := db.Query(`
@@ -472,18 +855,16 @@ func getTaskHandler(w http.ResponseWriter, r *http.Request) {
 		task.Comments = append(task.Comments, comment)
 	}
 
+	if err := applyMentions(&task); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(task)
 }
 
 func createTaskHandler(w http.ResponseWriter, r *http.Request) {
-	// Only admins can create tasks
-	role := r.Context().Value("role").(string)
-	if role != "admin" {
-		http.Error(w, "Unauthorized", http.StatusForbidden)
-		return
-	}
-
 	userID := r.Context().Value("userId").(string)
 
 	var task Task
@@ -493,37 +874,99 @@ func createTaskHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
 	// Insert task into database
 	now := time.Now()
-	err = db.QueryRow(`
-		INSERT INTO tasks (title, description, state, priority, assignee, created_by, created_at, updated_at)
-		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
-		RETURNING id, created_at, updated_at
-	`, task.Title, task.Description, task.State, task.Priority, task.Assignee, userID, now, now).Scan(&task.ID, &task.CreatedAt, &task.UpdatedAt)
+	err = tx.QueryRow(`
+		INSERT INTO tasks (title, description, state, priority, due_at, team_id, created_by, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, NULLIF($6, '')::uuid, $7, $8, $9)
+		RETURNING id, number, created_at, updated_at
+	`, task.Title, task.Description, task.State, task.Priority, task.DueAt, task.TeamID, userID, now, now).Scan(&task.ID, &task.Number, &task.CreatedAt, &task.UpdatedAt)
 
 	if err != nil {
 		http.Error(w, "Error creating task: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
+	task.Key = taskKey(task.Number)
 
-	// Get assignee username
-	if task.Assignee != "" {
-		var username string
-		err = db.QueryRow("SELECT username FROM users WHERE id = $1", task.Assignee).Scan(&username)
-		if err == nil {
-			task.Assignee = username
+	// assigneeId is the primary assignee, assigneeIds any further ones
+	if task.AssigneeID == "" && task.Assignee != nil {
+		task.AssigneeID = task.Assignee.ID
+	}
+	var primary *string
+	if task.AssigneeID != "" {
+		primary = &task.AssigneeID
+	}
+	var ids *[]string
+	if task.AssigneeIDs != nil {
+		ids = &task.AssigneeIDs
+	}
+	added, err := setTaskAssignees(tx, task.ID, primary, ids)
+	if err != nil {
+		if !assigneeError(w, err) {
+			http.Error(w, "Error creating task: "+err.Error(), http.StatusInternalServerError)
 		}
-		
-		// Create notification for the assignee
-		_, err = db.Exec(`
-			INSERT INTO notifications (user_id, message, read, created_at)
-			VALUES ($1, $2, false, $3)
-		`, task.Assignee, fmt.Sprintf("Вам назначена новая задача: %s", task.Title), now)
-		
-		if err != nil {
-			log.Printf("Error creating notification: %v", err)
+		return
+	}
+
+	mentioned, err := recordDescriptionMentions(tx, task.ID, task.Description)
+	if err != nil {
+		http.Error(w, "Error creating task: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Error creating task: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Create notifications for the assignees
+	assigned := NotificationEvent{
+		Type:    notifTaskAssigned,
+		TaskID:  task.ID,
+		ActorID: userID,
+		Params:  map[string]interface{}{"title": task.Title},
+	}
+	notifyUsers(added, assigned)
+	chat.notify(assigned, added)
+	notifyUsers(mentioned, NotificationEvent{
+		Type:    notifMentioned,
+		TaskID:  task.ID,
+		ActorID: userID,
+		Params:  map[string]interface{}{"title": task.Title, "source": "description"},
+	})
+
+	people, err := loadTaskPeople([]string{task.ID})
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	people.apply(&task)
+	if err := applyMentions(&task); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	// Let the whole team know about the new task
+	if task.TeamID != "" {
+		if err := db.QueryRow("SELECT name FROM teams WHERE id = $1", task.TeamID).Scan(&task.Team); err == nil {
+			notifyTeam(task.TeamID, NotificationEvent{
+				Type:    notifTeamTaskAssigned,
+				TaskID:  task.ID,
+				ActorID: userID,
+				Params:  map[string]interface{}{"title": task.Title, "team": task.Team},
+			})
 		}
 	}
+	emitWebhookEvent(userID, hookTaskCreated, map[string]interface{}{
+		"task": task,
+	})
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated)
@@ -541,20 +984,22 @@ func updateTaskHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Check if user is admin or just updating state
-	role := r.Context().Value("role").(string)
-	if role != "admin" {
-		// Regular users can only update state
-		if _, stateExists := updates["state"]; !stateExists || len(updates) > 1 {
-			http.Error(w, "Unauthorized: Regular users can only update task state", http.StatusForbidden)
+	// Moving a task and editing its other fields are separate permissions
+	for field := range updates {
+		perm := permTaskEdit
+		if field == "state" {
+			perm = permTaskMove
+		}
+		if !hasPermission(r, perm) {
+			http.Error(w, "Permission denied: "+perm+" required to update "+field, http.StatusForbidden)
 			return
 		}
 	}
 
-	// Get the current task state and assignee before update
+	// Get the current task state and team before update
 	var oldState string
-	var assigneeID sql.NullString
-	err = db.QueryRow("SELECT state, assignee FROM tasks WHERE id = $1", taskID).Scan(&oldState, &assigneeID)
+	var oldTeamID sql.NullString
+	err = db.QueryRow("SELECT state, team_id FROM tasks WHERE id = $1", taskID).Scan(&oldState, &oldTeamID)
 	if err != nil {
 		http.Error(w, "Task not found", http.StatusNotFound)
 		return
@@ -565,22 +1010,12 @@ func updateTaskHandler(w http.ResponseWriter, r *http.Request) {
 	params := []interface{}{}
 	paramCount := 1
 
-	if state, ok := updates["state"].(string); ok {
+	state, stateChanged := updates["state"].(string)
+	if stateChanged {
 		query += fmt.Sprintf(", state = $%d", paramCount)
 		params = append(params, state)
 		paramCount++
-		
-		// If state has changed, create a notification for the assignee
-		if state != oldState && assigneeID.Valid {
-			_, err = db.Exec(`
-				INSERT INTO notifications (user_id, message, read, created_at)
-				VALUES ($1, $2, false, $3)
-			`, assigneeID.String, fmt.Sprintf("Статус вашей задачи изменен на: %s", state), time.Now())
-			
-			if err != nil {
-				log.Printf("Error creating notification: %v", err)
-			}
-		}
+		stateChanged = state != oldState
 	}
 
 	if title, ok := updates["title"].(string); ok {
@@ -601,69 +1036,254 @@ func updateTaskHandler(w http.ResponseWriter, r *http.Request) {
 		paramCount++
 	}
 
-	if assignee, ok := updates["assignee"].(string); ok {
-		query += fmt.Sprintf(", assignee = $%d", paramCount)
-		params = append(params, assignee)
+	// A new due date gets its own reminder, null clears it
+	if due, ok := updates["dueAt"]; ok {
+		var dueAt *time.Time
+		if due != nil {
+			v, isString := due.(string)
+			t, err := time.Parse(time.RFC3339, v)
+			if !isString || err != nil {
+				http.Error(w, "dueAt must be an RFC 3339 time or null", http.StatusBadRequest)
+				return
+			}
+			dueAt = &t
+		}
+		query += fmt.Sprintf(", due_at = $%d, due_soon_notified = false", paramCount)
+		params = append(params, dueAt)
 		paramCount++
-		
-		// If assignee has changed, create a notification for the new assignee
-		if assignee != "" && (!assigneeID.Valid || assignee != assigneeID.String) {
-			var taskTitle string
-			err = db.QueryRow("SELECT title FROM tasks WHERE id = $1", taskID).Scan(&taskTitle)
-			if err == nil {
-				_, err = db.Exec(`
-					INSERT INTO notifications (user_id, message, read, created_at)
-					VALUES ($1, $2, false, $3)
-				`, assignee, fmt.Sprintf("Вам назначена задача: %s", taskTitle), time.Now())
-				
-				if err != nil {
-					log.Printf("Error creating notification: %v", err)
-				}
+	}
+
+	teamID, teamChanged := updates["teamId"].(string)
+	if teamChanged {
+		query += fmt.Sprintf(", team_id = NULLIF($%d, '')::uuid", paramCount)
+		params = append(params, teamID)
+		paramCount++
+		teamChanged = teamID != oldTeamID.String
+	}
+
+	// "assigneeId" sets the primary assignee, "assigneeIds" replaces all of
+	// them. A bare ID in "assignee" is still accepted for older clients.
+	var primary *string
+	if assignee, ok := updates["assigneeId"].(string); ok {
+		primary = &assignee
+	} else if assignee, ok := updates["assignee"].(string); ok {
+		primary = &assignee
+	}
+	var ids *[]string
+	if list, ok := updates["assigneeIds"].([]interface{}); ok {
+		assigneeIDs := []string{}
+		for _, v := range list {
+			id, ok := v.(string)
+			if !ok {
+				http.Error(w, "assigneeIds must be a list of user IDs", http.StatusBadRequest)
+				return
 			}
+			assigneeIDs = append(assigneeIDs, id)
 		}
+		ids = &assigneeIDs
 	}
 
-	query += fmt.Sprintf(" WHERE id = $%d RETURNING id, title, description, state, priority, assignee, created_at, updated_at", paramCount)
+	query += fmt.Sprintf(" WHERE id = $%d RETURNING id, number, title, description, state, priority, due_at, team_id, created_at, updated_at", paramCount)
 	params = append(params, taskID)
 
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
 	var task Task
-	var newAssigneeID sql.NullString
-	err = db.QueryRow(query, params...).Scan(&task.ID, &task.Title, &task.Description, &task.State, &task.Priority, &newAssigneeID, &task.CreatedAt, &task.UpdatedAt)
+	var newTeamID sql.NullString
+	var dueAt sql.NullTime
+	err = tx.QueryRow(query, params...).Scan(&task.ID, &task.Number, &task.Title, &task.Description, &task.State, &task.Priority, &dueAt, &newTeamID, &task.CreatedAt, &task.UpdatedAt)
+	if err != nil {
+		http.Error(w, "Error updating task: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if dueAt.Valid {
+		task.DueAt = &dueAt.Time
+	}
+	task.Key = taskKey(task.Number)
+
+	added, err := setTaskAssignees(tx, taskID, primary, ids)
 	if err != nil {
+		if !assigneeError(w, err) {
+			http.Error(w, "Error updating task: "+err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	// Only people mentioned for the first time hear about description edits
+	mentioned := []string{}
+	if _, ok := updates["description"].(string); ok {
+		if mentioned, err = recordDescriptionMentions(tx, taskID, task.Description); err != nil {
+			http.Error(w, "Error updating task: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
 		http.Error(w, "Error updating task: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	// Get assignee username if assignee ID exists
-	if newAssigneeID.Valid {
-		var username string
-		err = db.QueryRow("SELECT username FROM users WHERE id = $1", newAssigneeID.String).Scan(&username)
-		if err == nil {
-			task.Assignee = username
+	userID := r.Context().Value("userId").(string)
+
+	// Everyone following the task hears about state changes, new assignees
+	// get their own notification instead
+	if stateChanged {
+		moved := NotificationEvent{
+			Type:    notifTaskStateChanged,
+			TaskID:  taskID,
+			ActorID: userID,
+			Params:  map[string]interface{}{"title": task.Title, "state": state, "from": oldState},
+		}
+		notifyTaskFollowers(moved)
+		chat.notify(moved, nil)
+	}
+	assigned := NotificationEvent{
+		Type:    notifTaskAssigned,
+		TaskID:  taskID,
+		ActorID: userID,
+		Params:  map[string]interface{}{"title": task.Title},
+	}
+	notifyUsers(added, assigned)
+	chat.notify(assigned, added)
+	notifyUsers(mentioned, NotificationEvent{
+		Type:    notifMentioned,
+		TaskID:  taskID,
+		ActorID: userID,
+		Params:  map[string]interface{}{"title": task.Title, "source": "description"},
+	})
+
+	if newTeamID.Valid {
+		task.TeamID = newTeamID.String
+		if err := db.QueryRow("SELECT name FROM teams WHERE id = $1", task.TeamID).Scan(&task.Team); err == nil && teamChanged {
+			notifyTeam(task.TeamID, NotificationEvent{
+				Type:    notifTeamTaskAssigned,
+				TaskID:  taskID,
+				ActorID: userID,
+				Params:  map[string]interface{}{"title": task.Title, "team": task.Team},
+			})
 		}
 	}
 
+	people, err := loadTaskPeople([]string{task.ID})
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	people.apply(&task)
+	if err := applyMentions(&task); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	changed := []string{}
+	for field := range updates {
+		changed = append(changed, field)
+	}
+	sort.Strings(changed)
+	emitWebhookEvent(userID, hookTaskUpdated, map[string]interface{}{
+		"task":    task,
+		"changed": changed,
+	})
+
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(task)
 }
 
-func deleteTaskHandler(w http.ResponseWriter, r *http.Request) {
-	// Only admins can delete tasks
-	role := r.Context().Value("role").(string)
-	if role != "admin" {
-		http.Error(w, "Unauthorized", http.StatusForbidden)
-		return
+// errUnknownColumn is returned when a task is moved to a column that doesn't exist
+var errUnknownColumn = errors.New("Unknown column")
+
+// resolveColumn finds a column by ID or by title, ignoring case
+func resolveColumn(name string) (string, error) {
+	var id string
+	err := db.QueryRow(`
+		SELECT id FROM columns WHERE lower(id) = lower($1) OR lower(title) = lower($1)
+		ORDER BY id = $1 DESC
+		LIMIT 1
+	`, strings.TrimSpace(name)).Scan(&id)
+	if err == sql.ErrNoRows {
+		return "", errUnknownColumn
 	}
+	return id, err
+}
+
+// moveTask moves a task to another column on behalf of a user outside the
+// REST API, such as a chat bot, notifying followers and webhooks like a
+// regular update does. state must be a column ID, see resolveColumn. It
+// returns sql.ErrNoRows if the task doesn't exist.
+func moveTask(taskID, state, actorID string) (Task, error) {
+	var task Task
+	var teamID, teamName sql.NullString
+	var dueAt sql.NullTime
+	var oldState string
+	err := db.QueryRow(`
+		UPDATE tasks t SET state = $1, updated_at = NOW()
+		FROM (SELECT id, state FROM tasks WHERE id::text = $2 FOR UPDATE) old
+		WHERE t.id = old.id
+		RETURNING t.id, t.number, t.title, t.description, t.state, t.priority, t.due_at, t.team_id,
+			(SELECT name FROM teams WHERE id = t.team_id), t.created_at, t.updated_at, old.state
+	`, state, taskID).Scan(&task.ID, &task.Number, &task.Title, &task.Description, &task.State, &task.Priority, &dueAt, &teamID, &teamName, &task.CreatedAt, &task.UpdatedAt, &oldState)
+	if err != nil {
+		return task, err
+	}
+	if dueAt.Valid {
+		task.DueAt = &dueAt.Time
+	}
+	task.TeamID = teamID.String
+	task.Team = teamName.String
+	task.Key = taskKey(task.Number)
+
+	people, err := loadTaskPeople([]string{task.ID})
+	if err != nil {
+		return task, err
+	}
+	people.apply(&task)
+	if err := applyMentions(&task); err != nil {
+		return task, err
+	}
+
+	if oldState != state {
+		moved := NotificationEvent{
+			Type:    notifTaskStateChanged,
+			TaskID:  task.ID,
+			ActorID: actorID,
+			Params:  map[string]interface{}{"title": task.Title, "state": state, "from": oldState},
+		}
+		notifyTaskFollowers(moved)
+		chat.notify(moved, nil)
+		emitWebhookEvent(actorID, hookTaskUpdated, map[string]interface{}{
+			"task":    task,
+			"changed": []string{"state"},
+		})
+	}
+	return task, nil
+}
 
+func deleteTaskHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	taskID := vars["id"]
 
-	// Delete task from database
-	_, err := db.Exec("DELETE FROM tasks WHERE id = $1", taskID)
+	// Delete task from database, keeping its title for the audit log
+	var title string
+	err := db.QueryRow("DELETE FROM tasks WHERE id = $1 RETURNING title", taskID).Scan(&title)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Task not found", http.StatusNotFound)
+		return
+	}
 	if err != nil {
 		http.Error(w, "Error deleting task: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
+	recordAudit(r, "", "task.deleted", "task", taskID, map[string]interface{}{
+		"title": title,
+	})
+	emitWebhookEvent(r.Context().Value("userId").(string), hookTaskDeleted, map[string]interface{}{
+		"task": map[string]string{"id": taskID, "title": title},
+	})
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]string{
@@ -674,32 +1294,62 @@ func deleteTaskHandler(w http.ResponseWriter, r *http.Request) {
 // Notification handlers
 func getNotificationsHandler(w http.ResponseWriter, r *http.Request) {
 	userID := r.Context().Value("userId").(string)
-	
-	rows, err := db.Query(`
-		SELECT id, user_id, message, read, created_at
-		FROM notifications
-		WHERE user_id = $1
-		ORDER BY created_at DESC
-	`, userID)
-	
+	q := r.URL.Query()
+
+	// Messages are rendered in the reader's language at read time
+	renderer, err := newNotificationRenderer(userLocale(userID))
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	query := notificationSelect + " WHERE n.user_id = $1"
+	params := []interface{}{userID}
+	if q.Get("unread") == "true" {
+		query += " AND NOT n.read"
+	}
+	if v := q.Get("cursor"); v != "" {
+		createdAt, id, err := parseNotificationCursor(v)
+		if err != nil {
+			http.Error(w, "invalid cursor", http.StatusBadRequest)
+			return
+		}
+		query += " AND (n.created_at, n.id) < ($2, $3)"
+		params = append(params, createdAt, id)
+	}
+
+	limit := 50
+	if v, err := strconv.Atoi(q.Get("limit")); err == nil && v > 0 && v <= 200 {
+		limit = v
+	}
+	// Fetch one extra row to know whether there is a next page
+	query += fmt.Sprintf(" ORDER BY n.created_at DESC, n.id DESC LIMIT %d", limit+1)
+
+	rows, err := db.Query(query, params...)
 	if err != nil {
 		http.Error(w, "Database error", http.StatusInternalServerError)
 		return
 	}
 	defer rows.Close()
 	
-	notifications := []Notification{}
+	page := NotificationPage{Items: []Notification{}}
 	for rows.Next() {
-		var notification Notification
-		if err := rows.Scan(&notification.ID, &notification.UserID, &notification.Message, &notification.Read, &notification.CreatedAt); err != nil {
+		notification, err := scanNotification(rows)
+		if err != nil {
 			http.Error(w, "Error scanning notifications", http.StatusInternalServerError)
 			return
 		}
-		notifications = append(notifications, notification)
+		renderer.render(&notification)
+		page.Items = append(page.Items, notification)
+	}
+
+	if len(page.Items) > limit {
+		page.Items = page.Items[:limit]
+		page.NextCursor = notificationCursor(page.Items[limit-1])
 	}
 	
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(notifications)
+	json.NewEncoder(w).Encode(page)
 }
 
 func markNotificationReadHandler(w http.ResponseWriter, r *http.Request) {
@@ -749,34 +1399,65 @@ func authMiddleware(next http.HandlerFunc) http.HandlerFunc {
 
 		tokenString := tokenParts[1]
 
+		// Personal access tokens are looked up in the database
+		if strings.HasPrefix(tokenString, patPrefix) {
+			userID, role, scopes, err := authenticatePAT(tokenString)
+			if err != nil {
+				http.Error(w, "Invalid or expired token", http.StatusUnauthorized)
+				return
+			}
+
+			if !patScopeAllows(scopes, r) {
+				http.Error(w, "Token scope does not allow this request", http.StatusForbidden)
+				return
+			}
+
+			ctx := r.Context()
+			ctx = context.WithValue(ctx, "userId", userID)
+			ctx = context.WithValue(ctx, "role", role)
+			ctx = context.WithValue(ctx, "authMethod", "pat")
+			next(w, r.WithContext(ctx))
+			return
+		}
+
 		// Parse and validate token
 		claims := &Claims{}
-		token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
-			return jwtSecret, nil
-		})
+		token, err := keyring.parse(tokenString, claims)
 
 		if err != nil || !token.Valid {
 			http.Error(w, "Invalid or expired token", http.StatusUnauthorized)
 			return
 		}
 
+		// Tokens issued before a password change are no longer valid, and the
+		// role is read fresh so role changes apply immediately
+		var role string
+		var sessionVersion int
+		err = db.QueryRow(
+			"SELECT role, session_version FROM users WHERE id = $1 AND deactivated_at IS NULL",
+			claims.UserID,
+		).Scan(&role, &sessionVersion)
+		if err != nil || sessionVersion != claims.SessionVersion {
+			http.Error(w, "Invalid or expired token", http.StatusUnauthorized)
+			return
+		}
+
 		// Add user ID and role to request context
 		ctx := r.Context()
 		ctx = context.WithValue(ctx, "userId", claims.UserID)
-		ctx = context.WithValue(ctx, "role", claims.Role)
+		ctx = context.WithValue(ctx, "role", role)
+		ctx = context.WithValue(ctx, "authMethod", "jwt")
+		r = r.WithContext(ctx)
 
-		// Call the next handler with the updated context
-		next(w, r.WithContext(ctx))
-	}
-}
-
-func adminMiddleware(next http.HandlerFunc) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		role := r.Context().Value("role").(string)
-		if role != "admin" {
-			http.Error(w, "Admin access required", http.StatusForbidden)
-			return
+		if claims.ImpersonatorID != "" {
+			if !checkImpersonator(claims) {
+				http.Error(w, "Invalid or expired token", http.StatusUnauthorized)
+				return
+			}
+			r = withImpersonation(r, claims)
 		}
+
+		// Call the next handler with the updated context
 		next(w, r)
 	}
-}
\ No newline at end of file
+}
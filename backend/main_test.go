@@ -0,0 +1,70 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestLoginHandlerBackoff(t *testing.T) {
+	t.Setenv("JWT_ALG", "HS256")
+	ring, err := loadKeyring()
+	if err != nil {
+		t.Fatal(err)
+	}
+	savedRing := keyring
+	keyring = ring
+	t.Cleanup(func() { keyring = savedRing })
+
+	userColumns := []string{"id", "username", "email", "password", "role", "email_verified", "session_version", "avatar_version", "deactivated_at", "created_at"}
+	tests := []struct {
+		name        string
+		password    string
+		deactivated bool
+		status      int
+		attempts    int
+	}{
+		{"success clears the backoff", "secret", false, http.StatusOK, 0},
+		{"wrong password", "guess", false, http.StatusUnauthorized, 3},
+		// The password was right, but that mustn't wipe the failures
+		{"deactivated account", "secret", true, http.StatusForbidden, 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock := mockDB(t)
+			l := NewMemoryLimiter()
+			savedLimiter := limiter
+			limiter = l
+			t.Cleanup(func() { limiter = savedLimiter })
+			key := accountLimitKey("bob@example.com")
+			l.Record(key, loginAccountPolicy)
+			l.Record(key, loginAccountPolicy)
+
+			deactivatedAt := sql.NullTime{Time: time.Now(), Valid: tt.deactivated}
+			mock.ExpectQuery(`FROM users WHERE lower\(email\) = lower\(\$1\)`).WithArgs("Bob@Example.com").
+				WillReturnRows(sqlmock.NewRows(userColumns).
+					AddRow(testUserA, "bob", "bob@example.com", "secret", "user", true, 1, nil, deactivatedAt, time.Now()))
+			mock.ExpectExec(`INSERT INTO audit_log`).WillReturnResult(sqlmock.NewResult(1, 1))
+
+			body := `{"email":"Bob@Example.com","password":"` + tt.password + `"}`
+			w := httptest.NewRecorder()
+			loginHandler(w, httptest.NewRequest("POST", "/api/auth/login", strings.NewReader(body)))
+
+			if w.Code != tt.status {
+				t.Errorf("status = %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			if got := l.state[key].Attempts; got != tt.attempts {
+				t.Errorf("account attempts = %d, want %d", got, tt.attempts)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"database/sql"
+	"regexp"
+	"strings"
+	"unicode/utf16"
+
+	"github.com/lib/pq"
+)
+
+// mentionPattern matches @username where the @ doesn't follow a letter or
+// digit, so email addresses aren't taken for mentions
+var mentionPattern = regexp.MustCompile(`(?:^|[^\p{L}\p{N}_.@])(@([\p{L}\p{N}_][\p{L}\p{N}_.\-]*))`)
+
+// Mention is a resolved @username in a text. Start and End are offsets in
+// UTF-16 code units, like JavaScript string indexes, and include the @.
+type Mention struct {
+	UserID   string `json:"userId"`
+	Username string `json:"username"`
+	Start    int    `json:"start"`
+	End      int    `json:"end"`
+}
+
+// rawMention is an @username found in a text before it is resolved, with
+// byte offsets
+type rawMention struct {
+	name       string
+	start, end int
+}
+
+// parseMentions finds every @username in a text. Trailing dots and dashes are
+// left out so a mention can end a sentence.
+func parseMentions(text string) []rawMention {
+	mentions := []rawMention{}
+	for _, m := range mentionPattern.FindAllStringSubmatchIndex(text, -1) {
+		name := strings.TrimRight(text[m[4]:m[5]], ".-")
+		if name == "" {
+			continue
+		}
+		mentions = append(mentions, rawMention{name: name, start: m[2], end: m[4] + len(name)})
+	}
+	return mentions
+}
+
+// utf16Len returns the length of s in UTF-16 code units
+func utf16Len(s string) int {
+	return len(utf16.Encode([]rune(s)))
+}
+
+// mentionIndex holds the users mentioned in a set of texts, keyed by the
+// lowercased username
+type mentionIndex map[string]UserRef
+
+// loadMentionIndex resolves every @username in the texts against the users
+// table with a single query
+func loadMentionIndex(texts ...string) (mentionIndex, error) {
+	index := make(mentionIndex)
+	names := []string{}
+	seen := make(map[string]bool)
+	for _, text := range texts {
+		for _, m := range parseMentions(text) {
+			name := strings.ToLower(m.name)
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	if len(names) == 0 {
+		return index, nil
+	}
+
+	rows, err := db.Query(`
+		SELECT id, username, avatar_version FROM users
+		WHERE lower(username) = ANY($1) AND erased_at IS NULL
+	`, pq.Array(names))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var ref UserRef
+		var avatarVersion sql.NullInt64
+		if err := rows.Scan(&ref.ID, &ref.Username, &avatarVersion); err != nil {
+			return nil, err
+		}
+		ref.AvatarURL = avatarURL(ref.ID, avatarVersion)
+		index[strings.ToLower(ref.Username)] = ref
+	}
+	return index, rows.Err()
+}
+
+// spans returns the mentions in a text that refer to known users
+func (mi mentionIndex) spans(text string) []Mention {
+	spans := []Mention{}
+	for _, m := range parseMentions(text) {
+		user, ok := mi[strings.ToLower(m.name)]
+		if !ok {
+			continue
+		}
+		start := utf16Len(text[:m.start])
+		spans = append(spans, Mention{
+			UserID:   user.ID,
+			Username: user.Username,
+			Start:    start,
+			End:      start + utf16Len(text[m.start:m.end]),
+		})
+	}
+	return spans
+}
+
+// userIDs returns the distinct users mentioned in a text
+func (mi mentionIndex) userIDs(text string) []string {
+	ids := []string{}
+	seen := make(map[string]bool)
+	for _, m := range mi.spans(text) {
+		if !seen[m.UserID] {
+			seen[m.UserID] = true
+			ids = append(ids, m.UserID)
+		}
+	}
+	return ids
+}
+
+// apply fills in the mention spans of a task's description and comments
+func (mi mentionIndex) apply(task *Task) {
+	task.DescriptionMentions = mi.spans(task.Description)
+	for i := range task.Comments {
+		task.Comments[i].Mentions = mi.spans(task.Comments[i].Content)
+	}
+}
+
+// applyMentions resolves and fills in the mentions of the given tasks
+func applyMentions(tasks ...*Task) error {
+	texts := []string{}
+	for _, task := range tasks {
+		texts = append(texts, task.Description)
+		for _, c := range task.Comments {
+			texts = append(texts, c.Content)
+		}
+	}
+	index, err := loadMentionIndex(texts...)
+	if err != nil {
+		return err
+	}
+	for _, task := range tasks {
+		index.apply(task)
+	}
+	return nil
+}
+
+// recordDescriptionMentions remembers who is mentioned in a task's
+// description and returns the users mentioned there for the first time, so
+// editing a description doesn't notify the same people again
+func recordDescriptionMentions(tx *sql.Tx, taskID, description string) ([]string, error) {
+	index, err := loadMentionIndex(description)
+	if err != nil {
+		return nil, err
+	}
+	ids := index.userIDs(description)
+	added := []string{}
+	if len(ids) == 0 {
+		return added, nil
+	}
+
+	rows, err := tx.Query(`
+		INSERT INTO task_mentions (task_id, user_id)
+		SELECT $1, unnest($2::uuid[])
+		ON CONFLICT DO NOTHING
+		RETURNING user_id
+	`, taskID, pq.Array(ids))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var userID string
+		if err := rows.Scan(&userID); err != nil {
+			return nil, err
+		}
+		added = append(added, userID)
+	}
+	return added, rows.Err()
+}
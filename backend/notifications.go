@@ -0,0 +1,458 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+// Notification types
+const (
+	notifTaskAssigned     = "task.assigned"
+	notifTaskStateChanged = "task.state_changed"
+	notifTeamTaskAssigned = "team.task_assigned"
+	notifMentioned        = "task.mentioned"
+	notifCommented        = "task.commented"
+	notifDueSoon          = "task.due_soon"
+	// Notifications created before types existed only have a stored message
+	notifLegacy = "message"
+)
+
+// Supported user interface languages, the first is the default
+var supportedLocales = []string{"ru", "en"}
+
+// notificationCatalog holds the message template of every notification type
+// per locale. {name} placeholders are replaced with the notification params.
+var notificationCatalog = map[string]map[string]string{
+	"ru": {
+		notifTaskAssigned:     "Вам назначена задача: {title}",
+		notifTaskStateChanged: "Статус задачи {title} изменен на: {state}",
+		notifTeamTaskAssigned: "Вашей команде {team} назначена задача: {title}",
+		notifMentioned:        "{actor} упомянул(а) вас в задаче: {title}",
+		notifCommented:        "{actor} прокомментировал(а) задачу: {title}",
+		notifDueSoon:          "Скоро срок задачи: {title}",
+	},
+	"en": {
+		notifTaskAssigned:     "You have been assigned a task: {title}",
+		notifTaskStateChanged: "Task {title} moved to: {state}",
+		notifTeamTaskAssigned: "Your team {team} has been assigned a task: {title}",
+		notifMentioned:        "{actor} mentioned you in a task: {title}",
+		notifCommented:        "{actor} commented on a task: {title}",
+		notifDueSoon:          "Task {title} is due soon",
+	},
+}
+
+// NotificationEvent is something users get notified about. Only the type and
+// params are stored, the message is rendered in each reader's language.
+type NotificationEvent struct {
+	Type    string
+	TaskID  string
+	ActorID string
+	Params  map[string]interface{}
+}
+
+// validLocale reports whether the locale is supported
+func validLocale(locale string) bool {
+	for _, l := range supportedLocales {
+		if l == locale {
+			return true
+		}
+	}
+	return false
+}
+
+// userLocale returns the user's preferred locale, falling back to the default
+func userLocale(userID string) string {
+	var locale string
+	if err := db.QueryRow("SELECT locale FROM users WHERE id = $1", userID).Scan(&locale); err != nil || !validLocale(locale) {
+		return supportedLocales[0]
+	}
+	return locale
+}
+
+// createNotifications stores an event for every user returned by the
+// recipients query, skipping the actor, deactivated users and users who muted
+// the task, and honouring each recipient's channel preferences. Placeholders
+// in recipients start at $3.
+func createNotifications(event NotificationEvent, recipients string, args ...interface{}) {
+	prefEvent, err := preferenceEvent(event.Type)
+	if err != nil {
+		log.Printf("Error creating notifications: %v", err)
+		return
+	}
+	if event.Params == nil {
+		event.Params = map[string]interface{}{}
+	}
+	params, err := json.Marshal(event.Params)
+	if err != nil {
+		log.Printf("Error encoding notification params: %v", err)
+		return
+	}
+
+	rows, err := db.Query(`
+		SELECT u.id FROM users u
+		WHERE u.id IN (`+recipients+`) AND u.id::text <> $1 AND u.deactivated_at IS NULL
+		AND NOT EXISTS (SELECT 1 FROM task_mutes m WHERE m.user_id = u.id AND m.task_id::text = $2)
+	`, append([]interface{}{event.ActorID, event.TaskID}, args...)...)
+	if err != nil {
+		log.Printf("Error resolving %s recipients: %v", event.Type, err)
+		return
+	}
+	userIDs := []string{}
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			log.Printf("Error resolving %s recipients: %v", event.Type, err)
+			return
+		}
+		userIDs = append(userIDs, id)
+	}
+	rows.Close()
+	if len(userIDs) == 0 {
+		return
+	}
+
+	prefs, err := loadPreferences(userIDs, prefEvent)
+	if err != nil {
+		log.Printf("Error loading notification preferences: %v", err)
+		return
+	}
+
+	inApp := []string{}
+	for _, id := range userIDs {
+		if prefs[id][channelInApp] {
+			inApp = append(inApp, id)
+		}
+	}
+
+	stored := make(map[string]Notification)
+	if len(inApp) > 0 {
+		rows, err := db.Query(`
+			INSERT INTO notifications (user_id, type, task_id, actor_id, params, read, created_at)
+			SELECT unnest($1::uuid[]), $2, NULLIF($3, '')::uuid, NULLIF($4, '')::uuid, $5, false, NOW()
+			RETURNING id, user_id, created_at
+		`, pq.Array(inApp), event.Type, event.TaskID, event.ActorID, params)
+		if err != nil {
+			log.Printf("Error creating %s notifications: %v", event.Type, err)
+			return
+		}
+		for rows.Next() {
+			var n Notification
+			if err := rows.Scan(&n.ID, &n.UserID, &n.CreatedAt); err != nil {
+				log.Printf("Error creating %s notifications: %v", event.Type, err)
+				break
+			}
+			stored[n.UserID] = n
+		}
+		rows.Close()
+	}
+
+	for _, id := range userIDs {
+		n, ok := stored[id]
+		if !ok {
+			n = Notification{UserID: id, CreatedAt: time.Now()}
+		}
+		n.Type = event.Type
+		n.TaskID = event.TaskID
+		n.ActorID = event.ActorID
+		n.Params = params
+		deliverExternally(n, prefs[id])
+	}
+}
+
+// notifyUsers notifies each of the given users
+func notifyUsers(userIDs []string, event NotificationEvent) {
+	if len(userIDs) == 0 {
+		return
+	}
+	createNotifications(event, "SELECT unnest($3::uuid[])", pq.Array(userIDs))
+}
+
+// notifyTaskFollowers notifies every assignee and watcher of the event's task
+// but the given users
+func notifyTaskFollowers(event NotificationEvent, except ...string) {
+	createNotifications(event, `
+		SELECT user_id FROM task_assignees WHERE task_id = $3
+		UNION
+		SELECT user_id FROM task_watchers WHERE task_id = $3
+		EXCEPT
+		SELECT unnest($4::uuid[])`, event.TaskID, pq.Array(except))
+}
+
+// notifyTeam notifies every member of a team
+func notifyTeam(teamID string, event NotificationEvent) {
+	createNotifications(event, "SELECT user_id FROM team_members WHERE team_id = $3", teamID)
+}
+
+// notificationSelect is the column list read by scanNotification
+const notificationSelect = `
+	SELECT n.id, n.user_id, n.type, COALESCE(n.task_id::text, ''), COALESCE(n.actor_id::text, ''), COALESCE(a.username, ''), n.params, n.message, n.read, n.created_at
+	FROM notifications n
+	LEFT JOIN users a ON a.id = n.actor_id`
+
+// scanNotification reads a row selected with notificationSelect
+func scanNotification(rows *sql.Rows) (Notification, error) {
+	var n Notification
+	var params []byte
+	err := rows.Scan(&n.ID, &n.UserID, &n.Type, &n.TaskID, &n.ActorID, &n.Actor, &params, &n.Message, &n.Read, &n.CreatedAt)
+	n.Params = json.RawMessage(params)
+	return n, err
+}
+
+// notificationRenderer renders notification messages in one locale
+type notificationRenderer struct {
+	locale  string
+	columns map[string]string
+}
+
+// newNotificationRenderer loads what is needed to render messages, such as
+// column titles, which notifications only reference by ID
+func newNotificationRenderer(locale string) (*notificationRenderer, error) {
+	rows, err := db.Query("SELECT id, title FROM columns")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	columns := make(map[string]string)
+	for rows.Next() {
+		var id, title string
+		if err := rows.Scan(&id, &title); err != nil {
+			return nil, err
+		}
+		columns[id] = title
+	}
+	return &notificationRenderer{locale: locale, columns: columns}, rows.Err()
+}
+
+// render fills in the notification's message from the catalog
+func (nr *notificationRenderer) render(n *Notification) {
+	template, ok := notificationCatalog[nr.locale][n.Type]
+	if !ok {
+		// Legacy and unknown types keep their stored message
+		return
+	}
+
+	var params map[string]interface{}
+	if err := json.Unmarshal(n.Params, &params); err != nil {
+		params = map[string]interface{}{}
+	}
+	if state, ok := params["state"].(string); ok {
+		if title, ok := nr.columns[state]; ok {
+			params["state"] = title
+		}
+	}
+	params["actor"] = n.Actor
+
+	pairs := []string{}
+	for k, v := range params {
+		pairs = append(pairs, "{"+k+"}", fmt.Sprint(v))
+	}
+	n.Message = strings.NewReplacer(pairs...).Replace(template)
+}
+
+// NotificationPage is a page of notifications with the cursor of the next page
+type NotificationPage struct {
+	Items      []Notification `json:"items"`
+	NextCursor string         `json:"nextCursor,omitempty"`
+}
+
+// notificationCursor encodes the position after a notification
+func notificationCursor(n Notification) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(n.CreatedAt.Format(time.RFC3339Nano) + "," + n.ID))
+}
+
+// parseNotificationCursor decodes a cursor made by notificationCursor
+func parseNotificationCursor(cursor string) (time.Time, string, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return time.Time{}, "", err
+	}
+	parts := strings.SplitN(string(raw), ",", 2)
+	if len(parts) != 2 || !uuidPattern.MatchString(parts[1]) {
+		return time.Time{}, "", fmt.Errorf("malformed cursor")
+	}
+	createdAt, err := time.Parse(time.RFC3339Nano, parts[0])
+	return createdAt, parts[1], err
+}
+
+func getUnreadNotificationCountHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userId").(string)
+
+	var count int
+	err := db.QueryRow("SELECT COUNT(*) FROM notifications WHERE user_id = $1 AND NOT read", userID).Scan(&count)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{
+		"count": count,
+	})
+}
+
+func markAllNotificationsReadHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userId").(string)
+
+	result, err := db.Exec("UPDATE notifications SET read = true WHERE user_id = $1 AND NOT read", userID)
+	if err != nil {
+		http.Error(w, "Error updating notifications", http.StatusInternalServerError)
+		return
+	}
+	updated, _ := result.RowsAffected()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int64{
+		"updated": updated,
+	})
+}
+
+func deleteNotificationHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	notificationID := vars["id"]
+	userID := r.Context().Value("userId").(string)
+
+	result, err := db.Exec("DELETE FROM notifications WHERE id::text = $1 AND user_id = $2", notificationID, userID)
+	if err != nil {
+		http.Error(w, "Error deleting notification", http.StatusInternalServerError)
+		return
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil || rowsAffected == 0 {
+		http.Error(w, "Notification not found or not owned by user", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "Notification deleted",
+	})
+}
+
+// runDueSoonReminders periodically notifies the followers of tasks that become
+// due within DUE_SOON_WINDOW (default 24 hours). Each due date is reminded of
+// once; changing it arms the reminder again.
+func runDueSoonReminders() {
+	window := 24 * time.Hour
+	if d, err := time.ParseDuration(os.Getenv("DUE_SOON_WINDOW")); err == nil && d > 0 {
+		window = d
+	}
+
+	ticker := time.NewTicker(5 * time.Minute)
+	defer ticker.Stop()
+	for {
+		if err := remindDueSoon(window); err != nil {
+			log.Printf("Error sending due date reminders: %v", err)
+		}
+		<-ticker.C
+	}
+}
+
+// remindDueSoon notifies the followers of every task due within the window
+// that they weren't reminded of yet. Marking the tasks claims them, so
+// several server instances don't remind twice.
+func remindDueSoon(window time.Duration) error {
+	now := time.Now()
+	rows, err := db.Query(`
+		UPDATE tasks SET due_soon_notified = true
+		WHERE NOT due_soon_notified AND due_at > $1 AND due_at <= $2
+		RETURNING id, title, due_at
+	`, now, now.Add(window))
+	if err != nil {
+		return err
+	}
+	type dueTask struct {
+		id, title string
+		dueAt     time.Time
+	}
+	due := []dueTask{}
+	for rows.Next() {
+		var t dueTask
+		if err := rows.Scan(&t.id, &t.title, &t.dueAt); err != nil {
+			rows.Close()
+			return err
+		}
+		due = append(due, t)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, t := range due {
+		notifyTaskFollowers(NotificationEvent{
+			Type:   notifDueSoon,
+			TaskID: t.id,
+			Params: map[string]interface{}{"title": t.title, "dueAt": t.dueAt.UTC().Format(time.RFC3339)},
+		})
+	}
+	return nil
+}
+
+// retentionSetting reads a retention duration from the environment, falling
+// back to def when it is unset or invalid. 0 keeps rows forever.
+func retentionSetting(name string, def time.Duration) time.Duration {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		log.Printf("Invalid %s %q, using %s", name, v, def)
+		return def
+	}
+	return d
+}
+
+// runNotificationRetention periodically deletes read notifications older than
+// NOTIFICATION_RETENTION (default 30 days). Processed queued emails, finished
+// webhook deliveries and Telegram messages have their own settings, which
+// default to NOTIFICATION_RETENTION. 0 disables a purge. Unread notifications
+// are always kept, and stale rate limiter state always goes.
+func runNotificationRetention() {
+	notifications := retentionSetting("NOTIFICATION_RETENTION", 30*24*time.Hour)
+	purges := []struct {
+		what      string
+		query     string
+		retention time.Duration
+	}{
+		{"read notifications", "DELETE FROM notifications WHERE read AND created_at < $1", notifications},
+		{"queued emails", "DELETE FROM email_queue WHERE status NOT IN ('pending', 'sending') AND created_at < $1",
+			retentionSetting("EMAIL_QUEUE_RETENTION", notifications)},
+		{"webhook deliveries", "DELETE FROM webhook_deliveries WHERE status NOT IN ('pending', 'sending') AND created_at < $1",
+			retentionSetting("WEBHOOK_DELIVERY_RETENTION", notifications)},
+		{"Telegram messages", "DELETE FROM telegram_messages WHERE status NOT IN ('pending', 'sending') AND created_at < $1",
+			retentionSetting("TELEGRAM_MESSAGE_RETENTION", notifications)},
+		// Backoffs that ran out long ago, kept by RATE_LIMITER=postgres
+		{"rate limits", "DELETE FROM rate_limits WHERE blocked_until < NOW() AND last_attempt < $1", rateLimitStateTTL},
+	}
+
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for {
+		for _, p := range purges {
+			if p.retention <= 0 {
+				continue
+			}
+			result, err := db.Exec(p.query, time.Now().Add(-p.retention))
+			if err != nil {
+				log.Printf("Error purging %s: %v", p.what, err)
+			} else if n, _ := result.RowsAffected(); n > 0 {
+				log.Printf("Purged %d %s older than %s", n, p.what, p.retention)
+			}
+		}
+		<-ticker.C
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestRemindDueSoon(t *testing.T) {
+	mock := mockDB(t)
+	due := time.Now().Add(3 * time.Hour)
+
+	// Claiming the tasks marks them, so the next run skips them
+	mock.ExpectQuery(`UPDATE tasks SET due_soon_notified = true\s+WHERE NOT due_soon_notified AND due_at > \$1 AND due_at <= \$2`).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "title", "due_at"}).AddRow(testTask, "Report", due))
+	mock.ExpectQuery(`SELECT u.id FROM users u\s+WHERE u.id IN \(\s+SELECT user_id FROM task_assignees`).
+		WithArgs("", testTask, testTask, sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(testUserB))
+	mock.ExpectQuery(`SELECT user_id, channel, enabled FROM notification_preferences`).WithArgs(sqlmock.AnyArg(), eventDueSoon).
+		WillReturnRows(sqlmock.NewRows([]string{"user_id", "channel", "enabled"}))
+	mock.ExpectQuery(`INSERT INTO notifications`).WithArgs(sqlmock.AnyArg(), notifDueSoon, testTask, "", sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "created_at"}).AddRow("1", testUserB, time.Now()))
+
+	if err := remindDueSoon(24 * time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestNotifyTaskFollowersExcept(t *testing.T) {
+	mock := mockDB(t)
+
+	// The mentioned follower is left out of the comment notification
+	mock.ExpectQuery(`EXCEPT\s+SELECT unnest\(\$4::uuid\[\]\)`).
+		WithArgs(testUserA, testTask, testTask, `{"`+testUserB+`"}`).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}))
+
+	notifyTaskFollowers(NotificationEvent{Type: notifCommented, TaskID: testTask, ActorID: testUserA}, testUserB)
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
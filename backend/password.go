@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	passwordResetTTL = time.Hour
+	verifyEmailTTL   = 48 * time.Hour
+)
+
+// ForgotPasswordRequest represents the forgot password request body
+type ForgotPasswordRequest struct {
+	Email string `json:"email"`
+}
+
+// ResetPasswordRequest represents the password reset request body
+type ResetPasswordRequest struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+// VerifyEmailRequest represents the email verification request body
+type VerifyEmailRequest struct {
+	Token string `json:"token"`
+}
+
+// sendVerificationEmail issues a verification token and mails the link to the user
+func sendVerificationEmail(userID, email string) error {
+	token, err := issueUserToken(userID, tokenPurposeVerifyEmail, verifyEmailTTL)
+	if err != nil {
+		return err
+	}
+
+	link := appURL + "/verify-email?token=" + url.QueryEscape(token)
+	return mailer.Send(Mail{
+		To:      email,
+		Subject: "Подтвердите адрес электронной почты",
+		Text:    fmt.Sprintf("Чтобы подтвердить адрес, перейдите по ссылке:\n%s\n\nСсылка действительна %d ч.", link, int(verifyEmailTTL.Hours())),
+	})
+}
+
+func forgotPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	var req ForgotPasswordRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Throttle per client IP and per address, whether or not it is registered
+	ipKey := "forgot:ip:" + clientIP(r)
+	accountKey := "forgot:account:" + strings.ToLower(strings.TrimSpace(req.Email))
+	if wait, _ := checkLimits(ipKey, accountKey); wait > 0 {
+		writeRetryAfter(w, wait, "Too many password reset requests, try again later")
+		return
+	}
+	if err := limiter.Record(ipKey, forgotPasswordIPPolicy); err != nil {
+		log.Printf("Error recording rate limit: %v", err)
+	}
+	if err := limiter.Record(accountKey, forgotPasswordAccountPolicy); err != nil {
+		log.Printf("Error recording rate limit: %v", err)
+	}
+
+	// Always answer the same way so the endpoint can't be used to probe emails
+	response := map[string]string{
+		"message": "If the email is registered, a reset link has been sent",
+	}
+
+	var userID, email string
+	err := db.QueryRow("SELECT id, email FROM users WHERE lower(email) = lower($1) AND deactivated_at IS NULL", strings.TrimSpace(req.Email)).Scan(&userID, &email)
+	if err == nil {
+		token, err := issueUserToken(userID, tokenPurposePasswordReset, passwordResetTTL)
+		if err != nil {
+			log.Printf("Error issuing password reset token: %v", err)
+		} else {
+			link := appURL + "/reset-password?token=" + url.QueryEscape(token)
+			err = mailer.Send(Mail{
+				To:      email,
+				Subject: "Сброс пароля",
+				Text:    fmt.Sprintf("Чтобы задать новый пароль, перейдите по ссылке:\n%s\n\nСсылка действительна %d мин. Если вы не запрашивали сброс, проигнорируйте это письмо.", link, int(passwordResetTTL.Minutes())),
+			})
+			if err != nil {
+				log.Printf("Error sending password reset email: %v", err)
+			}
+		}
+		recordAudit(r, userID, "auth.password_reset_requested", "user", userID, nil)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func resetPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	var req ResetPasswordRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if req.Password == "" {
+		http.Error(w, "Password is required", http.StatusBadRequest)
+		return
+	}
+
+	userID, err := consumeUserToken(req.Token, tokenPurposePasswordReset)
+	if err != nil {
+		http.Error(w, "Invalid or expired token", http.StatusBadRequest)
+		return
+	}
+
+	// The link proves ownership of the address and signs out every session
+	_, err = db.Exec(
+		"UPDATE users SET password = $1, email_verified = true, session_version = session_version + 1 WHERE id = $2",
+		req.Password, userID,
+	)
+	if err != nil {
+		http.Error(w, "Error updating password", http.StatusInternalServerError)
+		return
+	}
+	recordAudit(r, userID, "auth.password_reset", "user", userID, nil)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "Password has been reset",
+	})
+}
+
+func verifyEmailHandler(w http.ResponseWriter, r *http.Request) {
+	var req VerifyEmailRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// The same endpoint confirms a changed email address
+	if userID, err := consumeUserToken(req.Token, tokenPurposeChangeEmail); err == nil {
+		email, err := confirmEmailChange(userID)
+		if err != nil {
+			if msg, ok := uniqueViolationMessage(err); ok {
+				http.Error(w, msg, http.StatusConflict)
+				return
+			}
+			http.Error(w, "Invalid or expired token", http.StatusBadRequest)
+			return
+		}
+		recordAudit(r, userID, "user.email_changed", "user", userID, map[string]interface{}{
+			"email": email,
+		})
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{
+			"message": "Email changed",
+		})
+		return
+	}
+
+	userID, err := consumeUserToken(req.Token, tokenPurposeVerifyEmail)
+	if err != nil {
+		http.Error(w, "Invalid or expired token", http.StatusBadRequest)
+		return
+	}
+
+	_, err = db.Exec("UPDATE users SET email_verified = true WHERE id = $1", userID)
+	if err != nil {
+		http.Error(w, "Error verifying email", http.StatusInternalServerError)
+		return
+	}
+	recordAudit(r, userID, "auth.email_verified", "user", userID, nil)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "Email verified",
+	})
+}
+
+func resendVerificationHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userId").(string)
+
+	var email string
+	var verified bool
+	err := db.QueryRow("SELECT email, email_verified FROM users WHERE id = $1", userID).Scan(&email, &verified)
+	if err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	if verified {
+		http.Error(w, "Email already verified", http.StatusBadRequest)
+		return
+	}
+
+	if err := sendVerificationEmail(userID, email); err != nil {
+		log.Printf("Error sending verification email: %v", err)
+		http.Error(w, "Error sending verification email", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "Verification email sent",
+	})
+}
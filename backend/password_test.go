@@ -0,0 +1,40 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestForgotPasswordHandlerThrottle(t *testing.T) {
+	mock := mockDB(t)
+	saved := limiter
+	limiter = NewMemoryLimiter()
+	t.Cleanup(func() { limiter = saved })
+
+	// Unknown addresses count too, so the limit reveals nothing
+	for i := 0; i <= forgotPasswordAccountPolicy.FreeAttempts; i++ {
+		mock.ExpectQuery(`FROM users WHERE lower\(email\) = lower\(\$1\)`).WithArgs("Nobody@Example.com").
+			WillReturnRows(sqlmock.NewRows([]string{"id", "email"}))
+		w := httptest.NewRecorder()
+		forgotPasswordHandler(w, httptest.NewRequest("POST", "/api/auth/forgot-password", strings.NewReader(`{"email":" Nobody@Example.com"}`)))
+		if w.Code != http.StatusOK {
+			t.Fatalf("request %d: status = %d, want %d", i+1, w.Code, http.StatusOK)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	forgotPasswordHandler(w, httptest.NewRequest("POST", "/api/auth/forgot-password", strings.NewReader(`{"email":"nobody@example.com"}`)))
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusTooManyRequests)
+	}
+	if w.Header().Get("Retry-After") == "" {
+		t.Error("Retry-After header missing")
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
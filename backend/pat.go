@@ -0,0 +1,234 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+// Prefix that distinguishes personal access tokens from JWTs
+const patPrefix = "tfp_"
+
+// Personal access token scopes
+const (
+	scopeRead       = "read"
+	scopeTasksWrite = "tasks:write"
+	scopeAdmin      = "admin"
+)
+
+var validScopes = map[string]bool{
+	scopeRead:       true,
+	scopeTasksWrite: true,
+	scopeAdmin:      true,
+}
+
+// PersonalAccessToken represents a user-managed API token
+type PersonalAccessToken struct {
+	ID         string     `json:"id"`
+	Name       string     `json:"name"`
+	Scopes     []string   `json:"scopes"`
+	ExpiresAt  *time.Time `json:"expiresAt"`
+	LastUsedAt *time.Time `json:"lastUsedAt"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	Token      string     `json:"token,omitempty"`
+}
+
+// CreateTokenRequest represents the create token request body
+type CreateTokenRequest struct {
+	Name          string   `json:"name"`
+	Scopes        []string `json:"scopes"`
+	ExpiresInDays int      `json:"expiresInDays"`
+}
+
+// authenticatePAT resolves a personal access token to its owner and scopes,
+// recording the time it was used
+func authenticatePAT(token string) (userID, role string, scopes []string, err error) {
+	err = db.QueryRow(`
+		UPDATE personal_access_tokens p SET last_used_at = NOW()
+		FROM users u
+		WHERE p.token_hash = $1 AND p.revoked_at IS NULL
+			AND (p.expires_at IS NULL OR p.expires_at > NOW())
+			AND u.id = p.user_id AND u.deactivated_at IS NULL
+		RETURNING u.id, u.role, p.scopes
+	`, hashToken(token)).Scan(&userID, &role, pq.Array(&scopes))
+	return
+}
+
+// patScopeAllows reports whether a request may be made with a token holding the given scopes
+func patScopeAllows(scopes []string, r *http.Request) bool {
+	has := func(scope string) bool {
+		for _, s := range scopes {
+			if s == scope {
+				return true
+			}
+		}
+		return false
+	}
+
+	if has(scopeAdmin) {
+		return true
+	}
+
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		return has(scopeRead) || has(scopeTasksWrite)
+	}
+
+	if has(scopeTasksWrite) {
+		return strings.HasPrefix(r.URL.Path, "/api/tasks") || strings.HasPrefix(r.URL.Path, "/api/notifications")
+	}
+
+	return false
+}
+
+// requireSession rejects requests authenticated with a personal access token,
+// so tokens can't be used to mint or revoke other tokens. Admins impersonating
+// a user are rejected too, these are the user's own sensitive actions.
+func requireSession(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if method, _ := r.Context().Value("authMethod").(string); method == "pat" {
+			http.Error(w, "This action requires an interactive session", http.StatusForbidden)
+			return
+		}
+		if isImpersonating(r) {
+			http.Error(w, "This action is not allowed while impersonating", http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	}
+}
+
+func getTokensHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userId").(string)
+
+	rows, err := db.Query(`
+		SELECT id, name, scopes, expires_at, last_used_at, created_at
+		FROM personal_access_tokens
+		WHERE user_id = $1 AND revoked_at IS NULL
+		ORDER BY created_at DESC
+	`, userID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	tokens := []PersonalAccessToken{}
+	for rows.Next() {
+		var token PersonalAccessToken
+		var expiresAt, lastUsedAt sql.NullTime
+		if err := rows.Scan(&token.ID, &token.Name, pq.Array(&token.Scopes), &expiresAt, &lastUsedAt, &token.CreatedAt); err != nil {
+			http.Error(w, "Error scanning tokens", http.StatusInternalServerError)
+			return
+		}
+		if expiresAt.Valid {
+			token.ExpiresAt = &expiresAt.Time
+		}
+		if lastUsedAt.Valid {
+			token.LastUsedAt = &lastUsedAt.Time
+		}
+		tokens = append(tokens, token)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tokens)
+}
+
+func createTokenHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userId").(string)
+
+	var req CreateTokenRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" {
+		http.Error(w, "Token name is required", http.StatusBadRequest)
+		return
+	}
+
+	if len(req.Scopes) == 0 {
+		req.Scopes = []string{scopeRead}
+	}
+	for _, scope := range req.Scopes {
+		if !validScopes[scope] {
+			http.Error(w, "Unknown scope: "+scope, http.StatusBadRequest)
+			return
+		}
+		if scope == scopeAdmin && !hasPermission(r, permUserManage) {
+			http.Error(w, "Only administrators can create tokens with the admin scope", http.StatusForbidden)
+			return
+		}
+	}
+
+	var expiresAt *time.Time
+	if req.ExpiresInDays > 0 {
+		t := time.Now().AddDate(0, 0, req.ExpiresInDays)
+		expiresAt = &t
+	}
+
+	raw, err := randomToken(32)
+	if err != nil {
+		http.Error(w, "Error generating token", http.StatusInternalServerError)
+		return
+	}
+	raw = patPrefix + raw
+
+	token := PersonalAccessToken{
+		Name:      req.Name,
+		Scopes:    req.Scopes,
+		ExpiresAt: expiresAt,
+		Token:     raw,
+	}
+	err = db.QueryRow(`
+		INSERT INTO personal_access_tokens (user_id, name, token_hash, scopes, expires_at)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id, created_at
+	`, userID, req.Name, hashToken(raw), pq.Array(req.Scopes), expiresAt).Scan(&token.ID, &token.CreatedAt)
+	if err != nil {
+		http.Error(w, "Error creating token", http.StatusInternalServerError)
+		return
+	}
+	recordAudit(r, "", "token.created", "token", token.ID, map[string]interface{}{
+		"name":   token.Name,
+		"scopes": token.Scopes,
+	})
+
+	// The raw token is only ever returned here
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(token)
+}
+
+func revokeTokenHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	tokenID := vars["id"]
+	userID := r.Context().Value("userId").(string)
+
+	result, err := db.Exec(`
+		UPDATE personal_access_tokens SET revoked_at = NOW()
+		WHERE id = $1 AND user_id = $2 AND revoked_at IS NULL
+	`, tokenID, userID)
+	if err != nil {
+		http.Error(w, "Error revoking token", http.StatusInternalServerError)
+		return
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil || rowsAffected == 0 {
+		http.Error(w, "Token not found", http.StatusNotFound)
+		return
+	}
+	recordAudit(r, "", "token.revoked", "token", tokenID, nil)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "Token revoked",
+	})
+}
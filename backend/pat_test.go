@@ -0,0 +1,38 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPatScopeAllows(t *testing.T) {
+	tests := []struct {
+		name   string
+		scopes []string
+		method string
+		path   string
+		want   bool
+	}{
+		{"read may get", []string{scopeRead}, "GET", "/api/tasks", true},
+		{"read may head", []string{scopeRead}, "HEAD", "/api/tasks", true},
+		{"read may not write", []string{scopeRead}, "POST", "/api/tasks", false},
+		{"tasks:write may get", []string{scopeTasksWrite}, "GET", "/api/users", true},
+		{"tasks:write may create tasks", []string{scopeTasksWrite}, "POST", "/api/tasks", true},
+		{"tasks:write may comment", []string{scopeTasksWrite}, "POST", "/api/tasks/" + testTask + "/comments", true},
+		{"tasks:write may mark notifications", []string{scopeTasksWrite}, "PATCH", "/api/notifications/1/read", true},
+		{"tasks:write may not change columns", []string{scopeTasksWrite}, "POST", "/api/columns", false},
+		{"tasks:write may not change users", []string{scopeTasksWrite}, "PATCH", "/api/auth/me", false},
+		{"admin may do anything", []string{scopeAdmin}, "DELETE", "/api/users/" + testUserB, true},
+		{"no scopes", nil, "GET", "/api/tasks", false},
+		{"unknown scope", []string{"tasks:read"}, "GET", "/api/tasks", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, tt.path, nil)
+			if got := patScopeAllows(tt.scopes, r); got != tt.want {
+				t.Errorf("patScopeAllows(%v, %s %s) = %v, want %v", tt.scopes, tt.method, tt.path, got, tt.want)
+			}
+		})
+	}
+}
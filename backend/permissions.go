@@ -0,0 +1,447 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+// Permissions that can be granted to a role
+const (
+	permBoardView       = "board.view"
+	permTaskCreate      = "task.create"
+	permTaskEdit        = "task.edit"
+	permTaskMove        = "task.move"
+	permTaskDelete      = "task.delete"
+	permCommentCreate   = "comment.create"
+	permCommentModerate = "comment.moderate"
+	permUserView        = "user.view"
+	permUserManage      = "user.manage"
+	permRoleManage      = "role.manage"
+	permTeamManage      = "team.manage"
+	permWebhookManage   = "webhook.manage"
+	permAuditView       = "audit.view"
+	permSettingsManage  = "settings.manage"
+)
+
+// allPermissions lists every permission with a short description
+var allPermissions = map[string]string{
+	permBoardView:       "View the board and tasks",
+	permTaskCreate:      "Create tasks",
+	permTaskEdit:        "Edit task title, description, priority and assignee",
+	permTaskMove:        "Move tasks between columns",
+	permTaskDelete:      "Delete tasks",
+	permCommentCreate:   "Comment on tasks",
+	permCommentModerate: "Delete other users' comments",
+	permUserView:        "List users",
+	permUserManage:      "Create users, invite, change roles and unlock accounts",
+	permRoleManage:      "Create and edit roles",
+	permTeamManage:      "Create, edit and delete any team",
+	permWebhookManage:   "Manage outgoing webhooks and view their deliveries",
+	permAuditView:       "View and export the audit log",
+	permSettingsManage:  "Change registration and other system settings",
+}
+
+// Built-in roles, which can't be deleted
+const (
+	roleAdmin = "admin"
+	roleUser  = "user"
+)
+
+// Role is a named set of permissions
+type Role struct {
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	Permissions []string `json:"permissions"`
+	Builtin     bool     `json:"builtin"`
+}
+
+// RoleRequest represents the create and update role request body
+type RoleRequest struct {
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	Permissions []string `json:"permissions"`
+}
+
+// UpdateUserRoleRequest represents the change user role request body
+type UpdateUserRoleRequest struct {
+	Role string `json:"role"`
+}
+
+var roleNamePattern = regexp.MustCompile(`^[a-z][a-z0-9_-]{1,49}$`)
+
+// roleCache keeps role permissions in memory for a short while so that
+// permission checks don't hit the database on every request
+var roleCache struct {
+	sync.Mutex
+	perms  map[string]map[string]bool
+	loaded time.Time
+}
+
+const roleCacheTTL = 30 * time.Second
+
+// rolePermissions returns the permission set of a role
+func rolePermissions(role string) (map[string]bool, error) {
+	roleCache.Lock()
+	defer roleCache.Unlock()
+
+	if roleCache.perms == nil || time.Since(roleCache.loaded) > roleCacheTTL {
+		rows, err := db.Query("SELECT name, permissions FROM roles")
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+
+		perms := make(map[string]map[string]bool)
+		for rows.Next() {
+			var name string
+			var list []string
+			if err := rows.Scan(&name, pq.Array(&list)); err != nil {
+				return nil, err
+			}
+			perms[name] = make(map[string]bool)
+			for _, p := range list {
+				perms[name][p] = true
+			}
+		}
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+
+		roleCache.perms = perms
+		roleCache.loaded = time.Now()
+	}
+
+	return roleCache.perms[role], nil
+}
+
+// invalidateRoleCache forces the next permission check to reload roles
+func invalidateRoleCache() {
+	roleCache.Lock()
+	roleCache.perms = nil
+	roleCache.Unlock()
+}
+
+// hasPermission reports whether the authenticated user's role grants the permission
+func hasPermission(r *http.Request, perm string) bool {
+	role, _ := r.Context().Value("role").(string)
+	perms, err := rolePermissions(role)
+	if err != nil {
+		return false
+	}
+	return perms[perm]
+}
+
+// canGrantRole reports whether the authenticated user holds every permission
+// of the role, so handing it out can't grant more than they have themselves
+func canGrantRole(r *http.Request, role string) (bool, error) {
+	perms, err := rolePermissions(role)
+	if err != nil {
+		return false, err
+	}
+	for perm := range perms {
+		if !hasPermission(r, perm) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// missingPermission returns the first of the permissions the authenticated
+// user doesn't hold, so a role can't be given more than they have themselves
+func missingPermission(r *http.Request, perms []string) (string, bool) {
+	for _, p := range perms {
+		if !hasPermission(r, p) {
+			return p, true
+		}
+	}
+	return "", false
+}
+
+// requirePermission allows the request if the user holds any of the given permissions.
+// It must be wrapped by authMiddleware.
+func requirePermission(next http.HandlerFunc, perms ...string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		for _, perm := range perms {
+			if hasPermission(r, perm) {
+				next(w, r)
+				return
+			}
+		}
+		http.Error(w, "Permission denied", http.StatusForbidden)
+	}
+}
+
+// validatePermissions checks that every permission is known
+func validatePermissions(perms []string) (string, bool) {
+	for _, p := range perms {
+		if _, ok := allPermissions[p]; !ok {
+			return p, false
+		}
+	}
+	return "", true
+}
+
+func getPermissionsHandler(w http.ResponseWriter, r *http.Request) {
+	names := make([]string, 0, len(allPermissions))
+	for name := range allPermissions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	permissions := []map[string]string{}
+	for _, name := range names {
+		permissions = append(permissions, map[string]string{
+			"name":        name,
+			"description": allPermissions[name],
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(permissions)
+}
+
+func getRolesHandler(w http.ResponseWriter, r *http.Request) {
+	rows, err := db.Query("SELECT name, description, permissions, builtin FROM roles ORDER BY builtin DESC, name")
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	roles := []Role{}
+	for rows.Next() {
+		var role Role
+		if err := rows.Scan(&role.Name, &role.Description, pq.Array(&role.Permissions), &role.Builtin); err != nil {
+			http.Error(w, "Error scanning roles", http.StatusInternalServerError)
+			return
+		}
+		roles = append(roles, role)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(roles)
+}
+
+func createRoleHandler(w http.ResponseWriter, r *http.Request) {
+	var req RoleRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if !roleNamePattern.MatchString(req.Name) {
+		http.Error(w, "Role name must be 2-50 lowercase letters, digits, '-' or '_'", http.StatusBadRequest)
+		return
+	}
+	if req.Permissions == nil {
+		req.Permissions = []string{}
+	}
+	if p, ok := validatePermissions(req.Permissions); !ok {
+		http.Error(w, "Unknown permission: "+p, http.StatusBadRequest)
+		return
+	}
+	if p, missing := missingPermission(r, req.Permissions); missing {
+		http.Error(w, "You can't grant a permission you don't have: "+p, http.StatusForbidden)
+		return
+	}
+
+	_, err := db.Exec(
+		"INSERT INTO roles (name, description, permissions) VALUES ($1, $2, $3)",
+		req.Name, req.Description, pq.Array(req.Permissions),
+	)
+	if err != nil {
+		if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23505" {
+			http.Error(w, "Role already exists", http.StatusConflict)
+			return
+		}
+		http.Error(w, "Error creating role", http.StatusInternalServerError)
+		return
+	}
+	invalidateRoleCache()
+	recordAudit(r, "", "role.created", "role", req.Name, map[string]interface{}{
+		"permissions": req.Permissions,
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(Role{
+		Name:        req.Name,
+		Description: req.Description,
+		Permissions: req.Permissions,
+	})
+}
+
+func updateRoleHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	name := vars["name"]
+
+	var req RoleRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// The admin role always holds every permission so nobody can lock themselves out
+	if name == roleAdmin {
+		http.Error(w, "The admin role can't be modified", http.StatusBadRequest)
+		return
+	}
+	if req.Permissions == nil {
+		req.Permissions = []string{}
+	}
+	if p, ok := validatePermissions(req.Permissions); !ok {
+		http.Error(w, "Unknown permission: "+p, http.StatusBadRequest)
+		return
+	}
+	if p, missing := missingPermission(r, req.Permissions); missing {
+		http.Error(w, "You can't grant a permission you don't have: "+p, http.StatusForbidden)
+		return
+	}
+	// Nor take permissions away from a role above the caller
+	ok, err := canGrantRole(r, name)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		http.Error(w, "You can't manage a role with permissions you don't have", http.StatusForbidden)
+		return
+	}
+
+	var role Role
+	err = db.QueryRow(`
+		UPDATE roles SET description = $1, permissions = $2
+		WHERE name = $3
+		RETURNING name, description, permissions, builtin
+	`, req.Description, pq.Array(req.Permissions), name).Scan(&role.Name, &role.Description, pq.Array(&role.Permissions), &role.Builtin)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Role not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Error updating role", http.StatusInternalServerError)
+		return
+	}
+	invalidateRoleCache()
+	recordAudit(r, "", "role.updated", "role", name, map[string]interface{}{
+		"permissions": role.Permissions,
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(role)
+}
+
+func deleteRoleHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	name := vars["name"]
+
+	var count int
+	err := db.QueryRow("SELECT COUNT(*) FROM users WHERE role = $1", name).Scan(&count)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if count > 0 {
+		http.Error(w, "Role is assigned to users", http.StatusConflict)
+		return
+	}
+
+	result, err := db.Exec("DELETE FROM roles WHERE name = $1 AND NOT builtin", name)
+	if err != nil {
+		http.Error(w, "Error deleting role", http.StatusInternalServerError)
+		return
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil || rowsAffected == 0 {
+		http.Error(w, "Role not found or built in", http.StatusNotFound)
+		return
+	}
+	invalidateRoleCache()
+	recordAudit(r, "", "role.deleted", "role", name, nil)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "Role deleted",
+	})
+}
+
+func updateUserRoleHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	userID := vars["id"]
+
+	var req UpdateUserRoleRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	req.Role = strings.TrimSpace(req.Role)
+
+	if userID == r.Context().Value("userId").(string) && req.Role != roleAdmin {
+		http.Error(w, "You can't change your own role", http.StatusBadRequest)
+		return
+	}
+
+	// Neither the new role nor the one taken away may exceed the caller's
+	var currentRole string
+	err := db.QueryRow("SELECT role FROM users WHERE id = $1", userID).Scan(&currentRole)
+	if err == sql.ErrNoRows {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	for _, role := range []string{req.Role, currentRole} {
+		ok, err := canGrantRole(r, role)
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		if !ok {
+			http.Error(w, "You can't manage a role with permissions you don't have", http.StatusForbidden)
+			return
+		}
+	}
+
+	var user User
+	var oldRole string
+	var avatarVersion sql.NullInt64
+	err = db.QueryRow(`
+		UPDATE users u SET role = $1
+		FROM (SELECT role FROM users WHERE id = $2 FOR UPDATE) old
+		WHERE u.id = $2
+		RETURNING u.id, u.username, u.email, u.role, u.email_verified, u.avatar_version, u.created_at, old.role
+	`, req.Role, userID).Scan(&user.ID, &user.Username, &user.Email, &user.Role, &user.EmailVerified, &avatarVersion, &user.CreatedAt, &oldRole)
+	if err == sql.ErrNoRows {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		// Foreign key violation: the role doesn't exist
+		if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23503" {
+			http.Error(w, "Unknown role", http.StatusBadRequest)
+			return
+		}
+		http.Error(w, "Error updating user role", http.StatusInternalServerError)
+		return
+	}
+	user.AvatarURL = avatarURL(user.ID, avatarVersion)
+	recordAudit(r, "", "user.role_changed", "user", userID, map[string]interface{}{
+		"from": oldRole,
+		"to":   user.Role,
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(user)
+}
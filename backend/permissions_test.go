@@ -0,0 +1,65 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gorilla/mux"
+)
+
+func TestRoleHandlersRefuseEscalation(t *testing.T) {
+	tests := []struct {
+		name   string
+		role   string // empty creates a role
+		body   string
+		status int
+	}{
+		{"create within own permissions", "", `{"name":"viewer","permissions":["board.view"]}`, http.StatusCreated},
+		{"create with user.manage", "", `{"name":"owner","permissions":["user.manage"]}`, http.StatusForbidden},
+		{"update within own permissions", "member", `{"permissions":["board.view","role.manage"]}`, http.StatusOK},
+		{"update adding audit.view", "member", `{"permissions":["board.view","audit.view"]}`, http.StatusForbidden},
+		{"update own role", "role-manager", `{"permissions":["role.manage","user.manage"]}`, http.StatusForbidden},
+		{"update a role above the caller", "auditor", `{"permissions":[]}`, http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock := mockDB(t)
+			// A successful change invalidates the cache, so fill it for each case
+			setRoles(t, map[string][]string{
+				"role-manager": {permRoleManage, permBoardView},
+				"member":       {permBoardView},
+				"auditor":      {permAuditView},
+			})
+			w := httptest.NewRecorder()
+			if tt.role == "" {
+				if tt.status == http.StatusCreated {
+					mock.ExpectExec(`INSERT INTO roles`).WillReturnResult(sqlmock.NewResult(0, 1))
+					mock.ExpectExec(`INSERT INTO audit_log`).WillReturnResult(sqlmock.NewResult(1, 1))
+				}
+				r := httptest.NewRequest("POST", "/api/roles", strings.NewReader(tt.body))
+				createRoleHandler(w, asUser(r, testUserA, "role-manager"))
+			} else {
+				if tt.status == http.StatusOK {
+					mock.ExpectQuery(`UPDATE roles`).WillReturnRows(
+						sqlmock.NewRows([]string{"name", "description", "permissions", "builtin"}).
+							AddRow(tt.role, "", "{board.view,role.manage}", false))
+					mock.ExpectExec(`INSERT INTO audit_log`).WillReturnResult(sqlmock.NewResult(1, 1))
+				}
+				r := httptest.NewRequest("PATCH", "/api/roles/"+tt.role, strings.NewReader(tt.body))
+				r = mux.SetURLVars(r, map[string]string{"name": tt.role})
+				updateRoleHandler(w, asUser(r, testUserA, "role-manager"))
+			}
+
+			if w.Code != tt.status {
+				t.Errorf("status = %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
@@ -0,0 +1,393 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+// Events users can set notification preferences for
+const (
+	eventAssigned     = "assigned"
+	eventStateChanged = "state_changed"
+	eventCommented    = "commented"
+	eventMentioned    = "mentioned"
+	eventDueSoon      = "due_soon"
+)
+
+// Channels notifications are delivered through
+const (
+	channelInApp    = "in_app"
+	channelEmail    = "email"
+	channelWebhook  = "webhook"
+	channelTelegram = "telegram"
+)
+
+var notificationEvents = []string{eventAssigned, eventStateChanged, eventCommented, eventMentioned, eventDueSoon}
+
+var notificationChannels = []string{channelInApp, channelEmail, channelWebhook, channelTelegram}
+
+// defaultPreferences apply until a user changes them: everything shows up in
+// the app, and direct assignments, mentions and due dates are also emailed.
+// Webhooks and Telegram only deliver once the user sets them up, so they are
+// on for everything but comments.
+var defaultPreferences = map[string]map[string]bool{
+	eventAssigned:     {channelInApp: true, channelEmail: true, channelWebhook: true, channelTelegram: true},
+	eventStateChanged: {channelInApp: true, channelWebhook: true, channelTelegram: true},
+	eventCommented:    {channelInApp: true},
+	eventMentioned:    {channelInApp: true, channelEmail: true, channelWebhook: true, channelTelegram: true},
+	eventDueSoon:      {channelInApp: true, channelEmail: true, channelWebhook: true, channelTelegram: true},
+}
+
+// notificationTypeEvents maps each notification type to its preference event
+var notificationTypeEvents = map[string]string{
+	notifTaskAssigned:     eventAssigned,
+	notifTeamTaskAssigned: eventAssigned,
+	notifTaskStateChanged: eventStateChanged,
+	notifCommented:        eventCommented,
+	notifMentioned:        eventMentioned,
+	notifDueSoon:          eventDueSoon,
+}
+
+// externalChannels deliver notifications outside the app, keyed by channel.
+// Each delivery function is registered by the feature implementing it and
+// must not deliver before notBefore, the end of the user's quiet hours.
+var externalChannels = map[string]func(n Notification, notBefore time.Time){}
+
+// Email delivery modes
+const (
+	emailModeInstant = "instant"
+	emailModeDaily   = "daily"
+)
+
+var clockPattern = regexp.MustCompile(`^([01][0-9]|2[0-3]):[0-5][0-9]$`)
+
+// QuietHours is a daily window in the user's timezone during which nothing is
+// delivered outside the app, deliveries wait until it ends. The window may
+// wrap past midnight.
+type QuietHours struct {
+	Start    string `json:"start"`
+	End      string `json:"end"`
+	Timezone string `json:"timezone"`
+}
+
+// NotificationPreferences is the full set of a user's notification settings
+type NotificationPreferences struct {
+	Events     map[string]map[string]bool `json:"events"`
+	QuietHours *QuietHours                `json:"quietHours"`
+	EmailMode  string                     `json:"emailMode"`
+}
+
+// contains reports whether the window includes the given time
+func (q *QuietHours) contains(t time.Time) bool {
+	loc, err := time.LoadLocation(q.Timezone)
+	if err != nil {
+		loc = time.UTC
+	}
+	now := t.In(loc).Format("15:04")
+	if q.Start <= q.End {
+		return now >= q.Start && now < q.End
+	}
+	return now >= q.Start || now < q.End
+}
+
+// nextEnd returns when the window ends next after t
+func (q *QuietHours) nextEnd(t time.Time) time.Time {
+	loc, err := time.LoadLocation(q.Timezone)
+	if err != nil {
+		loc = time.UTC
+	}
+	return nextClockTime(t.In(loc), q.End)
+}
+
+// nextClockTime returns the first time after t, in t's location, at which the
+// wall clock shows hhmm
+func nextClockTime(t time.Time, hhmm string) time.Time {
+	clock, err := time.Parse("15:04", hhmm)
+	if err != nil {
+		return t
+	}
+	next := time.Date(t.Year(), t.Month(), t.Day(), clock.Hour(), clock.Minute(), 0, 0, t.Location())
+	if !next.After(t) {
+		next = next.AddDate(0, 0, 1)
+	}
+	return next
+}
+
+// loadPreferences returns the preferences of several users for one event,
+// merged with the defaults
+func loadPreferences(userIDs []string, event string) (map[string]map[string]bool, error) {
+	prefs := make(map[string]map[string]bool)
+	for _, id := range userIDs {
+		prefs[id] = make(map[string]bool)
+		for channel, enabled := range defaultPreferences[event] {
+			prefs[id][channel] = enabled
+		}
+	}
+
+	rows, err := db.Query(`
+		SELECT user_id, channel, enabled FROM notification_preferences
+		WHERE user_id = ANY($1::uuid[]) AND event = $2
+	`, pq.Array(userIDs), event)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var userID, channel string
+		var enabled bool
+		if err := rows.Scan(&userID, &channel, &enabled); err != nil {
+			return nil, err
+		}
+		if prefs[userID] != nil {
+			prefs[userID][channel] = enabled
+		}
+	}
+	return prefs, rows.Err()
+}
+
+// loadQuietHours returns the user's quiet hours, or nil if they have none
+func loadQuietHours(userID string) (*QuietHours, error) {
+	var start, end sql.NullString
+	var q QuietHours
+	err := db.QueryRow(
+		"SELECT quiet_hours_start, quiet_hours_end, timezone FROM users WHERE id = $1",
+		userID,
+	).Scan(&start, &end, &q.Timezone)
+	if err != nil || !start.Valid || !end.Valid {
+		return nil, err
+	}
+	q.Start = start.String
+	q.End = end.String
+	return &q, nil
+}
+
+// quietUntil returns when the user's quiet hours end if they are in them
+// right now, or the current time otherwise
+func quietUntil(userID string) time.Time {
+	now := time.Now()
+	q, err := loadQuietHours(userID)
+	if err != nil || q == nil || !q.contains(now) {
+		return now
+	}
+	return q.nextEnd(now)
+}
+
+// loadNotificationPreferences returns all of a user's notification settings,
+// merged with the defaults
+func loadNotificationPreferences(userID string) (*NotificationPreferences, error) {
+	prefs := &NotificationPreferences{Events: make(map[string]map[string]bool)}
+	for _, event := range notificationEvents {
+		channels, err := loadPreferences([]string{userID}, event)
+		if err != nil {
+			return nil, err
+		}
+		prefs.Events[event] = make(map[string]bool)
+		for _, channel := range notificationChannels {
+			prefs.Events[event][channel] = channels[userID][channel]
+		}
+	}
+
+	quietHours, err := loadQuietHours(userID)
+	if err != nil {
+		return nil, err
+	}
+	prefs.QuietHours = quietHours
+
+	if err := db.QueryRow("SELECT email_mode FROM users WHERE id = $1", userID).Scan(&prefs.EmailMode); err != nil {
+		return nil, err
+	}
+	return prefs, nil
+}
+
+func getNotificationPreferencesHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userId").(string)
+
+	prefs, err := loadNotificationPreferences(userID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(prefs)
+}
+
+// updateNotificationPreferencesHandler stores the given preferences. Anything
+// left out keeps its current setting: events, channels, quiet hours and their
+// timezone. quietHours set to null turns quiet hours off.
+func updateNotificationPreferencesHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userId").(string)
+
+	var req struct {
+		Events     map[string]map[string]bool `json:"events"`
+		QuietHours json.RawMessage            `json:"quietHours"`
+		EmailMode  string                     `json:"emailMode"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	validEvent := make(map[string]bool)
+	for _, e := range notificationEvents {
+		validEvent[e] = true
+	}
+	validChannel := make(map[string]bool)
+	for _, c := range notificationChannels {
+		validChannel[c] = true
+	}
+	for event, channels := range req.Events {
+		if !validEvent[event] {
+			http.Error(w, "Unknown event: "+event, http.StatusBadRequest)
+			return
+		}
+		for channel := range channels {
+			if !validChannel[channel] {
+				http.Error(w, "Unknown channel: "+channel, http.StatusBadRequest)
+				return
+			}
+		}
+	}
+
+	if req.EmailMode != "" && req.EmailMode != emailModeInstant && req.EmailMode != emailModeDaily {
+		http.Error(w, "emailMode must be instant or daily", http.StatusBadRequest)
+		return
+	}
+
+	var quietHours *QuietHours
+	if len(req.QuietHours) > 0 {
+		if err := json.Unmarshal(req.QuietHours, &quietHours); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if q := quietHours; q != nil {
+		if !clockPattern.MatchString(q.Start) || !clockPattern.MatchString(q.End) || q.Start == q.End {
+			http.Error(w, "Quiet hours must be two different HH:MM times", http.StatusBadRequest)
+			return
+		}
+		if q.Timezone != "" {
+			if _, err := time.LoadLocation(q.Timezone); err != nil {
+				http.Error(w, "Unknown timezone: "+q.Timezone, http.StatusBadRequest)
+				return
+			}
+		}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	for event, channels := range req.Events {
+		for channel, enabled := range channels {
+			_, err := tx.Exec(`
+				INSERT INTO notification_preferences (user_id, event, channel, enabled) VALUES ($1, $2, $3, $4)
+				ON CONFLICT (user_id, event, channel) DO UPDATE SET enabled = EXCLUDED.enabled
+			`, userID, event, channel, enabled)
+			if err != nil {
+				http.Error(w, "Error saving preferences", http.StatusInternalServerError)
+				return
+			}
+		}
+	}
+
+	if len(req.QuietHours) > 0 {
+		var start, end interface{}
+		timezone := ""
+		if q := quietHours; q != nil {
+			start, end, timezone = q.Start, q.End, q.Timezone
+		}
+		_, err = tx.Exec(`
+			UPDATE users SET quiet_hours_start = $1, quiet_hours_end = $2, timezone = COALESCE(NULLIF($3, ''), timezone)
+			WHERE id = $4
+		`, start, end, timezone, userID)
+		if err != nil {
+			http.Error(w, "Error saving preferences", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if req.EmailMode != "" {
+		if _, err := tx.Exec("UPDATE users SET email_mode = $1 WHERE id = $2", req.EmailMode, userID); err != nil {
+			http.Error(w, "Error saving preferences", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Error saving preferences", http.StatusInternalServerError)
+		return
+	}
+
+	getNotificationPreferencesHandler(w, r)
+}
+
+// setTaskMuted mutes or unmutes notifications about a task for the current user
+func setTaskMuted(w http.ResponseWriter, r *http.Request, mute bool) {
+	vars := mux.Vars(r)
+	taskID := vars["id"]
+	userID := r.Context().Value("userId").(string)
+
+	var err error
+	if mute {
+		_, err = db.Exec("INSERT INTO task_mutes (user_id, task_id) VALUES ($1, $2) ON CONFLICT DO NOTHING", userID, taskID)
+	} else {
+		_, err = db.Exec("DELETE FROM task_mutes WHERE user_id = $1 AND task_id::text = $2", userID, taskID)
+	}
+	if err != nil {
+		if pqErr, ok := err.(*pq.Error); ok && (pqErr.Code == "23503" || pqErr.Code == "22P02") {
+			http.Error(w, "Task not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Error updating task mute", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"taskId": taskID,
+		"muted":  mute,
+	})
+}
+
+func muteTaskHandler(w http.ResponseWriter, r *http.Request) {
+	setTaskMuted(w, r, true)
+}
+
+func unmuteTaskHandler(w http.ResponseWriter, r *http.Request) {
+	setTaskMuted(w, r, false)
+}
+
+// deliverExternally hands a notification to the external channels the
+// recipient enabled, holding it back until their quiet hours are over
+func deliverExternally(n Notification, channels map[string]bool) {
+	if len(externalChannels) == 0 {
+		return
+	}
+	notBefore := quietUntil(n.UserID)
+	for channel, deliver := range externalChannels {
+		if channels[channel] {
+			deliver(n, notBefore)
+		}
+	}
+}
+
+// preferenceEvent returns the preference event of a notification type
+func preferenceEvent(notificationType string) (string, error) {
+	event, ok := notificationTypeEvents[notificationType]
+	if !ok {
+		return "", fmt.Errorf("no preference event for notification type %s", notificationType)
+	}
+	return event, nil
+}
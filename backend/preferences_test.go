@@ -0,0 +1,116 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// expectPreferencesLoaded expects the queries of getNotificationPreferencesHandler
+func expectPreferencesLoaded(mock sqlmock.Sqlmock) {
+	for range notificationEvents {
+		mock.ExpectQuery(`SELECT user_id, channel, enabled FROM notification_preferences`).
+			WillReturnRows(sqlmock.NewRows([]string{"user_id", "channel", "enabled"}))
+	}
+	mock.ExpectQuery(`SELECT quiet_hours_start, quiet_hours_end, timezone FROM users`).
+		WillReturnRows(sqlmock.NewRows([]string{"quiet_hours_start", "quiet_hours_end", "timezone"}).AddRow("22:00", "07:00", "Europe/Moscow"))
+	mock.ExpectQuery(`SELECT email_mode FROM users`).
+		WillReturnRows(sqlmock.NewRows([]string{"email_mode"}).AddRow(emailModeInstant))
+}
+
+func TestUpdateNotificationPreferencesHandler(t *testing.T) {
+	tests := []struct {
+		name   string
+		body   string
+		expect func(mock sqlmock.Sqlmock)
+		status int
+	}{
+		{
+			// Quiet hours and their timezone are left as they are
+			name: "events only",
+			body: `{"events":{"assigned":{"email":false}}}`,
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectExec(`INSERT INTO notification_preferences`).WithArgs(testUserA, eventAssigned, channelEmail, false).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectCommit()
+				expectPreferencesLoaded(mock)
+			},
+			status: http.StatusOK,
+		},
+		{
+			name: "webhook channel and due soon event",
+			body: `{"events":{"due_soon":{"webhook":false}}}`,
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectExec(`INSERT INTO notification_preferences`).WithArgs(testUserA, eventDueSoon, channelWebhook, false).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectCommit()
+				expectPreferencesLoaded(mock)
+			},
+			status: http.StatusOK,
+		},
+		{
+			name: "quiet hours keep the timezone when it's left out",
+			body: `{"quietHours":{"start":"23:00","end":"08:00"}}`,
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectExec(`UPDATE users SET quiet_hours_start`).WithArgs("23:00", "08:00", "", testUserA).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectCommit()
+				expectPreferencesLoaded(mock)
+			},
+			status: http.StatusOK,
+		},
+		{
+			name: "null turns quiet hours off",
+			body: `{"quietHours":null}`,
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectExec(`UPDATE users SET quiet_hours_start`).WithArgs(nil, nil, "", testUserA).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectCommit()
+				expectPreferencesLoaded(mock)
+			},
+			status: http.StatusOK,
+		},
+		{
+			name:   "unknown channel",
+			body:   `{"events":{"assigned":{"sms":true}}}`,
+			status: http.StatusBadRequest,
+		},
+		{
+			name:   "unknown event",
+			body:   `{"events":{"archived":{"email":true}}}`,
+			status: http.StatusBadRequest,
+		},
+		{
+			name:   "bad timezone",
+			body:   `{"quietHours":{"start":"23:00","end":"08:00","timezone":"Mars/Olympus"}}`,
+			status: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock := mockDB(t)
+			if tt.expect != nil {
+				tt.expect(mock)
+			}
+
+			r := httptest.NewRequest("PUT", "/api/auth/me/notification-preferences", strings.NewReader(tt.body))
+			w := httptest.NewRecorder()
+			updateNotificationPreferencesHandler(w, asUser(r, testUserA, "member"))
+
+			if w.Code != tt.status {
+				t.Errorf("status = %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
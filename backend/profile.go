@@ -0,0 +1,276 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/lib/pq"
+)
+
+const tokenPurposeChangeEmail = "change_email"
+
+// UpdateProfileRequest represents the profile update request body.
+// Changing the email requires the current password.
+type UpdateProfileRequest struct {
+	Username        *string `json:"username"`
+	Email           *string `json:"email"`
+	Locale          *string `json:"locale"`
+	CurrentPassword string  `json:"currentPassword"`
+}
+
+// ChangePasswordRequest represents the password change request body
+type ChangePasswordRequest struct {
+	CurrentPassword string `json:"currentPassword"`
+	NewPassword     string `json:"newPassword"`
+}
+
+// issueSessionToken signs a JWT for the user carrying their current session version
+func issueSessionToken(userID, role string, sessionVersion int) (string, error) {
+	claims := &Claims{
+		UserID:         userID,
+		Role:           role,
+		SessionVersion: sessionVersion,
+		StandardClaims: jwt.StandardClaims{
+			IssuedAt:  time.Now().Unix(),
+			ExpiresAt: time.Now().Add(24 * time.Hour).Unix(),
+		},
+	}
+	return keyring.sign(claims)
+}
+
+// uniqueViolationMessage translates a unique constraint violation on users
+// into a user-facing message
+func uniqueViolationMessage(err error) (string, bool) {
+	pqErr, ok := err.(*pq.Error)
+	if !ok || pqErr.Code != "23505" {
+		return "", false
+	}
+	if strings.Contains(pqErr.Constraint, "username") {
+		return "Username already taken", true
+	}
+	return "Email already in use", true
+}
+
+// checkPassword compares the user's stored password
+func checkPassword(userID, password string) (bool, error) {
+	var stored string
+	err := db.QueryRow("SELECT password FROM users WHERE id = $1", userID).Scan(&stored)
+	if err != nil {
+		return false, err
+	}
+	return stored == password, nil
+}
+
+func updateProfileHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userId").(string)
+
+	var req UpdateProfileRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var current User
+	err := db.QueryRow("SELECT username, email FROM users WHERE id = $1", userID).Scan(&current.Username, &current.Email)
+	if err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	// Validate every field before writing any, so a bad request changes nothing
+	var username, email string
+	if req.Username != nil {
+		username = strings.TrimSpace(*req.Username)
+		if username == "" || len(username) > 255 {
+			http.Error(w, "Username must be 1-255 characters", http.StatusBadRequest)
+			return
+		}
+		if username == current.Username {
+			username = ""
+		}
+	}
+
+	if req.Locale != nil && !validLocale(*req.Locale) {
+		http.Error(w, "Unsupported locale, use one of: "+strings.Join(supportedLocales, ", "), http.StatusBadRequest)
+		return
+	}
+
+	if req.Email != nil {
+		email = strings.TrimSpace(*req.Email)
+		if !strings.Contains(email, "@") {
+			http.Error(w, "A valid email is required", http.StatusBadRequest)
+			return
+		}
+		if strings.EqualFold(email, current.Email) {
+			email = ""
+		}
+	}
+	if email != "" {
+		ok, err := checkPassword(userID, req.CurrentPassword)
+		if err != nil || !ok {
+			http.Error(w, "Current password is incorrect", http.StatusForbidden)
+			return
+		}
+
+		// Check early so the user gets an immediate answer; the unique
+		// constraint still guards the final swap on verification
+		var taken bool
+		err = db.QueryRow("SELECT EXISTS (SELECT 1 FROM users WHERE lower(email) = lower($1))", email).Scan(&taken)
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		if taken {
+			http.Error(w, "Email already in use", http.StatusConflict)
+			return
+		}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	if username != "" {
+		if _, err := tx.Exec("UPDATE users SET username = $1 WHERE id = $2", username, userID); err != nil {
+			if msg, ok := uniqueViolationMessage(err); ok {
+				http.Error(w, msg, http.StatusConflict)
+				return
+			}
+			http.Error(w, "Error updating profile", http.StatusInternalServerError)
+			return
+		}
+	}
+	if req.Locale != nil {
+		if _, err := tx.Exec("UPDATE users SET locale = $1 WHERE id = $2", *req.Locale, userID); err != nil {
+			http.Error(w, "Error updating profile", http.StatusInternalServerError)
+			return
+		}
+	}
+	// The new address only takes effect once it has been verified
+	if email != "" {
+		if _, err := tx.Exec("UPDATE users SET pending_email = $1 WHERE id = $2", email, userID); err != nil {
+			http.Error(w, "Error updating profile", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Error updating profile", http.StatusInternalServerError)
+		return
+	}
+
+	if username != "" {
+		recordAudit(r, "", "user.username_changed", "user", userID, map[string]interface{}{
+			"from": current.Username,
+			"to":   username,
+		})
+	}
+	if email != "" {
+		if err := sendEmailChangeVerification(userID, current.Email, email); err != nil {
+			log.Printf("Error sending email change verification: %v", err)
+		}
+		recordAudit(r, "", "user.email_change_requested", "user", userID, map[string]interface{}{
+			"from": current.Email,
+			"to":   email,
+		})
+	}
+
+	getCurrentUserHandler(w, r)
+}
+
+// sendEmailChangeVerification mails a confirmation link to the new address and
+// a heads-up to the old one
+func sendEmailChangeVerification(userID, oldEmail, newEmail string) error {
+	token, err := issueUserToken(userID, tokenPurposeChangeEmail, verifyEmailTTL)
+	if err != nil {
+		return err
+	}
+
+	err = mailer.Send(Mail{
+		To:      oldEmail,
+		Subject: "Изменение адреса электронной почты",
+		Text:    fmt.Sprintf("Для вашей учётной записи запрошена смена адреса на %s. Если это были не вы, смените пароль.", newEmail),
+	})
+	if err != nil {
+		log.Printf("Error notifying old email address: %v", err)
+	}
+
+	link := appURL + "/verify-email?token=" + url.QueryEscape(token)
+	return mailer.Send(Mail{
+		To:      newEmail,
+		Subject: "Подтвердите новый адрес электронной почты",
+		Text:    fmt.Sprintf("Чтобы подтвердить новый адрес, перейдите по ссылке:\n%s\n\nСсылка действительна %d ч.", link, int(verifyEmailTTL.Hours())),
+	})
+}
+
+// confirmEmailChange swaps in the pending email once its token is verified
+func confirmEmailChange(userID string) (string, error) {
+	var email string
+	err := db.QueryRow(`
+		UPDATE users SET email = pending_email, pending_email = NULL, email_verified = true
+		WHERE id = $1 AND pending_email IS NOT NULL
+		RETURNING email
+	`, userID).Scan(&email)
+	if err == sql.ErrNoRows {
+		return "", errInvalidToken
+	}
+	return email, err
+}
+
+func changePasswordHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userId").(string)
+
+	var req ChangePasswordRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if req.NewPassword == "" {
+		http.Error(w, "New password is required", http.StatusBadRequest)
+		return
+	}
+
+	ok, err := checkPassword(userID, req.CurrentPassword)
+	if err != nil || !ok {
+		http.Error(w, "Current password is incorrect", http.StatusForbidden)
+		return
+	}
+
+	// Bumping the session version invalidates every JWT issued so far,
+	// the caller gets a fresh token to stay signed in
+	var role string
+	var sessionVersion int
+	err = db.QueryRow(`
+		UPDATE users SET password = $1, session_version = session_version + 1
+		WHERE id = $2
+		RETURNING role, session_version
+	`, req.NewPassword, userID).Scan(&role, &sessionVersion)
+	if err != nil {
+		http.Error(w, "Error updating password", http.StatusInternalServerError)
+		return
+	}
+	recordAudit(r, "", "auth.password_changed", "user", userID, nil)
+
+	tokenString, err := issueSessionToken(userID, role, sessionVersion)
+	if err != nil {
+		http.Error(w, "Error generating token", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "Password changed, other sessions have been signed out",
+		"token":   tokenString,
+	})
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestUpdateProfileHandlerValidatesFirst(t *testing.T) {
+	tests := []struct {
+		name          string
+		body          string
+		checkPassword bool
+		status        int
+	}{
+		{"invalid email", `{"username":"bob2","email":"nope"}`, false, http.StatusBadRequest},
+		{"invalid locale", `{"username":"bob2","locale":"xx"}`, false, http.StatusBadRequest},
+		{"wrong password", `{"username":"bob2","email":"new@example.com","currentPassword":"guess"}`, true, http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock := mockDB(t)
+			mock.ExpectQuery(`SELECT username, email FROM users`).WithArgs(testUserA).
+				WillReturnRows(sqlmock.NewRows([]string{"username", "email"}).AddRow("bob", "bob@example.com"))
+			if tt.checkPassword {
+				mock.ExpectQuery(`SELECT password FROM users`).WithArgs(testUserA).
+					WillReturnRows(sqlmock.NewRows([]string{"password"}).AddRow("secret"))
+			}
+
+			// Nothing is written, the username included
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest("PATCH", "/api/auth/me", strings.NewReader(tt.body))
+			updateProfileHandler(w, asUser(r, testUserA, "user"))
+
+			if w.Code != tt.status {
+				t.Errorf("status = %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestUpdateProfileHandlerOneTransaction(t *testing.T) {
+	mock := mockDB(t)
+	saved := mailer
+	mailer = &recordingMailer{}
+	t.Cleanup(func() { mailer = saved })
+
+	mock.ExpectQuery(`SELECT username, email FROM users`).WithArgs(testUserA).
+		WillReturnRows(sqlmock.NewRows([]string{"username", "email"}).AddRow("bob", "bob@example.com"))
+	mock.ExpectQuery(`SELECT password FROM users`).WithArgs(testUserA).
+		WillReturnRows(sqlmock.NewRows([]string{"password"}).AddRow("secret"))
+	mock.ExpectQuery(`SELECT EXISTS`).WithArgs("new@example.com").
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+	mock.ExpectBegin()
+	mock.ExpectExec(`UPDATE users SET username`).WithArgs("bob2", testUserA).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(`UPDATE users SET pending_email`).WithArgs("new@example.com", testUserA).
+		WillReturnError(sqlmock.ErrCancelled)
+	mock.ExpectRollback()
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("PATCH", "/api/auth/me", strings.NewReader(`{"username":"bob2","email":"new@example.com","currentPassword":"secret"}`))
+	updateProfileHandler(w, asUser(r, testUserA, "user"))
+
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusInternalServerError)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
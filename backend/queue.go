@@ -0,0 +1,41 @@
+package main
+
+import (
+	"database/sql"
+	"time"
+)
+
+// The outgoing queues (notification emails, webhook deliveries and Telegram
+// messages) are worked the same way. Due rows are claimed with a lease and
+// the claim is committed before anything is sent, so several server instances
+// can share a queue, no lock is held while waiting on the remote side and a
+// database error can't undo the record of what was already sent. Rows whose
+// lease ran out because the instance sending them died are claimed again,
+// and so are rows whose outcome couldn't be recorded.
+
+// claimDue runs a claim query, an UPDATE ... RETURNING that marks the due
+// rows 'sending' until $1, and scans each claimed row
+func claimDue(query string, lease time.Duration, scan func(rows *sql.Rows) error) error {
+	rows, err := db.Query(query, time.Now().Add(lease))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		if err := scan(rows); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// retryDelay is the wait before the next attempt, doubling from base with
+// every attempt made up to max
+func retryDelay(base, max time.Duration, attempts int) time.Duration {
+	delay := base << uint(attempts-1)
+	if delay > max || delay <= 0 {
+		return max
+	}
+	return delay
+}
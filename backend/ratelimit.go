@@ -0,0 +1,333 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// LimitPolicy describes how quickly a key is throttled
+type LimitPolicy struct {
+	FreeAttempts    int           // attempts allowed before any delay
+	BaseDelay       time.Duration // delay after the first attempt over the limit, doubled on each further one
+	MaxDelay        time.Duration
+	LockoutAfter    int // lock the key after this many attempts, 0 disables lockout
+	LockoutDuration time.Duration
+	Window          time.Duration // attempts older than this are forgotten
+}
+
+// limitState is the per-key state shared by the limiter implementations
+type limitState struct {
+	Attempts     int
+	LastAttempt  time.Time
+	BlockedUntil time.Time
+	Locked       bool
+}
+
+// next applies one more attempt to the state according to the policy
+func (s limitState) next(p LimitPolicy, now time.Time) limitState {
+	// Start over once the window has passed or a lockout has been served
+	if !now.Before(s.BlockedUntil) && (s.Locked || now.Sub(s.LastAttempt) > p.Window) {
+		s = limitState{}
+	}
+
+	s.Attempts++
+	s.LastAttempt = now
+
+	if p.LockoutAfter > 0 && s.Attempts >= p.LockoutAfter {
+		s.Locked = true
+		s.BlockedUntil = now.Add(p.LockoutDuration)
+		return s
+	}
+
+	if s.Attempts > p.FreeAttempts {
+		delay := p.MaxDelay
+		if n := s.Attempts - p.FreeAttempts - 1; n < 30 {
+			if d := p.BaseDelay << uint(n); d < delay {
+				delay = d
+			}
+		}
+		s.BlockedUntil = now.Add(delay)
+	}
+	return s
+}
+
+// RateLimiter throttles repeated attempts per key with exponential backoff
+type RateLimiter interface {
+	// Blocked returns how long the key must wait before its next attempt
+	// and whether it is locked out rather than just delayed
+	Blocked(key string) (time.Duration, bool, error)
+	// Record registers an attempt against the key
+	Record(key string, p LimitPolicy) error
+	// Reset forgets all attempts for the key
+	Reset(key string) error
+}
+
+var limiter RateLimiter
+
+var (
+	loginIPPolicy = LimitPolicy{
+		FreeAttempts: 20,
+		BaseDelay:    time.Second,
+		MaxDelay:     5 * time.Minute,
+		Window:       15 * time.Minute,
+	}
+	loginAccountPolicy = LimitPolicy{
+		FreeAttempts:    3,
+		BaseDelay:       time.Second,
+		MaxDelay:        15 * time.Minute,
+		LockoutAfter:    10,
+		LockoutDuration: 30 * time.Minute,
+		Window:          time.Hour,
+	}
+	registerIPPolicy = LimitPolicy{
+		FreeAttempts: 5,
+		BaseDelay:    time.Minute,
+		MaxDelay:     time.Hour,
+		Window:       time.Hour,
+	}
+	// Reset requests send mail, so they are throttled per address as well
+	forgotPasswordIPPolicy = LimitPolicy{
+		FreeAttempts: 10,
+		BaseDelay:    time.Minute,
+		MaxDelay:     time.Hour,
+		Window:       time.Hour,
+	}
+	forgotPasswordAccountPolicy = LimitPolicy{
+		FreeAttempts: 3,
+		BaseDelay:    5 * time.Minute,
+		MaxDelay:     time.Hour,
+		Window:       time.Hour,
+	}
+)
+
+// rateLimitStateTTL is how long rate limiter state is kept after the last
+// attempt; it's longer than the window of any policy
+const rateLimitStateTTL = 24 * time.Hour
+
+// newLimiterFromEnv builds the limiter selected by RATE_LIMITER ("memory" or "postgres")
+// and applies the lockout settings from the environment
+func newLimiterFromEnv() RateLimiter {
+	if n, err := strconv.Atoi(os.Getenv("LOGIN_LOCKOUT_THRESHOLD")); err == nil {
+		loginAccountPolicy.LockoutAfter = n
+	}
+	if d, err := time.ParseDuration(os.Getenv("LOGIN_LOCKOUT_DURATION")); err == nil {
+		loginAccountPolicy.LockoutDuration = d
+	}
+
+	if os.Getenv("RATE_LIMITER") == "postgres" {
+		return &PostgresLimiter{db: db}
+	}
+	return NewMemoryLimiter()
+}
+
+// MemoryLimiter keeps limiter state in process memory. It is the default and
+// is only suitable for a single instance.
+type MemoryLimiter struct {
+	mu    sync.Mutex
+	state map[string]limitState
+}
+
+func NewMemoryLimiter() *MemoryLimiter {
+	return &MemoryLimiter{state: make(map[string]limitState)}
+}
+
+func (l *MemoryLimiter) Blocked(key string) (time.Duration, bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	s := l.state[key]
+	wait := time.Until(s.BlockedUntil)
+	if wait <= 0 {
+		return 0, false, nil
+	}
+	return wait, s.Locked, nil
+}
+
+func (l *MemoryLimiter) Record(key string, p LimitPolicy) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.state[key] = l.state[key].next(p, now)
+
+	// Drop stale keys so the map doesn't grow without bound
+	if len(l.state) > 10000 {
+		for k, s := range l.state {
+			if now.Sub(s.LastAttempt) > 24*time.Hour && now.After(s.BlockedUntil) {
+				delete(l.state, k)
+			}
+		}
+	}
+	return nil
+}
+
+func (l *MemoryLimiter) Reset(key string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	delete(l.state, key)
+	return nil
+}
+
+// PostgresLimiter stores limiter state in the rate_limits table so that
+// all instances of the backend share it
+type PostgresLimiter struct {
+	db *sql.DB
+}
+
+func (l *PostgresLimiter) Blocked(key string) (time.Duration, bool, error) {
+	var blockedUntil time.Time
+	var locked bool
+	err := l.db.QueryRow("SELECT blocked_until, locked FROM rate_limits WHERE key = $1", key).Scan(&blockedUntil, &locked)
+	if err == sql.ErrNoRows {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+
+	wait := time.Until(blockedUntil)
+	if wait <= 0 {
+		return 0, false, nil
+	}
+	return wait, locked, nil
+}
+
+func (l *PostgresLimiter) Record(key string, p LimitPolicy) error {
+	tx, err := l.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("INSERT INTO rate_limits (key) VALUES ($1) ON CONFLICT (key) DO NOTHING", key)
+	if err != nil {
+		return err
+	}
+
+	var s limitState
+	err = tx.QueryRow(
+		"SELECT attempts, last_attempt, blocked_until, locked FROM rate_limits WHERE key = $1 FOR UPDATE",
+		key,
+	).Scan(&s.Attempts, &s.LastAttempt, &s.BlockedUntil, &s.Locked)
+	if err != nil {
+		return err
+	}
+
+	s = s.next(p, time.Now())
+	_, err = tx.Exec(
+		"UPDATE rate_limits SET attempts = $1, last_attempt = $2, blocked_until = $3, locked = $4 WHERE key = $5",
+		s.Attempts, s.LastAttempt, s.BlockedUntil, s.Locked, key,
+	)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (l *PostgresLimiter) Reset(key string) error {
+	_, err := l.db.Exec("DELETE FROM rate_limits WHERE key = $1", key)
+	return err
+}
+
+// accountLimitKey returns the limiter key for login attempts against an email
+func accountLimitKey(email string) string {
+	return "login:account:" + strings.ToLower(strings.TrimSpace(email))
+}
+
+// clientIP returns the address of the client, honouring X-Forwarded-For
+// only when TRUST_PROXY is enabled
+func clientIP(r *http.Request) string {
+	if trustProxy {
+		if fwd := r.Header.Get("X-Forwarded-For"); fwd != "" {
+			return strings.TrimSpace(strings.Split(fwd, ",")[0])
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// writeRetryAfter responds with 429 and a Retry-After header in whole seconds
+func writeRetryAfter(w http.ResponseWriter, wait time.Duration, message string) {
+	seconds := int(wait.Seconds())
+	if wait > time.Duration(seconds)*time.Second {
+		seconds++
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	http.Error(w, message, http.StatusTooManyRequests)
+}
+
+// checkLimits returns the longest wait among the keys, or zero if none is blocked
+func checkLimits(keys ...string) (time.Duration, bool) {
+	var longest time.Duration
+	var locked bool
+	for _, key := range keys {
+		wait, l, err := limiter.Blocked(key)
+		if err != nil {
+			// Fail open, a broken limiter must not lock everybody out
+			log.Printf("Error checking rate limit: %v", err)
+			continue
+		}
+		if wait > longest {
+			longest = wait
+		}
+		locked = locked || l
+	}
+	return longest, locked
+}
+
+// recordFailedLogin counts a failed login against the client IP and the
+// account and records it in the audit log. userID is empty for unknown emails.
+func recordFailedLogin(r *http.Request, email, userID, reason string) {
+	ip := clientIP(r)
+	if err := limiter.Record("login:ip:"+ip, loginIPPolicy); err != nil {
+		log.Printf("Error recording rate limit: %v", err)
+	}
+	if err := limiter.Record(accountLimitKey(email), loginAccountPolicy); err != nil {
+		log.Printf("Error recording rate limit: %v", err)
+	}
+
+	recordAudit(r, userID, "auth.login_failed", "user", userID, map[string]interface{}{
+		"email":  email,
+		"reason": reason,
+	})
+	log.Printf("Failed login for %q from %s: %s", email, ip, reason)
+}
+
+func unlockUserHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	userID := vars["id"]
+
+	var email string
+	err := db.QueryRow("SELECT email FROM users WHERE id = $1", userID).Scan(&email)
+	if err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	if err := limiter.Reset(accountLimitKey(email)); err != nil {
+		http.Error(w, "Error unlocking user", http.StatusInternalServerError)
+		return
+	}
+	recordAudit(r, "", "user.unlocked", "user", userID, nil)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "User unlocked",
+	})
+}
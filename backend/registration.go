@@ -0,0 +1,436 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+// Registration modes
+const (
+	registrationOpen     = "open"     // anyone can register
+	registrationInvite   = "invite"   // an invitation is required
+	registrationDomains  = "domains"  // only emails from allowed domains, or with an invitation
+	registrationDisabled = "disabled" // accounts are created by administrators only
+)
+
+const tokenPurposeInvitation = "invitation"
+
+const defaultInvitationTTL = 7 * 24 * time.Hour
+
+// RegistrationSettings controls who may create an account
+type RegistrationSettings struct {
+	Mode           string   `json:"mode"`
+	AllowedDomains []string `json:"allowedDomains"`
+}
+
+// Invitation represents an admin-issued invitation to register
+type Invitation struct {
+	ID         string     `json:"id"`
+	Email      string     `json:"email"`
+	Role       string     `json:"role"`
+	InvitedBy  string     `json:"invitedBy"`
+	ExpiresAt  time.Time  `json:"expiresAt"`
+	AcceptedAt *time.Time `json:"acceptedAt"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	Link       string     `json:"link,omitempty"`
+}
+
+// InvitationRequest represents the create invitation request body
+type InvitationRequest struct {
+	Email         string `json:"email"`
+	Role          string `json:"role"`
+	ExpiresInDays int    `json:"expiresInDays"`
+}
+
+// CreateUserRequest represents the admin create user request body
+type CreateUserRequest struct {
+	Username string `json:"username"`
+	Email    string `json:"email"`
+	Password string `json:"password"`
+	Role     string `json:"role"`
+}
+
+// loadRegistrationSettings reads the registration settings, falling back to
+// REGISTRATION_MODE and REGISTRATION_DOMAINS when none are stored
+func loadRegistrationSettings() (RegistrationSettings, error) {
+	var raw []byte
+	err := db.QueryRow("SELECT value FROM settings WHERE key = 'registration'").Scan(&raw)
+	if err == sql.ErrNoRows {
+		settings := RegistrationSettings{Mode: os.Getenv("REGISTRATION_MODE"), AllowedDomains: []string{}}
+		if settings.Mode == "" {
+			settings.Mode = registrationOpen
+		}
+		for _, d := range strings.Split(os.Getenv("REGISTRATION_DOMAINS"), ",") {
+			if d = strings.ToLower(strings.TrimSpace(d)); d != "" {
+				settings.AllowedDomains = append(settings.AllowedDomains, d)
+			}
+		}
+		return settings, nil
+	}
+	if err != nil {
+		return RegistrationSettings{}, err
+	}
+
+	var settings RegistrationSettings
+	err = json.Unmarshal(raw, &settings)
+	return settings, err
+}
+
+// emailDomainAllowed reports whether the email's domain is in the list
+func emailDomainAllowed(email string, domains []string) bool {
+	at := strings.LastIndex(email, "@")
+	if at < 0 {
+		return false
+	}
+	domain := strings.ToLower(email[at+1:])
+	for _, d := range domains {
+		if domain == d {
+			return true
+		}
+	}
+	return false
+}
+
+// acceptInvitation marks the invitation as used within tx and returns the role
+// it grants. The invitation must have been issued for the same email.
+func acceptInvitation(tx *sql.Tx, token, email string) (string, error) {
+	raw, ok := verifySignedToken(token, tokenPurposeInvitation)
+	if !ok {
+		return "", errInvalidToken
+	}
+
+	var role string
+	err := tx.QueryRow(`
+		UPDATE invitations SET accepted_at = NOW()
+		WHERE token_hash = $1 AND lower(email) = lower($2)
+			AND accepted_at IS NULL AND revoked_at IS NULL AND expires_at > NOW()
+		RETURNING role
+	`, hashToken(raw), email).Scan(&role)
+	if err != nil {
+		return "", errInvalidToken
+	}
+	return role, nil
+}
+
+// bootstrapAdmin creates the first administrator from BOOTSTRAP_ADMIN_EMAIL and
+// BOOTSTRAP_ADMIN_PASSWORD. It does nothing once any admin exists, and an
+// advisory lock keeps concurrently starting instances from racing. An
+// existing account with the email or username isn't promoted, since anyone
+// may have registered it, so the bootstrap is skipped instead.
+func bootstrapAdmin() error {
+	email := os.Getenv("BOOTSTRAP_ADMIN_EMAIL")
+	password := os.Getenv("BOOTSTRAP_ADMIN_PASSWORD")
+	if email == "" || password == "" {
+		return nil
+	}
+	username := os.Getenv("BOOTSTRAP_ADMIN_USERNAME")
+	if username == "" {
+		username = "admin"
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("SELECT pg_advisory_xact_lock(hashtext('taskflow.bootstrap_admin'))"); err != nil {
+		return err
+	}
+
+	var hasAdmin bool
+	if err := tx.QueryRow("SELECT EXISTS (SELECT 1 FROM users WHERE role = $1)", roleAdmin).Scan(&hasAdmin); err != nil {
+		return err
+	}
+	if hasAdmin {
+		return nil
+	}
+
+	result, err := tx.Exec(`
+		INSERT INTO users (username, email, password, role, email_verified)
+		VALUES ($1, $2, $3, $4, true)
+		ON CONFLICT DO NOTHING
+	`, username, email, password, roleAdmin)
+	if err != nil {
+		return err
+	}
+
+	if n, _ := result.RowsAffected(); n > 0 {
+		log.Printf("Bootstrapped administrator %s", email)
+	} else {
+		log.Printf("Not bootstrapping administrator %s: the email or username %s is already taken", email, username)
+	}
+	return tx.Commit()
+}
+
+func getRegistrationSettingsHandler(w http.ResponseWriter, r *http.Request) {
+	settings, err := loadRegistrationSettings()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(settings)
+}
+
+func updateRegistrationSettingsHandler(w http.ResponseWriter, r *http.Request) {
+	var settings RegistrationSettings
+	if err := json.NewDecoder(r.Body).Decode(&settings); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	switch settings.Mode {
+	case registrationOpen, registrationInvite, registrationDomains, registrationDisabled:
+	default:
+		http.Error(w, "mode must be one of open, invite, domains, disabled", http.StatusBadRequest)
+		return
+	}
+
+	domains := []string{}
+	for _, d := range settings.AllowedDomains {
+		if d = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(d, "@"))); d != "" {
+			domains = append(domains, d)
+		}
+	}
+	settings.AllowedDomains = domains
+	if settings.Mode == registrationDomains && len(domains) == 0 {
+		http.Error(w, "allowedDomains is required in domains mode", http.StatusBadRequest)
+		return
+	}
+
+	value, _ := json.Marshal(settings)
+	_, err := db.Exec(`
+		INSERT INTO settings (key, value) VALUES ('registration', $1)
+		ON CONFLICT (key) DO UPDATE SET value = EXCLUDED.value, updated_at = NOW()
+	`, value)
+	if err != nil {
+		http.Error(w, "Error saving settings", http.StatusInternalServerError)
+		return
+	}
+	recordAudit(r, "", "settings.registration_changed", "settings", "registration", map[string]interface{}{
+		"mode":           settings.Mode,
+		"allowedDomains": settings.AllowedDomains,
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(settings)
+}
+
+func getInvitationsHandler(w http.ResponseWriter, r *http.Request) {
+	rows, err := db.Query(`
+		SELECT id, email, role, COALESCE(invited_by::text, ''), expires_at, accepted_at, created_at
+		FROM invitations
+		WHERE revoked_at IS NULL
+		ORDER BY created_at DESC
+	`)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	invitations := []Invitation{}
+	for rows.Next() {
+		var inv Invitation
+		var acceptedAt sql.NullTime
+		if err := rows.Scan(&inv.ID, &inv.Email, &inv.Role, &inv.InvitedBy, &inv.ExpiresAt, &acceptedAt, &inv.CreatedAt); err != nil {
+			http.Error(w, "Error scanning invitations", http.StatusInternalServerError)
+			return
+		}
+		if acceptedAt.Valid {
+			inv.AcceptedAt = &acceptedAt.Time
+		}
+		invitations = append(invitations, inv)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(invitations)
+}
+
+func createInvitationHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userId").(string)
+
+	var req InvitationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	req.Email = strings.TrimSpace(req.Email)
+	if !strings.Contains(req.Email, "@") {
+		http.Error(w, "A valid email is required", http.StatusBadRequest)
+		return
+	}
+	if req.Role == "" {
+		req.Role = roleUser
+	}
+	ok, err := canGrantRole(r, req.Role)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		http.Error(w, "You can't grant a role with permissions you don't have", http.StatusForbidden)
+		return
+	}
+
+	ttl := defaultInvitationTTL
+	if req.ExpiresInDays > 0 {
+		ttl = time.Duration(req.ExpiresInDays) * 24 * time.Hour
+	}
+
+	raw, err := randomToken(32)
+	if err != nil {
+		http.Error(w, "Error generating invitation", http.StatusInternalServerError)
+		return
+	}
+	token := raw + "." + signToken(tokenPurposeInvitation, raw)
+
+	inv := Invitation{Email: req.Email, Role: req.Role, InvitedBy: userID}
+	err = db.QueryRow(`
+		INSERT INTO invitations (email, role, token_hash, invited_by, expires_at)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id, expires_at, created_at
+	`, req.Email, req.Role, hashToken(raw), userID, time.Now().Add(ttl)).Scan(&inv.ID, &inv.ExpiresAt, &inv.CreatedAt)
+	if err != nil {
+		if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23503" {
+			http.Error(w, "Unknown role", http.StatusBadRequest)
+			return
+		}
+		http.Error(w, "Error creating invitation", http.StatusInternalServerError)
+		return
+	}
+
+	inv.Link = appURL + "/register?invite=" + url.QueryEscape(token) + "&email=" + url.QueryEscape(req.Email)
+	err = mailer.Send(Mail{
+		To:      req.Email,
+		Subject: "Приглашение в TaskFlow",
+		Text:    fmt.Sprintf("Вас пригласили в TaskFlow. Чтобы создать учётную запись, перейдите по ссылке:\n%s\n\nПриглашение действительно до %s.", inv.Link, inv.ExpiresAt.Format("02.01.2006 15:04")),
+	})
+	if err != nil {
+		log.Printf("Error sending invitation email: %v", err)
+	}
+	recordAudit(r, "", "invitation.created", "invitation", inv.ID, map[string]interface{}{
+		"email": inv.Email,
+		"role":  inv.Role,
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(inv)
+}
+
+func revokeInvitationHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	invitationID := vars["id"]
+
+	result, err := db.Exec(`
+		UPDATE invitations SET revoked_at = NOW()
+		WHERE id = $1 AND accepted_at IS NULL AND revoked_at IS NULL
+	`, invitationID)
+	if err != nil {
+		http.Error(w, "Error revoking invitation", http.StatusInternalServerError)
+		return
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil || rowsAffected == 0 {
+		http.Error(w, "Invitation not found or already used", http.StatusNotFound)
+		return
+	}
+	recordAudit(r, "", "invitation.revoked", "invitation", invitationID, nil)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "Invitation revoked",
+	})
+}
+
+func createUserHandler(w http.ResponseWriter, r *http.Request) {
+	var req CreateUserRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	req.Username = strings.TrimSpace(req.Username)
+	req.Email = strings.TrimSpace(req.Email)
+	if req.Username == "" || !strings.Contains(req.Email, "@") {
+		http.Error(w, "Username and a valid email are required", http.StatusBadRequest)
+		return
+	}
+	if req.Role == "" {
+		req.Role = roleUser
+	}
+	ok, err := canGrantRole(r, req.Role)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		http.Error(w, "You can't grant a role with permissions you don't have", http.StatusForbidden)
+		return
+	}
+
+	// Without a password the user sets one through the reset link we mail them
+	password := req.Password
+	if password == "" {
+		password, _ = randomToken(24)
+	}
+
+	var user User
+	err = db.QueryRow(`
+		INSERT INTO users (username, email, password, role, email_verified)
+		VALUES ($1, $2, $3, $4, true)
+		RETURNING id, username, email, role, email_verified, created_at
+	`, req.Username, req.Email, password, req.Role).Scan(&user.ID, &user.Username, &user.Email, &user.Role, &user.EmailVerified, &user.CreatedAt)
+	if err != nil {
+		if msg, ok := uniqueViolationMessage(err); ok {
+			http.Error(w, msg, http.StatusConflict)
+			return
+		}
+		if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23503" {
+			http.Error(w, "Unknown role", http.StatusBadRequest)
+			return
+		}
+		http.Error(w, "Error creating user", http.StatusInternalServerError)
+		return
+	}
+
+	if req.Password == "" {
+		token, err := issueUserToken(user.ID, tokenPurposePasswordReset, defaultInvitationTTL)
+		if err == nil {
+			err = mailer.Send(Mail{
+				To:      user.Email,
+				Subject: "Ваша учётная запись в TaskFlow",
+				Text:    fmt.Sprintf("Для вас создана учётная запись в TaskFlow. Чтобы задать пароль, перейдите по ссылке:\n%s", appURL+"/reset-password?token="+url.QueryEscape(token)),
+			})
+		}
+		if err != nil {
+			log.Printf("Error sending account setup email: %v", err)
+		}
+	}
+	recordAudit(r, "", "user.created", "user", user.ID, map[string]interface{}{
+		"email": user.Email,
+		"role":  user.Role,
+	})
+	emitWebhookEvent(r.Context().Value("userId").(string), hookUserCreated, map[string]interface{}{
+		"user": map[string]string{"id": user.ID, "username": user.Username, "role": user.Role},
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(user)
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestBootstrapAdmin(t *testing.T) {
+	tests := []struct {
+		name     string
+		hasAdmin bool
+		inserted int64
+	}{
+		{name: "creates the first admin", inserted: 1},
+		// The account isn't promoted and startup goes on
+		{name: "email or username taken", inserted: 0},
+		{name: "admin exists", hasAdmin: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock := mockDB(t)
+			t.Setenv("BOOTSTRAP_ADMIN_EMAIL", "root@example.com")
+			t.Setenv("BOOTSTRAP_ADMIN_PASSWORD", "secret")
+			t.Setenv("BOOTSTRAP_ADMIN_USERNAME", "")
+
+			mock.ExpectBegin()
+			mock.ExpectExec(`SELECT pg_advisory_xact_lock`).WillReturnResult(sqlmock.NewResult(0, 0))
+			mock.ExpectQuery(`SELECT EXISTS \(SELECT 1 FROM users WHERE role = \$1\)`).WithArgs(roleAdmin).
+				WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(tt.hasAdmin))
+			if tt.hasAdmin {
+				mock.ExpectRollback()
+			} else {
+				mock.ExpectExec(`INSERT INTO users (.|\n)*ON CONFLICT DO NOTHING`).
+					WithArgs("admin", "root@example.com", "secret", roleAdmin).
+					WillReturnResult(sqlmock.NewResult(0, tt.inserted))
+				mock.ExpectCommit()
+			}
+
+			if err := bootstrapAdmin(); err != nil {
+				t.Fatalf("bootstrapAdmin() error = %v", err)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
@@ -0,0 +1,439 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+// Team is a named group of users that tasks can be assigned to
+type Team struct {
+	ID          string    `json:"id"`
+	Name        string    `json:"name"`
+	Description string    `json:"description"`
+	LeadID      string    `json:"leadId,omitempty"`
+	Members     []UserRef `json:"members"`
+	CreatedAt   time.Time `json:"createdAt"`
+}
+
+// TeamRequest represents the create and update team request body. On update,
+// omitted fields are left unchanged and MemberIDs replaces the member list.
+type TeamRequest struct {
+	Name        *string   `json:"name"`
+	Description *string   `json:"description"`
+	LeadID      *string   `json:"leadId"`
+	MemberIDs   *[]string `json:"memberIds"`
+}
+
+// loadTeamMembers fills in the members of the given teams
+func loadTeamMembers(teams []Team) error {
+	if len(teams) == 0 {
+		return nil
+	}
+	index := make(map[string]int)
+	ids := make([]string, len(teams))
+	for i, t := range teams {
+		index[t.ID] = i
+		ids[i] = t.ID
+		teams[i].Members = []UserRef{}
+	}
+
+	rows, err := db.Query(`
+		SELECT m.team_id, u.id, u.username, u.avatar_version
+		FROM team_members m
+		JOIN users u ON u.id = m.user_id
+		WHERE m.team_id = ANY($1::uuid[])
+		ORDER BY u.username
+	`, pq.Array(ids))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var teamID string
+		var member UserRef
+		var avatarVersion sql.NullInt64
+		if err := rows.Scan(&teamID, &member.ID, &member.Username, &avatarVersion); err != nil {
+			return err
+		}
+		member.AvatarURL = avatarURL(member.ID, avatarVersion)
+		i := index[teamID]
+		teams[i].Members = append(teams[i].Members, member)
+	}
+	return rows.Err()
+}
+
+// getTeam loads a single team with its members
+func getTeam(teamID string) (*Team, error) {
+	var team Team
+	var leadID sql.NullString
+	err := db.QueryRow(
+		"SELECT id, name, description, lead_id, created_at FROM teams WHERE id = $1",
+		teamID,
+	).Scan(&team.ID, &team.Name, &team.Description, &leadID, &team.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	team.LeadID = leadID.String
+
+	teams := []Team{team}
+	if err := loadTeamMembers(teams); err != nil {
+		return nil, err
+	}
+	return &teams[0], nil
+}
+
+// canManageTeam reports whether the user may edit the team: team managers can
+// edit any team, leads only their own
+func canManageTeam(r *http.Request, teamID string) bool {
+	if hasPermission(r, permTeamManage) {
+		return true
+	}
+	userID := r.Context().Value("userId").(string)
+	var isLead bool
+	err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM teams WHERE id = $1 AND lead_id = $2)", teamID, userID).Scan(&isLead)
+	return err == nil && isLead
+}
+
+// teamMutationError translates constraint violations on teams into a response
+func teamMutationError(w http.ResponseWriter, err error) {
+	if pqErr, ok := err.(*pq.Error); ok {
+		switch pqErr.Code {
+		case "23505":
+			http.Error(w, "Team name already taken", http.StatusConflict)
+			return
+		case "23503":
+			http.Error(w, "Unknown user", http.StatusBadRequest)
+			return
+		case "22P02":
+			http.Error(w, "Invalid user ID", http.StatusBadRequest)
+			return
+		}
+	}
+	http.Error(w, "Error saving team", http.StatusInternalServerError)
+}
+
+// setTeamMembers replaces the members of a team, always keeping the lead
+func setTeamMembers(tx *sql.Tx, teamID string, memberIDs []string) error {
+	if _, err := tx.Exec("DELETE FROM team_members WHERE team_id = $1", teamID); err != nil {
+		return err
+	}
+	_, err := tx.Exec(`
+		INSERT INTO team_members (team_id, user_id)
+		SELECT $1::uuid, unnest($2::uuid[])
+		UNION
+		SELECT id, lead_id FROM teams WHERE id = $1 AND lead_id IS NOT NULL
+		ON CONFLICT DO NOTHING
+	`, teamID, pq.Array(memberIDs))
+	return err
+}
+
+func getTeamsHandler(w http.ResponseWriter, r *http.Request) {
+	query := "SELECT id, name, description, lead_id, created_at FROM teams"
+	params := []interface{}{}
+	if r.URL.Query().Get("mine") == "true" {
+		query += " WHERE id IN (SELECT team_id FROM team_members WHERE user_id = $1)"
+		params = append(params, r.Context().Value("userId").(string))
+	}
+
+	rows, err := db.Query(query+" ORDER BY name", params...)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	teams := []Team{}
+	for rows.Next() {
+		var team Team
+		var leadID sql.NullString
+		if err := rows.Scan(&team.ID, &team.Name, &team.Description, &leadID, &team.CreatedAt); err != nil {
+			http.Error(w, "Error scanning teams", http.StatusInternalServerError)
+			return
+		}
+		team.LeadID = leadID.String
+		teams = append(teams, team)
+	}
+
+	if err := loadTeamMembers(teams); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(teams)
+}
+
+func getTeamHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	team, err := getTeam(vars["id"])
+	if err != nil {
+		http.Error(w, "Team not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(team)
+}
+
+func createTeamHandler(w http.ResponseWriter, r *http.Request) {
+	var req TeamRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if req.Name == nil || strings.TrimSpace(*req.Name) == "" || len(*req.Name) > 255 {
+		http.Error(w, "Team name must be 1-255 characters", http.StatusBadRequest)
+		return
+	}
+	name := strings.TrimSpace(*req.Name)
+	description := ""
+	if req.Description != nil {
+		description = *req.Description
+	}
+	leadID := ""
+	if req.LeadID != nil {
+		leadID = *req.LeadID
+	}
+	memberIDs := []string{}
+	if req.MemberIDs != nil {
+		memberIDs = *req.MemberIDs
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var teamID string
+	err = tx.QueryRow(`
+		INSERT INTO teams (name, description, lead_id) VALUES ($1, $2, NULLIF($3, '')::uuid)
+		RETURNING id
+	`, name, description, leadID).Scan(&teamID)
+	if err != nil {
+		teamMutationError(w, err)
+		return
+	}
+	if err := setTeamMembers(tx, teamID, memberIDs); err != nil {
+		teamMutationError(w, err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Error saving team", http.StatusInternalServerError)
+		return
+	}
+	recordAudit(r, "", "team.created", "team", teamID, map[string]interface{}{
+		"name":      name,
+		"leadId":    leadID,
+		"memberIds": memberIDs,
+	})
+
+	team, err := getTeam(teamID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(team)
+}
+
+func updateTeamHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	teamID := vars["id"]
+
+	var req TeamRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if !canManageTeam(r, teamID) {
+		http.Error(w, "Permission denied", http.StatusForbidden)
+		return
+	}
+	// Leads can manage members but not hand the team over to someone else
+	if req.LeadID != nil && !hasPermission(r, permTeamManage) {
+		http.Error(w, "Permission denied: "+permTeamManage+" required to change the lead", http.StatusForbidden)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	query := "UPDATE teams SET name = name"
+	params := []interface{}{}
+	paramCount := 1
+
+	if req.Name != nil {
+		name := strings.TrimSpace(*req.Name)
+		if name == "" || len(name) > 255 {
+			http.Error(w, "Team name must be 1-255 characters", http.StatusBadRequest)
+			return
+		}
+		query += fmt.Sprintf(", name = $%d", paramCount)
+		params = append(params, name)
+		paramCount++
+	}
+
+	if req.Description != nil {
+		query += fmt.Sprintf(", description = $%d", paramCount)
+		params = append(params, *req.Description)
+		paramCount++
+	}
+
+	if req.LeadID != nil {
+		query += fmt.Sprintf(", lead_id = NULLIF($%d, '')::uuid", paramCount)
+		params = append(params, *req.LeadID)
+		paramCount++
+	}
+
+	query += fmt.Sprintf(" WHERE id = $%d", paramCount)
+	params = append(params, teamID)
+
+	result, err := tx.Exec(query, params...)
+	if err != nil {
+		teamMutationError(w, err)
+		return
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil || rowsAffected == 0 {
+		http.Error(w, "Team not found", http.StatusNotFound)
+		return
+	}
+
+	if req.MemberIDs != nil {
+		err = setTeamMembers(tx, teamID, *req.MemberIDs)
+	} else if req.LeadID != nil && *req.LeadID != "" {
+		// A new lead is always a member of their team
+		_, err = tx.Exec("INSERT INTO team_members (team_id, user_id) VALUES ($1, $2) ON CONFLICT DO NOTHING", teamID, *req.LeadID)
+	}
+	if err != nil {
+		teamMutationError(w, err)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Error saving team", http.StatusInternalServerError)
+		return
+	}
+
+	details := map[string]interface{}{}
+	if req.Name != nil {
+		details["name"] = *req.Name
+	}
+	if req.LeadID != nil {
+		details["leadId"] = *req.LeadID
+	}
+	if req.MemberIDs != nil {
+		details["memberIds"] = *req.MemberIDs
+	}
+	recordAudit(r, "", "team.updated", "team", teamID, details)
+
+	team, err := getTeam(teamID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(team)
+}
+
+func deleteTeamHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	teamID := vars["id"]
+
+	// Tasks assigned to the team are kept and simply lose the team
+	var name string
+	err := db.QueryRow("DELETE FROM teams WHERE id = $1 RETURNING name", teamID).Scan(&name)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Team not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Error deleting team", http.StatusInternalServerError)
+		return
+	}
+	recordAudit(r, "", "team.deleted", "team", teamID, map[string]interface{}{
+		"name": name,
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "Team deleted",
+	})
+}
+
+// setTeamMembership adds or removes a single member
+func setTeamMembership(w http.ResponseWriter, r *http.Request, add bool) {
+	vars := mux.Vars(r)
+	teamID := vars["id"]
+	userID := vars["userId"]
+
+	if !canManageTeam(r, teamID) {
+		http.Error(w, "Permission denied", http.StatusForbidden)
+		return
+	}
+
+	var err error
+	action := "team.member_added"
+	if add {
+		_, err = db.Exec("INSERT INTO team_members (team_id, user_id) VALUES ($1, $2) ON CONFLICT DO NOTHING", teamID, userID)
+	} else {
+		action = "team.member_removed"
+		var isLead bool
+		err = db.QueryRow("SELECT EXISTS (SELECT 1 FROM teams WHERE id = $1 AND lead_id = $2)", teamID, userID).Scan(&isLead)
+		if err == nil && isLead {
+			http.Error(w, "The team lead can't be removed, change the lead first", http.StatusConflict)
+			return
+		}
+		if err == nil {
+			_, err = db.Exec("DELETE FROM team_members WHERE team_id = $1 AND user_id = $2", teamID, userID)
+		}
+	}
+	if err != nil {
+		if pqErr, ok := err.(*pq.Error); ok && (pqErr.Code == "23503" || pqErr.Code == "22P02") {
+			http.Error(w, "Team or user not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Error updating team", http.StatusInternalServerError)
+		return
+	}
+	recordAudit(r, "", action, "team", teamID, map[string]interface{}{
+		"userId": userID,
+	})
+
+	team, err := getTeam(teamID)
+	if err != nil {
+		http.Error(w, "Team not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(team)
+}
+
+func addTeamMemberHandler(w http.ResponseWriter, r *http.Request) {
+	setTeamMembership(w, r, true)
+}
+
+func removeTeamMemberHandler(w http.ResponseWriter, r *http.Request) {
+	setTeamMembership(w, r, false)
+}
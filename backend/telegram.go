@@ -0,0 +1,563 @@
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Provider of accounts linked through the Telegram bot
+const chatProviderTelegram = "telegram"
+
+const (
+	// Give up on a Telegram message after this many failed attempts
+	maxTelegramAttempts = 5
+	// Retry delays double from the base delay up to the maximum
+	telegramRetryBase = 30 * time.Second
+	telegramRetryMax  = 30 * time.Minute
+	// How long a claimed batch of messages is reserved for the instance
+	// sending it; 50 messages at the client timeout fit within it
+	telegramSendLease = time.Hour
+)
+
+// telegramStrings holds the bot's texts per locale
+var telegramStrings = map[string]map[string]string{
+	"ru": {
+		"help":         "Команды:\n/link &lt;код&gt; — привязать аккаунт (код выдается в профиле TaskFlow)\n/my — мои задачи\n/unlink — отвязать аккаунт\n\nОтветьте на уведомление текстом, чтобы оставить комментарий, или командой /move &lt;колонка&gt;, чтобы перенести задачу.",
+		"notLinked":    "Аккаунт не привязан к TaskFlow. Получите код в профиле и отправьте /link &lt;код&gt;.",
+		"linked":       "Аккаунт привязан к пользователю <b>{username}</b>. Уведомления будут приходить сюда.",
+		"badCode":      "Код неверный или устарел.",
+		"unlinked":     "Аккаунт отвязан от TaskFlow.",
+		"replyNeeded":  "Ответьте этой командой на уведомление о задаче.",
+		"noTask":       "Задача не найдена.",
+		"noColumn":     "Колонка не найдена: {column}",
+		"noPermission": "У вас нет прав на это действие.",
+		"moved":        "Задача <b>{title}</b> перенесена в «{column}».",
+		"commented":    "Комментарий к задаче <b>{title}</b> добавлен.",
+		"noTasks":      "У вас нет открытых задач.",
+		"myTasks":      "Ваши задачи:",
+		"openTask":     "Открыть задачу",
+		"replyHint":    "Ответьте, чтобы прокомментировать, или /move &lt;колонка&gt;",
+		"error":        "Не удалось выполнить команду, попробуйте позже.",
+	},
+	"en": {
+		"help":         "Commands:\n/link &lt;code&gt; — link your account (get the code in your TaskFlow profile)\n/my — your tasks\n/unlink — unlink your account\n\nReply to a notification with text to comment, or with /move &lt;column&gt; to move the task.",
+		"notLinked":    "Your account isn't linked to TaskFlow. Get a code in your profile and send /link &lt;code&gt;.",
+		"linked":       "Your account is now linked to <b>{username}</b>. Notifications will arrive here.",
+		"badCode":      "The code is invalid or has expired.",
+		"unlinked":     "Your account has been unlinked from TaskFlow.",
+		"replyNeeded":  "Send this command as a reply to a task notification.",
+		"noTask":       "Task not found.",
+		"noColumn":     "Unknown column: {column}",
+		"noPermission": "You are not allowed to do that.",
+		"moved":        "Task <b>{title}</b> moved to “{column}”.",
+		"commented":    "Comment added to <b>{title}</b>.",
+		"noTasks":      "You have no open tasks.",
+		"myTasks":      "Your tasks:",
+		"openTask":     "Open task",
+		"replyHint":    "Reply to comment, or /move &lt;column&gt;",
+		"error":        "The command failed, please try again later.",
+	},
+}
+
+// telegramBot talks to the Telegram Bot API
+type telegramBot struct {
+	token         string
+	apiURL        string
+	webhookSecret string
+	client        *http.Client
+	wake          chan struct{}
+}
+
+var telegram *telegramBot
+
+// newTelegramBotFromEnv configures the bot from TELEGRAM_BOT_TOKEN,
+// TELEGRAM_API_URL and TELEGRAM_WEBHOOK_SECRET. It returns nil without a token.
+func newTelegramBotFromEnv() *telegramBot {
+	token := os.Getenv("TELEGRAM_BOT_TOKEN")
+	if token == "" {
+		return nil
+	}
+	apiURL := strings.TrimSuffix(os.Getenv("TELEGRAM_API_URL"), "/")
+	if apiURL == "" {
+		apiURL = "https://api.telegram.org"
+	}
+	return &telegramBot{
+		token:         token,
+		apiURL:        apiURL,
+		webhookSecret: os.Getenv("TELEGRAM_WEBHOOK_SECRET"),
+		// Long enough for long polling
+		client: &http.Client{Timeout: 60 * time.Second},
+		wake:   make(chan struct{}, 1),
+	}
+}
+
+// Bot API types, only the fields we use
+type tgUpdate struct {
+	UpdateID int64      `json:"update_id"`
+	Message  *tgMessage `json:"message"`
+}
+
+type tgMessage struct {
+	MessageID      int64      `json:"message_id"`
+	From           *tgUser    `json:"from"`
+	Chat           tgChat     `json:"chat"`
+	Text           string     `json:"text"`
+	ReplyToMessage *tgMessage `json:"reply_to_message"`
+}
+
+type tgUser struct {
+	ID        int64  `json:"id"`
+	Username  string `json:"username"`
+	FirstName string `json:"first_name"`
+}
+
+type tgChat struct {
+	ID   int64  `json:"id"`
+	Type string `json:"type"`
+}
+
+// telegramError is an error reported by the Bot API
+type telegramError struct {
+	Code        int
+	Description string
+	RetryAfter  int
+}
+
+func (e *telegramError) Error() string {
+	return fmt.Sprintf("telegram: %d %s", e.Code, e.Description)
+}
+
+// call invokes a Bot API method and decodes its result
+func (b *telegramBot) call(method string, params interface{}, result interface{}) error {
+	body, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+	resp, err := b.client.Post(b.apiURL+"/bot"+b.token+"/"+method, "application/json", bytes.NewReader(body))
+	if err != nil {
+		// The URL carries the bot token, keep it out of logs and last_error
+		var uerr *url.Error
+		if errors.As(err, &uerr) {
+			err = uerr.Err
+		}
+		return fmt.Errorf("telegram: %s: %v", method, err)
+	}
+	defer resp.Body.Close()
+
+	var envelope struct {
+		OK          bool            `json:"ok"`
+		Result      json.RawMessage `json:"result"`
+		ErrorCode   int             `json:"error_code"`
+		Description string          `json:"description"`
+		Parameters  struct {
+			RetryAfter int `json:"retry_after"`
+		} `json:"parameters"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 8<<20)).Decode(&envelope); err != nil {
+		return fmt.Errorf("telegram: %s: %v", resp.Status, err)
+	}
+	if !envelope.OK {
+		code := envelope.ErrorCode
+		if code == 0 {
+			code = resp.StatusCode
+		}
+		return &telegramError{Code: code, Description: envelope.Description, RetryAfter: envelope.Parameters.RetryAfter}
+	}
+	if result != nil {
+		return json.Unmarshal(envelope.Result, result)
+	}
+	return nil
+}
+
+// sendMessage sends an HTML formatted message and returns its message ID
+func (b *telegramBot) sendMessage(chatID int64, text string) (int64, error) {
+	var sent tgMessage
+	err := b.call("sendMessage", map[string]interface{}{
+		"chat_id":                  chatID,
+		"text":                     text,
+		"parse_mode":               "HTML",
+		"disable_web_page_preview": true,
+	}, &sent)
+	return sent.MessageID, err
+}
+
+// telegramText returns a bot text in the locale with placeholders filled in.
+// Values are HTML escaped.
+func telegramText(locale, key string, pairs ...string) string {
+	s, ok := telegramStrings[locale][key]
+	if !ok {
+		s = telegramStrings[supportedLocales[0]][key]
+	}
+	for i := 1; i < len(pairs); i += 2 {
+		pairs[i] = html.EscapeString(pairs[i])
+	}
+	return strings.NewReplacer(pairs...).Replace(s)
+}
+
+// queueNotification is the Telegram channel. The message goes to every
+// Telegram chat the user linked, once quiet hours are over.
+func (b *telegramBot) queueNotification(n Notification, notBefore time.Time) {
+	result, err := db.Exec(`
+		INSERT INTO telegram_messages (user_id, chat_id, type, task_id, actor_id, params, next_attempt_at)
+		SELECT $1, external_id::bigint, $2, NULLIF($3, '')::uuid, NULLIF($4, '')::uuid, $5, $6
+		FROM chat_accounts WHERE provider = $7 AND user_id = $1
+	`, n.UserID, n.Type, n.TaskID, n.ActorID, []byte(n.Params), notBefore, chatProviderTelegram)
+	if err != nil {
+		log.Printf("Error queueing Telegram notification: %v", err)
+		return
+	}
+	if n, _ := result.RowsAffected(); n > 0 {
+		select {
+		case b.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// runQueue sends due notification messages in the background
+func (b *telegramBot) runQueue() {
+	ticker := time.NewTicker(30 * time.Second)
+	defer ticker.Stop()
+	for {
+		if err := b.processQueue(); err != nil {
+			log.Printf("Error processing Telegram messages: %v", err)
+		}
+		select {
+		case <-ticker.C:
+		case <-b.wake:
+		}
+	}
+}
+
+// telegramQueued is a claimed notification message
+type telegramQueued struct {
+	id       int64
+	chatID   int64
+	attempts int
+	locale   string
+	n        Notification
+}
+
+// processQueue sends every due message once, claimed as described in
+// queue.go
+func (b *telegramBot) processQueue() error {
+	var messages []telegramQueued
+	err := claimDue(`
+		WITH due AS (
+			SELECT m.id FROM telegram_messages m
+			JOIN users u ON u.id = m.user_id
+			WHERE m.status IN ('pending', 'sending') AND m.next_attempt_at <= NOW() AND u.deactivated_at IS NULL
+			ORDER BY m.created_at
+			LIMIT 50
+			FOR UPDATE OF m SKIP LOCKED
+		)
+		UPDATE telegram_messages m SET status = 'sending', next_attempt_at = $1
+		FROM due, users u
+		WHERE m.id = due.id AND u.id = m.user_id
+		RETURNING m.id, m.chat_id, m.attempts, m.user_id, u.locale, m.type, COALESCE(m.task_id::text, ''),
+			COALESCE(m.actor_id::text, ''), COALESCE((SELECT username FROM users a WHERE a.id = m.actor_id), ''),
+			m.params, m.created_at
+	`, telegramSendLease, func(rows *sql.Rows) error {
+		var q telegramQueued
+		var params []byte
+		if err := rows.Scan(&q.id, &q.chatID, &q.attempts, &q.n.UserID, &q.locale, &q.n.Type, &q.n.TaskID, &q.n.ActorID, &q.n.Actor, &params, &q.n.CreatedAt); err != nil {
+			return err
+		}
+		q.n.Params = params
+		if !validLocale(q.locale) {
+			q.locale = supportedLocales[0]
+		}
+		messages = append(messages, q)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	sort.Slice(messages, func(i, j int) bool {
+		return messages[i].n.CreatedAt.Before(messages[j].n.CreatedAt)
+	})
+
+	renderers := make(map[string]*notificationRenderer)
+	for _, q := range messages {
+		if err := b.sendQueued(q, renderers); err != nil {
+			log.Printf("Error processing Telegram message %d: %v", q.id, err)
+		}
+	}
+	return nil
+}
+
+// sendQueued sends a claimed message and records the outcome
+func (b *telegramBot) sendQueued(q telegramQueued, renderers map[string]*notificationRenderer) error {
+	renderer, ok := renderers[q.locale]
+	if !ok {
+		var err error
+		if renderer, err = newNotificationRenderer(q.locale); err != nil {
+			return err
+		}
+		renderers[q.locale] = renderer
+	}
+	renderer.render(&q.n)
+
+	text := "<b>" + html.EscapeString(q.n.Message) + "</b>"
+	if q.n.TaskID != "" {
+		text += fmt.Sprintf("\n<a href=\"%s\">%s</a>\n<i>%s</i>",
+			html.EscapeString(appURL+"/tasks/"+q.n.TaskID), telegramText(q.locale, "openTask"), telegramText(q.locale, "replyHint"))
+	}
+
+	messageID, sendErr := b.sendMessage(q.chatID, text)
+	if sendErr == nil {
+		_, err := db.Exec("UPDATE telegram_messages SET status = 'sent', message_id = $2, sent_at = NOW() WHERE id = $1", q.id, messageID)
+		return err
+	}
+
+	// Blocked bots and bad chats won't recover, rate limits say when to retry
+	attempts := q.attempts + 1
+	delay := retryDelay(telegramRetryBase, telegramRetryMax, attempts)
+	status := "pending"
+	var tgErr *telegramError
+	if errors.As(sendErr, &tgErr) {
+		if tgErr.RetryAfter > 0 {
+			delay = time.Duration(tgErr.RetryAfter) * time.Second
+		} else if tgErr.Code == http.StatusBadRequest || tgErr.Code == http.StatusForbidden {
+			status = "failed"
+		}
+	}
+	if attempts >= maxTelegramAttempts {
+		status = "failed"
+	}
+	log.Printf("Error sending Telegram message %d: %v", q.id, sendErr)
+	_, err := db.Exec(`
+		UPDATE telegram_messages SET status = $2, attempts = attempts + 1, last_error = $3, next_attempt_at = $4
+		WHERE id = $1
+	`, q.id, status, sendErr.Error(), time.Now().Add(delay))
+	return err
+}
+
+// runPolling receives updates with getUpdates when no webhook secret is set
+func (b *telegramBot) runPolling() {
+	var offset int64
+	for {
+		var updates []tgUpdate
+		err := b.call("getUpdates", map[string]interface{}{
+			"offset":          offset,
+			"timeout":         30,
+			"allowed_updates": []string{"message"},
+		}, &updates)
+		if err != nil {
+			log.Printf("Error getting Telegram updates: %v", err)
+			time.Sleep(5 * time.Second)
+			continue
+		}
+		for _, u := range updates {
+			offset = u.UpdateID + 1
+			b.handleUpdate(u)
+		}
+	}
+}
+
+// telegramWebhookHandler receives updates when the bot's webhook is set up
+// with TELEGRAM_WEBHOOK_SECRET as its secret token
+func telegramWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	if telegram == nil || telegram.webhookSecret == "" {
+		http.Error(w, "Telegram webhook is not configured", http.StatusNotFound)
+		return
+	}
+	secret := r.Header.Get("X-Telegram-Bot-Api-Secret-Token")
+	if subtle.ConstantTimeCompare([]byte(secret), []byte(telegram.webhookSecret)) != 1 {
+		http.Error(w, "Invalid secret token", http.StatusUnauthorized)
+		return
+	}
+
+	var update tgUpdate
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&update); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	telegram.handleUpdate(update)
+	w.WriteHeader(http.StatusOK)
+}
+
+// handleUpdate answers a message sent to the bot. Only private chats are
+// handled, since the chat identifies the linked user.
+func (b *telegramBot) handleUpdate(u tgUpdate) {
+	m := u.Message
+	if m == nil || m.Chat.Type != "private" || m.Text == "" {
+		return
+	}
+	reply := b.handleMessage(m)
+	if reply == "" {
+		return
+	}
+	if _, err := b.sendMessage(m.Chat.ID, reply); err != nil {
+		log.Printf("Error replying on Telegram: %v", err)
+	}
+}
+
+// handleMessage runs a command and returns the reply
+func (b *telegramBot) handleMessage(m *tgMessage) string {
+	externalID := strconv.FormatInt(m.Chat.ID, 10)
+	text := strings.TrimSpace(m.Text)
+	command, arg := "", text
+	if strings.HasPrefix(text, "/") {
+		command, arg = text, ""
+		if i := strings.IndexAny(text, " \t\n"); i >= 0 {
+			command, arg = text[:i], strings.TrimSpace(text[i+1:])
+		}
+		// Commands may be addressed as /command@botname
+		if i := strings.Index(command, "@"); i >= 0 {
+			command = command[:i]
+		}
+		command = strings.ToLower(command)
+	}
+
+	user, err := lookupChatUser(chatProviderTelegram, externalID)
+	if err != nil {
+		log.Printf("Error looking up Telegram user: %v", err)
+		return telegramText(supportedLocales[0], "error")
+	}
+	locale := supportedLocales[0]
+	if user != nil {
+		locale = user.Locale
+	}
+
+	switch command {
+	case "/start", "/link":
+		if arg == "" {
+			if user == nil {
+				return telegramText(locale, "notLinked")
+			}
+			return telegramText(locale, "help")
+		}
+		name := ""
+		if m.From != nil {
+			name = m.From.Username
+			if name == "" {
+				name = m.From.FirstName
+			}
+		}
+		userID, err := linkChatAccount(chatProviderTelegram, externalID, name, arg)
+		if err != nil {
+			return telegramText(locale, "badCode")
+		}
+		linked, err := lookupChatUser(chatProviderTelegram, externalID)
+		if err != nil || linked == nil {
+			return telegramText(locale, "error")
+		}
+		log.Printf("Telegram chat %s linked to user %s", externalID, userID)
+		return telegramText(linked.Locale, "linked", "{username}", linked.Username)
+	case "/unlink":
+		if _, err := unlinkChatAccount(chatProviderTelegram, externalID); err != nil {
+			return telegramText(locale, "error")
+		}
+		return telegramText(locale, "unlinked")
+	case "/help":
+		return telegramText(locale, "help")
+	}
+
+	if user == nil {
+		return telegramText(locale, "notLinked")
+	}
+
+	switch command {
+	case "/my", "/tasks":
+		return b.myTasksText(user)
+	case "/move", "/comment", "":
+	default:
+		return telegramText(locale, "help")
+	}
+
+	// Moving and commenting act on the task of the notification replied to
+	if m.ReplyToMessage == nil {
+		return telegramText(locale, "replyNeeded")
+	}
+	var taskID string
+	err = db.QueryRow(`
+		SELECT task_id FROM telegram_messages
+		WHERE chat_id = $1 AND message_id = $2 AND user_id = $3 AND task_id IS NOT NULL
+	`, m.Chat.ID, m.ReplyToMessage.MessageID, user.ID).Scan(&taskID)
+	if err == sql.ErrNoRows {
+		return telegramText(locale, "replyNeeded")
+	}
+	if err != nil {
+		return telegramText(locale, "error")
+	}
+
+	perms, err := rolePermissions(user.Role)
+	if err != nil {
+		return telegramText(locale, "error")
+	}
+
+	if command == "/move" {
+		if !perms[permTaskMove] {
+			return telegramText(locale, "noPermission")
+		}
+		column, err := resolveColumn(arg)
+		if err == errUnknownColumn {
+			return telegramText(locale, "noColumn", "{column}", arg)
+		}
+		if err != nil {
+			return telegramText(locale, "error")
+		}
+		task, err := moveTask(taskID, column, user.ID)
+		if err == sql.ErrNoRows {
+			return telegramText(locale, "noTask")
+		}
+		if err != nil {
+			log.Printf("Error moving task from Telegram: %v", err)
+			return telegramText(locale, "error")
+		}
+		var columnTitle string
+		db.QueryRow("SELECT title FROM columns WHERE id = $1", column).Scan(&columnTitle)
+		return telegramText(locale, "moved", "{title}", task.Title, "{column}", columnTitle)
+	}
+
+	if arg == "" {
+		return telegramText(locale, "help")
+	}
+	if !perms[permCommentCreate] {
+		return telegramText(locale, "noPermission")
+	}
+	if _, err := addComment(taskID, user.ID, arg); err != nil {
+		if err == sql.ErrNoRows {
+			return telegramText(locale, "noTask")
+		}
+		log.Printf("Error adding comment from Telegram: %v", err)
+		return telegramText(locale, "error")
+	}
+	var title string
+	db.QueryRow("SELECT title FROM tasks WHERE id = $1", taskID).Scan(&title)
+	return telegramText(locale, "commented", "{title}", title)
+}
+
+// myTasksText lists the user's open tasks
+func (b *telegramBot) myTasksText(user *chatUser) string {
+	tasks, err := loadOpenTasks(user.ID)
+	if err != nil {
+		log.Printf("Error listing Telegram user tasks: %v", err)
+		return telegramText(user.Locale, "error")
+	}
+	if len(tasks) == 0 {
+		return telegramText(user.Locale, "noTasks")
+	}
+
+	lines := []string{telegramText(user.Locale, "myTasks")}
+	for _, t := range tasks {
+		lines = append(lines, fmt.Sprintf("• <a href=\"%s\">%s</a> — %s (P%d)",
+			html.EscapeString(appURL+"/tasks/"+t.ID), html.EscapeString(t.Title), html.EscapeString(t.Column), t.Priority))
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// fakeBotAPI is a Bot API server that keeps the messages sent through it and
+// answers with the given error, if any
+type fakeBotAPI struct {
+	sent  []map[string]interface{}
+	fail  string
+	calls []string
+}
+
+func newFakeBotAPI(t *testing.T, api *fakeBotAPI) *telegramBot {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, "/bottest-token/") {
+			t.Errorf("unexpected path %s", r.URL.Path)
+		}
+		api.calls = append(api.calls, strings.TrimPrefix(r.URL.Path, "/bottest-token/"))
+		var params map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&params)
+		if api.fail != "" {
+			w.Write([]byte(api.fail))
+			return
+		}
+		api.sent = append(api.sent, params)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"ok":     true,
+			"result": map[string]interface{}{"message_id": 100 + len(api.sent)},
+		})
+	}))
+	t.Cleanup(server.Close)
+
+	t.Setenv("TELEGRAM_BOT_TOKEN", "test-token")
+	t.Setenv("TELEGRAM_API_URL", server.URL+"/")
+	t.Setenv("TELEGRAM_WEBHOOK_SECRET", "")
+	return newTelegramBotFromEnv()
+}
+
+const testChatID = 4242
+
+var chatUserColumns = []string{"id", "username", "role", "locale"}
+
+func expectChatUser(mock sqlmock.Sqlmock, linked bool) {
+	rows := sqlmock.NewRows(chatUserColumns)
+	if linked {
+		rows.AddRow(testUserA, "alice", "member", "en")
+	}
+	mock.ExpectQuery(`SELECT u.id, u.username, u.role, u.locale\s+FROM chat_accounts`).
+		WithArgs(chatProviderTelegram, "4242").WillReturnRows(rows)
+}
+
+func TestTelegramHandleUpdate(t *testing.T) {
+	tests := []struct {
+		name    string
+		text    string
+		replyTo int64
+		expect  func(mock sqlmock.Sqlmock)
+		reply   string
+	}{
+		{
+			name:   "help",
+			text:   "/help",
+			expect: func(mock sqlmock.Sqlmock) { expectChatUser(mock, false) },
+			reply:  telegramText(supportedLocales[0], "help"),
+		},
+		{
+			name:   "text from an unlinked chat",
+			text:   "hello",
+			expect: func(mock sqlmock.Sqlmock) { expectChatUser(mock, false) },
+			reply:  telegramText(supportedLocales[0], "notLinked"),
+		},
+		{
+			name: "link with a code",
+			text: "/link@taskflow_bot abcd-1234",
+			expect: func(mock sqlmock.Sqlmock) {
+				expectChatUser(mock, false)
+				mock.ExpectQuery(`UPDATE user_tokens SET used_at = NOW\(\)`).WithArgs(hashToken("ABCD-1234"), tokenPurposeChatLink).
+					WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow(testUserA))
+				mock.ExpectExec(`INSERT INTO chat_accounts`).WithArgs(chatProviderTelegram, "4242", "alice_tg", testUserA).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				expectChatUser(mock, true)
+			},
+			reply: telegramText("en", "linked", "{username}", "alice"),
+		},
+		{
+			name: "link with a bad code",
+			text: "/link nope",
+			expect: func(mock sqlmock.Sqlmock) {
+				expectChatUser(mock, false)
+				mock.ExpectQuery(`UPDATE user_tokens SET used_at = NOW\(\)`).WillReturnError(sql.ErrNoRows)
+			},
+			reply: telegramText(supportedLocales[0], "badCode"),
+		},
+		{
+			name: "unlink",
+			text: "/unlink",
+			expect: func(mock sqlmock.Sqlmock) {
+				expectChatUser(mock, true)
+				mock.ExpectExec(`DELETE FROM chat_accounts`).WithArgs(chatProviderTelegram, "4242").WillReturnResult(sqlmock.NewResult(0, 1))
+			},
+			reply: telegramText("en", "unlinked"),
+		},
+		{
+			name:   "comment without a reply",
+			text:   "looks good",
+			expect: func(mock sqlmock.Sqlmock) { expectChatUser(mock, true) },
+			reply:  telegramText("en", "replyNeeded"),
+		},
+		{
+			name:    "reply comments on the task",
+			text:    "looks good",
+			replyTo: 77,
+			expect: func(mock sqlmock.Sqlmock) {
+				expectChatUser(mock, true)
+				mock.ExpectQuery(`SELECT task_id FROM telegram_messages`).WithArgs(testChatID, 77, testUserA).
+					WillReturnRows(sqlmock.NewRows([]string{"task_id"}).AddRow(testTask))
+				mock.ExpectQuery(`INSERT INTO comments`).WithArgs(testTask, "looks good", testUserA).
+					WillReturnRows(sqlmock.NewRows([]string{"id", "content", "username", "created_at", "title"}).
+						AddRow("c1", "looks good", "alice", time.Now(), "Report"))
+				mock.ExpectExec(`INSERT INTO webhook_deliveries`).WillReturnResult(sqlmock.NewResult(0, 0))
+				mock.ExpectQuery(`SELECT title FROM tasks`).WithArgs(testTask).
+					WillReturnRows(sqlmock.NewRows([]string{"title"}).AddRow("Report"))
+			},
+			reply: telegramText("en", "commented", "{title}", "Report"),
+		},
+		{
+			name:    "reply to a message that isn't a notification",
+			text:    "looks good",
+			replyTo: 78,
+			expect: func(mock sqlmock.Sqlmock) {
+				expectChatUser(mock, true)
+				mock.ExpectQuery(`SELECT task_id FROM telegram_messages`).WillReturnError(sql.ErrNoRows)
+			},
+			reply: telegramText("en", "replyNeeded"),
+		},
+		{
+			name:    "move without permission",
+			text:    "/move done",
+			replyTo: 77,
+			expect: func(mock sqlmock.Sqlmock) {
+				expectChatUser(mock, true)
+				mock.ExpectQuery(`SELECT task_id FROM telegram_messages`).
+					WillReturnRows(sqlmock.NewRows([]string{"task_id"}).AddRow(testTask))
+			},
+			reply: telegramText("en", "noPermission"),
+		},
+		{
+			name: "my tasks",
+			text: "/my",
+			expect: func(mock sqlmock.Sqlmock) {
+				expectChatUser(mock, true)
+				mock.ExpectQuery(`SELECT t.id, t.title, t.priority, c.title(.|\n)*ORDER BY t.priority ASC`).WithArgs(testUserA).
+					WillReturnRows(sqlmock.NewRows([]string{"id", "title", "priority", "column"}))
+			},
+			reply: telegramText("en", "noTasks"),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api := &fakeBotAPI{}
+			bot := newFakeBotAPI(t, api)
+			mock := mockDB(t)
+			setRoles(t, map[string][]string{"member": {permCommentCreate}})
+			tt.expect(mock)
+
+			m := &tgMessage{
+				MessageID: 1,
+				From:      &tgUser{ID: 1, Username: "alice_tg"},
+				Chat:      tgChat{ID: testChatID, Type: "private"},
+				Text:      tt.text,
+			}
+			if tt.replyTo != 0 {
+				m.ReplyToMessage = &tgMessage{MessageID: tt.replyTo}
+			}
+			bot.handleUpdate(tgUpdate{UpdateID: 1, Message: m})
+
+			if len(api.sent) != 1 {
+				t.Fatalf("sent %d messages, want 1", len(api.sent))
+			}
+			if got := api.sent[0]["text"]; got != tt.reply {
+				t.Errorf("reply = %q, want %q", got, tt.reply)
+			}
+			if got := api.sent[0]["chat_id"]; got != float64(testChatID) {
+				t.Errorf("chat_id = %v", got)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestTelegramHandleUpdateIgnoresGroups(t *testing.T) {
+	api := &fakeBotAPI{}
+	bot := newFakeBotAPI(t, api)
+	mock := mockDB(t)
+
+	bot.handleUpdate(tgUpdate{Message: &tgMessage{Chat: tgChat{ID: -1, Type: "group"}, Text: "/help"}})
+	if len(api.calls) != 0 {
+		t.Errorf("bot answered a group chat: %v", api.calls)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+var telegramQueueColumns = []string{"id", "chat_id", "attempts", "user_id", "locale", "type", "task_id", "actor_id", "actor", "params", "created_at"}
+
+func TestTelegramProcessQueue(t *testing.T) {
+	tests := []struct {
+		name   string
+		fail   string
+		expect func(mock sqlmock.Sqlmock)
+	}{
+		{
+			name: "sent",
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectExec(`UPDATE telegram_messages SET status = 'sent'`).WithArgs(1, 101).WillReturnResult(sqlmock.NewResult(0, 1))
+			},
+		},
+		{
+			name: "blocked bot fails the message",
+			fail: `{"ok":false,"error_code":403,"description":"Forbidden: bot was blocked by the user"}`,
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectExec(`UPDATE telegram_messages SET status = \$2`).
+					WithArgs(1, "failed", "telegram: 403 Forbidden: bot was blocked by the user", sqlmock.AnyArg()).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+			},
+		},
+		{
+			name: "rate limit is retried",
+			fail: `{"ok":false,"error_code":429,"description":"Too Many Requests","parameters":{"retry_after":5}}`,
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectExec(`UPDATE telegram_messages SET status = \$2`).
+					WithArgs(1, "pending", sqlmock.AnyArg(), sqlmock.AnyArg()).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+			},
+		},
+		{
+			// The message stays claimed and nothing is rolled back
+			name: "database error recording a send",
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectExec(`UPDATE telegram_messages SET status = 'sent'`).WillReturnError(sql.ErrConnDone)
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api := &fakeBotAPI{fail: tt.fail}
+			bot := newFakeBotAPI(t, api)
+			mock := mockDB(t)
+
+			// The claim is a statement of its own, committed before sending
+			mock.ExpectQuery(`UPDATE telegram_messages m SET status = 'sending'`).WillReturnRows(
+				sqlmock.NewRows(telegramQueueColumns).
+					AddRow(1, testChatID, 0, testUserA, "en", notifTaskAssigned, testTask, "", "", []byte(`{"title":"Report"}`), time.Now()))
+			mock.ExpectQuery(`SELECT id, title FROM columns`).WillReturnRows(sqlmock.NewRows([]string{"id", "title"}))
+			tt.expect(mock)
+
+			if err := bot.processQueue(); err != nil {
+				t.Fatal(err)
+			}
+			if len(api.calls) != 1 || api.calls[0] != "sendMessage" {
+				t.Fatalf("API calls = %v, want one sendMessage", api.calls)
+			}
+			if tt.fail == "" {
+				text, _ := api.sent[0]["text"].(string)
+				if !strings.Contains(text, "Report") || !strings.Contains(text, appURL+"/tasks/"+testTask) {
+					t.Errorf("message lacks the task: %s", text)
+				}
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestTelegramCallHidesToken(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	server.Close()
+	t.Setenv("TELEGRAM_BOT_TOKEN", "secret-token")
+	t.Setenv("TELEGRAM_API_URL", server.URL)
+	bot := newTelegramBotFromEnv()
+
+	_, err := bot.sendMessage(testChatID, "hi")
+	if err == nil {
+		t.Fatal("expected an error from a closed server")
+	}
+	if strings.Contains(err.Error(), "secret-token") {
+		t.Errorf("error leaks the bot token: %v", err)
+	}
+	if !strings.Contains(err.Error(), "sendMessage") {
+		t.Errorf("error doesn't name the method: %v", err)
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+)
+
+// Purposes of single-use user tokens
+const (
+	tokenPurposePasswordReset = "password_reset"
+	tokenPurposeVerifyEmail   = "verify_email"
+	tokenPurposeChatLink      = "chat_link"
+)
+
+var errInvalidToken = errors.New("invalid or expired token")
+
+// randomToken returns n random bytes encoded as URL-safe base64
+func randomToken(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// hashToken returns the hex SHA-256 of a token, which is what we store
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// signToken computes the HMAC that binds a token to its purpose
+func signToken(purpose, raw string) string {
+	mac := hmac.New(sha256.New, jwtSecret)
+	mac.Write([]byte(purpose + ":" + raw))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// verifySignedToken checks the signature of a "<raw>.<sig>" token and returns the raw part
+func verifySignedToken(token, purpose string) (string, bool) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 || !hmac.Equal([]byte(parts[1]), []byte(signToken(purpose, parts[0]))) {
+		return "", false
+	}
+	return parts[0], true
+}
+
+// issueUserToken creates a signed single-use token for the user. Only the hash
+// of the token is stored, the returned value is sent to the user.
+func issueUserToken(userID, purpose string, ttl time.Duration) (string, error) {
+	raw, err := randomToken(32)
+	if err != nil {
+		return "", err
+	}
+
+	// Invalidate earlier tokens of the same purpose
+	_, err = db.Exec(`
+		UPDATE user_tokens SET used_at = NOW()
+		WHERE user_id = $1 AND purpose = $2 AND used_at IS NULL
+	`, userID, purpose)
+	if err != nil {
+		return "", err
+	}
+
+	_, err = db.Exec(`
+		INSERT INTO user_tokens (user_id, purpose, token_hash, expires_at)
+		VALUES ($1, $2, $3, $4)
+	`, userID, purpose, hashToken(raw), time.Now().Add(ttl))
+	if err != nil {
+		return "", err
+	}
+
+	return raw + "." + signToken(purpose, raw), nil
+}
+
+// consumeUserToken verifies the signature and marks the token as used,
+// returning the owning user ID. A token can be consumed only once.
+func consumeUserToken(token, purpose string) (string, error) {
+	raw, ok := verifySignedToken(token, purpose)
+	if !ok {
+		return "", errInvalidToken
+	}
+
+	var userID string
+	err := db.QueryRow(`
+		UPDATE user_tokens SET used_at = NOW()
+		WHERE token_hash = $1 AND purpose = $2 AND used_at IS NULL AND expires_at > NOW()
+		RETURNING user_id
+	`, hashToken(raw), purpose).Scan(&userID)
+	if err != nil {
+		return "", errInvalidToken
+	}
+
+	return userID, nil
+}
+
+// linkCodeAlphabet leaves out characters that are easy to mix up when typing
+const linkCodeAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+
+// issueLinkCode creates a short single-use code for the user, meant to be
+// typed into a chat app rather than followed as a link. Only its hash is stored.
+func issueLinkCode(userID string, ttl time.Duration) (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	for i := range b {
+		b[i] = linkCodeAlphabet[int(b[i])%len(linkCodeAlphabet)]
+	}
+	code := string(b)
+
+	_, err := db.Exec(`
+		UPDATE user_tokens SET used_at = NOW()
+		WHERE user_id = $1 AND purpose = $2 AND used_at IS NULL
+	`, userID, tokenPurposeChatLink)
+	if err != nil {
+		return "", err
+	}
+
+	_, err = db.Exec(`
+		INSERT INTO user_tokens (user_id, purpose, token_hash, expires_at)
+		VALUES ($1, $2, $3, $4)
+	`, userID, tokenPurposeChatLink, hashToken(code), time.Now().Add(ttl))
+	if err != nil {
+		return "", err
+	}
+	return code, nil
+}
+
+// consumeLinkCode marks a link code as used and returns the owning user ID
+func consumeLinkCode(code string) (string, error) {
+	var userID string
+	err := db.QueryRow(`
+		UPDATE user_tokens SET used_at = NOW()
+		WHERE token_hash = $1 AND purpose = $2 AND used_at IS NULL AND expires_at > NOW()
+		RETURNING user_id
+	`, hashToken(strings.ToUpper(strings.TrimSpace(code))), tokenPurposeChatLink).Scan(&userID)
+	if err != nil {
+		return "", errInvalidToken
+	}
+	return userID, nil
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// setUserDeactivated deactivates or reactivates a user. Deactivated users keep
+// their tasks, comments and history but can't sign in or use existing tokens.
+func setUserDeactivated(w http.ResponseWriter, r *http.Request, deactivate bool) {
+	vars := mux.Vars(r)
+	userID := vars["id"]
+
+	if deactivate && userID == r.Context().Value("userId").(string) {
+		http.Error(w, "You can't deactivate your own account", http.StatusBadRequest)
+		return
+	}
+
+	// Only users whose role the caller could grant may be deactivated, or
+	// a custom role could lock out the admins
+	var role string
+	err := db.QueryRow("SELECT role FROM users WHERE id = $1", userID).Scan(&role)
+	if err == sql.ErrNoRows {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	ok, err := canGrantRole(r, role)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		http.Error(w, "You can't manage a user with permissions you don't have", http.StatusForbidden)
+		return
+	}
+
+	query := `
+		UPDATE users SET deactivated_at = NOW(), session_version = session_version + 1
+		WHERE id = $1 AND deactivated_at IS NULL`
+	action := "user.deactivated"
+	event := hookUserDeactivated
+	if !deactivate {
+		// Erased accounts stay deactivated for good
+		query = "UPDATE users SET deactivated_at = NULL WHERE id = $1 AND deactivated_at IS NOT NULL AND erased_at IS NULL"
+		action = "user.reactivated"
+		event = hookUserReactivated
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(query, userID)
+	if err != nil {
+		http.Error(w, "Error updating user", http.StatusInternalServerError)
+		return
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil || rowsAffected == 0 {
+		http.Error(w, "User not found or already in that state", http.StatusNotFound)
+		return
+	}
+
+	if deactivate {
+		// Personal access tokens are rejected while deactivated anyway, but
+		// revoking them keeps a reactivated account from silently regaining them
+		_, err = tx.Exec("UPDATE personal_access_tokens SET revoked_at = NOW() WHERE user_id = $1 AND revoked_at IS NULL", userID)
+		if err != nil {
+			http.Error(w, "Error revoking tokens", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Error updating user", http.StatusInternalServerError)
+		return
+	}
+	recordAudit(r, "", action, "user", userID, nil)
+	emitWebhookEvent(r.Context().Value("userId").(string), event, map[string]interface{}{
+		"user": map[string]string{"id": userID},
+	})
+
+	message := "User deactivated"
+	if !deactivate {
+		message = "User reactivated"
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": message,
+	})
+}
+
+func deactivateUserHandler(w http.ResponseWriter, r *http.Request) {
+	setUserDeactivated(w, r, true)
+}
+
+func reactivateUserHandler(w http.ResponseWriter, r *http.Request) {
+	setUserDeactivated(w, r, false)
+}
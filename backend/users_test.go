@@ -0,0 +1,78 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gorilla/mux"
+)
+
+func TestDeactivateUserHandler(t *testing.T) {
+	tests := []struct {
+		name       string
+		targetRole string
+		expect     func(mock sqlmock.Sqlmock)
+		status     int
+	}{
+		{
+			name:       "deactivated and tokens revoked together",
+			targetRole: "member",
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectExec(`UPDATE users SET deactivated_at = NOW\(\)`).WithArgs(testUserB).WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectExec(`UPDATE personal_access_tokens SET revoked_at`).WithArgs(testUserB).WillReturnResult(sqlmock.NewResult(0, 2))
+				mock.ExpectCommit()
+				mock.ExpectExec(`INSERT INTO audit_log`).WillReturnResult(sqlmock.NewResult(1, 1))
+				mock.ExpectExec(`INSERT INTO webhook_deliveries`).WillReturnResult(sqlmock.NewResult(0, 0))
+			},
+			status: http.StatusOK,
+		},
+		{
+			// Nothing is deactivated when the tokens can't be revoked
+			name:       "revoking fails",
+			targetRole: "member",
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectExec(`UPDATE users SET deactivated_at = NOW\(\)`).WithArgs(testUserB).WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectExec(`UPDATE personal_access_tokens SET revoked_at`).WillReturnError(errors.New("connection reset"))
+				mock.ExpectRollback()
+			},
+			status: http.StatusInternalServerError,
+		},
+		{
+			name:       "admin by a user manager",
+			targetRole: roleAdmin,
+			expect:     func(mock sqlmock.Sqlmock) {},
+			status:     http.StatusForbidden,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock := mockDB(t)
+			setRoles(t, map[string][]string{
+				"user-manager": {permUserManage, permBoardView},
+				"member":       {permBoardView},
+				roleAdmin:      {permUserManage, permBoardView, permRoleManage},
+			})
+			mock.ExpectQuery(`SELECT role FROM users WHERE id = \$1`).WithArgs(testUserB).
+				WillReturnRows(sqlmock.NewRows([]string{"role"}).AddRow(tt.targetRole))
+			tt.expect(mock)
+
+			r := httptest.NewRequest("POST", "/api/users/"+testUserB+"/deactivate", nil)
+			r = mux.SetURLVars(asUser(r, testUserA, "user-manager"), map[string]string{"id": testUserB})
+			w := httptest.NewRecorder()
+			deactivateUserHandler(w, r)
+
+			if w.Code != tt.status {
+				t.Errorf("status = %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
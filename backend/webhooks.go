@@ -0,0 +1,839 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+// Board events webhooks can subscribe to
+const (
+	hookTaskCreated     = "task.created"
+	hookTaskUpdated     = "task.updated"
+	hookTaskDeleted     = "task.deleted"
+	hookCommentCreated  = "comment.created"
+	hookCommentDeleted  = "comment.deleted"
+	hookUserCreated     = "user.created"
+	hookUserDeactivated = "user.deactivated"
+	hookUserReactivated = "user.reactivated"
+	// Sent only to personal webhooks, see queueNotificationWebhook
+	hookNotification = "notification"
+)
+
+var webhookEvents = []string{
+	hookTaskCreated, hookTaskUpdated, hookTaskDeleted,
+	hookCommentCreated, hookCommentDeleted,
+	hookUserCreated, hookUserDeactivated, hookUserReactivated,
+}
+
+const (
+	// A delivery is given up after this many failed attempts
+	maxWebhookAttempts = 8
+	// Retry delays double from the base delay up to the maximum
+	webhookRetryBase = 30 * time.Second
+	webhookRetryMax  = time.Hour
+	// A webhook is disabled after this many failed attempts in a row
+	webhookDisableAfter = 20
+	// How much of the receiver's response is kept in the delivery log
+	webhookResponseLimit = 4096
+	// How long a claimed batch of deliveries is reserved for the instance
+	// posting it; 50 deliveries at the client timeout fit well within it
+	webhookSendLease = 15 * time.Minute
+)
+
+// webhookClient sends webhook requests; receivers must answer within the timeout
+var webhookClient = &http.Client{Timeout: 10 * time.Second}
+
+// webhookWake triggers the delivery worker when new deliveries are queued
+var webhookWake = make(chan struct{}, 1)
+
+// Webhook is a subscription of an external URL to board events
+type Webhook struct {
+	ID                  string     `json:"id"`
+	URL                 string     `json:"url"`
+	Secret              string     `json:"secret,omitempty"`
+	Events              []string   `json:"events"`
+	Active              bool       `json:"active"`
+	ConsecutiveFailures int        `json:"consecutiveFailures"`
+	DisabledAt          *time.Time `json:"disabledAt,omitempty"`
+	CreatedAt           time.Time  `json:"createdAt"`
+	UpdatedAt           time.Time  `json:"updatedAt"`
+}
+
+// WebhookRequest is the body of creating or updating a webhook. Omitted
+// fields are left unchanged on update.
+type WebhookRequest struct {
+	URL    *string   `json:"url"`
+	Secret *string   `json:"secret"`
+	Events *[]string `json:"events"`
+	Active *bool     `json:"active"`
+}
+
+// WebhookDelivery is one attempt series at delivering an event to a webhook
+type WebhookDelivery struct {
+	ID             string          `json:"id"`
+	WebhookID      string          `json:"webhookId"`
+	Event          string          `json:"event"`
+	Payload        json.RawMessage `json:"payload"`
+	Status         string          `json:"status"`
+	Attempts       int             `json:"attempts"`
+	ResponseStatus int             `json:"responseStatus,omitempty"`
+	ResponseBody   string          `json:"responseBody,omitempty"`
+	LastError      string          `json:"lastError,omitempty"`
+	RedeliveryOf   string          `json:"redeliveryOf,omitempty"`
+	NextAttemptAt  *time.Time      `json:"nextAttemptAt,omitempty"`
+	DeliveredAt    *time.Time      `json:"deliveredAt,omitempty"`
+	CreatedAt      time.Time       `json:"createdAt"`
+}
+
+// WebhookPayload is the JSON body posted to webhooks
+type WebhookPayload struct {
+	ID        string      `json:"id"`
+	Event     string      `json:"event"`
+	ActorID   string      `json:"actorId,omitempty"`
+	CreatedAt time.Time   `json:"createdAt"`
+	Data      interface{} `json:"data"`
+}
+
+// webhookSignature returns the X-Signature header value of a payload
+func webhookSignature(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// webhookPayload encodes an event as posted to webhooks, with a new event ID
+func webhookPayload(actorID, event string, data interface{}) ([]byte, error) {
+	eventID, err := randomToken(16)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(WebhookPayload{
+		ID:        eventID,
+		Event:     event,
+		ActorID:   actorID,
+		CreatedAt: time.Now().UTC(),
+		Data:      data,
+	})
+}
+
+// emitWebhookEvent queues the event for every active webhook subscribed to
+// it. actorID is the user who caused it, if any. Failures are logged and
+// never fail the request.
+func emitWebhookEvent(actorID, event string, data interface{}) {
+	payload, err := webhookPayload(actorID, event, data)
+	if err != nil {
+		log.Printf("Error encoding %s webhook payload: %v", event, err)
+		return
+	}
+
+	result, err := db.Exec(`
+		INSERT INTO webhook_deliveries (webhook_id, event, payload)
+		SELECT id, $1, $2 FROM webhooks WHERE active AND $1 = ANY(events) AND user_id IS NULL
+	`, event, payload)
+	if err != nil {
+		log.Printf("Error queueing %s webhook deliveries: %v", event, err)
+		return
+	}
+	if n, _ := result.RowsAffected(); n > 0 {
+		wakeWebhookWorker()
+	}
+}
+
+// wakeWebhookWorker asks the delivery worker to look for due deliveries now
+func wakeWebhookWorker() {
+	select {
+	case webhookWake <- struct{}{}:
+	default:
+	}
+}
+
+// sendWebhook posts a payload to a webhook URL and returns the response
+// status and the start of the response body. Any non-2xx status is an error.
+func sendWebhook(client *http.Client, target, secret, deliveryID, event string, payload []byte) (int, string, error) {
+	req, err := http.NewRequest(http.MethodPost, target, bytes.NewReader(payload))
+	if err != nil {
+		return 0, "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "TaskFlow-Webhooks/1.0")
+	req.Header.Set("X-Signature", webhookSignature(secret, payload))
+	req.Header.Set("X-Webhook-Event", event)
+	req.Header.Set("X-Webhook-Delivery", deliveryID)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, "", err
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, webhookResponseLimit))
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, string(body), fmt.Errorf("receiver responded with %s", resp.Status)
+	}
+	return resp.StatusCode, string(body), nil
+}
+
+// runWebhookDeliveries delivers queued webhook events in the background
+func runWebhookDeliveries() {
+	ticker := time.NewTicker(10 * time.Second)
+	defer ticker.Stop()
+	for {
+		if err := processWebhookDeliveries(); err != nil {
+			log.Printf("Error processing webhook deliveries: %v", err)
+		}
+		select {
+		case <-ticker.C:
+		case <-webhookWake:
+		}
+	}
+}
+
+// processWebhookDeliveries attempts every due delivery once, claimed as
+// described in queue.go
+func processWebhookDeliveries() error {
+	type due struct {
+		delivery WebhookDelivery
+		url      string
+		secret   string
+	}
+	var deliveries []due
+	err := claimDue(`
+		WITH due AS (
+			SELECT d.id FROM webhook_deliveries d
+			JOIN webhooks w ON w.id = d.webhook_id
+			WHERE d.status IN ('pending', 'sending') AND d.next_attempt_at <= NOW() AND w.active
+			ORDER BY d.created_at
+			LIMIT 50
+			FOR UPDATE OF d SKIP LOCKED
+		)
+		UPDATE webhook_deliveries d SET status = 'sending', next_attempt_at = $1
+		FROM due, webhooks w
+		WHERE d.id = due.id AND w.id = d.webhook_id
+		RETURNING d.id, d.webhook_id, d.event, d.payload, d.attempts, d.created_at, w.url, w.secret
+	`, webhookSendLease, func(rows *sql.Rows) error {
+		var d due
+		var payload []byte
+		if err := rows.Scan(&d.delivery.ID, &d.delivery.WebhookID, &d.delivery.Event, &payload, &d.delivery.Attempts, &d.delivery.CreatedAt, &d.url, &d.secret); err != nil {
+			return err
+		}
+		d.delivery.Payload = payload
+		deliveries = append(deliveries, d)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	sort.Slice(deliveries, func(i, j int) bool {
+		return deliveries[i].delivery.CreatedAt.Before(deliveries[j].delivery.CreatedAt)
+	})
+
+	for _, d := range deliveries {
+		// A webhook may have been disabled by an earlier delivery in this
+		// run; its deliveries go back to waiting until it is enabled again
+		var active bool
+		if err := db.QueryRow("SELECT active FROM webhooks WHERE id = $1", d.delivery.WebhookID).Scan(&active); err != nil {
+			log.Printf("Error checking webhook %s: %v", d.delivery.WebhookID, err)
+			continue
+		}
+		if !active {
+			if _, err := db.Exec("UPDATE webhook_deliveries SET status = 'pending' WHERE id = $1 AND status = 'sending'", d.delivery.ID); err != nil {
+				log.Printf("Error releasing webhook delivery %s: %v", d.delivery.ID, err)
+			}
+			continue
+		}
+
+		status, body, sendErr := sendWebhook(webhookClient, d.url, d.secret, d.delivery.ID, d.delivery.Event, d.delivery.Payload)
+		if err := recordWebhookAttempt(d.delivery, status, body, sendErr); err != nil {
+			log.Printf("Error recording webhook delivery %s: %v", d.delivery.ID, err)
+		}
+	}
+	return nil
+}
+
+// recordWebhookAttempt stores the outcome of a delivery attempt, schedules a
+// retry and disables the webhook after too many failures in a row
+func recordWebhookAttempt(d WebhookDelivery, status int, body string, sendErr error) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if sendErr == nil {
+		_, err := tx.Exec(`
+			UPDATE webhook_deliveries SET status = 'succeeded', attempts = attempts + 1, response_status = $2,
+				response_body = $3, last_error = '', delivered_at = NOW()
+			WHERE id = $1
+		`, d.ID, status, body)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec("UPDATE webhooks SET consecutive_failures = 0 WHERE id = $1", d.WebhookID); err != nil {
+			return err
+		}
+		return tx.Commit()
+	}
+
+	attempts := d.Attempts + 1
+	newStatus := "pending"
+	delay := retryDelay(webhookRetryBase, webhookRetryMax, attempts)
+	if attempts >= maxWebhookAttempts {
+		newStatus = "failed"
+	}
+	_, err = tx.Exec(`
+		UPDATE webhook_deliveries SET status = $2, attempts = attempts + 1, response_status = NULLIF($3, 0),
+			response_body = $4, last_error = $5, next_attempt_at = $6
+		WHERE id = $1
+	`, d.ID, newStatus, status, body, sendErr.Error(), time.Now().Add(delay))
+	if err != nil {
+		return err
+	}
+
+	var failures int
+	err = tx.QueryRow(`
+		UPDATE webhooks SET consecutive_failures = consecutive_failures + 1
+		WHERE id = $1
+		RETURNING consecutive_failures
+	`, d.WebhookID).Scan(&failures)
+	if err != nil {
+		return err
+	}
+	if failures >= webhookDisableAfter {
+		log.Printf("Disabling webhook %s after %d failed deliveries in a row", d.WebhookID, failures)
+		if _, err := tx.Exec("UPDATE webhooks SET active = false, disabled_at = NOW() WHERE id = $1 AND active", d.WebhookID); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// webhookSelect is the column list read by scanWebhook
+const webhookSelect = `
+	SELECT id, url, events, active, consecutive_failures, disabled_at, created_at, updated_at
+	FROM webhooks`
+
+// scanWebhook reads a row selected with webhookSelect
+func scanWebhook(row interface{ Scan(...interface{}) error }) (Webhook, error) {
+	var hook Webhook
+	var disabledAt sql.NullTime
+	err := row.Scan(&hook.ID, &hook.URL, pq.Array(&hook.Events), &hook.Active, &hook.ConsecutiveFailures, &disabledAt, &hook.CreatedAt, &hook.UpdatedAt)
+	if disabledAt.Valid {
+		hook.DisabledAt = &disabledAt.Time
+	}
+	return hook, err
+}
+
+// validateWebhookRequest checks the fields that are set
+func validateWebhookRequest(req WebhookRequest) string {
+	if req.URL != nil {
+		u, err := url.Parse(*req.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return "url must be an absolute http or https URL"
+		}
+	}
+	if req.Secret != nil && len(*req.Secret) < 16 {
+		return "secret must be at least 16 characters"
+	}
+	if req.Events != nil {
+		if len(*req.Events) == 0 {
+			return "At least one event is required"
+		}
+		for _, e := range *req.Events {
+			known := false
+			for _, valid := range webhookEvents {
+				known = known || e == valid
+			}
+			if !known {
+				return "Unknown event: " + e
+			}
+		}
+	}
+	return ""
+}
+
+func getWebhooksHandler(w http.ResponseWriter, r *http.Request) {
+	rows, err := db.Query(webhookSelect + " WHERE user_id IS NULL ORDER BY created_at")
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	hooks := []Webhook{}
+	for rows.Next() {
+		hook, err := scanWebhook(rows)
+		if err != nil {
+			http.Error(w, "Error scanning webhooks", http.StatusInternalServerError)
+			return
+		}
+		hooks = append(hooks, hook)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"webhooks": hooks,
+		"events":   webhookEvents,
+	})
+}
+
+// createWebhookHandler adds a webhook. Without a secret one is generated; the
+// secret is only ever returned here.
+func createWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	var req WebhookRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.URL == nil || req.Events == nil {
+		http.Error(w, "url and events are required", http.StatusBadRequest)
+		return
+	}
+	if msg := validateWebhookRequest(req); msg != "" {
+		http.Error(w, msg, http.StatusBadRequest)
+		return
+	}
+
+	secret := ""
+	if req.Secret != nil {
+		secret = *req.Secret
+	} else {
+		var err error
+		if secret, err = randomToken(32); err != nil {
+			http.Error(w, "Error creating webhook", http.StatusInternalServerError)
+			return
+		}
+	}
+	active := req.Active == nil || *req.Active
+
+	userID := r.Context().Value("userId").(string)
+	hook, err := scanWebhook(db.QueryRow(`
+		INSERT INTO webhooks (url, secret, events, active, created_by)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id, url, events, active, consecutive_failures, disabled_at, created_at, updated_at
+	`, *req.URL, secret, pq.Array(*req.Events), active, userID))
+	if err != nil {
+		http.Error(w, "Error creating webhook", http.StatusInternalServerError)
+		return
+	}
+	hook.Secret = secret
+
+	recordAudit(r, "", "webhook.created", "webhook", hook.ID, map[string]interface{}{
+		"url":    hook.URL,
+		"events": hook.Events,
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(hook)
+}
+
+func getWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	hook, err := scanWebhook(db.QueryRow(webhookSelect+" WHERE id::text = $1 AND user_id IS NULL", vars["id"]))
+	if err == sql.ErrNoRows {
+		http.Error(w, "Webhook not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(hook)
+}
+
+// updateWebhook applies the set fields of the request to a webhook, either a
+// board webhook or a personal one, and returns it with the audit details.
+// Re-enabling a disabled webhook clears its failure count so it gets a fresh
+// start.
+func updateWebhook(webhookID string, personal bool, req WebhookRequest) (Webhook, map[string]interface{}, error) {
+	query := "UPDATE webhooks SET updated_at = NOW()"
+	params := []interface{}{}
+	details := map[string]interface{}{}
+	add := func(column string, value interface{}) {
+		params = append(params, value)
+		query += fmt.Sprintf(", %s = $%d", column, len(params))
+	}
+	if req.URL != nil {
+		add("url", *req.URL)
+		details["url"] = *req.URL
+	}
+	if req.Secret != nil {
+		add("secret", *req.Secret)
+		details["secretChanged"] = true
+	}
+	if req.Events != nil {
+		add("events", pq.Array(*req.Events))
+		details["events"] = *req.Events
+	}
+	if req.Active != nil {
+		add("active", *req.Active)
+		if *req.Active {
+			query += ", consecutive_failures = 0, disabled_at = NULL"
+		}
+		details["active"] = *req.Active
+	}
+	scope := "user_id IS NULL"
+	if personal {
+		scope = "user_id IS NOT NULL"
+	}
+	params = append(params, webhookID)
+	query += fmt.Sprintf(" WHERE id::text = $%d AND %s", len(params), scope)
+	query += " RETURNING id, url, events, active, consecutive_failures, disabled_at, created_at, updated_at"
+
+	hook, err := scanWebhook(db.QueryRow(query, params...))
+	return hook, details, err
+}
+
+// updateWebhookHandler changes a board webhook, see updateWebhook
+func updateWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	webhookID := vars["id"]
+
+	var req WebhookRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if msg := validateWebhookRequest(req); msg != "" {
+		http.Error(w, msg, http.StatusBadRequest)
+		return
+	}
+
+	hook, details, err := updateWebhook(webhookID, false, req)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Webhook not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Error updating webhook", http.StatusInternalServerError)
+		return
+	}
+	recordAudit(r, "", "webhook.updated", "webhook", hook.ID, details)
+	if hook.Active {
+		wakeWebhookWorker()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(hook)
+}
+
+func deleteWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	webhookID := vars["id"]
+
+	var hookURL string
+	err := db.QueryRow("DELETE FROM webhooks WHERE id::text = $1 AND user_id IS NULL RETURNING url", webhookID).Scan(&hookURL)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Webhook not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Error deleting webhook", http.StatusInternalServerError)
+		return
+	}
+	recordAudit(r, "", "webhook.deleted", "webhook", webhookID, map[string]interface{}{
+		"url": hookURL,
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "Webhook deleted",
+	})
+}
+
+// webhookDeliverySelect is the column list read by scanWebhookDelivery
+const webhookDeliverySelect = `
+	SELECT id, webhook_id, event, payload, status, attempts, COALESCE(response_status, 0), response_body, last_error,
+		COALESCE(redelivery_of::text, ''), next_attempt_at, delivered_at, created_at
+	FROM webhook_deliveries`
+
+// scanWebhookDelivery reads a row selected with webhookDeliverySelect
+func scanWebhookDelivery(row interface{ Scan(...interface{}) error }) (WebhookDelivery, error) {
+	var d WebhookDelivery
+	var payload []byte
+	var nextAttemptAt, deliveredAt sql.NullTime
+	err := row.Scan(&d.ID, &d.WebhookID, &d.Event, &payload, &d.Status, &d.Attempts, &d.ResponseStatus, &d.ResponseBody,
+		&d.LastError, &d.RedeliveryOf, &nextAttemptAt, &deliveredAt, &d.CreatedAt)
+	d.Payload = payload
+	if nextAttemptAt.Valid && d.Status == "pending" {
+		d.NextAttemptAt = &nextAttemptAt.Time
+	}
+	if deliveredAt.Valid {
+		d.DeliveredAt = &deliveredAt.Time
+	}
+	return d, err
+}
+
+// getWebhookDeliveriesHandler lists a webhook's deliveries, newest first,
+// optionally filtered by ?status= and paged with ?before=<deliveryId>
+func getWebhookDeliveriesHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	webhookID := vars["id"]
+	q := r.URL.Query()
+
+	var exists bool
+	if err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM webhooks WHERE id::text = $1 AND user_id IS NULL)", webhookID).Scan(&exists); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if !exists {
+		http.Error(w, "Webhook not found", http.StatusNotFound)
+		return
+	}
+
+	limit := 50
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 200 {
+			http.Error(w, "limit must be between 1 and 200", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	conditions := []string{"webhook_id::text = $1"}
+	params := []interface{}{webhookID}
+	if status := q.Get("status"); status != "" {
+		params = append(params, status)
+		conditions = append(conditions, fmt.Sprintf("status = $%d", len(params)))
+	}
+	if before := q.Get("before"); before != "" {
+		if !uuidPattern.MatchString(before) {
+			http.Error(w, "invalid before", http.StatusBadRequest)
+			return
+		}
+		params = append(params, before)
+		conditions = append(conditions, fmt.Sprintf(
+			"(created_at, id) < (SELECT created_at, id FROM webhook_deliveries WHERE id = $%d)", len(params)))
+	}
+	params = append(params, limit)
+
+	rows, err := db.Query(webhookDeliverySelect+" WHERE "+strings.Join(conditions, " AND ")+
+		fmt.Sprintf(" ORDER BY created_at DESC, id DESC LIMIT $%d", len(params)), params...)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	deliveries := []WebhookDelivery{}
+	for rows.Next() {
+		d, err := scanWebhookDelivery(rows)
+		if err != nil {
+			http.Error(w, "Error scanning deliveries", http.StatusInternalServerError)
+			return
+		}
+		deliveries = append(deliveries, d)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(deliveries)
+}
+
+// redeliverWebhookHandler queues a delivery again with the same payload. The
+// original delivery is kept in the log and the copy points back to it.
+func redeliverWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	webhookID := vars["id"]
+	deliveryID := vars["deliveryId"]
+
+	d, err := scanWebhookDelivery(db.QueryRow(`
+		INSERT INTO webhook_deliveries (webhook_id, event, payload, redelivery_of)
+		SELECT webhook_id, event, payload, id FROM webhook_deliveries
+		WHERE id::text = $1 AND webhook_id::text = $2
+		AND webhook_id IN (SELECT id FROM webhooks WHERE user_id IS NULL)
+		RETURNING id, webhook_id, event, payload, status, attempts, COALESCE(response_status, 0), response_body, last_error,
+			COALESCE(redelivery_of::text, ''), next_attempt_at, delivered_at, created_at
+	`, deliveryID, webhookID))
+	if err == sql.ErrNoRows {
+		http.Error(w, "Delivery not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Error queueing delivery", http.StatusInternalServerError)
+		return
+	}
+	recordAudit(r, "", "webhook.redelivered", "webhook", webhookID, map[string]interface{}{
+		"deliveryId": deliveryID,
+	})
+	wakeWebhookWorker()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(d)
+}
+
+// queueNotificationWebhook queues a notification for the user's personal
+// webhook, if they have an active one. The message is rendered in the user's
+// language, like the in-app notification.
+func queueNotificationWebhook(n Notification, notBefore time.Time) {
+	var webhookID string
+	err := db.QueryRow("SELECT id FROM webhooks WHERE user_id = $1 AND active", n.UserID).Scan(&webhookID)
+	if err == sql.ErrNoRows {
+		return
+	}
+	if err != nil {
+		log.Printf("Error queueing notification webhook: %v", err)
+		return
+	}
+
+	if n.ActorID != "" {
+		if err := db.QueryRow("SELECT username FROM users WHERE id = $1", n.ActorID).Scan(&n.Actor); err != nil {
+			log.Printf("Error queueing notification webhook: %v", err)
+			return
+		}
+	}
+	renderer, err := newNotificationRenderer(userLocale(n.UserID))
+	if err != nil {
+		log.Printf("Error queueing notification webhook: %v", err)
+		return
+	}
+	renderer.render(&n)
+
+	payload, err := webhookPayload(n.ActorID, hookNotification, n)
+	if err != nil {
+		log.Printf("Error encoding notification webhook payload: %v", err)
+		return
+	}
+	_, err = db.Exec(
+		"INSERT INTO webhook_deliveries (webhook_id, event, payload, next_attempt_at) VALUES ($1, $2, $3, $4)",
+		webhookID, hookNotification, payload, notBefore,
+	)
+	if err != nil {
+		log.Printf("Error queueing notification webhook: %v", err)
+		return
+	}
+	wakeWebhookWorker()
+}
+
+func getNotificationWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userId").(string)
+
+	hook, err := scanWebhook(db.QueryRow(webhookSelect+" WHERE user_id = $1", userID))
+	if err == sql.ErrNoRows {
+		http.Error(w, "No notification webhook set", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(hook)
+}
+
+// putNotificationWebhookHandler sets the user's personal webhook, which the
+// webhook notification channel posts to. The first call needs a url; without
+// a secret one is generated and returned only then.
+func putNotificationWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userId").(string)
+
+	var req WebhookRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Events != nil {
+		http.Error(w, "A notification webhook receives every notification its channel is on for", http.StatusBadRequest)
+		return
+	}
+	if msg := validateWebhookRequest(req); msg != "" {
+		http.Error(w, msg, http.StatusBadRequest)
+		return
+	}
+
+	var webhookID string
+	err := db.QueryRow("SELECT id FROM webhooks WHERE user_id = $1", userID).Scan(&webhookID)
+	if err != nil && err != sql.ErrNoRows {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	if err == nil {
+		hook, details, err := updateWebhook(webhookID, true, req)
+		if err != nil {
+			http.Error(w, "Error updating webhook", http.StatusInternalServerError)
+			return
+		}
+		recordAudit(r, "", "user.notification_webhook_updated", "webhook", hook.ID, details)
+		if hook.Active {
+			wakeWebhookWorker()
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(hook)
+		return
+	}
+
+	if req.URL == nil {
+		http.Error(w, "url is required", http.StatusBadRequest)
+		return
+	}
+	secret := ""
+	if req.Secret != nil {
+		secret = *req.Secret
+	} else if secret, err = randomToken(32); err != nil {
+		http.Error(w, "Error creating webhook", http.StatusInternalServerError)
+		return
+	}
+	active := req.Active == nil || *req.Active
+
+	// The unique index on user_id turns a concurrent second call into an error
+	hook, err := scanWebhook(db.QueryRow(`
+		INSERT INTO webhooks (url, secret, events, active, created_by, user_id)
+		VALUES ($1, $2, $3, $4, $5, $5)
+		RETURNING id, url, events, active, consecutive_failures, disabled_at, created_at, updated_at
+	`, *req.URL, secret, pq.Array([]string{hookNotification}), active, userID))
+	if err != nil {
+		http.Error(w, "Error creating webhook", http.StatusInternalServerError)
+		return
+	}
+	hook.Secret = secret
+	recordAudit(r, "", "user.notification_webhook_created", "webhook", hook.ID, map[string]interface{}{
+		"url": hook.URL,
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(hook)
+}
+
+func deleteNotificationWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userId").(string)
+
+	var webhookID string
+	err := db.QueryRow("DELETE FROM webhooks WHERE user_id = $1 RETURNING id", userID).Scan(&webhookID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "No notification webhook set", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Error deleting webhook", http.StatusInternalServerError)
+		return
+	}
+	recordAudit(r, "", "user.notification_webhook_deleted", "webhook", webhookID, nil)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "Webhook deleted",
+	})
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestWebhookSignature(t *testing.T) {
+	tests := []struct {
+		secret string
+		body   string
+		want   string
+	}{
+		{"", "", "sha256=b613679a0814d9ec772f95d778c35fc5ff1697c493715653c6c712144292c5ad"},
+		{"key", "The quick brown fox jumps over the lazy dog", "sha256=f7bc83f430538424b13298e6aa6fb143ef4d59a14946175997479dbc2d1a3cd8"},
+	}
+	for _, tt := range tests {
+		if got := webhookSignature(tt.secret, []byte(tt.body)); got != tt.want {
+			t.Errorf("webhookSignature(%q, %q) = %s, want %s", tt.secret, tt.body, got, tt.want)
+		}
+	}
+	if webhookSignature("a", []byte("x")) == webhookSignature("b", []byte("x")) {
+		t.Error("signature doesn't depend on the secret")
+	}
+}
+
+const (
+	testHook     = "44444444-4444-4444-4444-444444444444"
+	testDelivery = "55555555-5555-5555-5555-555555555555"
+	testSecond   = "66666666-6666-6666-6666-666666666666"
+)
+
+var webhookClaimColumns = []string{"id", "webhook_id", "event", "payload", "attempts", "created_at", "url", "secret"}
+
+func TestProcessWebhookDeliveries(t *testing.T) {
+	payload := `{"event":"task.created"}`
+	created := time.Now().Add(-time.Minute)
+
+	tests := []struct {
+		name     string
+		status   int
+		attempts int
+		expect   func(mock sqlmock.Sqlmock)
+		posts    int
+	}{
+		{
+			name:   "delivered",
+			status: http.StatusOK,
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`SELECT active FROM webhooks`).WillReturnRows(sqlmock.NewRows([]string{"active"}).AddRow(true))
+				mock.ExpectBegin()
+				mock.ExpectExec(`UPDATE webhook_deliveries SET status = 'succeeded'`).WithArgs(testDelivery, 200, "ok").WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectExec(`UPDATE webhooks SET consecutive_failures = 0`).WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectCommit()
+			},
+			posts: 1,
+		},
+		{
+			name:   "receiver error is retried",
+			status: http.StatusInternalServerError,
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`SELECT active FROM webhooks`).WillReturnRows(sqlmock.NewRows([]string{"active"}).AddRow(true))
+				mock.ExpectBegin()
+				mock.ExpectExec(`UPDATE webhook_deliveries SET status = \$2`).
+					WithArgs(testDelivery, "pending", 500, "ok", "receiver responded with 500 Internal Server Error", sqlmock.AnyArg()).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectQuery(`UPDATE webhooks SET consecutive_failures = consecutive_failures \+ 1`).WillReturnRows(sqlmock.NewRows([]string{"consecutive_failures"}).AddRow(1))
+				mock.ExpectCommit()
+			},
+			posts: 1,
+		},
+		{
+			name:     "last attempt fails the delivery and disables the webhook",
+			status:   http.StatusInternalServerError,
+			attempts: maxWebhookAttempts - 1,
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`SELECT active FROM webhooks`).WillReturnRows(sqlmock.NewRows([]string{"active"}).AddRow(true))
+				mock.ExpectBegin()
+				mock.ExpectExec(`UPDATE webhook_deliveries SET status = \$2`).
+					WithArgs(testDelivery, "failed", 500, "ok", sqlmock.AnyArg(), sqlmock.AnyArg()).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectQuery(`UPDATE webhooks SET consecutive_failures = consecutive_failures \+ 1`).WillReturnRows(sqlmock.NewRows([]string{"consecutive_failures"}).AddRow(webhookDisableAfter))
+				mock.ExpectExec(`UPDATE webhooks SET active = false`).WithArgs(testHook).WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectCommit()
+			},
+			posts: 1,
+		},
+		{
+			name:   "disabled webhook releases the claim",
+			status: http.StatusOK,
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`SELECT active FROM webhooks`).WillReturnRows(sqlmock.NewRows([]string{"active"}).AddRow(false))
+				mock.ExpectExec(`UPDATE webhook_deliveries SET status = 'pending'`).WithArgs(testDelivery).WillReturnResult(sqlmock.NewResult(0, 1))
+			},
+		},
+		{
+			// The delivery stays claimed and nothing is rolled back
+			name:   "database error recording a delivery",
+			status: http.StatusOK,
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`SELECT active FROM webhooks`).WillReturnRows(sqlmock.NewRows([]string{"active"}).AddRow(true))
+				mock.ExpectBegin().WillReturnError(errors.New("connection reset"))
+			},
+			posts: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			posts := 0
+			receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				posts++
+				body, _ := io.ReadAll(r.Body)
+				if string(body) != payload {
+					t.Errorf("body = %s, want %s", body, payload)
+				}
+				if got := r.Header.Get("X-Signature"); got != webhookSignature("s3cret", body) {
+					t.Errorf("X-Signature = %s", got)
+				}
+				if got := r.Header.Get("X-Webhook-Delivery"); got != testDelivery {
+					t.Errorf("X-Webhook-Delivery = %s", got)
+				}
+				w.WriteHeader(tt.status)
+				w.Write([]byte("ok"))
+			}))
+			defer receiver.Close()
+
+			mock := mockDB(t)
+			// The claim is a statement of its own, committed before posting
+			mock.ExpectQuery(`UPDATE webhook_deliveries d SET status = 'sending'`).WillReturnRows(
+				sqlmock.NewRows(webhookClaimColumns).
+					AddRow(testDelivery, testHook, hookTaskCreated, []byte(payload), tt.attempts, created, receiver.URL, "s3cret"))
+			tt.expect(mock)
+
+			if err := processWebhookDeliveries(); err != nil {
+				t.Fatal(err)
+			}
+			if posts != tt.posts {
+				t.Errorf("receiver got %d posts, want %d", posts, tt.posts)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestProcessWebhookDeliveriesOrder(t *testing.T) {
+	var order []string
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		order = append(order, r.Header.Get("X-Webhook-Delivery"))
+	}))
+	defer receiver.Close()
+
+	mock := mockDB(t)
+	now := time.Now()
+	mock.ExpectQuery(`UPDATE webhook_deliveries d SET status = 'sending'`).WillReturnRows(
+		sqlmock.NewRows(webhookClaimColumns).
+			AddRow(testSecond, testHook, hookTaskUpdated, []byte(`{}`), 0, now, receiver.URL, "").
+			AddRow(testDelivery, testHook, hookTaskCreated, []byte(`{}`), 0, now.Add(-time.Second), receiver.URL, ""))
+	for range []string{testDelivery, testSecond} {
+		mock.ExpectQuery(`SELECT active FROM webhooks`).WillReturnRows(sqlmock.NewRows([]string{"active"}).AddRow(true))
+		mock.ExpectBegin()
+		mock.ExpectExec(`UPDATE webhook_deliveries SET status = 'succeeded'`).WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec(`UPDATE webhooks SET consecutive_failures = 0`).WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+	}
+
+	if err := processWebhookDeliveries(); err != nil {
+		t.Fatal(err)
+	}
+	if len(order) != 2 || order[0] != testDelivery || order[1] != testSecond {
+		t.Errorf("delivered in order %v, want oldest first", order)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+// payloadArg captures a JSON payload passed to a query
+type payloadArg struct{ got map[string]interface{} }
+
+func (a *payloadArg) Match(v driver.Value) bool {
+	b, ok := v.([]byte)
+	return ok && json.Unmarshal(b, &a.got) == nil
+}
+
+func TestQueueNotificationWebhook(t *testing.T) {
+	notBefore := time.Now().Add(time.Hour)
+	n := Notification{
+		UserID:  testUserB,
+		Type:    notifCommented,
+		TaskID:  testTask,
+		ActorID: testUserA,
+		Params:  json.RawMessage(`{"title":"Report"}`),
+	}
+
+	t.Run("without a webhook", func(t *testing.T) {
+		mock := mockDB(t)
+		mock.ExpectQuery(`SELECT id FROM webhooks WHERE user_id = \$1 AND active`).WithArgs(testUserB).
+			WillReturnRows(sqlmock.NewRows([]string{"id"}))
+
+		queueNotificationWebhook(n, notBefore)
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("rendered in the user's language after quiet hours", func(t *testing.T) {
+		mock := mockDB(t)
+		mock.ExpectQuery(`SELECT id FROM webhooks WHERE user_id = \$1 AND active`).WithArgs(testUserB).
+			WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(testHook))
+		mock.ExpectQuery(`SELECT username FROM users`).WithArgs(testUserA).
+			WillReturnRows(sqlmock.NewRows([]string{"username"}).AddRow("alice"))
+		mock.ExpectQuery(`SELECT locale FROM users`).WithArgs(testUserB).
+			WillReturnRows(sqlmock.NewRows([]string{"locale"}).AddRow("en"))
+		mock.ExpectQuery(`SELECT id, title FROM columns`).WillReturnRows(sqlmock.NewRows([]string{"id", "title"}))
+		payload := &payloadArg{}
+		mock.ExpectExec(`INSERT INTO webhook_deliveries`).WithArgs(testHook, hookNotification, payload, notBefore).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+
+		queueNotificationWebhook(n, notBefore)
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Fatal(err)
+		}
+		data, _ := payload.got["data"].(map[string]interface{})
+		if payload.got["event"] != hookNotification || data["message"] != "alice commented on a task: Report" {
+			t.Errorf("payload = %v", payload.got)
+		}
+	})
+}
+
+func TestPutNotificationWebhookHandler(t *testing.T) {
+	webhookColumns := []string{"id", "url", "events", "active", "consecutive_failures", "disabled_at", "created_at", "updated_at"}
+	now := time.Now()
+
+	tests := []struct {
+		name   string
+		body   string
+		expect func(mock sqlmock.Sqlmock)
+		status int
+		secret bool
+	}{
+		{
+			name: "created with a generated secret",
+			body: `{"url":"https://example.com/hook"}`,
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`SELECT id FROM webhooks WHERE user_id = \$1`).WithArgs(testUserA).
+					WillReturnRows(sqlmock.NewRows([]string{"id"}))
+				mock.ExpectQuery(`INSERT INTO webhooks`).
+					WithArgs("https://example.com/hook", sqlmock.AnyArg(), `{"notification"}`, true, testUserA).
+					WillReturnRows(sqlmock.NewRows(webhookColumns).AddRow(testHook, "https://example.com/hook", "{notification}", true, 0, nil, now, now))
+				mock.ExpectExec(`INSERT INTO audit_log`).WillReturnResult(sqlmock.NewResult(1, 1))
+			},
+			status: http.StatusCreated,
+			secret: true,
+		},
+		{
+			name: "updated",
+			body: `{"active":false}`,
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`SELECT id FROM webhooks WHERE user_id = \$1`).WithArgs(testUserA).
+					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(testHook))
+				mock.ExpectQuery(`UPDATE webhooks SET updated_at = NOW\(\), active = \$1 WHERE id::text = \$2 AND user_id IS NOT NULL`).
+					WithArgs(false, testHook).
+					WillReturnRows(sqlmock.NewRows(webhookColumns).AddRow(testHook, "https://example.com/hook", "{notification}", false, 0, nil, now, now))
+				mock.ExpectExec(`INSERT INTO audit_log`).WillReturnResult(sqlmock.NewResult(1, 1))
+			},
+			status: http.StatusOK,
+		},
+		{
+			name: "first call without a url",
+			body: `{"active":true}`,
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`SELECT id FROM webhooks WHERE user_id = \$1`).WithArgs(testUserA).
+					WillReturnRows(sqlmock.NewRows([]string{"id"}))
+			},
+			status: http.StatusBadRequest,
+		},
+		{
+			name:   "events can't be chosen",
+			body:   `{"url":"https://example.com/hook","events":["task.created"]}`,
+			expect: func(mock sqlmock.Sqlmock) {},
+			status: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock := mockDB(t)
+			tt.expect(mock)
+
+			r := httptest.NewRequest("PUT", "/api/auth/me/notification-webhook", strings.NewReader(tt.body))
+			w := httptest.NewRecorder()
+			putNotificationWebhookHandler(w, asUser(r, testUserA, "member"))
+
+			if w.Code != tt.status {
+				t.Errorf("status = %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			var hook Webhook
+			json.NewDecoder(w.Body).Decode(&hook)
+			if (hook.Secret != "") != tt.secret {
+				t.Errorf("secret returned = %v, want %v", hook.Secret != "", tt.secret)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
@@ -102,7 +102,7 @@ export const fetchUsers = async (): Promise<User[]> => {
 export const fetchNotifications = async (): Promise<Notification[]> => {
   try {
     const response = await api.get('/notifications');
-    return response.data;
+    return response.data.items;
   } catch (error) {
     console.error('Ошибка загрузки уведомлений:', error);
     throw error;
@@ -8,7 +8,8 @@ export const mockBoardData: Board = {
       description: 'Crash Unexpected token < in JSON at position 0',
       state: 'backlog',
       priority: 1,
-      assignee: 'Lisa Evans',
+      assignee: { id: 'user-1', username: 'Lisa Evans', avatarUrl: '' },
+      assignees: [{ id: 'user-1', username: 'Lisa Evans', avatarUrl: '' }],
       comments: [{ id: 'c1', content: 'This is critical', author: 'John', createdAt: '2023-04-01T10:00:00Z' }],
       createdAt: '2023-04-01T09:00:00Z',
       updatedAt: '2023-04-01T09:00:00Z'
@@ -19,7 +20,8 @@ export const mockBoardData: Board = {
       description: 'New Task Short Description',
       state: 'backlog',
       priority: 2,
-      assignee: 'Lisa Evans',
+      assignee: { id: 'user-1', username: 'Lisa Evans', avatarUrl: '' },
+      assignees: [{ id: 'user-1', username: 'Lisa Evans', avatarUrl: '' }],
       comments: [],
       createdAt: '2023-04-02T09:00:00Z',
       updatedAt: '2023-04-02T09:00:00Z'
@@ -30,7 +32,8 @@ export const mockBoardData: Board = {
       description: 'One More Example Short Description',
       state: 'backlog',
       priority: 3,
-      assignee: 'Lisa Evans',
+      assignee: { id: 'user-1', username: 'Lisa Evans', avatarUrl: '' },
+      assignees: [{ id: 'user-1', username: 'Lisa Evans', avatarUrl: '' }],
       comments: [],
       createdAt: '2023-04-03T09:00:00Z',
       updatedAt: '2023-04-03T09:00:00Z'
@@ -41,7 +44,8 @@ export const mockBoardData: Board = {
       description: 'DEV: Mise a disposition not working',
       state: 'pending',
       priority: 2,
-      assignee: 'Lisa Evans',
+      assignee: { id: 'user-1', username: 'Lisa Evans', avatarUrl: '' },
+      assignees: [{ id: 'user-1', username: 'Lisa Evans', avatarUrl: '' }],
       comments: [],
       createdAt: '2023-04-04T09:00:00Z',
       updatedAt: '2023-04-04T09:00:00Z'
@@ -52,7 +56,8 @@ export const mockBoardData: Board = {
       description: 'Journal: find locking solution',
       state: 'pending',
       priority: 3,
-      assignee: 'Lisa Evans',
+      assignee: { id: 'user-1', username: 'Lisa Evans', avatarUrl: '' },
+      assignees: [{ id: 'user-1', username: 'Lisa Evans', avatarUrl: '' }],
       comments: [],
       createdAt: '2023-04-05T09:00:00Z',
       updatedAt: '2023-04-05T09:00:00Z'
@@ -63,7 +68,8 @@ export const mockBoardData: Board = {
       description: 'Extract Tasks from JIRA into GSheets',
       state: 'inprogress',
       priority: 1,
-      assignee: 'David Green',
+      assignee: { id: 'user-2', username: 'David Green', avatarUrl: '' },
+      assignees: [{ id: 'user-2', username: 'David Green', avatarUrl: '' }],
       comments: [],
       createdAt: '2023-04-06T09:00:00Z',
       updatedAt: '2023-04-06T09:00:00Z'
@@ -74,7 +80,8 @@ export const mockBoardData: Board = {
       description: 'Display always for repose "Statut de l\'execution de la fonction: "',
       state: 'inprogress',
       priority: 2,
-      assignee: 'Lisa Evans',
+      assignee: { id: 'user-1', username: 'Lisa Evans', avatarUrl: '' },
+      assignees: [{ id: 'user-1', username: 'Lisa Evans', avatarUrl: '' }],
       comments: [],
       createdAt: '2023-04-07T09:00:00Z',
       updatedAt: '2023-04-07T09:00:00Z'
@@ -85,7 +92,8 @@ export const mockBoardData: Board = {
       description: 'Functions d\'administration',
       state: 'inprogress',
       priority: 3,
-      assignee: 'Lisa Evans',
+      assignee: { id: 'user-1', username: 'Lisa Evans', avatarUrl: '' },
+      assignees: [{ id: 'user-1', username: 'Lisa Evans', avatarUrl: '' }],
       comments: [],
       createdAt: '2023-04-08T09:00:00Z',
       updatedAt: '2023-04-08T09:00:00Z'
@@ -96,7 +104,8 @@ export const mockBoardData: Board = {
       description: 'One Example Short Description',
       state: 'inprogress',
       priority: 2,
-      assignee: 'Lisa Evans',
+      assignee: { id: 'user-1', username: 'Lisa Evans', avatarUrl: '' },
+      assignees: [{ id: 'user-1', username: 'Lisa Evans', avatarUrl: '' }],
       comments: [{ id: 'c2', content: 'Need to check this', author: 'Sarah', createdAt: '2023-04-09T11:00:00Z' }],
       createdAt: '2023-04-09T09:00:00Z',
       updatedAt: '2023-04-09T09:00:00Z'
@@ -107,7 +116,8 @@ export const mockBoardData: Board = {
       description: 'Lister: second click generates error',
       state: 'aprove',
       priority: 1,
-      assignee: 'Lisa Evans',
+      assignee: { id: 'user-1', username: 'Lisa Evans', avatarUrl: '' },
+      assignees: [{ id: 'user-1', username: 'Lisa Evans', avatarUrl: '' }],
       comments: [],
       createdAt: '2023-04-10T09:00:00Z',
       updatedAt: '2023-04-10T09:00:00Z'
@@ -118,7 +128,8 @@ export const mockBoardData: Board = {
       description: 'CSS regression on fieldset-container',
       state: 'aprove',
       priority: 2,
-      assignee: 'Lisa Evans',
+      assignee: { id: 'user-1', username: 'Lisa Evans', avatarUrl: '' },
+      assignees: [{ id: 'user-1', username: 'Lisa Evans', avatarUrl: '' }],
       comments: [],
       createdAt: '2023-04-11T09:00:00Z',
       updatedAt: '2023-04-11T09:00:00Z'
@@ -129,7 +140,8 @@ export const mockBoardData: Board = {
       description: 'Find a fast solution',
       state: 'aproved',
       priority: 1,
-      assignee: 'Lisa Evans',
+      assignee: { id: 'user-1', username: 'Lisa Evans', avatarUrl: '' },
+      assignees: [{ id: 'user-1', username: 'Lisa Evans', avatarUrl: '' }],
       comments: [],
       createdAt: '2023-04-12T09:00:00Z',
       updatedAt: '2023-04-12T09:00:00Z'
@@ -140,7 +152,8 @@ export const mockBoardData: Board = {
       description: 'Journal: find locking solution',
       state: 'aproved',
       priority: 2,
-      assignee: 'Lisa Evans',
+      assignee: { id: 'user-1', username: 'Lisa Evans', avatarUrl: '' },
+      assignees: [{ id: 'user-1', username: 'Lisa Evans', avatarUrl: '' }],
       comments: [],
       createdAt: '2023-04-13T09:00:00Z',
       updatedAt: '2023-04-13T09:00:00Z'
@@ -151,7 +164,8 @@ export const mockBoardData: Board = {
       description: 'Journal: find locking solution',
       state: 'aproved',
       priority: 3,
-      assignee: 'Lisa Evans',
+      assignee: { id: 'user-1', username: 'Lisa Evans', avatarUrl: '' },
+      assignees: [{ id: 'user-1', username: 'Lisa Evans', avatarUrl: '' }],
       comments: [],
       createdAt: '2023-04-14T09:00:00Z',
       updatedAt: '2023-04-14T09:00:00Z'
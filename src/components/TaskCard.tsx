@@ -59,8 +59,8 @@ const TaskCard: React.FC<TaskCardProps> = ({ task, index }) => {
             
             <div className="flex items-center">
               {task.assignee && (
-                <div className="w-6 h-6 rounded-full bg-gray-600 flex items-center justify-center text-xs text-white" title={task.assignee}>
-                  {getInitials(task.assignee)}
+                <div className="w-6 h-6 rounded-full bg-gray-600 flex items-center justify-center text-xs text-white" title={task.assignee.username}>
+                  {getInitials(task.assignee.username)}
                 </div>
               )}
             </div>
@@ -51,7 +51,7 @@ const TaskModal: React.FC<TaskModalProps> = ({ isOpen, onClose, onTaskCreated, c
         description: data.description,
         state: data.state,
         priority: Number(data.priority),
-        assignee: data.assignee,
+        assigneeId: data.assignee,
       });
       
       onTaskCreated(newTask);
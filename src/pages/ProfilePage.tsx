@@ -26,8 +26,7 @@ const ProfilePage: React.FC = () => {
           
           // Filter tasks for the current user
           const userTasks = Object.values(boardData.tasks).filter(task => 
-            task.assignee === auth.user?.username || 
-            task.assignee === auth.user?.id
+            task.assignees?.some(assignee => assignee.id === auth.user?.id)
           );
           
           setTaskStats({
@@ -284,9 +284,9 @@ const TaskDetailPage: React.FC = () => {
                     <h3 className="text-lg font-medium mb-2">Исполнитель</h3>
                     <div className="flex items-center">
                       <div className="w-8 h-8 rounded-full bg-blue-100 flex items-center justify-center text-blue-600 font-bold mr-2">
-                        {task.assignee ? task.assignee.charAt(0).toUpperCase() : '?'}
+                        {task.assignee ? task.assignee.username.charAt(0).toUpperCase() : '?'}
                       </div>
-                      <span>{task.assignee || 'Не назначен'}</span>
+                      <span>{task.assignee?.username || 'Не назначен'}</span>
                     </div>
                   </div>
                   
@@ -51,7 +51,7 @@ const UsersPage: React.FC = () => {
   const getUserTaskStats = (userId: string) => {
     if (!board) return { total: 0, inProgress: 0, pending: 0, completed: 0 };
     
-    const userTasks = Object.values(board.tasks).filter(task => task.assignee === userId);
+    const userTasks = Object.values(board.tasks).filter(task => task.assignees?.some(assignee => assignee.id === userId));
     
     return {
       total: userTasks.length,
@@ -13,13 +13,23 @@ export interface AuthState {
   isAdmin: boolean;
 }
 
+export interface UserRef {
+  id: string;
+  username: string;
+  avatarUrl: string;
+}
+
 export interface Task {
   id: string;
   title: string;
   description: string;
   state: string;
   priority: number;
-  assignee?: string;
+  dueAt?: string;
+  assigneeId?: string;
+  assignee?: UserRef;
+  assigneeIds?: string[];
+  assignees?: UserRef[];
   comments?: Comment[];
   createdAt: string;
   updatedAt: string;